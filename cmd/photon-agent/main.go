@@ -5,12 +5,19 @@ import (
 	"errors"
 	"flag"
 	"fmt"
+	"io/fs"
 	"log"
+	"net"
 	"net/http"
+	"net/url"
 	"os"
 	"os/signal"
 	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
 	"syscall"
+	"time"
 
 	"github.com/dustin/go-humanize"
 	"github.com/hashicorp/go-cleanhttp"
@@ -21,6 +28,7 @@ import (
 	"github.com/pddg/photon-container/internal/metrics"
 	"github.com/pddg/photon-container/internal/photon"
 	"github.com/pddg/photon-container/internal/photondata"
+	"github.com/pddg/photon-container/internal/scheduler"
 	"github.com/pddg/photon-container/internal/server"
 	"github.com/pddg/photon-container/internal/unarchiver"
 	"github.com/pddg/photon-container/internal/updater"
@@ -28,17 +36,43 @@ import (
 
 var (
 	port                          int
+	proxyPort                     int
 	logLevel                      string
 	logFormat                     string
 	databaseURL                   string
+	databaseChecksum              string
 	listenIP                      string
 	defaultLanguage               string
+	photonImportTimeout           string
 	updateStrategy                string
+	freshnessPolicy               string
+	extractionRatio               string
 	downloadSpeedLimitBytesPerSec string
+	downloadConnections           int
 	ioSpeedLimitBytesPerSec       string
+	decompressionWorkers          int
+	unarchiveAllowedPrefixes      string
+	unarchiveMaxEntries           int
+	unarchiveMaxBytes             string
+	unarchiveUmask                string
+	unarchiveDurable              bool
 	photonJarPath                 string
 	photonDir                     string
 	disableMetrics                bool
+	jobHistorySize                int
+	retainGenerations             int
+	blueGreenPort                 int
+	blueGreenMemory               string
+	validate                      bool
+	validationPort                int
+	validationQueries             string
+	validationMinFeatures         int
+	validationTimeout             string
+	schedule                      string
+	scheduleWindow                string
+	scheduleJitter                string
+	scheduleMinInterval           string
+	scheduleDryRun                bool
 )
 
 func main() {
@@ -46,21 +80,53 @@ func main() {
 	flag.StringVar(&logFormat, "log-format", getEnv("PHOTON_AGENT_LOG_FORMAT", "json"), "log format")
 	// Photon agent server options
 	flag.IntVar(&port, "port", 8080, "port to listen on")
+	flag.IntVar(&proxyPort, "proxy-port", getEnvInt("PHOTON_AGENT_PROXY_PORT", 0), "port to serve /api, /reverse and /status of Photon on. it answers 503 while the database is updated. 0 disables it")
+	flag.IntVar(&jobHistorySize, "job-history-size", getEnvInt("PHOTON_AGENT_JOB_HISTORY_SIZE", updater.DefaultJobHistorySize), "number of finished update jobs kept in the history")
 	flag.BoolVar(&disableMetrics, "disable-metrics", false, "disable photon database metrics (/metrics only provide go runtime information)")
 
 	// Photon database source options
 	flag.StringVar(&databaseURL, "database-url", getEnv("PHOTON_AGENT_DATABASE_URL", photondata.DefaultDatabaseURL), "URL of the Photon database to download")
+	flag.StringVar(&databaseChecksum, "database-checksum", getEnv("PHOTON_AGENT_DATABASE_CHECKSUM", ""), "how to verify the Photon database. none, md5, sha256, sha512, sha256:sums=SHA256SUMS or sha256:{{digest}}. default is md5")
 
 	// Photon server options
 	flag.StringVar(&photonJarPath, "photon-jar-path", getEnv("PHOTON_AGENT_PHOTON_JAR_PATH", "/photon/photon.jar"), "path to the Photon jar file")
 	flag.StringVar(&photonDir, "photon-dir", getEnv("PHOTON_AGENT_PHOTON_DIR", "/photon"), "directory to store the Photon data")
 	flag.StringVar(&updateStrategy, "update-strategy", getEnv("PHOTON_AGENT_UPDATE_STRATEGY", string(updater.DefaultUpdateStrategy)), "update strategy for the Photon database")
+	flag.StringVar(&freshnessPolicy, "freshness-policy", getEnv("PHOTON_AGENT_FRESHNESS_POLICY", string(updater.FreshnessThreshold)), "how to decide whether the archive is newer than the database. threshold, threshold:{{duration}}, etag, checksum or always")
+	flag.StringVar(&extractionRatio, "extraction-ratio", getEnv("PHOTON_AGENT_EXTRACTION_RATIO", strconv.FormatFloat(updater.DefaultExtractionRatio, 'f', -1, 64)), "estimated ratio of the extracted database to the compressed archive, to check the free space before the update")
 	flag.StringVar(&listenIP, "photon-listen-ip", getEnv("PHOTON_AGENT_PHOTON_LISTEN_IP", "127.0.0.1"), "IP address to listen on by photon")
 	flag.StringVar(&defaultLanguage, "photon-default-language", getEnv("PHOTON_AGENT_PHOTON_DEFAULT_LANGUAGE", "en"), "default language for the Photon server")
+	flag.IntVar(&retainGenerations, "retain-generations", getEnvInt("PHOTON_AGENT_RETAIN_GENERATIONS", 0), "number of previous databases retained to switch back to when the disk space allows. 0 retains none")
+	flag.StringVar(&photonImportTimeout, "photon-import-timeout", getEnv("PHOTON_AGENT_PHOTON_IMPORT_TIMEOUT", photondata.DefaultImportTimeout.String()), "time to wait for Photon to serve the new database before rolling back to the previous one. e.g. 10m")
+
+	// Validation options
+	flag.BoolVar(&validate, "validate", getEnvBool("PHOTON_AGENT_VALIDATE", false), "run Photon on the new database on a side port and run the smoke queries before promoting it. only for the parallel and streaming strategies")
+	flag.IntVar(&blueGreenPort, "bluegreen-port", getEnvInt("PHOTON_AGENT_BLUEGREEN_PORT", 2324), "port which the second Photon server of the bluegreen strategy listens on")
+	flag.StringVar(&blueGreenMemory, "bluegreen-memory", getEnv("PHOTON_AGENT_BLUEGREEN_MEMORY", ""), "memory which the second Photon server of the bluegreen strategy needs (e.g. 8GB). default is the memory used by the live one")
+	flag.IntVar(&validationPort, "validation-port", getEnvInt("PHOTON_AGENT_VALIDATION_PORT", photon.DefaultValidationPort), "port which Photon listens on to validate the new database")
+	flag.StringVar(&validationQueries, "validation-queries", getEnv("PHOTON_AGENT_VALIDATION_QUERIES", "/api?q=Berlin"), "comma separated smoke queries run against the new database. e.g. /api?q=Berlin,/api?q=Tokyo")
+	flag.IntVar(&validationMinFeatures, "validation-min-features", getEnvInt("PHOTON_AGENT_VALIDATION_MIN_FEATURES", 1), "number of features each smoke query must return at least")
+	flag.StringVar(&validationTimeout, "validation-timeout", getEnv("PHOTON_AGENT_VALIDATION_TIMEOUT", photon.DefaultValidationTimeout.String()), "time to wait for Photon to be ready on the new database. e.g. 10m")
 
 	// Speed limit options
 	flag.StringVar(&downloadSpeedLimitBytesPerSec, "download-speed-limit", getEnv("PHOTON_AGENT_DOWNLOAD_SPEED_LIMIT", ""), "download speed limit in bytes per second (e.g. 10MB). default is unlimited")
+	flag.IntVar(&downloadConnections, "download-connections", getEnvInt("PHOTON_AGENT_DOWNLOAD_CONNECTIONS", 1), "number of connections to download the archive at the same time. the speed limit is applied to the total")
 	flag.StringVar(&ioSpeedLimitBytesPerSec, "io-speed-limit", getEnv("PHOTON_AGENT_IO_SPEED_LIMIT", ""), "I/O speed limit in bytes per second (e.g. 100MB). default is unlimited")
+
+	// Schedule options
+	flag.StringVar(&schedule, "schedule", getEnv("PHOTON_AGENT_SCHEDULE", ""), "cron expression to check for a newer database and update to it. e.g. '0 3 * * 1'. empty disables the automatic updates")
+	flag.StringVar(&scheduleWindow, "schedule-window", getEnv("PHOTON_AGENT_SCHEDULE_WINDOW", ""), "time of day when the automatic updates may start. e.g. 22:00-04:00. empty allows any time")
+	flag.StringVar(&scheduleJitter, "schedule-jitter", getEnv("PHOTON_AGENT_SCHEDULE_JITTER", "0s"), "maximum random delay of the automatic updates. e.g. 30m")
+	flag.StringVar(&scheduleMinInterval, "schedule-min-interval", getEnv("PHOTON_AGENT_SCHEDULE_MIN_INTERVAL", "0s"), "minimum time since the last successful update to start an automatic update. e.g. 72h")
+	flag.BoolVar(&scheduleDryRun, "schedule-dry-run", getEnvBool("PHOTON_AGENT_SCHEDULE_DRY_RUN", false), "only log the automatic updates instead of starting them")
+
+	// Unarchive options
+	flag.IntVar(&decompressionWorkers, "decompression-workers", getEnvInt("PHOTON_AGENT_DECOMPRESSION_WORKERS", runtime.NumCPU()), "number of goroutines to decompress bzip2 blocks of the archive. 1 decompresses the archive sequentially")
+	flag.StringVar(&unarchiveAllowedPrefixes, "unarchive-allowed-prefixes", getEnv("PHOTON_AGENT_UNARCHIVE_ALLOWED_PREFIXES", "photon_data/"), "comma separated top-level directories allowed in the archive. empty allows all")
+	flag.IntVar(&unarchiveMaxEntries, "unarchive-max-entries", getEnvInt("PHOTON_AGENT_UNARCHIVE_MAX_ENTRIES", 1000000), "maximum number of entries in the archive. 0 is unlimited")
+	flag.StringVar(&unarchiveMaxBytes, "unarchive-max-bytes", getEnv("PHOTON_AGENT_UNARCHIVE_MAX_BYTES", "1TB"), "maximum total size of files in the archive (e.g. 500GB). empty is unlimited")
+	flag.StringVar(&unarchiveUmask, "unarchive-umask", getEnv("PHOTON_AGENT_UNARCHIVE_UMASK", "0022"), "umask applied to the modes of extracted files in octal")
+	flag.BoolVar(&unarchiveDurable, "unarchive-durable", getEnvBool("PHOTON_AGENT_UNARCHIVE_DURABLE", false), "sync extracted files and directories to the storage before marking the extraction complete")
 	flag.Parse()
 
 	logger, err := logging.Configure(logLevel, logFormat, os.Stderr)
@@ -103,6 +169,37 @@ func innerMain(ctx context.Context) error {
 		}
 		downloaderOptions = append(downloaderOptions, downloader.WithDownloadSpeedLimit(downloadSpeedLimit))
 	}
+	downloaderOptions = append(downloaderOptions, downloader.WithConnections(downloadConnections))
+	// Publish the progress of the update jobs to /migrate/events.
+	downloaderOptions = append(downloaderOptions, downloader.WithProgressFunc(updater.ReportDownloadProgress))
+	unarchiverOptions = append(unarchiverOptions, unarchiver.WithProgressFunc(updater.ReportExtractProgress))
+	unarchiverOptions = append(unarchiverOptions, unarchiver.WithDecompressionWorkers(decompressionWorkers))
+	if unarchiveAllowedPrefixes != "" {
+		unarchiverOptions = append(unarchiverOptions, unarchiver.WithAllowedPrefixes(strings.Split(unarchiveAllowedPrefixes, ",")...))
+	}
+	unarchiverOptions = append(unarchiverOptions, unarchiver.WithMaxEntries(unarchiveMaxEntries))
+	umask, err := strconv.ParseUint(unarchiveUmask, 8, 32)
+	if err != nil {
+		return fmt.Errorf("failed to parse unarchive umask: %w", err)
+	}
+	unarchiverOptions = append(unarchiverOptions, unarchiver.WithUmask(fs.FileMode(umask)))
+	if unarchiveDurable {
+		unarchiverOptions = append(unarchiverOptions, unarchiver.WithDurable())
+	}
+	if unarchiveMaxBytes != "" {
+		maxBytes, err := humanize.ParseBytes(unarchiveMaxBytes)
+		if err != nil {
+			return fmt.Errorf("failed to parse unarchive max bytes: %w", err)
+		}
+		unarchiverOptions = append(unarchiverOptions, unarchiver.WithMaxTotalBytes(int64(maxBytes)))
+	}
+	if databaseChecksum != "" {
+		// Validate the specification before starting the server.
+		if _, err := downloader.ParseChecksumProvider(databaseChecksum); err != nil {
+			return fmt.Errorf("invalid database checksum: %w", err)
+		}
+		archiveOptions = append(archiveOptions, photondata.WithChecksum(databaseChecksum))
+	}
 
 	photonArchive, err := photondata.NewArchive(databaseURL, archiveOptions...)
 	if err != nil {
@@ -110,32 +207,105 @@ func innerMain(ctx context.Context) error {
 	}
 	dl := downloader.New(httpClient, downloaderOptions...)
 	ua := unarchiver.NewUnarchiver(unarchiverOptions...)
-	photonServer := photon.NewPhotonServer(ctx, photonJarPath, photonDir, photon.WithArgs(
-		"-listen-ip", listenIP,
-		"-default-language", defaultLanguage,
-	))
 	photonDataDir := filepath.Join(photonDir, "photon_data")
-	migrator := photondata.NewMigrator(photonDataDir, httpClient)
+	importTimeout, err := time.ParseDuration(photonImportTimeout)
+	if err != nil {
+		return fmt.Errorf("failed to parse Photon import timeout: %w", err)
+	}
+	migrator := photondata.NewMigrator(photonDataDir, httpClient,
+		photondata.WithPhotonURL(fmt.Sprintf("http://localhost:%d/", photon.DefaultPort)),
+		photondata.WithGreenSlot(fmt.Sprintf("http://localhost:%d/", blueGreenPort)),
+		photondata.WithImportTimeout(importTimeout),
+		photondata.WithRetainGenerations(retainGenerations),
+	)
+	// Recover the database left by a migration interrupted by a restart before Photon uses it.
+	if err := migrator.Recover(ctx, filepath.Join(photonDataDir, "temp")); err != nil {
+		return fmt.Errorf("failed to recover migration: %w", err)
+	}
+	// The bluegreen strategy may have switched Photon to the green slot.
+	liveSlot := migrator.LiveSlot()
+	photonServer := photon.NewPhotonServer(ctx, photonJarPath, migrator.SlotPhotonDir(liveSlot),
+		photon.WithArgs(
+			"-listen-ip", listenIP,
+			"-default-language", defaultLanguage,
+		),
+		photon.WithListenPort(migrator.SlotPort(liveSlot)),
+	)
+	var updaterOptions []updater.UpdaterOption
+	freshness, err := updater.ParseFreshnessPolicy(freshnessPolicy)
+	if err != nil {
+		return fmt.Errorf("invalid freshness policy: %w", err)
+	}
+	updaterOptions = append(updaterOptions, updater.WithFreshnessPolicy(freshness))
+	ratio, err := strconv.ParseFloat(extractionRatio, 64)
+	if err != nil || ratio <= 0 {
+		return fmt.Errorf("invalid extraction ratio %q", extractionRatio)
+	}
+	updaterOptions = append(updaterOptions, updater.WithExtractionRatio(ratio))
+	if validate {
+		timeout, err := time.ParseDuration(validationTimeout)
+		if err != nil {
+			return fmt.Errorf("failed to parse validation timeout: %w", err)
+		}
+		var queries []string
+		if validationQueries != "" {
+			queries = strings.Split(validationQueries, ",")
+		}
+		updaterOptions = append(updaterOptions, updater.WithValidator(photon.NewValidator(photonJarPath, httpClient,
+			photon.WithValidationPort(validationPort),
+			photon.WithValidationTimeout(timeout),
+			photon.WithSmokeQueries(queries...),
+			photon.WithMinFeatures(validationMinFeatures),
+			photon.WithValidationArgs("-default-language", defaultLanguage),
+		)))
+	}
+	if blueGreenMemory != "" {
+		memory, err := humanize.ParseBytes(blueGreenMemory)
+		if err != nil {
+			return fmt.Errorf("failed to parse bluegreen memory: %w", err)
+		}
+		updaterOptions = append(updaterOptions, updater.WithBlueGreenMemory(memory))
+	}
+	strategy := updater.NewUpdateStrategy(updateStrategy)
+	jobs, err := updater.NewJobManager(ctx, strategy, filepath.Join(photonDir, "jobs.json"), updater.WithJobHistorySize(jobHistorySize))
+	if err != nil {
+		return fmt.Errorf("failed to initialize job manager: %w", err)
+	}
 	updater, err := updater.New(
-		updater.NewUpdateStrategy(updateStrategy),
+		strategy,
 		dl,
 		ua,
 		photonServer,
 		migrator,
 		photonDataDir,
+		updaterOptions...,
 	)
 	if err != nil {
 		return fmt.Errorf("failed to initialize updater: %w", err)
 	}
 
+	var sched *scheduler.Scheduler
+	if schedule != "" {
+		sched, err = newScheduler(updater, migrator, jobs, photonArchive)
+		if err != nil {
+			return fmt.Errorf("failed to initialize scheduler: %w", err)
+		}
+	}
+
+	var proxyMetrics *metrics.ProxyMetrics
 	if !disableMetrics {
 		latestDataMetrics := metrics.NewLatestPhotonDataMetrics(ctx, dl, photonArchive)
 		prometheus.MustRegister(latestDataMetrics)
 		migrateMetrics := metrics.NewMigrateStatusMetrics(ctx, migrator)
 		prometheus.MustRegister(migrateMetrics)
+		prometheus.MustRegister(metrics.NewSupervisorMetrics(photonServer))
+		if proxyPort > 0 {
+			proxyMetrics = metrics.NewProxyMetrics()
+			prometheus.MustRegister(proxyMetrics)
+		}
 	}
 
-	apiHandler := server.NewAPIServer(ctx, migrator, updater, photonArchive)
+	apiHandler := server.NewAPIServer(ctx, migrator, updater, updater, updater, jobs, photonServer, photonArchive)
 	accessLogMw := logging.NewAccessLogMiddleware(accessLogger)
 	srv := http.Server{
 		Addr:    fmt.Sprintf(":%d", port),
@@ -148,10 +318,41 @@ func innerMain(ctx context.Context) error {
 			logger.ErrorContext(shutdownCtx, "failed to shutdown server", "error", err)
 		}
 	}()
-	logger.InfoContext(ctx, "starting photon", "port", 2322)
+	logger.InfoContext(ctx, "starting photon", "slot", liveSlot, "port", migrator.SlotPort(liveSlot))
 	if err := photonServer.Start(ctx); err != nil {
 		return fmt.Errorf("failed to start Photon server: %w", err)
 	}
+	if proxyPort > 0 {
+		var observer server.ProxyObserver
+		if proxyMetrics != nil {
+			observer = proxyMetrics
+		}
+		// Follow the slot switched by the bluegreen strategy.
+		target := func() *url.URL {
+			return photonURL(listenIP, migrator.SlotPort(migrator.LiveSlot()))
+		}
+		proxySrv := http.Server{
+			Addr:    fmt.Sprintf(":%d", proxyPort),
+			Handler: accessLogMw.Use(server.NewPhotonProxy(target, migrator, jobs, observer)),
+		}
+		go func() {
+			<-ctx.Done()
+			shutdownCtx := context.WithoutCancel(ctx)
+			if err := proxySrv.Shutdown(shutdownCtx); err != nil {
+				logger.ErrorContext(shutdownCtx, "failed to shutdown proxy", "error", err)
+			}
+		}()
+		go func() {
+			logger.InfoContext(ctx, "starting proxy", "port", proxyPort)
+			if err := proxySrv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+				logger.ErrorContext(ctx, "failed to start proxy", "error", err)
+				cancel()
+			}
+		}()
+	}
+	if sched != nil {
+		go sched.Run(ctx)
+	}
 	logger.InfoContext(ctx, "starting server", "port", port)
 	if err := srv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
 		return fmt.Errorf("failed to start server: %w", err)
@@ -159,6 +360,41 @@ func innerMain(ctx context.Context) error {
 	return nil
 }
 
+// newScheduler creates the scheduler of the automatic updates from the flags.
+func newScheduler(u *updater.Updater, migrator *photondata.Migrator, jobs *updater.JobManager, archive photondata.Archive) (*scheduler.Scheduler, error) {
+	var options []scheduler.SchedulerOption
+	if scheduleWindow != "" {
+		window, err := scheduler.ParseWindow(scheduleWindow)
+		if err != nil {
+			return nil, err
+		}
+		options = append(options, scheduler.WithWindow(window))
+	}
+	jitter, err := time.ParseDuration(scheduleJitter)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse schedule jitter: %w", err)
+	}
+	options = append(options, scheduler.WithJitter(jitter))
+	minInterval, err := time.ParseDuration(scheduleMinInterval)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse schedule min interval: %w", err)
+	}
+	options = append(options, scheduler.WithMinInterval(minInterval))
+	if scheduleDryRun {
+		options = append(options, scheduler.WithDryRun())
+	}
+	return scheduler.New(schedule, u, migrator, jobs, archive, options...)
+}
+
+// photonURL returns the URL of the Photon server listening on the IP address and the port.
+func photonURL(listenIP string, port int) *url.URL {
+	host := listenIP
+	if ip := net.ParseIP(listenIP); ip == nil || ip.IsUnspecified() {
+		host = "127.0.0.1"
+	}
+	return &url.URL{Scheme: "http", Host: net.JoinHostPort(host, strconv.Itoa(port))}
+}
+
 func getEnv(key, defaultValue string) string {
 	value := os.Getenv(key)
 	if value == "" {
@@ -167,6 +403,22 @@ func getEnv(key, defaultValue string) string {
 	return value
 }
 
+func getEnvInt(key string, defaultValue int) int {
+	value, err := strconv.Atoi(os.Getenv(key))
+	if err != nil {
+		return defaultValue
+	}
+	return value
+}
+
+func getEnvBool(key string, defaultValue bool) bool {
+	value, err := strconv.ParseBool(os.Getenv(key))
+	if err != nil {
+		return defaultValue
+	}
+	return value
+}
+
 func parseSpeedLimit(s string) (float64, error) {
 	if s == "" {
 		return 0, nil
@@ -5,8 +5,10 @@ import (
 	"flag"
 	"fmt"
 	"log"
+	"log/slog"
 	"os"
 	"os/signal"
+	"strconv"
 	"syscall"
 	"time"
 
@@ -17,21 +19,27 @@ import (
 	"github.com/pddg/photon-container/internal/downloader"
 	"github.com/pddg/photon-container/internal/logging"
 	"github.com/pddg/photon-container/internal/photondata"
+	"github.com/pddg/photon-container/internal/unarchiver"
 )
 
 var (
 	logLevel                      string
 	logFormat                     string
 	databaseURL                   string
+	databaseChecksum              string
 	archivePath                   string
 	archiveDownloadPath           string
 	downloadOnly                  bool
 	waitUntilDone                 bool
 	noComplessed                  bool
+	compression                   string
 	force                         bool
+	resume                        bool
+	uncompressedSize              string
 	photonAgentURL                string
 	progressIntervalStr           string
 	downloadSpeedLimitBytesPerSec string
+	downloadConnections           int
 )
 
 func main() {
@@ -39,16 +47,21 @@ func main() {
 	flag.StringVar(&logFormat, "log-format", getEnv("PHOTON_AGENT_LOG_FORMAT", "json"), "log format")
 
 	flag.StringVar(&databaseURL, "database-url", getEnv("PHOTON_AGENT_DATABASE_URL", photondata.DefaultDatabaseURL), "URL of the Photon database to download")
+	flag.StringVar(&databaseChecksum, "database-checksum", getEnv("PHOTON_AGENT_DATABASE_CHECKSUM", ""), "how to verify the Photon database. none, md5, sha256, sha512, sha256:sums=SHA256SUMS or sha256:{{digest}}. default is md5")
 
 	flag.StringVar(&archivePath, "archive", getEnv("PHOTON_UPDATER_ARCHIVE", ""), "path to the local archive if you want to use it instead of downloading")
 	flag.StringVar(&archiveDownloadPath, "download-to", getEnv("PHOTON_UPDATER_DOWNLOAD_TO", "/tmp/photon-db.tar.bz2"), "path to download the archive. Skip downloading if md5sum matches with the existing file")
 	flag.StringVar(&photonAgentURL, "photon-agent-url", getEnv("PHOTON_AGENT_URL", "http://localhost:8080"), "URL of the photon-agent server")
 	flag.BoolVar(&downloadOnly, "download-only", getEnv("PHOTON_UPDATER_DOWNLOAD_ONLY", "false") == "true", "only download the archive and exit")
 	flag.BoolVar(&waitUntilDone, "wait", getEnv("PHOTON_UPDATER_WAIT", "false") == "true", "wait until the migration is done")
-	flag.BoolVar(&noComplessed, "no-compressed", getEnv("PHOTON_UPDATER_NO_COMPRESSED", "false") == "true", "Archive is not compressed. Server will skip decompression")
+	flag.BoolVar(&noComplessed, "no-compressed", getEnv("PHOTON_UPDATER_NO_COMPRESSED", "false") == "true", "Archive is not compressed. Server will skip decompression. Not required since the server detects the compression")
+	flag.StringVar(&compression, "compression", getEnv("PHOTON_UPDATER_COMPRESSION", ""), "compression of the archive. none, bzip2, gzip, zstd or xz. default is detected by the server")
 	flag.BoolVar(&force, "force", getEnv("PHOTON_UPDATER_FORCE", "false") == "true", "force to initiate migration")
+	flag.BoolVar(&resume, "resume", getEnv("PHOTON_UPDATER_RESUME", "false") == "true", "resume the interrupted upload from the offset accepted by the photon-agent")
+	flag.StringVar(&uncompressedSize, "uncompressed-size", getEnv("PHOTON_UPDATER_UNCOMPRESSED_SIZE", ""), "uncompressed size of the archive (e.g. 200GB). the agent refuses the upload if it does not fit. default is estimated by the agent")
 	flag.StringVar(&progressIntervalStr, "progress-interval", getEnv("PHOTON_UPDATER_PROGRESS_INTERVAL", "1m"), "progress interval. e.g. 1m, 5s")
 	flag.StringVar(&downloadSpeedLimitBytesPerSec, "download-speed-limit", getEnv("PHOTON_UPDATER_DOWNLOAD_SPEED_LIMIT", ""), "download speed limit in bytes per second (e.g. 10MB). default is unlimited")
+	flag.IntVar(&downloadConnections, "download-connections", getEnvInt("PHOTON_UPDATER_DOWNLOAD_CONNECTIONS", 1), "number of connections to download the archive at the same time. the speed limit is applied to the total")
 	flag.Parse()
 
 	logger, err := logging.Configure(logLevel, logFormat, os.Stderr)
@@ -96,32 +109,65 @@ func innerMain(ctx context.Context) error {
 		return nil
 	}
 
+	if resume {
+		offset, err := agentClient.UploadOffset(ctx)
+		if err != nil {
+			return err
+		}
+		if offset.Offset > 0 {
+			logger.InfoContext(ctx, "resume the interrupted upload", "offset", offset.Offset, "entries", offset.Entries, "last_entry", offset.LastEntry)
+			uploadOptions = append(uploadOptions, photonagent.WithResumeOffset(offset.Offset))
+		}
+	}
+
 	logger.InfoContext(ctx, "start uploading photon database. this may take a while", "archive", archivePath)
-	if err := agentClient.MigrateStart(ctx, archivePath, uploadOptions...); err != nil {
+	started, err := agentClient.MigrateStart(ctx, archivePath, uploadOptions...)
+	if err != nil {
 		return err
 	}
+	logger = logger.With("job_id", started.JobID)
 	if waitUntilDone {
-		for {
-			select {
-			case <-ctx.Done():
-				return ctx.Err()
-			case <-time.After(progressInterval):
-				resp, err := agentClient.MigrateStatus(ctx)
-				if err != nil {
-					return err
-				}
-				if resp.State == photondata.MigrationStateMigrated {
-					logger.InfoContext(ctx, "migration is done", "version", resp.Version)
-					return nil
-				}
-				logger.InfoContext(ctx, "migration is in progress", "state", resp.State)
+		finished, err := agentClient.WatchJob(ctx, started.JobID, func(event *photonagent.Event) {
+			logEvent(ctx, logger, event)
+		})
+		if err != nil {
+			return err
+		}
+		if finished.State != photonagent.JobStateSucceeded {
+			if finished.Attention != "" {
+				logger.ErrorContext(ctx, "migration needs attention", "attention", finished.Attention)
 			}
+			return fmt.Errorf("migration %s: %s", finished.State, finished.Error)
 		}
+		resp, err := agentClient.MigrateStatus(ctx)
+		if err != nil {
+			return err
+		}
+		logger.InfoContext(ctx, "migration is done", "version", resp.Version)
+		return nil
 	}
-	logger.InfoContext(ctx, "migration has been started. See server logs for the progress")
+	logger.InfoContext(ctx, "migration has been started. See /jobs/{id} of the agent for the progress")
 	return nil
 }
 
+// logEvent logs the event of the job streamed from the photon-agent.
+func logEvent(ctx context.Context, logger *slog.Logger, event *photonagent.Event) {
+	switch event.Type {
+	case photonagent.EventStep:
+		logger.InfoContext(ctx, "migration is in progress", "step", event.Step, "total_steps", event.TotalSteps, "step_name", event.StepName)
+	case photonagent.EventDownloadProgress:
+		logger.InfoContext(ctx, "download progress", "bytes_read", humanize.Bytes(uint64(event.BytesRead)), "total_bytes", humanize.Bytes(uint64(event.TotalBytes)), "rate", humanize.Bytes(uint64(event.BytesPerSec))+"/s")
+	case photonagent.EventExtractProgress:
+		logger.InfoContext(ctx, "extract progress", "bytes", humanize.Bytes(uint64(event.BytesRead)), "entries", event.Entries, "rate", humanize.Bytes(uint64(event.BytesPerSec))+"/s")
+	case photonagent.EventPhotonStopped:
+		logger.InfoContext(ctx, "Photon server stopped")
+	case photonagent.EventPhotonStarted:
+		logger.InfoContext(ctx, "Photon server started")
+	case photonagent.EventPhotonSwitched:
+		logger.InfoContext(ctx, "Photon server switched to new database")
+	}
+}
+
 func getEnv(key, defaultValue string) string {
 	value := os.Getenv(key)
 	if value == "" {
@@ -130,6 +176,14 @@ func getEnv(key, defaultValue string) string {
 	return value
 }
 
+func getEnvInt(key string, defaultValue int) int {
+	value, err := strconv.Atoi(os.Getenv(key))
+	if err != nil {
+		return defaultValue
+	}
+	return value
+}
+
 func initOptions(
 	progressInterval time.Duration,
 ) (
@@ -144,6 +198,13 @@ func initOptions(
 		uploadOptions   []photonagent.UploadOption
 	)
 	downloadOptions = append(downloadOptions, downloader.WithProgressInterval(progressInterval))
+	downloadOptions = append(downloadOptions, downloader.WithConnections(downloadConnections))
+	if databaseChecksum != "" {
+		if _, err := downloader.ParseChecksumProvider(databaseChecksum); err != nil {
+			return nil, nil, nil, fmt.Errorf("invalid database checksum: %w", err)
+		}
+		archiveOptions = append(archiveOptions, photondata.WithChecksum(databaseChecksum))
+	}
 	uploadOptions = append(uploadOptions, photonagent.WithProgressInterval(progressInterval))
 	if downloadSpeedLimitBytesPerSec != "" {
 		limitBytes, err := humanize.ParseBytes(downloadSpeedLimitBytesPerSec)
@@ -158,5 +219,18 @@ func initOptions(
 	if noComplessed {
 		uploadOptions = append(uploadOptions, photonagent.WithNoCompressedArchive())
 	}
+	if compression != "" {
+		if _, err := unarchiver.ParseCompression(compression); err != nil {
+			return nil, nil, nil, fmt.Errorf("invalid compression: %w", err)
+		}
+		uploadOptions = append(uploadOptions, photonagent.WithCompression(compression))
+	}
+	if uncompressedSize != "" {
+		size, err := humanize.ParseBytes(uncompressedSize)
+		if err != nil {
+			return nil, nil, nil, fmt.Errorf("failed to parse uncompressed size: %w", err)
+		}
+		uploadOptions = append(uploadOptions, photonagent.WithUncompressedSize(int64(size)))
+	}
 	return archiveOptions, downloadOptions, uploadOptions, nil
 }
@@ -6,11 +6,14 @@ import (
 	"fmt"
 	"io"
 	"net/http"
+	"net/url"
 	"os"
 	"strings"
+	"time"
 
 	"github.com/pddg/photon-container/internal/logging"
 	"github.com/pddg/photon-container/internal/photondata"
+	"github.com/pddg/photon-container/internal/unarchiver"
 )
 
 type Client struct {
@@ -31,42 +34,191 @@ func NewClient(
 	}
 }
 
-func (c *Client) MigrateStart(ctx context.Context, archivePath string, options ...UploadOption) error {
+// MigrateStartResponse is the job started by the upload.
+type MigrateStartResponse struct {
+	JobID   string `json:"job_id"`
+	Message string `json:"message"`
+}
+
+func (c *Client) MigrateStart(ctx context.Context, archivePath string, options ...UploadOption) (*MigrateStartResponse, error) {
 	opts := initUploadOptions(options...)
 	f, err := os.Open(archivePath)
 	if err != nil {
-		return fmt.Errorf("photonagent.Client.MigrateStart: failed to open %q: %w", archivePath, err)
+		return nil, fmt.Errorf("photonagent.Client.MigrateStart: failed to open %q: %w", archivePath, err)
 	}
 	defer f.Close()
 	stat, err := f.Stat()
 	if err != nil {
-		return fmt.Errorf("photonagent.Client.MigrateStart: failed to get file size: %w", err)
+		return nil, fmt.Errorf("photonagent.Client.MigrateStart: failed to get file size: %w", err)
 	}
 	p := NewProgress(ctx, f, stat.Size(), opts.progressInterval, logging.FromContext(ctx))
 	defer p.Stop()
-	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.baseURL+"migrate/upload", p)
+	var body io.Reader = p
+	if opts.resumeOffset > 0 {
+		rest, err := restOfTarStream(ctx, p, opts)
+		if err != nil {
+			return nil, fmt.Errorf("photonagent.Client.MigrateStart: %w", err)
+		}
+		defer rest.Close()
+		body = rest
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.baseURL+"migrate/upload", body)
 	if err != nil {
-		return err
+		return nil, err
 	}
 	req.URL.RawQuery = opts.toQuery().Encode()
+	if opts.resumeOffset == 0 {
+		// The server estimates the space which the upload needs from its size.
+		req.ContentLength = stat.Size()
+	}
 	resp, err := c.httpClient.Do(req)
 	if err != nil {
-		return err
+		return nil, err
+	}
+	defer resp.Body.Close()
+	bodyByte, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("photonagent.Client.MigrateStart: failed to read response body: %w", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("photonagent.Client.MigrateStart: unexpected status code: %d %s", resp.StatusCode, string(bodyByte))
+	}
+	var res *MigrateStartResponse
+	if err := json.Unmarshal(bodyByte, &res); err != nil {
+		return nil, fmt.Errorf("photonagent.Client.MigrateStart: failed to unmarshal response body: %w", err)
+	}
+	return res, nil
+}
+
+// States of an update job.
+const (
+	JobStateRunning    = "running"
+	JobStateSucceeded  = "succeeded"
+	JobStateFailed     = "failed"
+	JobStateCanceled   = "canceled"
+	JobStateRolledBack = "rolled_back"
+	JobStateSkipped    = "skipped"
+)
+
+// JobResponse is the status of an update job.
+type JobResponse struct {
+	ID             string     `json:"id"`
+	Kind           string     `json:"kind"`
+	Strategy       string     `json:"strategy"`
+	State          string     `json:"state"`
+	Step           int        `json:"step"`
+	TotalSteps     int        `json:"total_steps"`
+	StepName       string     `json:"step_name"`
+	BytesProcessed int64      `json:"bytes_processed"`
+	StartedAt      time.Time  `json:"started_at"`
+	FinishedAt     *time.Time `json:"finished_at,omitempty"`
+	Error          string     `json:"error,omitempty"`
+	Attention      string     `json:"attention,omitempty"`
+	Warnings       []string   `json:"warnings,omitempty"`
+}
+
+func (c *Client) Job(ctx context.Context, id string) (*JobResponse, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.baseURL+"jobs/"+url.PathEscape(id), nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("photonagent.Client.Job: failed to send request: %w", err)
 	}
 	defer resp.Body.Close()
 	bodyByte, err := io.ReadAll(resp.Body)
 	if err != nil {
-		return fmt.Errorf("photonagent.Client.MigrateStart: failed to read response body: %w", err)
+		return nil, fmt.Errorf("photonagent.Client.Job: failed to read response body: %w", err)
 	}
 	if resp.StatusCode != http.StatusOK {
-		return fmt.Errorf("photonagent.Client.MigrateStart: unexpected status code: %d %s", resp.StatusCode, string(bodyByte))
+		return nil, fmt.Errorf("photonagent.Client.Job: unexpected status code: %d %s", resp.StatusCode, string(bodyByte))
+	}
+	var res *JobResponse
+	if err := json.Unmarshal(bodyByte, &res); err != nil {
+		return nil, fmt.Errorf("photonagent.Client.Job: failed to unmarshal response body: %w", err)
+	}
+	return res, nil
+}
+
+// CancelJob cancels the running job.
+// The job is finished in background. Poll it with Job until it is canceled.
+func (c *Client) CancelJob(ctx context.Context, id string) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodDelete, c.baseURL+"jobs/"+url.PathEscape(id), nil)
+	if err != nil {
+		return err
+	}
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("photonagent.Client.CancelJob: failed to send request: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusAccepted {
+		bodyByte, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("photonagent.Client.CancelJob: unexpected status code: %d %s", resp.StatusCode, string(bodyByte))
 	}
 	return nil
 }
 
+// restOfTarStream decompresses the archive and skips the tar stream until the offset to resume from.
+func restOfTarStream(ctx context.Context, archive io.Reader, opts *uploadOptions) (io.ReadCloser, error) {
+	compression, err := unarchiver.ParseCompression(opts.compression)
+	if err != nil {
+		return nil, err
+	}
+	if opts.noComplession {
+		compression = unarchiver.CompressionNone
+	}
+	r, err := unarchiver.NewUnarchiver().Decompress(ctx, archive, compression)
+	if err != nil {
+		return nil, err
+	}
+	logging.FromContext(ctx).InfoContext(ctx, "skip the tar stream already accepted", "offset", opts.resumeOffset)
+	if _, err := io.CopyN(io.Discard, r, opts.resumeOffset); err != nil {
+		r.Close()
+		return nil, fmt.Errorf("failed to skip the tar stream until offset %d: %w", opts.resumeOffset, err)
+	}
+	return r, nil
+}
+
+// UploadOffsetResponse is the offset of the tar stream from which the interrupted upload can be resumed.
+// Offset is 0 if there is no interrupted upload.
+type UploadOffsetResponse struct {
+	Offset    int64  `json:"offset"`
+	Entries   int    `json:"entries,omitempty"`
+	LastEntry string `json:"last_entry,omitempty"`
+	UpdatedAt string `json:"updated_at,omitempty"`
+}
+
+func (c *Client) UploadOffset(ctx context.Context) (*UploadOffsetResponse, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.baseURL+"migrate/upload/offset", nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("photonagent.Client.UploadOffset: failed to send request: %w", err)
+	}
+	defer resp.Body.Close()
+	bodyByte, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("photonagent.Client.UploadOffset: failed to read response body: %w", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("photonagent.Client.UploadOffset: unexpected status code: %d %s", resp.StatusCode, string(bodyByte))
+	}
+	var res *UploadOffsetResponse
+	if err := json.Unmarshal(bodyByte, &res); err != nil {
+		return nil, fmt.Errorf("photonagent.Client.UploadOffset: failed to unmarshal response body: %w", err)
+	}
+	return res, nil
+}
+
 type MigrateStatusResponse struct {
 	State   photondata.MigrationState `json:"state"`
 	Version string                    `json:"version"`
+	// Reason describes why the last migration has failed or has been rolled back.
+	Reason string `json:"reason,omitempty"`
 }
 
 func (c *Client) MigrateStatus(ctx context.Context) (*MigrateStatusResponse, error) {
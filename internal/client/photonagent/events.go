@@ -0,0 +1,153 @@
+package photonagent
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/pddg/photon-container/internal/logging"
+)
+
+// Types of an event of an update job.
+const (
+	EventStep             = "step"
+	EventDownloadProgress = "download_progress"
+	EventExtractProgress  = "extract_progress"
+	EventPhotonStopped    = "photon_stopped"
+	EventPhotonStarted    = "photon_started"
+	EventPhotonSwitched   = "photon_switched"
+	EventFinished         = "finished"
+)
+
+// Event is an event of an update job streamed from /migrate/events.
+type Event struct {
+	Type        string    `json:"type"`
+	JobID       string    `json:"job_id"`
+	Time        time.Time `json:"time"`
+	Step        int       `json:"step,omitempty"`
+	TotalSteps  int       `json:"total_steps,omitempty"`
+	StepName    string    `json:"step_name,omitempty"`
+	BytesRead   int64     `json:"bytes_read,omitempty"`
+	TotalBytes  int64     `json:"total_bytes,omitempty"`
+	BytesPerSec float64   `json:"bytes_per_sec,omitempty"`
+	Entries     int       `json:"entries,omitempty"`
+	State       string    `json:"state,omitempty"`
+	Error       string    `json:"error,omitempty"`
+	Attention   string    `json:"attention,omitempty"`
+}
+
+// jobPollInterval is the interval to poll the job when the event stream is not available.
+const jobPollInterval = 5 * time.Second
+
+// WatchJob subscribes to the events of the job and calls handle for each of them.
+// It returns the finished event when the job is finished.
+// When the stream ends or fails before the job is finished, it polls the job instead.
+func (c *Client) WatchJob(ctx context.Context, id string, handle func(*Event)) (*Event, error) {
+	finished, err := c.streamJob(ctx, id, handle)
+	if finished != nil {
+		return finished, nil
+	}
+	if ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
+	logging.FromContext(ctx).WarnContext(ctx, "the event stream is closed before the job is finished. poll the job instead", "job_id", id, "error", err)
+	ticker := time.NewTicker(jobPollInterval)
+	defer ticker.Stop()
+	for {
+		finished, err := c.jobFinished(ctx, id)
+		if err != nil {
+			return nil, fmt.Errorf("photonagent.Client.WatchJob: %w", err)
+		}
+		if finished != nil {
+			handle(finished)
+			return finished, nil
+		}
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// streamJob reads the events of the job from /migrate/events until the finished event.
+// The job is also checked on each keep-alive, so that a finished event lost in the stream does not block it forever.
+// It returns a nil event with the reason when the stream ends before the job is finished.
+func (c *Client) streamJob(ctx context.Context, id string, handle func(*Event)) (*Event, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.baseURL+"migrate/events?job_id="+url.QueryEscape(id), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "text/event-stream")
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to send request: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		bodyByte, _ := io.ReadAll(resp.Body)
+		return nil, fmt.Errorf("unexpected status code: %d %s", resp.StatusCode, string(bodyByte))
+	}
+	scanner := bufio.NewScanner(resp.Body)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if strings.HasPrefix(line, ":") {
+			// The stream is idle. Make sure that the job is still running.
+			finished, err := c.jobFinished(ctx, id)
+			if err != nil {
+				return nil, err
+			}
+			if finished != nil {
+				handle(finished)
+				return finished, nil
+			}
+			continue
+		}
+		// Only the data lines are used, since the type of the event is also in the data.
+		data, ok := strings.CutPrefix(line, "data:")
+		if !ok {
+			continue
+		}
+		var event Event
+		if err := json.Unmarshal([]byte(strings.TrimSpace(data)), &event); err != nil {
+			return nil, fmt.Errorf("failed to unmarshal event: %w", err)
+		}
+		handle(&event)
+		if event.Type == EventFinished {
+			return &event, nil
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read events: %w", err)
+	}
+	return nil, fmt.Errorf("stream closed before the job is finished")
+}
+
+// jobFinished returns the finished event built from the status of the job, or nil if the job is still running.
+func (c *Client) jobFinished(ctx context.Context, id string) (*Event, error) {
+	job, err := c.Job(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	if job.State == JobStateRunning {
+		return nil, nil
+	}
+	finishedAt := time.Now().UTC()
+	if job.FinishedAt != nil {
+		finishedAt = *job.FinishedAt
+	}
+	return &Event{
+		Type:      EventFinished,
+		JobID:     job.ID,
+		Time:      finishedAt,
+		State:     job.State,
+		Error:     job.Error,
+		Attention: job.Attention,
+	}, nil
+}
@@ -2,13 +2,17 @@ package photonagent
 
 import (
 	"net/url"
+	"strconv"
 	"time"
 )
 
 type uploadOptions struct {
 	noComplession    bool
+	compression      string
 	forceUpdate      bool
 	progressInterval time.Duration
+	resumeOffset     int64
+	uncompressedSize int64
 }
 
 func initUploadOptions(opts ...UploadOption) *uploadOptions {
@@ -26,9 +30,25 @@ func (uo *uploadOptions) toQuery() url.Values {
 	if uo.noComplession {
 		v.Set("no_compression", "true")
 	}
+	if uo.compression != "" {
+		v.Set("compression", uo.compression)
+	}
 	if uo.forceUpdate {
 		v.Set("force", "true")
 	}
+	if uo.uncompressedSize > 0 {
+		v.Set("uncompressed_size", strconv.FormatInt(uo.uncompressedSize, 10))
+	}
+	if uo.resumeOffset > 0 {
+		// The rest of the tar stream is sent without compression.
+		v.Del("no_compression")
+		v.Set("compression", "none")
+		v.Set("offset", strconv.FormatInt(uo.resumeOffset, 10))
+		v.Del("uncompressed_size")
+		if rest := uo.uncompressedSize - uo.resumeOffset; rest > 0 {
+			v.Set("uncompressed_size", strconv.FormatInt(rest, 10))
+		}
+	}
 	return v
 }
 
@@ -36,12 +56,21 @@ type UploadOption func(*uploadOptions)
 
 // WithNoCompressedArchive reperesents an option that the archive is not compressed.
 // Server will skip decompression for the archive.
+// It is not required since the server detects the compression from the archive.
 func WithNoCompressedArchive() UploadOption {
 	return func(o *uploadOptions) {
 		o.noComplession = true
 	}
 }
 
+// WithCompression specifies the compression format of the archive such as `zstd`.
+// Server detects the compression from the archive if it is not specified.
+func WithCompression(compression string) UploadOption {
+	return func(o *uploadOptions) {
+		o.compression = compression
+	}
+}
+
 // WithForceUpload reperesents an option that the update process is forced.
 // This will reset the migration state.
 func WithForceUpload() UploadOption {
@@ -61,3 +90,20 @@ func WithProgressInterval(interval time.Duration) UploadOption {
 		o.progressInterval = interval
 	}
 }
+
+// WithResumeOffset resumes the interrupted upload from the offset of the tar stream.
+// The archive is decompressed locally and only the rest of the tar stream from the offset is sent.
+// The offset can be obtained by Client.UploadOffset.
+func WithResumeOffset(offset int64) UploadOption {
+	return func(o *uploadOptions) {
+		o.resumeOffset = offset
+	}
+}
+
+// WithUncompressedSize declares the size of the uncompressed tar stream of the archive.
+// The server refuses the upload if it does not fit in the free space. Otherwise the server estimates it.
+func WithUncompressedSize(size int64) UploadOption {
+	return func(o *uploadOptions) {
+		o.uncompressedSize = size
+	}
+}
@@ -0,0 +1,146 @@
+package downloader
+
+import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"time"
+
+	"github.com/fujiwara/shapeio"
+
+	"github.com/pddg/photon-container/internal/logging"
+)
+
+// streamHash calculates the checksum of the partial file while it is written.
+// It implements the io.Writer interface.
+type streamHash struct {
+	h hash.Hash
+	// size is the number of bytes hashed from the beginning of the file.
+	size int64
+}
+
+func newStreamHash(h hash.Hash) *streamHash {
+	return &streamHash{h: h}
+}
+
+func (s *streamHash) Write(p []byte) (int, error) {
+	n, err := s.h.Write(p)
+	s.size += int64(n)
+	return n, err
+}
+
+func (s *streamHash) reset() {
+	s.h.Reset()
+	s.size = 0
+}
+
+func (s *streamHash) sum() string {
+	return hexDigest(s.h)
+}
+
+func hexDigest(h hash.Hash) string {
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// hashPrefix resets the hash and feeds the first n bytes of the file to it.
+// It is used when a download is resumed from the partial file written by another process.
+func (d *Downloader) hashPrefix(ctx context.Context, s *streamHash, file string, n int64) error {
+	s.reset()
+	f, err := os.Open(file)
+	if err != nil {
+		return fmt.Errorf("failed to open file %q: %w", file, err)
+	}
+	defer f.Close()
+
+	// Limit the read speed.
+	r := shapeio.NewReaderWithContext(io.LimitReader(f, n), ctx)
+	r.SetRateLimit(d.limitReadBytesPerSec)
+	if _, err := io.Copy(s, r); err != nil {
+		return fmt.Errorf("failed to hash %q: %w", file, err)
+	}
+	if s.size != n {
+		return fmt.Errorf("failed to hash %q: got %d bytes, want %d bytes", file, s.size, n)
+	}
+	return nil
+}
+
+// checksumCache is the sidecar file of the downloaded file which keeps its checksum.
+// The checksum is reused as long as the size and the modification time of the file are not changed,
+// so that the existing file does not have to be read again.
+type checksumCache struct {
+	Algorithm Algorithm `json:"algorithm"`
+	Digest    string    `json:"digest"`
+	Size      int64     `json:"size"`
+	ModTime   time.Time `json:"mod_time"`
+}
+
+func checksumCachePath(file string) string {
+	return file + ".checksum.json"
+}
+
+// loadChecksumCache returns the cached checksum of the file.
+// Empty string is returned if there is no cache or it is outdated.
+func loadChecksumCache(file string, algorithm Algorithm, stat os.FileInfo) string {
+	cacheBytes, err := os.ReadFile(checksumCachePath(file))
+	if err != nil {
+		return ""
+	}
+	var cache checksumCache
+	if err := json.Unmarshal(cacheBytes, &cache); err != nil {
+		return ""
+	}
+	if cache.Algorithm != algorithm || cache.Size != stat.Size() || !cache.ModTime.Equal(stat.ModTime()) {
+		return ""
+	}
+	return cache.Digest
+}
+
+func saveChecksumCache(file string, algorithm Algorithm, digest string) error {
+	stat, err := os.Stat(file)
+	if err != nil {
+		return fmt.Errorf("failed to stat %q: %w", file, err)
+	}
+	cacheBytes, err := json.Marshal(checksumCache{
+		Algorithm: algorithm,
+		Digest:    digest,
+		Size:      stat.Size(),
+		ModTime:   stat.ModTime(),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to marshal checksum cache: %w", err)
+	}
+	if err := os.WriteFile(checksumCachePath(file), cacheBytes, 0644); err != nil {
+		return fmt.Errorf("failed to write checksum cache: %w", err)
+	}
+	return nil
+}
+
+// removeChecksumCache removes the checksum cache of the file.
+func removeChecksumCache(file string) error {
+	if err := os.Remove(checksumCachePath(file)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+// cachedChecksumFile returns the checksum of the existing file.
+// The cached value is used if the file has not been changed since it was calculated.
+func (d *Downloader) cachedChecksumFile(ctx context.Context, file string, stat os.FileInfo, algorithm Algorithm) (string, error) {
+	if cached := loadChecksumCache(file, algorithm, stat); cached != "" {
+		logging.FromContext(ctx).DebugContext(ctx, "use cached checksum", "file", file, "algorithm", algorithm, "digest", cached)
+		return cached, nil
+	}
+	got, err := d.hashFile(ctx, file, algorithm)
+	if err != nil {
+		return "", err
+	}
+	if err := saveChecksumCache(file, algorithm, got); err != nil {
+		logging.FromContext(ctx).WarnContext(ctx, "failed to cache checksum", "file", file, "error", err)
+	}
+	return got, nil
+}
@@ -0,0 +1,269 @@
+package downloader
+
+import (
+	"bufio"
+	"context"
+	"crypto/md5"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/hashicorp/go-retryablehttp"
+
+	"github.com/pddg/photon-container/internal/photondata"
+)
+
+// Algorithm is a hash algorithm used to verify the downloaded archive.
+type Algorithm string
+
+const (
+	AlgorithmMD5    Algorithm = "md5"
+	AlgorithmSHA256 Algorithm = "sha256"
+	AlgorithmSHA512 Algorithm = "sha512"
+)
+
+// NewAlgorithm returns the Algorithm of the given name.
+func NewAlgorithm(name string) (Algorithm, error) {
+	switch Algorithm(strings.ToLower(name)) {
+	case AlgorithmMD5:
+		return AlgorithmMD5, nil
+	case AlgorithmSHA256:
+		return AlgorithmSHA256, nil
+	case AlgorithmSHA512:
+		return AlgorithmSHA512, nil
+	default:
+		return "", fmt.Errorf("unsupported checksum algorithm %q", name)
+	}
+}
+
+// New returns a new hash.Hash of the algorithm.
+func (a Algorithm) New() hash.Hash {
+	switch a {
+	case AlgorithmSHA256:
+		return sha256.New()
+	case AlgorithmSHA512:
+		return sha512.New()
+	default:
+		return md5.New()
+	}
+}
+
+// validDigest returns true if the digest is a hex string of the right length.
+func (a Algorithm) validDigest(digest string) bool {
+	decoded, err := hex.DecodeString(digest)
+	if err != nil {
+		return false
+	}
+	return len(decoded) == a.New().Size()
+}
+
+// Checksum is the expected checksum of an archive.
+// The zero value means that the archive is not verified.
+type Checksum struct {
+	Algorithm Algorithm
+	Digest    string
+}
+
+// Enabled returns true if the archive should be verified.
+func (c Checksum) Enabled() bool {
+	return c.Algorithm != ""
+}
+
+func (c Checksum) String() string {
+	if !c.Enabled() {
+		return "none"
+	}
+	return string(c.Algorithm) + ":" + c.Digest
+}
+
+// FetchFunc fetches the content of the given URL.
+type FetchFunc func(ctx context.Context, url string) ([]byte, error)
+
+// ChecksumProvider provides the expected checksum of an archive.
+type ChecksumProvider interface {
+	Checksum(ctx context.Context, fetch FetchFunc, archive photondata.Archive) (Checksum, error)
+}
+
+// SidecarChecksum returns a ChecksumProvider which fetches `{{archive URL}}.{{algorithm}}`.
+// e.g. `photon-db-planet-1.0-latest.tar.bz2.md5`
+// Both of the `{{digest}}  {{filename}}` layout and the digest only layout are accepted.
+func SidecarChecksum(algorithm Algorithm) ChecksumProvider {
+	return &sidecarChecksum{algorithm: algorithm}
+}
+
+type sidecarChecksum struct {
+	algorithm Algorithm
+}
+
+func (p *sidecarChecksum) Checksum(ctx context.Context, fetch FetchFunc, archive photondata.Archive) (Checksum, error) {
+	body, err := fetch(ctx, archive.URL()+"."+string(p.algorithm))
+	if err != nil {
+		return Checksum{}, fmt.Errorf("failed to fetch %s: %w", p.algorithm, err)
+	}
+	digest, _ := parseChecksumLine(p.algorithm, strings.TrimSpace(string(body)))
+	if !p.algorithm.validDigest(digest) {
+		return Checksum{}, fmt.Errorf("invalid %s format: %q", p.algorithm, string(body))
+	}
+	return Checksum{Algorithm: p.algorithm, Digest: digest}, nil
+}
+
+// SumsFileChecksum returns a ChecksumProvider which fetches a file listing the checksums of many archives,
+// such as `SHA256SUMS`. The file is looked up in the same directory as the archive.
+func SumsFileChecksum(algorithm Algorithm, fileName string) ChecksumProvider {
+	return &sumsFileChecksum{algorithm: algorithm, fileName: fileName}
+}
+
+type sumsFileChecksum struct {
+	algorithm Algorithm
+	fileName  string
+}
+
+func (p *sumsFileChecksum) Checksum(ctx context.Context, fetch FetchFunc, archive photondata.Archive) (Checksum, error) {
+	body, err := fetch(ctx, archive.BaseURL()+"/"+p.fileName)
+	if err != nil {
+		return Checksum{}, fmt.Errorf("failed to fetch %s: %w", p.fileName, err)
+	}
+	scanner := bufio.NewScanner(strings.NewReader(string(body)))
+	for scanner.Scan() {
+		digest, name := parseChecksumLine(p.algorithm, strings.TrimSpace(scanner.Text()))
+		if name == archive.Name() && p.algorithm.validDigest(digest) {
+			return Checksum{Algorithm: p.algorithm, Digest: digest}, nil
+		}
+	}
+	return Checksum{}, fmt.Errorf("%s does not contain %q", p.fileName, archive.Name())
+}
+
+// StaticChecksum returns a ChecksumProvider which always provides the given digest.
+func StaticChecksum(algorithm Algorithm, digest string) ChecksumProvider {
+	return &staticChecksum{checksum: Checksum{Algorithm: algorithm, Digest: strings.ToLower(digest)}}
+}
+
+type staticChecksum struct {
+	checksum Checksum
+}
+
+func (p *staticChecksum) Checksum(ctx context.Context, fetch FetchFunc, archive photondata.Archive) (Checksum, error) {
+	return p.checksum, nil
+}
+
+// NoChecksum returns a ChecksumProvider which disables the verification.
+func NoChecksum() ChecksumProvider {
+	return &staticChecksum{}
+}
+
+// ParseChecksumProvider parses the checksum specification.
+// The following formats are supported:
+//
+//   - `none`: disable the verification
+//   - `{{algorithm}}`: fetch `{{archive URL}}.{{algorithm}}` (e.g. `sha256`)
+//   - `{{algorithm}}:sums={{file}}`: fetch `{{file}}` in the same directory as the archive (e.g. `sha256:sums=SHA256SUMS`)
+//   - `{{algorithm}}:{{digest}}`: use the given digest
+//
+// Supported algorithms are md5, sha256 and sha512.
+// nil is returned for an empty specification.
+func ParseChecksumProvider(spec string) (ChecksumProvider, error) {
+	if spec == "" {
+		return nil, nil
+	}
+	if spec == "none" {
+		return NoChecksum(), nil
+	}
+	name, rest, _ := strings.Cut(spec, ":")
+	algorithm, err := NewAlgorithm(name)
+	if err != nil {
+		return nil, fmt.Errorf("downloader.ParseChecksumProvider: %w", err)
+	}
+	if rest == "" {
+		return SidecarChecksum(algorithm), nil
+	}
+	if fileName, ok := strings.CutPrefix(rest, "sums="); ok {
+		if fileName == "" {
+			return nil, fmt.Errorf("downloader.ParseChecksumProvider: empty file name in %q", spec)
+		}
+		return SumsFileChecksum(algorithm, fileName), nil
+	}
+	if !algorithm.validDigest(strings.ToLower(rest)) {
+		return nil, fmt.Errorf("downloader.ParseChecksumProvider: invalid %s digest %q", algorithm, rest)
+	}
+	return StaticChecksum(algorithm, rest), nil
+}
+
+// parseChecksumLine parses a line of checksum files and returns the digest and the file name.
+// The following layouts are supported:
+//
+//   - GNU coreutils: `{{digest}}  {{filename}}` or `{{digest}} *{{filename}}`
+//   - BSD: `SHA256 ({{filename}}) = {{digest}}`
+//   - digest only: `{{digest}}`
+func parseChecksumLine(algorithm Algorithm, line string) (string, string) {
+	if rest, ok := strings.CutPrefix(strings.ToLower(line), string(algorithm)+" ("); ok {
+		// Use the original line to keep the case of the file name.
+		rest = line[len(line)-len(rest):]
+		name, digest, ok := strings.Cut(rest, ") = ")
+		if !ok {
+			return "", ""
+		}
+		return strings.ToLower(strings.TrimSpace(digest)), name
+	}
+	digest, name, _ := strings.Cut(line, " ")
+	name = strings.TrimPrefix(strings.TrimLeft(name, " "), "*")
+	name = strings.TrimPrefix(name, "./")
+	return strings.ToLower(digest), name
+}
+
+// fetchBody is a FetchFunc using the client of the Downloader.
+func (d *Downloader) fetchBody(ctx context.Context, url string) ([]byte, error) {
+	req, err := retryablehttp.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request for %q: %w", url, err)
+	}
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to request %q: %w", url, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("failed to download %q: %s", url, resp.Status)
+	}
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %q: %w", url, err)
+	}
+	return body, nil
+}
+
+// checksumProvider returns the ChecksumProvider for the archive.
+// The provider configured for the archive takes precedence over the one of the Downloader.
+func (d *Downloader) checksumProvider(archive photondata.Archive) (ChecksumProvider, error) {
+	provider, err := ParseChecksumProvider(archive.Checksum())
+	if err != nil {
+		return nil, err
+	}
+	if provider != nil {
+		return provider, nil
+	}
+	return d.defaultChecksum, nil
+}
+
+// ExpectedChecksum returns the checksum which the archive is verified against when it is downloaded.
+// The zero value is returned if the archive is not verified.
+func (d *Downloader) ExpectedChecksum(ctx context.Context, archive photondata.Archive) (Checksum, error) {
+	checksum, err := d.expectedChecksum(ctx, archive)
+	if err != nil {
+		return Checksum{}, fmt.Errorf("downloader.Downloader.ExpectedChecksum: %w", err)
+	}
+	return checksum, nil
+}
+
+// expectedChecksum returns the expected checksum of the archive.
+func (d *Downloader) expectedChecksum(ctx context.Context, archive photondata.Archive) (Checksum, error) {
+	provider, err := d.checksumProvider(archive)
+	if err != nil {
+		return Checksum{}, err
+	}
+	return provider.Checksum(ctx, d.fetchBody, archive)
+}
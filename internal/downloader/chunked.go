@@ -0,0 +1,382 @@
+package downloader
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/dustin/go-humanize"
+	"github.com/fujiwara/shapeio"
+	"github.com/hashicorp/go-retryablehttp"
+	"golang.org/x/time/rate"
+
+	"github.com/pddg/photon-container/internal/logging"
+)
+
+const (
+	// minChunkSize is the minimum size of a byte range fetched by a connection.
+	minChunkSize = 8 * 1024 * 1024
+	// chunksPerConnection is the number of byte ranges assigned to a connection on average.
+	// Splitting into more chunks than connections balances the load between slow and fast connections.
+	chunksPerConnection = 4
+	// burstLimit is the burst size of the download speed limiter shared between connections.
+	burstLimit = 1000 * 1000 * 1000
+)
+
+// chunkState is the state of a byte range of the remote file.
+type chunkState struct {
+	// Start is the first byte position of the chunk.
+	Start int64 `json:"start"`
+	// End is the last byte position of the chunk (exclusive).
+	End int64 `json:"end"`
+	// Written is the number of bytes which have been written from Start.
+	Written int64 `json:"written"`
+}
+
+func (c *chunkState) done() bool {
+	return c.Start+c.Written >= c.End
+}
+
+func splitChunks(size int64, connections int) []chunkState {
+	chunkSize := max(size/int64(connections*chunksPerConnection), minChunkSize)
+	var chunks []chunkState
+	for start := int64(0); start < size; start += chunkSize {
+		chunks = append(chunks, chunkState{
+			Start: start,
+			End:   min(start+chunkSize, size),
+		})
+	}
+	return chunks
+}
+
+// rangeSupport returns the response of HEAD request if the server supports range requests.
+// nil is returned if the server does not support it.
+func (d *Downloader) rangeSupport(ctx context.Context, url string) (*http.Response, error) {
+	req, err := retryablehttp.NewRequestWithContext(ctx, http.MethodHead, url, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request: %w", err)
+	}
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to request: %w", err)
+	}
+	// Discard the body to reuse the connection.
+	// HEAD request will not have a body.
+	_, _ = io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("failed to check range support: %s", resp.Status)
+	}
+	if resp.Header.Get("Accept-Ranges") != "bytes" || resp.ContentLength <= 0 {
+		return nil, nil
+	}
+	return resp, nil
+}
+
+// fetchChunked downloads the remote file to the partial file using multiple connections.
+// The partial file is preallocated, and each connection writes its byte range at the right offset.
+// It falls back to fetch if the server does not support range requests.
+// The chunks are finished out of order. Whenever the finished chunks from the beginning of the file grow,
+// their bytes are read back and fed to the hash, so that the file does not have to be read again as a whole.
+func (d *Downloader) fetchChunked(ctx context.Context, url string, partial *partialDownload, hash *streamHash) error {
+	logger := logging.FromContext(ctx)
+	head, err := d.rangeSupport(ctx, url)
+	if err != nil {
+		return err
+	}
+	if head == nil {
+		logger.InfoContext(ctx, "server does not support range requests. fall back to a single connection", "url", url)
+		return d.fetch(ctx, url, partial, hash)
+	}
+	size := head.ContentLength
+
+	meta, err := partial.loadMeta()
+	if err != nil {
+		return fmt.Errorf("failed to check partial file: %w", err)
+	}
+	resume := meta.URL == url && meta.Size == size && len(meta.Chunks) > 0 && meta.ifRange() != "" && meta.sameAs(head)
+	if resume {
+		if stat, err := os.Stat(partial.path); err != nil || stat.Size() != size {
+			resume = false
+		}
+	}
+	if !resume {
+		meta = newPartialMeta(url, head, size)
+		meta.Chunks = splitChunks(size, d.connections)
+	}
+
+	flag := os.O_RDWR | os.O_CREATE
+	if !resume {
+		flag |= os.O_TRUNC
+	}
+	f, err := os.OpenFile(partial.path, flag, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to open partial file %q: %w", partial.path, err)
+	}
+	// Close the file before returning. The error is ignored because it is closed explicitly below.
+	defer f.Close()
+	if !resume {
+		if err := f.Truncate(size); err != nil {
+			return fmt.Errorf("failed to preallocate partial file %q: %w", partial.path, err)
+		}
+	}
+
+	var (
+		doneBytes int64
+		pending   []int
+	)
+	for i := range meta.Chunks {
+		doneBytes += meta.Chunks[i].Written
+		if !meta.Chunks[i].done() {
+			pending = append(pending, i)
+		}
+	}
+	logger.InfoContext(ctx, "start chunked downloading", "url", url, "connections", d.connections, "chunks", len(meta.Chunks), "pending_chunks", len(pending), "downloaded", humanize.Bytes(uint64(doneBytes)), "total", humanize.Bytes(uint64(size)))
+
+	// The speed limit is applied to the sum of all connections.
+	limiter := rate.NewLimiter(rate.Limit(d.limitDownloadBytesPerSec), burstLimit)
+	limiter.AllowN(time.Now(), burstLimit)
+	var progress io.Writer = io.Discard
+	if !d.hideProgress {
+		p := d.newProgress(ctx, size, logger)
+		p.Skip(doneBytes)
+		defer p.Stop()
+		progress = p
+	}
+
+	// The metadata is saved when a chunk is finished or failed, so that the download can be resumed later.
+	var metaMutex sync.Mutex
+	written := make([]atomic.Int64, len(meta.Chunks))
+	for i := range meta.Chunks {
+		written[i].Store(meta.Chunks[i].Written)
+	}
+	saveMeta := func() error {
+		metaMutex.Lock()
+		defer metaMutex.Unlock()
+		for i := range meta.Chunks {
+			meta.Chunks[i].Written = written[i].Load()
+		}
+		return partial.saveMeta(meta)
+	}
+	if err := saveMeta(); err != nil {
+		return fmt.Errorf("failed to save partial metadata: %w", err)
+	}
+
+	// Workers read their own copy of the chunks since saveMeta updates meta.Chunks.
+	chunks := slices.Clone(meta.Chunks)
+	// hashMutex is held by the worker which feeds the hash. Other workers do not wait for it.
+	var hashMutex sync.Mutex
+	feedHash := func() error {
+		return d.hashFinishedPrefix(ctx, hash, f, chunks, written)
+	}
+	if !resume {
+		hash.reset()
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	queue := make(chan int, len(pending))
+	for _, i := range pending {
+		queue <- i
+	}
+	close(queue)
+	var (
+		wg       sync.WaitGroup
+		errMutex sync.Mutex
+		errs     []error
+	)
+	for range min(d.connections, len(pending)) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range queue {
+				chunk := chunks[i]
+				err := d.fetchChunkWithRetry(ctx, url, meta, f, chunk, &written[i], limiter, progress)
+				if saveErr := saveMeta(); saveErr != nil {
+					err = errors.Join(err, fmt.Errorf("failed to save partial metadata: %w", saveErr))
+				}
+				if err == nil && hashMutex.TryLock() {
+					if hashErr := feedHash(); hashErr != nil {
+						err = fmt.Errorf("failed to hash partial file: %w", hashErr)
+					}
+					hashMutex.Unlock()
+				}
+				if err != nil {
+					errMutex.Lock()
+					errs = append(errs, fmt.Errorf("chunk %d-%d: %w", chunk.Start, chunk.End, err))
+					errMutex.Unlock()
+					// Stop other connections. The progress is kept in the metadata.
+					cancel()
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	if len(errs) > 0 {
+		return errors.Join(errs...)
+	}
+	// The last chunk may have been finished while another worker was feeding the hash.
+	if err := feedHash(); err != nil {
+		return fmt.Errorf("failed to hash partial file: %w", err)
+	}
+	if hash.size != size {
+		return fmt.Errorf("failed to hash partial file: hashed %d bytes, want %d bytes", hash.size, size)
+	}
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("failed to close partial file: %w", err)
+	}
+	return nil
+}
+
+// hashFinishedPrefix feeds the bytes of the finished chunks from the beginning of the file to the hash.
+// The bytes which have been fed already are skipped, and the chunks finished meanwhile are fed as well.
+// The chunks must be sorted by their Start.
+func (d *Downloader) hashFinishedPrefix(ctx context.Context, hash *streamHash, f *os.File, chunks []chunkState, written []atomic.Int64) error {
+	for {
+		var end int64
+		for i := range chunks {
+			if chunks[i].Start+written[i].Load() < chunks[i].End {
+				break
+			}
+			end = chunks[i].End
+		}
+		if hash.size > end {
+			// The hash was fed by another download of the file.
+			hash.reset()
+		}
+		if hash.size == end {
+			return nil
+		}
+		// Limit the read speed.
+		r := shapeio.NewReaderWithContext(io.NewSectionReader(f, hash.size, end-hash.size), ctx)
+		r.SetRateLimit(d.limitReadBytesPerSec)
+		if _, err := io.Copy(hash, r); err != nil {
+			return err
+		}
+		if hash.size != end {
+			return fmt.Errorf("hashed %d bytes, want %d bytes", hash.size, end)
+		}
+	}
+}
+
+// fetchChunkWithRetry downloads a byte range of the remote file.
+// The chunk is retried by itself up to maxResumeAttempts times when the transfer is interrupted.
+func (d *Downloader) fetchChunkWithRetry(
+	ctx context.Context,
+	url string,
+	meta partialMeta,
+	f *os.File,
+	chunk chunkState,
+	written *atomic.Int64,
+	limiter *rate.Limiter,
+	progress io.Writer,
+) error {
+	logger := logging.FromContext(ctx)
+	for attempt := 1; ; attempt++ {
+		err := d.fetchChunk(ctx, url, meta, f, chunk, written, limiter, progress)
+		if err == nil {
+			return nil
+		}
+		if !errors.Is(err, errInterrupted) || ctx.Err() != nil || attempt > d.maxResumeAttempts {
+			return err
+		}
+		wait := time.Duration(attempt) * d.client.RetryWaitMin
+		logger.WarnContext(ctx, "chunk download interrupted. retrying", "start", chunk.Start, "end", chunk.End, "attempt", attempt, "wait", wait, "error", err)
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(wait):
+		}
+	}
+}
+
+func (d *Downloader) fetchChunk(
+	ctx context.Context,
+	url string,
+	meta partialMeta,
+	f *os.File,
+	chunk chunkState,
+	written *atomic.Int64,
+	limiter *rate.Limiter,
+	progress io.Writer,
+) error {
+	offset := chunk.Start + written.Load()
+	if offset >= chunk.End {
+		return nil
+	}
+	req, err := retryablehttp.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return fmt.Errorf("failed to create request: %w", err)
+	}
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", offset, chunk.End-1))
+	req.Header.Set("If-Range", meta.ifRange())
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to request: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusPartialContent {
+		// 200 means that the remote file has been changed.
+		return fmt.Errorf("failed to download chunk: %s", resp.Status)
+	}
+	start, _, err := parseContentRange(resp.Header.Get("Content-Range"))
+	if err != nil {
+		return fmt.Errorf("failed to download chunk: %w", err)
+	}
+	if start != offset || !meta.sameAs(resp) {
+		return fmt.Errorf("failed to download chunk: unexpected response for range %d-%d", offset, chunk.End-1)
+	}
+
+	body := &limitedReader{ctx: ctx, r: io.LimitReader(resp.Body, chunk.End-offset), limiter: limiter}
+	w := &chunkWriter{w: io.NewOffsetWriter(f, offset), written: written}
+	if _, err := io.Copy(io.MultiWriter(w, progress), body); err != nil {
+		var pathErr *fs.PathError
+		if errors.As(err, &pathErr) {
+			// Failed to write to the local file. Retrying will not help.
+			return fmt.Errorf("failed to write to partial file: %w", err)
+		}
+		return fmt.Errorf("%w: %w", errInterrupted, err)
+	}
+	if got := chunk.Start + written.Load(); got != chunk.End {
+		return fmt.Errorf("%w: chunk ends at %d, want %d", errInterrupted, got, chunk.End)
+	}
+	return nil
+}
+
+// chunkWriter counts the bytes written to the partial file.
+type chunkWriter struct {
+	w       io.Writer
+	written *atomic.Int64
+}
+
+func (w *chunkWriter) Write(p []byte) (int, error) {
+	n, err := w.w.Write(p)
+	w.written.Add(int64(n))
+	return n, err
+}
+
+// limitedReader is a reader which shares a rate limiter with other readers.
+type limitedReader struct {
+	ctx     context.Context
+	r       io.Reader
+	limiter *rate.Limiter
+}
+
+func (r *limitedReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	if err != nil {
+		return n, err
+	}
+	if err := r.limiter.WaitN(r.ctx, n); err != nil {
+		return n, err
+	}
+	return n, nil
+}
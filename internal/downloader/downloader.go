@@ -2,16 +2,14 @@ package downloader
 
 import (
 	"context"
-	"crypto/md5"
 	"encoding/hex"
 	"errors"
 	"fmt"
 	"io"
+	"io/fs"
 	"math"
 	"net/http"
 	"os"
-	"path"
-	"strings"
 	"time"
 
 	"github.com/dustin/go-humanize"
@@ -38,6 +36,11 @@ type Downloader struct {
 	// Default is 1 minute.
 	progressInterval time.Duration
 
+	// progressFunc receives the progress of downloads in addition to the log.
+	// Use WithProgressFunc option to set this value.
+	// Default is nil.
+	progressFunc ProgressFunc
+
 	// limitDownloadPerSec sets the download speed limit in bytes per second.
 	// Use WithDownloadSpeedLimit option to set this value.
 	// Default is math.MaxFloat64.
@@ -47,6 +50,21 @@ type Downloader struct {
 	// Use WithReadSpeedLimit option to set this value.
 	// Default is math.MaxFloat64.
 	limitReadBytesPerSec float64
+
+	// maxResumeAttempts sets how many times an interrupted download is resumed within a Download call.
+	// Use WithMaxResumeAttempts option to set this value.
+	// Default is 5.
+	maxResumeAttempts int
+
+	// connections sets the number of connections used to download a file.
+	// Use WithConnections option to set this value.
+	// Default is 1.
+	connections int
+
+	// defaultChecksum provides the expected checksum of archives which do not have their own configuration.
+	// Use WithChecksumProvider option to set this value.
+	// Default is SidecarChecksum(AlgorithmMD5).
+	defaultChecksum ChecksumProvider
 }
 
 // New creates a new Downloader with the given http.Client and baseURL.
@@ -78,6 +96,9 @@ func New(httpClient *http.Client, options ...DownloaderOption) *Downloader {
 		progressInterval:         1 * time.Minute,
 		limitDownloadBytesPerSec: math.MaxFloat64,
 		limitReadBytesPerSec:     math.MaxFloat64,
+		maxResumeAttempts:        5,
+		connections:              1,
+		defaultChecksum:          SidecarChecksum(AlgorithmMD5),
 	}
 	for _, opt := range options {
 		opt(d)
@@ -89,134 +110,222 @@ func New(httpClient *http.Client, options ...DownloaderOption) *Downloader {
 // Download URL is constructed by concatenating the baseURL and dbPath.
 // Eliminate the leading slash of dbPath.
 // The download progress is logged at the interval set by the WithProgressInterval option.
-// After the download is complete, the MD5 sum of the downloaded file is verified.
-// If the MD5 sum does not match, the downloaded file will be removed and an error is returned.
+// The file is downloaded to `{{dest}}.part` first. If the transfer is interrupted, it is resumed
+// by a Range request up to the times set by the WithMaxResumeAttempts option.
+// The partial file is kept on failure, so that the next call can resume it as well.
+// ETag or Last-Modified is used to detect that the remote file has been changed in the meantime.
+// The checksum is calculated while downloading and verified after the download is complete.
+// The expected checksum is obtained by the ChecksumProvider configured for the archive (see photondata.WithChecksum),
+// or the one set by the WithChecksumProvider option. By default, `{{archive URL}}.md5` is used.
+// If the checksum does not match, the downloaded file will be removed and an error is returned.
 func (d *Downloader) Download(ctx context.Context, archive photondata.Archive, dest string) error {
 	logger := logging.FromContext(ctx)
 	url := archive.URL()
-	// Get the MD5 sum of the file first.
-	// Download database file may require a long time, so we need to check the MD5 sum first.
-	md5sum, err := d.getMD5Sum(ctx, url)
+	// Get the checksum of the file first.
+	// Download database file may require a long time, so we need to check the checksum first.
+	expected, err := d.expectedChecksum(ctx, archive)
 	if err != nil {
-		return fmt.Errorf("downloader.Downloader.Download: failed to verify md5sum: %w", err)
+		return fmt.Errorf("downloader.Downloader.Download: failed to get checksum: %w", err)
 	}
 
-	// Skip downloading if the file already exists and the MD5 sum matches.
+	// Skip downloading if the file already exists and the checksum matches.
 	if stat, err := os.Stat(dest); err == nil {
 		if stat.IsDir() {
 			return fmt.Errorf("downloader.Downloader.Download: destination %q is a directory", dest)
 		}
-		// Check the MD5 sum of the existing file.
-		got, err := d.md5sumFile(ctx, dest)
-		if err != nil {
-			return fmt.Errorf("downloader.Downloader.Download: failed to calculate md5sum of existing file: %w", err)
-		}
-		if got == md5sum {
-			logger.InfoContext(ctx, "file already exists", "file", dest, "md5sum", md5sum)
-			return nil
+		if expected.Enabled() {
+			// Check the checksum of the existing file.
+			// The cached checksum is used if the file has not been changed since the last check.
+			got, err := d.cachedChecksumFile(ctx, dest, stat, expected.Algorithm)
+			if err != nil {
+				return fmt.Errorf("downloader.Downloader.Download: failed to calculate checksum of existing file: %w", err)
+			}
+			if got == expected.Digest {
+				logger.InfoContext(ctx, "file already exists", "file", dest, "checksum", expected)
+				return nil
+			}
+			logger.InfoContext(ctx, "file already exists but checksum mismatch", "file", dest, "expected_checksum", expected, "actual_checksum", got)
+		} else {
+			logger.InfoContext(ctx, "file already exists but it can not be verified. download again", "file", dest)
 		}
-		logger.InfoContext(ctx, "file already exists but md5sum mismatch", "file", dest, "expected_md5sum", md5sum, "actual_md5sum", got)
-	}
-
-	logger.InfoContext(ctx, "start downloading", "url", url, "dest", dest, "md5sum", md5sum)
-	req, err := retryablehttp.NewRequestWithContext(ctx, http.MethodGet, url, nil)
-	if err != nil {
-		return fmt.Errorf("downloader.Downloader.Download: failed to create request: %w", err)
-	}
-	resp, err := d.client.Do(req)
-	if err != nil {
-		return fmt.Errorf("downloader.Downloader.Download: falied to request: %w", err)
-	}
-	defer resp.Body.Close()
-
-	if resp.StatusCode != http.StatusOK {
-		return fmt.Errorf("downloader.Downloader.Download: failed to download: %s", resp.Status)
 	}
 
-	// Create a temp file in the same directory as the destination file.
+	logger.InfoContext(ctx, "start downloading", "url", url, "dest", dest, "checksum", expected)
+	// Download to a partial file in the same directory as the destination file.
 	// This is required because the file may be on a different filesystem.
 	// Rename is an atomic operation within the same filesystem.
-	f, err := os.CreateTemp(path.Dir(dest), "tmp-*")
-	if err != nil {
-		return fmt.Errorf("downloader.Downloader.Download: failed to create temp file in %q: %w", path.Dir(dest), err)
-	}
-	defer func() {
-		// Close the file before removing it. All errors are ignored.
-		_ = f.Close()
-		_ = os.Remove(f.Name())
-	}()
-	// Limit the download speed.
-	body := shapeio.NewReaderWithContext(resp.Body, ctx)
-	body.SetRateLimit(d.limitDownloadBytesPerSec)
-
-	var r io.Reader = body
-	if !d.hideProgress {
-		progress := NewProgress(ctx, resp.ContentLength, d.progressInterval, logger)
-		defer progress.Stop()
-		r = io.TeeReader(body, progress)
+	// The partial file is kept even if the download fails, so that it can be resumed later.
+	partial := newPartialDownload(dest)
+	// The checksum is calculated while downloading, so that the whole file does not have to be read again.
+	hash := newStreamHash(expected.Algorithm.New())
+	for attempt := 1; ; attempt++ {
+		fetch := d.fetch
+		if d.connections > 1 {
+			fetch = d.fetchChunked
+		}
+		err := fetch(ctx, url, partial, hash)
+		if err == nil {
+			break
+		}
+		if !errors.Is(err, errInterrupted) || ctx.Err() != nil || attempt > d.maxResumeAttempts {
+			return fmt.Errorf("downloader.Downloader.Download: %w", err)
+		}
+		wait := time.Duration(attempt) * d.client.RetryWaitMin
+		logger.WarnContext(ctx, "download interrupted. resuming", "url", url, "attempt", attempt, "wait", wait, "error", err)
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("downloader.Downloader.Download: %w", ctx.Err())
+		case <-time.After(wait):
+		}
 	}
+	logger.InfoContext(ctx, "downloaded", "url", url, "dest", dest)
 
-	if _, err := io.Copy(f, r); err != nil && !errors.Is(err, io.EOF) {
-		return fmt.Errorf("downloader.Downloader.Download: failed to write to temp file: %w", err)
-	}
-	if err := f.Close(); err != nil {
-		return fmt.Errorf("downloader.Downloader.Download: failed to close temp file: %w", err)
+	if expected.Enabled() {
+		logger.InfoContext(ctx, "verifying checksum", "file", partial.path, "expected_checksum", expected)
+		got := hash.sum()
+		if got != expected.Digest {
+			// The partial file is broken. It must not be resumed.
+			if err := partial.remove(); err != nil {
+				logger.WarnContext(ctx, "failed to remove partial file", "path", partial.path, "error", err)
+			}
+			return fmt.Errorf("downloader.Downloader.Download: checksum mismatch: got %q, want %q", got, expected.Digest)
+		}
+		logger.InfoContext(ctx, "checksum verified", "file", dest, "expected_checksum", expected, "actual_checksum", got)
+	} else {
+		logger.WarnContext(ctx, "checksum verification is disabled", "file", dest)
 	}
-	logger.InfoContext(ctx, "downloaded", "url", url, "dest", dest, "size", humanize.Bytes(uint64(resp.ContentLength)))
 
-	// Verify the MD5 sum of the downloaded file.
-	// This must be done after the file is closed.
-	logger.InfoContext(ctx, "verifying md5sum", "file", f.Name(), "expected_md5sum", md5sum)
-	got, err := d.md5sumFile(ctx, f.Name())
-	if err != nil {
-		return fmt.Errorf("downloader.Downloader.Download: failed to calculate md5sum: %w", err)
+	if err := os.Rename(partial.path, dest); err != nil {
+		return fmt.Errorf("downloader.Downloader.Download: failed to rename partial file to %q: %w", dest, err)
 	}
-	if got != md5sum {
-		return fmt.Errorf("downloader.Downloader.Download: md5sum mismatch: got %q, want %q", got, md5sum)
+	if err := partial.remove(); err != nil {
+		logger.WarnContext(ctx, "failed to remove partial metadata", "path", partial.metaPath, "error", err)
 	}
-	logger.InfoContext(ctx, "md5sum verified", "file", dest, "expected_md5sum", md5sum, "actual_md5sum", got)
-
-	if err := os.Rename(f.Name(), dest); err != nil {
-		return fmt.Errorf("downloader.Downloader.Download: failed to rename temp file to %q: %w", dest, err)
+	if expected.Enabled() {
+		if err := saveChecksumCache(dest, expected.Algorithm, expected.Digest); err != nil {
+			logger.WarnContext(ctx, "failed to cache checksum", "file", dest, "error", err)
+		}
 	}
 	logger.InfoContext(ctx, "download complete", "url", url, "dest", dest)
 	return nil
 }
 
-func (d *Downloader) getMD5Sum(ctx context.Context, archiveUrl string) (string, error) {
+// errInterrupted indicates that the transfer was interrupted and it can be resumed.
+var errInterrupted = errors.New("download interrupted")
+
+// fetch downloads the remote file to the partial file.
+// If the partial file already has some bytes of the same remote file, only the rest of them is requested.
+// The written bytes are also fed to the hash.
+func (d *Downloader) fetch(ctx context.Context, url string, partial *partialDownload, hash *streamHash) error {
 	logger := logging.FromContext(ctx)
-	logger.InfoContext(ctx, "verifying m5sum of downloaded file")
-	url := archiveUrl + ".md5"
+	offset, meta, err := partial.resumeOffset(url)
+	if err != nil {
+		return fmt.Errorf("failed to check partial file: %w", err)
+	}
+	if offset > 0 && hash.size != offset {
+		// The partial file was written by another call. Its bytes have to be hashed first.
+		if err := d.hashPrefix(ctx, hash, partial.path, offset); err != nil {
+			return fmt.Errorf("failed to hash partial file: %w", err)
+		}
+	}
 	req, err := retryablehttp.NewRequestWithContext(ctx, http.MethodGet, url, nil)
 	if err != nil {
-		return "", fmt.Errorf("failed to create request for md5sum: %w", err)
+		return fmt.Errorf("failed to create request: %w", err)
+	}
+	if offset > 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+		// The server returns the whole file if the remote file has been changed.
+		req.Header.Set("If-Range", meta.ifRange())
 	}
 	resp, err := d.client.Do(req)
 	if err != nil {
-		return "", fmt.Errorf("falied to request md5sum: %w", err)
+		return fmt.Errorf("failed to request: %w", err)
 	}
 	defer resp.Body.Close()
 
-	if resp.StatusCode != http.StatusOK {
-		return "", fmt.Errorf("failed to download md5sum: %s", resp.Status)
+	size := resp.ContentLength
+	switch resp.StatusCode {
+	case http.StatusOK:
+		if offset > 0 {
+			logger.InfoContext(ctx, "remote file has been changed. restart downloading", "url", url, "partial_size", humanize.Bytes(uint64(offset)))
+		}
+		offset = 0
+		hash.reset()
+	case http.StatusPartialContent:
+		start, total, err := parseContentRange(resp.Header.Get("Content-Range"))
+		if err != nil {
+			return fmt.Errorf("failed to resume: %w", err)
+		}
+		if start != offset || !meta.sameAs(resp) {
+			// The server ignored If-Range. The partial file can not be used anymore.
+			if err := partial.remove(); err != nil {
+				return fmt.Errorf("failed to remove partial file: %w", err)
+			}
+			return fmt.Errorf("%w: remote file has been changed", errInterrupted)
+		}
+		size = total
+		logger.InfoContext(ctx, "resume downloading", "url", url, "offset", humanize.Bytes(uint64(offset)), "total", humanize.Bytes(uint64(size)))
+	case http.StatusRequestedRangeNotSatisfiable:
+		_, total, _ := parseContentRange(resp.Header.Get("Content-Range"))
+		if total == offset {
+			// The partial file has been already completed.
+			return nil
+		}
+		if err := partial.remove(); err != nil {
+			return fmt.Errorf("failed to remove partial file: %w", err)
+		}
+		return fmt.Errorf("%w: unexpected partial file size %d", errInterrupted, offset)
+	default:
+		return fmt.Errorf("failed to download: %s", resp.Status)
+	}
+	if err := partial.saveMeta(newPartialMeta(url, resp, size)); err != nil {
+		return fmt.Errorf("failed to save partial metadata: %w", err)
 	}
 
-	// Body will be as follows:
-	// {{md5sum}}  {{filename}}
-	body, err := io.ReadAll(resp.Body)
+	flag := os.O_WRONLY | os.O_CREATE | os.O_APPEND
+	if offset == 0 {
+		flag |= os.O_TRUNC
+	}
+	f, err := os.OpenFile(partial.path, flag, 0644)
 	if err != nil {
-		return "", fmt.Errorf("failed to read md5sum: %w", err)
+		return fmt.Errorf("failed to open partial file %q: %w", partial.path, err)
+	}
+	// Close the file before returning. The error is ignored because it is closed explicitly below.
+	defer f.Close()
+
+	// Limit the download speed.
+	body := shapeio.NewReaderWithContext(resp.Body, ctx)
+	body.SetRateLimit(d.limitDownloadBytesPerSec)
+
+	var r io.Reader = body
+	if !d.hideProgress {
+		progress := d.newProgress(ctx, size, logger)
+		progress.Skip(offset)
+		defer progress.Stop()
+		r = io.TeeReader(body, progress)
 	}
 
-	// Split the body by space.  The first element is the md5sum.
-	fields := strings.Fields(string(body))
-	if len(fields) < 2 {
-		return "", fmt.Errorf("invalid md5sum format: %q", string(body))
+	// The bytes are hashed only after they are written to the file successfully.
+	written, err := io.Copy(io.MultiWriter(f, hash), r)
+	if err != nil {
+		var pathErr *fs.PathError
+		if errors.As(err, &pathErr) {
+			// Failed to write to the local file. Retrying will not help.
+			return fmt.Errorf("failed to write to partial file: %w", err)
+		}
+		return fmt.Errorf("%w: %w", errInterrupted, err)
 	}
-	return string(fields[0]), nil
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("failed to close partial file: %w", err)
+	}
+	if size >= 0 && offset+written != size {
+		return fmt.Errorf("%w: got %d bytes, want %d bytes", errInterrupted, offset+written, size)
+	}
+	return nil
 }
 
-func (d *Downloader) md5sumFile(ctx context.Context, file string) (string, error) {
+// hashFile calculates the checksum of the file with the given algorithm.
+func (d *Downloader) hashFile(ctx context.Context, file string, algorithm Algorithm) (string, error) {
 	f, err := os.Open(file)
 	if err != nil {
 		return "", fmt.Errorf("failed to open file %q: %w", file, err)
@@ -227,22 +336,40 @@ func (d *Downloader) md5sumFile(ctx context.Context, file string) (string, error
 	r := shapeio.NewReaderWithContext(f, ctx)
 	r.SetRateLimit(d.limitReadBytesPerSec)
 
-	h := md5.New()
+	h := algorithm.New()
 	if _, err := io.Copy(h, r); err != nil {
-		return "", fmt.Errorf("failed to calculate md5sum: %w", err)
+		return "", fmt.Errorf("failed to calculate %s: %w", algorithm, err)
 	}
 	return hex.EncodeToString(h.Sum(nil)), nil
 }
 
+// ArchiveInfo is the metadata of the archive returned by the server without downloading it.
+type ArchiveInfo struct {
+	LastModified time.Time
+	// ETag is empty if the server does not return it.
+	ETag string
+	// Size is the Content-Length of the archive. It is -1 if the server does not return it.
+	Size int64
+}
+
 // GetLastModified returns the Last-Modified date that obtained from header of the given dbPath.
 func (d *Downloader) GetLastModified(ctx context.Context, archive photondata.Archive) (time.Time, error) {
+	info, err := d.Inspect(ctx, archive)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return info.LastModified, nil
+}
+
+// Inspect returns the Last-Modified date, the ETag and the size of the archive by the HEAD request.
+func (d *Downloader) Inspect(ctx context.Context, archive photondata.Archive) (ArchiveInfo, error) {
 	req, err := retryablehttp.NewRequestWithContext(ctx, http.MethodHead, archive.URL(), nil)
 	if err != nil {
-		return time.Time{}, fmt.Errorf("downloader.Downloader.GetLastModified: failed to create request: %w", err)
+		return ArchiveInfo{}, fmt.Errorf("downloader.Downloader.Inspect: failed to create request: %w", err)
 	}
 	resp, err := d.client.Do(req)
 	if err != nil {
-		return time.Time{}, fmt.Errorf("downloader.Downloader.GetLastModified: failed to request: %w", err)
+		return ArchiveInfo{}, fmt.Errorf("downloader.Downloader.Inspect: failed to request: %w", err)
 	}
 	defer resp.Body.Close()
 
@@ -251,11 +378,15 @@ func (d *Downloader) GetLastModified(ctx context.Context, archive photondata.Arc
 	_, _ = io.Copy(io.Discard, resp.Body)
 
 	if resp.StatusCode != http.StatusOK {
-		return time.Time{}, fmt.Errorf("downloader.Downloader.GetLastModified: failed to check latest: %s", resp.Status)
+		return ArchiveInfo{}, fmt.Errorf("downloader.Downloader.Inspect: failed to check latest: %s", resp.Status)
 	}
 	lastModified, err := http.ParseTime(resp.Header.Get("Last-Modified"))
 	if err != nil {
-		return time.Time{}, fmt.Errorf("downloader.Downloader.GetLastModified: failed to parse Last-Modified header: %w", err)
+		return ArchiveInfo{}, fmt.Errorf("downloader.Downloader.Inspect: failed to parse Last-Modified header: %w", err)
 	}
-	return lastModified, nil
+	return ArchiveInfo{
+		LastModified: lastModified,
+		ETag:         resp.Header.Get("ETag"),
+		Size:         resp.ContentLength,
+	}, nil
 }
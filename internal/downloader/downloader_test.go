@@ -1,14 +1,20 @@
 package downloader_test
 
 import (
+	"bytes"
+	"context"
 	"crypto/md5"
+	"crypto/sha256"
+	"crypto/sha512"
 	"encoding/hex"
 	"fmt"
+	"io"
 	"net/http"
 	"net/http/httptest"
 	"os"
 	"path/filepath"
 	"strings"
+	"sync"
 	"testing"
 	"time"
 
@@ -100,6 +106,39 @@ func Test_Downloader_Download(t *testing.T) {
 		// Verify
 		require.Error(t, err)
 	})
+	t.Run("progress func", func(t *testing.T) {
+		t.Parallel()
+		// Setup
+		dest := filepath.Join(t.TempDir(), "test")
+		want := []byte("hello, world")
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if strings.HasSuffix(r.URL.Path, ".md5") {
+				hash := md5.Sum(want)
+				w.WriteHeader(http.StatusOK)
+				w.Write([]byte(hex.EncodeToString(hash[:])))
+				return
+			}
+			w.WriteHeader(http.StatusOK)
+			w.Write(want)
+		}))
+		defer srv.Close()
+		archive, err := photondata.NewArchive(srv.URL, photondata.WithArchiveName("test"))
+		require.NoError(t, err)
+		var mutex sync.Mutex
+		var bytesReadGot, totalBytesGot int64
+		d := downloader.New(srv.Client(), downloader.WithProgressFunc(func(ctx context.Context, bytesRead, totalBytes int64) {
+			mutex.Lock()
+			defer mutex.Unlock()
+			bytesReadGot, totalBytesGot = bytesRead, totalBytes
+		}))
+
+		// Exercise
+		err = d.Download(t.Context(), archive, dest)
+		// Verify
+		require.NoError(t, err)
+		assert.Equal(t, int64(len(want)), bytesReadGot)
+		assert.Equal(t, int64(len(want)), totalBytesGot)
+	})
 }
 
 func Test_Downloader_GetLastModified(t *testing.T) {
@@ -122,3 +161,547 @@ func Test_Downloader_GetLastModified(t *testing.T) {
 	require.NoError(t, err)
 	assert.Equal(t, want, got, "last modified date is wrong")
 }
+
+func Test_Downloader_Inspect(t *testing.T) {
+	t.Parallel()
+	// Setup
+	wantLastModified := time.Now().UTC().Truncate(time.Second)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Last-Modified", wantLastModified.Format(http.TimeFormat))
+		w.Header().Set("ETag", `"abc"`)
+		w.Header().Set("Content-Length", "12345")
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer srv.Close()
+	archive, err := photondata.NewArchive(srv.URL, photondata.WithArchiveName("test"))
+	require.NoError(t, err)
+	d := downloader.New(srv.Client())
+
+	// Exercise
+	got, err := d.Inspect(t.Context(), archive)
+
+	// Verify
+	require.NoError(t, err)
+	assert.Equal(t, wantLastModified, got.LastModified)
+	assert.Equal(t, `"abc"`, got.ETag)
+	assert.Equal(t, int64(12345), got.Size)
+}
+
+func Test_Downloader_ExpectedChecksum(t *testing.T) {
+	t.Parallel()
+	// Setup
+	digest := strings.Repeat("a", 32)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/test.md5" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		fmt.Fprintf(w, "%s  test\n", digest)
+	}))
+	defer srv.Close()
+	archive, err := photondata.NewArchive(srv.URL, photondata.WithArchiveName("test"), photondata.WithChecksum("md5"))
+	require.NoError(t, err)
+	d := downloader.New(srv.Client())
+
+	// Exercise
+	got, err := d.ExpectedChecksum(t.Context(), archive)
+
+	// Verify
+	require.NoError(t, err)
+	assert.Equal(t, "md5:"+digest, got.String())
+}
+
+func Test_Downloader_Download_Resume(t *testing.T) {
+	t.Parallel()
+	want := []byte("hello, world. this file is downloaded in pieces")
+	newServer := func(t *testing.T, etag string, ranges *[]string) *httptest.Server {
+		t.Helper()
+		var mutex sync.Mutex
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if strings.HasSuffix(r.URL.Path, ".md5") {
+				hash := md5.Sum(want)
+				fmt.Fprintf(w, "%s  test", hex.EncodeToString(hash[:]))
+				return
+			}
+			mutex.Lock()
+			*ranges = append(*ranges, r.Header.Get("Range"))
+			mutex.Unlock()
+			w.Header().Set("ETag", etag)
+			http.ServeContent(w, r, "test", time.Time{}, bytes.NewReader(want))
+		}))
+	}
+	setupPartial := func(t *testing.T, dest, url, etag string, content []byte) {
+		t.Helper()
+		require.NoError(t, os.WriteFile(dest+".part", content, 0644))
+		meta := fmt.Sprintf(`{"url":%q,"etag":%q,"size":%d}`, url, etag, len(want))
+		require.NoError(t, os.WriteFile(dest+".part.json", []byte(meta), 0644))
+	}
+
+	t.Run("resume from partial file", func(t *testing.T) {
+		t.Parallel()
+		// Setup
+		dest := filepath.Join(t.TempDir(), "test")
+		var ranges []string
+		srv := newServer(t, `"v1"`, &ranges)
+		defer srv.Close()
+		archive, err := photondata.NewArchive(srv.URL, photondata.WithArchiveName("test"))
+		require.NoError(t, err)
+		setupPartial(t, dest, archive.URL(), `"v1"`, want[:10])
+		d := downloader.New(srv.Client(), downloader.WithoutProgress())
+
+		// Exercise
+		err = d.Download(t.Context(), archive, dest)
+
+		// Verify
+		require.NoError(t, err)
+		assert.Equal(t, []string{"bytes=10-"}, ranges, "only the rest of the file should be requested")
+		got, err := os.ReadFile(dest)
+		require.NoError(t, err)
+		assert.Equal(t, want, got)
+		assert.NoFileExists(t, dest+".part")
+		assert.NoFileExists(t, dest+".part.json")
+	})
+	t.Run("restart when remote file has been changed", func(t *testing.T) {
+		t.Parallel()
+		// Setup
+		dest := filepath.Join(t.TempDir(), "test")
+		var ranges []string
+		srv := newServer(t, `"v2"`, &ranges)
+		defer srv.Close()
+		archive, err := photondata.NewArchive(srv.URL, photondata.WithArchiveName("test"))
+		require.NoError(t, err)
+		setupPartial(t, dest, archive.URL(), `"v1"`, []byte("stale data"))
+		d := downloader.New(srv.Client(), downloader.WithoutProgress())
+
+		// Exercise
+		err = d.Download(t.Context(), archive, dest)
+
+		// Verify
+		require.NoError(t, err)
+		got, err := os.ReadFile(dest)
+		require.NoError(t, err)
+		assert.Equal(t, want, got)
+	})
+	t.Run("resume interrupted transfer", func(t *testing.T) {
+		t.Parallel()
+		// Setup
+		dest := filepath.Join(t.TempDir(), "test")
+		var (
+			mutex    sync.Mutex
+			ranges   []string
+			requests int
+		)
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if strings.HasSuffix(r.URL.Path, ".md5") {
+				hash := md5.Sum(want)
+				fmt.Fprintf(w, "%s  test", hex.EncodeToString(hash[:]))
+				return
+			}
+			mutex.Lock()
+			requests++
+			first := requests == 1
+			ranges = append(ranges, r.Header.Get("Range"))
+			mutex.Unlock()
+			w.Header().Set("ETag", `"v1"`)
+			if first {
+				// Send a part of the file and drop the connection.
+				w.Header().Set("Content-Length", fmt.Sprint(len(want)))
+				w.WriteHeader(http.StatusOK)
+				w.Write(want[:20])
+				w.(http.Flusher).Flush()
+				panic(http.ErrAbortHandler)
+			}
+			http.ServeContent(w, r, "test", time.Time{}, bytes.NewReader(want))
+		}))
+		defer srv.Close()
+		archive, err := photondata.NewArchive(srv.URL, photondata.WithArchiveName("test"))
+		require.NoError(t, err)
+		d := downloader.New(srv.Client(), downloader.WithoutProgress())
+
+		// Exercise
+		err = d.Download(t.Context(), archive, dest)
+
+		// Verify
+		require.NoError(t, err)
+		assert.Equal(t, []string{"", "bytes=20-"}, ranges)
+		got, err := os.ReadFile(dest)
+		require.NoError(t, err)
+		assert.Equal(t, want, got)
+	})
+}
+
+func Test_Downloader_Download_Connections(t *testing.T) {
+	t.Parallel()
+	// Large enough to be split into several chunks.
+	want := make([]byte, 20*1024*1024)
+	for i := range want {
+		want[i] = byte(i % 251)
+	}
+	hash := md5.Sum(want)
+	testCases := []struct {
+		name    string
+		digest  string
+		wantErr bool
+	}{
+		{
+			name:   "checksum matches",
+			digest: hex.EncodeToString(hash[:]),
+		},
+		{
+			name:    "checksum mismatch",
+			digest:  strings.Repeat("0", 32),
+			wantErr: true,
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+			// Setup
+			var (
+				mutex  sync.Mutex
+				ranges []string
+			)
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if strings.HasSuffix(r.URL.Path, ".md5") {
+					fmt.Fprintf(w, "%s  test", tc.digest)
+					return
+				}
+				if r.Method == http.MethodGet {
+					mutex.Lock()
+					ranges = append(ranges, r.Header.Get("Range"))
+					mutex.Unlock()
+				}
+				w.Header().Set("ETag", `"v1"`)
+				http.ServeContent(w, r, "test", time.Time{}, bytes.NewReader(want))
+			}))
+			defer srv.Close()
+			dest := filepath.Join(t.TempDir(), "test")
+			archive, err := photondata.NewArchive(srv.URL, photondata.WithArchiveName("test"))
+			require.NoError(t, err)
+			d := downloader.New(srv.Client(), downloader.WithoutProgress(), downloader.WithConnections(4))
+
+			// Exercise
+			err = d.Download(t.Context(), archive, dest)
+
+			// Verify
+			assert.Len(t, ranges, 3, "the file should be split into byte ranges")
+			for _, r := range ranges {
+				assert.True(t, strings.HasPrefix(r, "bytes="), "range request is expected: %q", r)
+			}
+			if tc.wantErr {
+				require.ErrorContains(t, err, "checksum mismatch")
+				assert.NoFileExists(t, dest)
+				assert.NoFileExists(t, dest+".part")
+				return
+			}
+			require.NoError(t, err)
+			got, err := os.ReadFile(dest)
+			require.NoError(t, err)
+			assert.Equal(t, want, got)
+			assert.NoFileExists(t, dest+".part.json")
+		})
+	}
+}
+
+func Test_Downloader_Download_ChecksumCache(t *testing.T) {
+	t.Parallel()
+	// Setup
+	want := []byte("hello, world")
+	hash := md5.Sum(want)
+	var requested bool
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasSuffix(r.URL.Path, ".md5") {
+			fmt.Fprintf(w, "%s  test", hex.EncodeToString(hash[:]))
+			return
+		}
+		requested = true
+		w.Write(want)
+	}))
+	defer srv.Close()
+	archive, err := photondata.NewArchive(srv.URL, photondata.WithArchiveName("test"))
+	require.NoError(t, err)
+	d := downloader.New(srv.Client(), downloader.WithoutProgress())
+	dest := filepath.Join(t.TempDir(), "test")
+
+	// Exercise1: Download the file. The checksum is cached.
+	err = d.Download(t.Context(), archive, dest)
+	require.NoError(t, err)
+	require.FileExists(t, dest+".checksum.json")
+
+	// Exercise2: Overwrite the file keeping its size and mtime.
+	// The cached checksum should be used instead of reading the file.
+	stat, err := os.Stat(dest)
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(dest, []byte("HELLO, WORLD"), 0644))
+	require.NoError(t, os.Chtimes(dest, stat.ModTime(), stat.ModTime()))
+	requested = false
+	err = d.Download(t.Context(), archive, dest)
+
+	// Verify
+	require.NoError(t, err)
+	assert.False(t, requested, "the file should not be downloaded again")
+}
+
+func Test_Remove(t *testing.T) {
+	t.Parallel()
+	testCases := []struct {
+		name      string
+		remove    func(dest string) error
+		withFiles []string
+		wantKept  []string
+		wantGone  []string
+	}{
+		{
+			name:      "remove",
+			remove:    downloader.Remove,
+			withFiles: []string{"", ".checksum.json", ".part", ".part.json"},
+			wantGone:  []string{"", ".checksum.json", ".part", ".part.json"},
+		},
+		{
+			name:      "remove without sidecars",
+			remove:    downloader.Remove,
+			withFiles: []string{""},
+			wantGone:  []string{"", ".checksum.json", ".part", ".part.json"},
+		},
+		{
+			name:      "remove partial",
+			remove:    downloader.RemovePartial,
+			withFiles: []string{"", ".checksum.json", ".part", ".part.json"},
+			wantKept:  []string{""},
+			wantGone:  []string{".checksum.json", ".part", ".part.json"},
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+			// Setup
+			dest := filepath.Join(t.TempDir(), "photon-db.tar.bz2")
+			for _, suffix := range tc.withFiles {
+				require.NoError(t, os.WriteFile(dest+suffix, []byte("hello, world"), 0644))
+			}
+
+			// Exercise
+			err := tc.remove(dest)
+
+			// Verify
+			require.NoError(t, err)
+			for _, suffix := range tc.wantKept {
+				assert.FileExists(t, dest+suffix)
+			}
+			for _, suffix := range tc.wantGone {
+				assert.NoFileExists(t, dest+suffix)
+			}
+		})
+	}
+}
+
+func Test_Downloader_Download_Checksum(t *testing.T) {
+	t.Parallel()
+	want := []byte("hello, world")
+	sha256sum := sha256.Sum256(want)
+	sha512sum := sha512.Sum512(want)
+	testCases := []struct {
+		name     string
+		checksum string
+		files    map[string]string
+		wantErr  bool
+	}{
+		{
+			name:     "sha256 sidecar",
+			checksum: "sha256",
+			files: map[string]string{
+				"/test.sha256": hex.EncodeToString(sha256sum[:]) + "  test\n",
+			},
+		},
+		{
+			name:     "sha512 sidecar in BSD layout",
+			checksum: "sha512",
+			files: map[string]string{
+				"/test.sha512": "SHA512 (test) = " + hex.EncodeToString(sha512sum[:]) + "\n",
+			},
+		},
+		{
+			name:     "sums file",
+			checksum: "sha256:sums=SHA256SUMS",
+			files: map[string]string{
+				"/SHA256SUMS": strings.Repeat("0", 64) + "  other.tar.bz2\n" + hex.EncodeToString(sha256sum[:]) + " *test\n",
+			},
+		},
+		{
+			name:     "sums file without the archive",
+			checksum: "sha256:sums=SHA256SUMS",
+			files: map[string]string{
+				"/SHA256SUMS": strings.Repeat("0", 64) + "  other.tar.bz2\n",
+			},
+			wantErr: true,
+		},
+		{
+			name:     "pinned digest",
+			checksum: "sha256:" + hex.EncodeToString(sha256sum[:]),
+		},
+		{
+			name:     "pinned digest mismatch",
+			checksum: "sha256:" + strings.Repeat("0", 64),
+			wantErr:  true,
+		},
+		{
+			name:     "disabled",
+			checksum: "none",
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+			// Setup
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.URL.Path == "/test" {
+					w.Write(want)
+					return
+				}
+				body, ok := tc.files[r.URL.Path]
+				if !ok {
+					http.NotFound(w, r)
+					return
+				}
+				w.Write([]byte(body))
+			}))
+			defer srv.Close()
+			archive, err := photondata.NewArchive(srv.URL, photondata.WithArchiveName("test"), photondata.WithChecksum(tc.checksum))
+			require.NoError(t, err)
+			d := downloader.New(srv.Client(), downloader.WithoutProgress())
+			dest := filepath.Join(t.TempDir(), "test")
+
+			// Exercise
+			err = d.Download(t.Context(), archive, dest)
+
+			// Verify
+			if tc.wantErr {
+				require.Error(t, err)
+				assert.NoFileExists(t, dest)
+				return
+			}
+			require.NoError(t, err)
+			got, err := os.ReadFile(dest)
+			require.NoError(t, err)
+			assert.Equal(t, want, got)
+		})
+	}
+}
+
+func Test_ParseChecksumProvider(t *testing.T) {
+	t.Parallel()
+	testCases := []struct {
+		spec    string
+		wantNil bool
+		wantErr bool
+	}{
+		{spec: "", wantNil: true},
+		{spec: "none"},
+		{spec: "md5"},
+		{spec: "SHA256"},
+		{spec: "sha512:sums=SHA512SUMS"},
+		{spec: "sha256:" + strings.Repeat("a", 64)},
+		{spec: "sha256:" + strings.Repeat("a", 32), wantErr: true},
+		{spec: "sha256:sums=", wantErr: true},
+		{spec: "crc32", wantErr: true},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.spec, func(t *testing.T) {
+			t.Parallel()
+			// Exercise
+			got, err := downloader.ParseChecksumProvider(tc.spec)
+
+			// Verify
+			if tc.wantErr {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			if tc.wantNil {
+				assert.Nil(t, got)
+			} else {
+				assert.NotNil(t, got)
+			}
+		})
+	}
+}
+
+func Test_Downloader_Stream(t *testing.T) {
+	t.Parallel()
+	want := bytes.Repeat([]byte("0123456789"), 10)
+	hash := md5.Sum(want)
+	newServer := func(t *testing.T, digest string, ranges *[]string) *httptest.Server {
+		t.Helper()
+		var (
+			mutex    sync.Mutex
+			requests int
+		)
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if strings.HasSuffix(r.URL.Path, ".md5") {
+				fmt.Fprintf(w, "%s  test", digest)
+				return
+			}
+			mutex.Lock()
+			requests++
+			first := requests == 1
+			*ranges = append(*ranges, r.Header.Get("Range"))
+			mutex.Unlock()
+			w.Header().Set("ETag", `"v1"`)
+			if first {
+				// Send a part of the file and drop the connection.
+				w.Header().Set("Content-Length", fmt.Sprint(len(want)))
+				w.WriteHeader(http.StatusOK)
+				w.Write(want[:20])
+				w.(http.Flusher).Flush()
+				panic(http.ErrAbortHandler)
+			}
+			http.ServeContent(w, r, "test", time.Time{}, bytes.NewReader(want))
+		}))
+	}
+	t.Run("resume interrupted stream", func(t *testing.T) {
+		t.Parallel()
+		// Setup
+		var ranges []string
+		srv := newServer(t, hex.EncodeToString(hash[:]), &ranges)
+		defer srv.Close()
+		archive, err := photondata.NewArchive(srv.URL, photondata.WithArchiveName("test"))
+		require.NoError(t, err)
+		d := downloader.New(srv.Client(), downloader.WithoutProgress())
+
+		// Exercise
+		stream, err := d.Stream(t.Context(), archive)
+		require.NoError(t, err)
+		defer stream.Close()
+		head := make([]byte, 50)
+		_, err = io.ReadFull(stream, head)
+		require.NoError(t, err)
+		err = stream.Verify()
+
+		// Verify
+		require.NoError(t, err)
+		assert.Equal(t, want[:50], head)
+		assert.Equal(t, []string{"", "bytes=20-"}, ranges)
+	})
+	t.Run("checksum mismatch", func(t *testing.T) {
+		t.Parallel()
+		// Setup
+		var ranges []string
+		srv := newServer(t, strings.Repeat("0", 32), &ranges)
+		defer srv.Close()
+		archive, err := photondata.NewArchive(srv.URL, photondata.WithArchiveName("test"))
+		require.NoError(t, err)
+		d := downloader.New(srv.Client(), downloader.WithoutProgress())
+
+		// Exercise
+		stream, err := d.Stream(t.Context(), archive)
+		require.NoError(t, err)
+		defer stream.Close()
+		got, err := io.ReadAll(stream)
+		require.NoError(t, err)
+		err = stream.Verify()
+
+		// Verify
+		assert.Error(t, err)
+		assert.Equal(t, want, got)
+	})
+}
@@ -19,7 +19,16 @@ func WithProgressInterval(interval time.Duration) DownloaderOption {
 	}
 }
 
+// WithProgressFunc sets the function which receives the progress of downloads, such as to publish it as events.
+// It is not called if the progress tracking is disabled by WithoutProgress.
+func WithProgressFunc(fn ProgressFunc) DownloaderOption {
+	return func(d *Downloader) {
+		d.progressFunc = fn
+	}
+}
+
 // WithDownloadSpeedLimit sets the download speed limit in bytes per second.
+// When the file is downloaded with multiple connections, the limit is applied to the total of them.
 // The default is math.MaxFloat64.
 func WithDownloadSpeedLimit(limit float64) DownloaderOption {
 	return func(d *Downloader) {
@@ -34,3 +43,29 @@ func WithReadSpeedLimit(limit float64) DownloaderOption {
 		d.limitReadBytesPerSec = limit
 	}
 }
+
+// WithMaxResumeAttempts sets how many times an interrupted download is resumed within a Download call.
+// The default is 5. 0 disables resuming within a call, but the partial file is still resumed by the next call.
+func WithMaxResumeAttempts(attempts int) DownloaderOption {
+	return func(d *Downloader) {
+		d.maxResumeAttempts = attempts
+	}
+}
+
+// WithConnections sets the number of connections used to download a file.
+// If it is greater than 1, the file is split into byte ranges and they are downloaded at the same time.
+// It falls back to a single connection if the server does not support range requests.
+// The default is 1.
+func WithConnections(connections int) DownloaderOption {
+	return func(d *Downloader) {
+		d.connections = max(connections, 1)
+	}
+}
+
+// WithChecksumProvider sets the ChecksumProvider used for archives which do not have their own configuration.
+// The default is SidecarChecksum(AlgorithmMD5).
+func WithChecksumProvider(provider ChecksumProvider) DownloaderOption {
+	return func(d *Downloader) {
+		d.defaultChecksum = provider
+	}
+}
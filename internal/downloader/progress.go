@@ -18,8 +18,14 @@ type Progress struct {
 
 	mutex     sync.Mutex
 	bytesRead int64
+	// report is called with the bytes read so far whenever they are updated.
+	report func(bytesRead int64)
 }
 
+// ProgressFunc receives the progress of a download whenever bytes are written.
+// It is called on the goroutine of the download, so it must return quickly.
+type ProgressFunc func(ctx context.Context, bytesRead, totalBytes int64)
+
 func NewProgress(
 	ctx context.Context,
 	totalBytes int64,
@@ -60,10 +66,32 @@ func (p *Progress) Write(b []byte) (int, error) {
 
 	n := len(b)
 	p.bytesRead += int64(n)
+	if p.report != nil {
+		p.report(p.bytesRead)
+	}
 
 	return n, nil
 }
 
+// Skip marks the given bytes as already read.
+// It is used when a download is resumed from the middle of the file.
+func (p *Progress) Skip(n int64) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.bytesRead += n
+}
+
 func (p *Progress) Stop() {
 	close(p.stopCh)
 }
+
+// newProgress creates the Progress of a download and reports it to the ProgressFunc.
+func (d *Downloader) newProgress(ctx context.Context, totalBytes int64, logger *slog.Logger) *Progress {
+	p := NewProgress(ctx, totalBytes, d.progressInterval, logger)
+	if d.progressFunc != nil {
+		p.report = func(bytesRead int64) {
+			d.progressFunc(ctx, bytesRead, totalBytes)
+		}
+	}
+	return p
+}
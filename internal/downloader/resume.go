@@ -0,0 +1,190 @@
+package downloader
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// partialDownload represents a download which has not been completed yet.
+// The downloaded bytes are kept in `{{dest}}.part` and the validators of the remote file
+// are kept in `{{dest}}.part.json`, so that the download can be resumed by another process.
+type partialDownload struct {
+	path     string
+	metaPath string
+}
+
+func newPartialDownload(dest string) *partialDownload {
+	return &partialDownload{
+		path:     dest + ".part",
+		metaPath: dest + ".part.json",
+	}
+}
+
+// partialMeta holds the validators of the remote file at the time the download was started.
+// They are used to detect that the remote file has been changed between two requests.
+type partialMeta struct {
+	URL          string `json:"url"`
+	ETag         string `json:"etag,omitempty"`
+	LastModified string `json:"last_modified,omitempty"`
+	Size         int64  `json:"size"`
+	// Chunks is the state of each byte range when the file is downloaded with multiple connections.
+	// Nil for a single connection download, whose progress is the size of the partial file.
+	Chunks []chunkState `json:"chunks,omitempty"`
+}
+
+func newPartialMeta(url string, resp *http.Response, size int64) partialMeta {
+	return partialMeta{
+		URL:          url,
+		ETag:         resp.Header.Get("ETag"),
+		LastModified: resp.Header.Get("Last-Modified"),
+		Size:         size,
+	}
+}
+
+// ifRange returns the value of If-Range header.
+// A strong ETag is preferred. Last-Modified is used as a fallback.
+// Empty string is returned if the remote file has no usable validator.
+func (m partialMeta) ifRange() string {
+	if m.ETag != "" && !strings.HasPrefix(m.ETag, "W/") {
+		return m.ETag
+	}
+	return m.LastModified
+}
+
+// sameAs returns true if the given response represents the same remote file.
+func (m partialMeta) sameAs(resp *http.Response) bool {
+	if etag := resp.Header.Get("ETag"); m.ETag != "" && etag != "" {
+		return m.ETag == etag
+	}
+	if lastModified := resp.Header.Get("Last-Modified"); m.LastModified != "" && lastModified != "" {
+		return m.LastModified == lastModified
+	}
+	// No validator to compare. Trust the server.
+	return true
+}
+
+// loadMeta loads the metadata of the partial file.
+// Zero value is returned if there is no metadata or it is broken.
+func (p *partialDownload) loadMeta() (partialMeta, error) {
+	metaBytes, err := os.ReadFile(p.metaPath)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return partialMeta{}, nil
+		}
+		return partialMeta{}, fmt.Errorf("failed to read %q: %w", p.metaPath, err)
+	}
+	var meta partialMeta
+	if err := json.Unmarshal(metaBytes, &meta); err != nil {
+		// Broken metadata. Start over.
+		return partialMeta{}, nil
+	}
+	return meta, nil
+}
+
+// resumeOffset returns the number of bytes already downloaded for the given URL.
+// 0 is returned if there is nothing to resume.
+func (p *partialDownload) resumeOffset(url string) (int64, partialMeta, error) {
+	meta, err := p.loadMeta()
+	if err != nil {
+		return 0, partialMeta{}, err
+	}
+	// A file downloaded with multiple connections is preallocated.
+	// Its size does not represent the progress.
+	if meta.URL != url || meta.ifRange() == "" || len(meta.Chunks) > 0 {
+		return 0, partialMeta{}, nil
+	}
+	stat, err := os.Stat(p.path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return 0, partialMeta{}, nil
+		}
+		return 0, partialMeta{}, fmt.Errorf("failed to stat %q: %w", p.path, err)
+	}
+	if meta.Size > 0 && stat.Size() > meta.Size {
+		return 0, partialMeta{}, nil
+	}
+	return stat.Size(), meta, nil
+}
+
+func (p *partialDownload) saveMeta(meta partialMeta) error {
+	metaBytes, err := json.Marshal(meta)
+	if err != nil {
+		return fmt.Errorf("failed to marshal metadata: %w", err)
+	}
+	if err := os.WriteFile(p.metaPath, metaBytes, 0644); err != nil {
+		return fmt.Errorf("failed to write %q: %w", p.metaPath, err)
+	}
+	return nil
+}
+
+// remove removes both of the partial file and its metadata.
+func (p *partialDownload) remove() error {
+	var errs []error
+	for _, file := range []string{p.path, p.metaPath} {
+		if err := os.Remove(file); err != nil && !errors.Is(err, os.ErrNotExist) {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// RemovePartial removes the partially downloaded file of dest and its metadata,
+// which are kept to resume the download. The checksum cache of dest is removed too.
+func RemovePartial(dest string) error {
+	if err := errors.Join(newPartialDownload(dest).remove(), removeChecksumCache(dest)); err != nil {
+		return fmt.Errorf("downloader.RemovePartial: %w", err)
+	}
+	return nil
+}
+
+// Remove removes the downloaded file of dest together with its checksum cache and the partial download.
+func Remove(dest string) error {
+	var errs []error
+	if err := os.Remove(dest); err != nil && !errors.Is(err, os.ErrNotExist) {
+		errs = append(errs, err)
+	}
+	errs = append(errs, newPartialDownload(dest).remove(), removeChecksumCache(dest))
+	if err := errors.Join(errs...); err != nil {
+		return fmt.Errorf("downloader.Remove: %w", err)
+	}
+	return nil
+}
+
+// parseContentRange parses Content-Range header like `bytes 100-199/200` or `bytes */200`.
+// It returns the first byte position and the complete length.
+// -1 is returned for the unknown values.
+func parseContentRange(value string) (int64, int64, error) {
+	rest, ok := strings.CutPrefix(value, "bytes ")
+	if !ok {
+		return -1, -1, fmt.Errorf("unsupported Content-Range %q", value)
+	}
+	rangePart, sizePart, ok := strings.Cut(rest, "/")
+	if !ok {
+		return -1, -1, fmt.Errorf("invalid Content-Range %q", value)
+	}
+	size := int64(-1)
+	if sizePart != "*" {
+		s, err := strconv.ParseInt(sizePart, 10, 64)
+		if err != nil {
+			return -1, -1, fmt.Errorf("invalid Content-Range %q: %w", value, err)
+		}
+		size = s
+	}
+	if rangePart == "*" {
+		return -1, size, nil
+	}
+	startPart, _, ok := strings.Cut(rangePart, "-")
+	if !ok {
+		return -1, -1, fmt.Errorf("invalid Content-Range %q", value)
+	}
+	start, err := strconv.ParseInt(startPart, 10, 64)
+	if err != nil {
+		return -1, -1, fmt.Errorf("invalid Content-Range %q: %w", value, err)
+	}
+	return start, size, nil
+}
@@ -0,0 +1,174 @@
+package downloader
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/dustin/go-humanize"
+	"github.com/fujiwara/shapeio"
+	"github.com/hashicorp/go-retryablehttp"
+
+	"github.com/pddg/photon-container/internal/logging"
+	"github.com/pddg/photon-container/internal/photondata"
+)
+
+// Stream is the body of an archive being downloaded.
+// It implements the io.ReadCloser interface, and the archive is not stored anywhere.
+// If the connection is interrupted, the rest of the archive is requested by a Range request transparently.
+// The checksum is calculated on the stream. Call Verify after reading the archive.
+type Stream struct {
+	ctx        context.Context
+	downloader *Downloader
+	url        string
+	expected   Checksum
+	hash       hash.Hash
+
+	meta     partialMeta
+	resp     *http.Response
+	reader   io.Reader
+	progress *Progress
+	offset   int64
+	size     int64
+	attempts int
+}
+
+// Stream starts downloading the archive and returns its body.
+// The download speed limit and the progress logging are applied as well as Download.
+// The caller must close the returned Stream.
+func (d *Downloader) Stream(ctx context.Context, archive photondata.Archive) (*Stream, error) {
+	expected, err := d.expectedChecksum(ctx, archive)
+	if err != nil {
+		return nil, fmt.Errorf("downloader.Downloader.Stream: failed to get checksum: %w", err)
+	}
+	s := &Stream{
+		ctx:        ctx,
+		downloader: d,
+		url:        archive.URL(),
+		expected:   expected,
+		hash:       expected.Algorithm.New(),
+		size:       -1,
+	}
+	if err := s.open(); err != nil {
+		return nil, fmt.Errorf("downloader.Downloader.Stream: %w", err)
+	}
+	logging.FromContext(ctx).InfoContext(ctx, "start streaming", "url", s.url, "size", humanize.Bytes(uint64(s.size)), "checksum", expected)
+	return s, nil
+}
+
+// open sends a request for the rest of the archive.
+func (s *Stream) open() error {
+	logger := logging.FromContext(s.ctx)
+	req, err := retryablehttp.NewRequestWithContext(s.ctx, http.MethodGet, s.url, nil)
+	if err != nil {
+		return fmt.Errorf("failed to create request: %w", err)
+	}
+	if s.offset > 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", s.offset))
+		if ifRange := s.meta.ifRange(); ifRange != "" {
+			req.Header.Set("If-Range", ifRange)
+		}
+	}
+	resp, err := s.downloader.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to request: %w", err)
+	}
+	if s.offset == 0 {
+		if resp.StatusCode != http.StatusOK {
+			resp.Body.Close()
+			return fmt.Errorf("failed to download: %s", resp.Status)
+		}
+		s.meta = newPartialMeta(s.url, resp, resp.ContentLength)
+		s.size = resp.ContentLength
+	} else {
+		// The bytes already read can not be taken back. Only the rest of the same file is acceptable.
+		if resp.StatusCode != http.StatusPartialContent {
+			resp.Body.Close()
+			return fmt.Errorf("failed to resume: %s", resp.Status)
+		}
+		start, _, err := parseContentRange(resp.Header.Get("Content-Range"))
+		if err != nil || start != s.offset || !s.meta.sameAs(resp) {
+			resp.Body.Close()
+			return fmt.Errorf("failed to resume: remote file has been changed")
+		}
+		logger.InfoContext(s.ctx, "resume streaming", "url", s.url, "offset", humanize.Bytes(uint64(s.offset)))
+	}
+	s.resp = resp
+
+	// Limit the download speed.
+	body := shapeio.NewReaderWithContext(resp.Body, s.ctx)
+	body.SetRateLimit(s.downloader.limitDownloadBytesPerSec)
+	s.reader = body
+	if !s.downloader.hideProgress {
+		if s.progress == nil {
+			s.progress = s.downloader.newProgress(s.ctx, s.size, logger)
+		}
+		s.reader = io.TeeReader(body, s.progress)
+	}
+	return nil
+}
+
+// Read implements the io.Reader interface.
+func (s *Stream) Read(p []byte) (int, error) {
+	for {
+		n, err := s.reader.Read(p)
+		if n > 0 {
+			s.hash.Write(p[:n])
+			s.offset += int64(n)
+		}
+		if err == nil || n > 0 {
+			// Return the bytes first. The error will be returned again by the next call.
+			return n, nil
+		}
+		if errors.Is(err, io.EOF) && (s.size < 0 || s.offset == s.size) {
+			return 0, io.EOF
+		}
+		if s.ctx.Err() != nil || s.attempts >= s.downloader.maxResumeAttempts {
+			return 0, fmt.Errorf("downloader.Stream.Read: %w", err)
+		}
+		s.attempts++
+		wait := time.Duration(s.attempts) * s.downloader.client.RetryWaitMin
+		logging.FromContext(s.ctx).WarnContext(s.ctx, "stream interrupted. resuming", "url", s.url, "attempt", s.attempts, "wait", wait, "error", err)
+		s.resp.Body.Close()
+		select {
+		case <-s.ctx.Done():
+			return 0, fmt.Errorf("downloader.Stream.Read: %w", s.ctx.Err())
+		case <-time.After(wait):
+		}
+		if openErr := s.open(); openErr != nil {
+			return 0, fmt.Errorf("downloader.Stream.Read: %w", errors.Join(err, openErr))
+		}
+	}
+}
+
+// Close implements the io.Closer interface.
+func (s *Stream) Close() error {
+	if s.progress != nil {
+		s.progress.Stop()
+		s.progress = nil
+	}
+	return s.resp.Body.Close()
+}
+
+// Verify reads the rest of the archive and verifies its checksum.
+// The consumer of the stream may not read the trailing bytes of the archive, such as the padding of tar.
+func (s *Stream) Verify() error {
+	logger := logging.FromContext(s.ctx)
+	if _, err := io.Copy(io.Discard, s); err != nil {
+		return fmt.Errorf("downloader.Stream.Verify: failed to read the rest of the archive: %w", err)
+	}
+	if !s.expected.Enabled() {
+		logger.WarnContext(s.ctx, "checksum verification is disabled", "url", s.url)
+		return nil
+	}
+	got := hexDigest(s.hash)
+	if got != s.expected.Digest {
+		return fmt.Errorf("downloader.Stream.Verify: checksum mismatch: got %q, want %q", got, s.expected.Digest)
+	}
+	logger.InfoContext(s.ctx, "checksum verified", "url", s.url, "expected_checksum", s.expected, "actual_checksum", got)
+	return nil
+}
@@ -0,0 +1,35 @@
+// Package fsutil provides the information of the file systems which the Photon database is stored in.
+package fsutil
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"path/filepath"
+)
+
+// ErrUnsupported is returned when the free space can not be measured on the platform.
+var ErrUnsupported = errors.New("not supported on this platform")
+
+// DirSize returns the total size of the regular files under the directory.
+func DirSize(path string) (int64, error) {
+	var total int64
+	err := filepath.WalkDir(path, func(_ string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		total += info.Size()
+		return nil
+	})
+	if err != nil {
+		return 0, fmt.Errorf("fsutil.DirSize: %w", err)
+	}
+	return total, nil
+}
@@ -0,0 +1,48 @@
+package fsutil_test
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/pddg/photon-container/internal/fsutil"
+)
+
+func Test_DirSize(t *testing.T) {
+	t.Parallel()
+	// Setup
+	dir := t.TempDir()
+	require.NoError(t, os.MkdirAll(filepath.Join(dir, "a", "b"), 0755))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "hello.txt"), []byte("hello"), 0644))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "a", "b", "world.txt"), []byte("world!"), 0644))
+	require.NoError(t, os.Symlink("hello.txt", filepath.Join(dir, "link")))
+
+	// Exercise
+	size, err := fsutil.DirSize(dir)
+
+	// Verify
+	require.NoError(t, err)
+	assert.Equal(t, int64(11), size)
+}
+
+func Test_DirSize_NotExist(t *testing.T) {
+	t.Parallel()
+	// Exercise
+	_, err := fsutil.DirSize(filepath.Join(t.TempDir(), "not-exist"))
+
+	// Verify
+	require.ErrorIs(t, err, os.ErrNotExist)
+}
+
+func Test_FreeSpace(t *testing.T) {
+	t.Parallel()
+	// Exercise
+	free, err := fsutil.FreeSpace(t.TempDir())
+
+	// Verify
+	require.NoError(t, err)
+	assert.Positive(t, free)
+}
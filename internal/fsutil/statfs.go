@@ -0,0 +1,17 @@
+//go:build linux || darwin
+
+package fsutil
+
+import (
+	"fmt"
+	"syscall"
+)
+
+// FreeSpace returns the number of bytes available to unprivileged users in the file system containing the path.
+func FreeSpace(path string) (uint64, error) {
+	var stat syscall.Statfs_t
+	if err := syscall.Statfs(path, &stat); err != nil {
+		return 0, fmt.Errorf("fsutil.FreeSpace: failed to statfs %q: %w", path, err)
+	}
+	return uint64(stat.Bavail) * uint64(stat.Bsize), nil
+}
@@ -0,0 +1,10 @@
+//go:build !linux && !darwin
+
+package fsutil
+
+import "fmt"
+
+// FreeSpace returns the number of bytes available to unprivileged users in the file system containing the path.
+func FreeSpace(path string) (uint64, error) {
+	return 0, fmt.Errorf("fsutil.FreeSpace: %w", ErrUnsupported)
+}
@@ -17,6 +17,11 @@ func (r *responseWriteInterceptor) WriteHeader(statusCode int) {
 	r.ResponseWriter.WriteHeader(statusCode)
 }
 
+// Unwrap returns the original ResponseWriter, so that http.ResponseController can flush a streaming response.
+func (r *responseWriteInterceptor) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+}
+
 type AccessLogMiddleware struct {
 	logger             *slog.Logger
 	ignorePathPrefixes []string
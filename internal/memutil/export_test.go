@@ -0,0 +1,6 @@
+//go:build linux
+
+package memutil
+
+// CgroupRoom exposes cgroupRoom to the tests with a fake cgroup root.
+var CgroupRoom = cgroupRoom
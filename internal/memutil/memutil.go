@@ -0,0 +1,7 @@
+// Package memutil provides the information of the memory which the Photon servers run in.
+package memutil
+
+import "errors"
+
+// ErrUnsupported is returned when the memory can not be measured on the platform.
+var ErrUnsupported = errors.New("not supported on this platform")
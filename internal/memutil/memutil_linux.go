@@ -0,0 +1,155 @@
+package memutil
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+const cgroupRoot = "/sys/fs/cgroup"
+
+// Available returns the number of bytes which can be allocated by a new process without swapping.
+// It is the smaller of MemAvailable of the host and the room left under the memory limit of the cgroup.
+func Available() (uint64, error) {
+	available, err := readKiB("/proc/meminfo", "MemAvailable:")
+	if err != nil {
+		return 0, fmt.Errorf("memutil.Available: %w", err)
+	}
+	room, limited, err := cgroupRoom(cgroupRoot)
+	if err != nil {
+		return 0, fmt.Errorf("memutil.Available: %w", err)
+	}
+	if limited {
+		available = min(available, room)
+	}
+	return available, nil
+}
+
+// ProcessRSS returns the resident set size of the process in bytes.
+func ProcessRSS(pid int) (uint64, error) {
+	rss, err := readKiB(filepath.Join("/proc", strconv.Itoa(pid), "status"), "VmRSS:")
+	if err != nil {
+		return 0, fmt.Errorf("memutil.ProcessRSS: %w", err)
+	}
+	return rss, nil
+}
+
+// readKiB reads the value in kB of the key from a file formatted as /proc/meminfo, and returns it in bytes.
+func readKiB(path, key string) (uint64, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, fmt.Errorf("failed to open %q: %w", path, err)
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 2 || fields[0] != key {
+			continue
+		}
+		value, err := strconv.ParseUint(fields[1], 10, 64)
+		if err != nil {
+			return 0, fmt.Errorf("failed to parse %s in %q: %w", key, path, err)
+		}
+		return value * 1024, nil
+	}
+	if err := scanner.Err(); err != nil {
+		return 0, fmt.Errorf("failed to read %q: %w", path, err)
+	}
+	return 0, fmt.Errorf("%s is not found in %q", key, path)
+}
+
+// cgroupRoom returns the room left under the memory limit of the cgroup mounted at root.
+// The usage excludes the inactive page cache which the kernel reclaims before hitting the limit,
+// like the working set used by kubelet for the eviction.
+// limited is false if the memory is not limited, or the cgroup is not mounted.
+func cgroupRoom(root string) (room uint64, limited bool, err error) {
+	// cgroup v2
+	limit, limited, err := readLimit(filepath.Join(root, "memory.max"))
+	if err != nil {
+		return 0, false, err
+	}
+	usagePath := filepath.Join(root, "memory.current")
+	statPath, inactiveKey := filepath.Join(root, "memory.stat"), "inactive_file"
+	if !limited {
+		// cgroup v1
+		limit, limited, err = readLimit(filepath.Join(root, "memory", "memory.limit_in_bytes"))
+		if err != nil {
+			return 0, false, err
+		}
+		usagePath = filepath.Join(root, "memory", "memory.usage_in_bytes")
+		statPath, inactiveKey = filepath.Join(root, "memory", "memory.stat"), "total_inactive_file"
+	}
+	if !limited {
+		return 0, false, nil
+	}
+	usage, _, err := readLimit(usagePath)
+	if err != nil {
+		return 0, false, err
+	}
+	inactive, err := readStat(statPath, inactiveKey)
+	if err != nil {
+		return 0, false, err
+	}
+	if inactive < usage {
+		usage -= inactive
+	} else {
+		usage = 0
+	}
+	if usage >= limit {
+		return 0, true, nil
+	}
+	return limit - usage, true, nil
+}
+
+// readStat reads the number of bytes of the key in memory.stat of the cgroup. It is 0 if the file or the key does not exist.
+func readStat(path, key string) (uint64, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return 0, nil
+		}
+		return 0, fmt.Errorf("failed to open %q: %w", path, err)
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) != 2 || fields[0] != key {
+			continue
+		}
+		value, err := strconv.ParseUint(fields[1], 10, 64)
+		if err != nil {
+			return 0, fmt.Errorf("failed to parse %s in %q: %w", key, path, err)
+		}
+		return value, nil
+	}
+	if err := scanner.Err(); err != nil {
+		return 0, fmt.Errorf("failed to read %q: %w", path, err)
+	}
+	return 0, nil
+}
+
+// readLimit reads the number of bytes in the cgroup file. ok is false if it does not exist or it is `max`.
+func readLimit(path string) (value uint64, ok bool, err error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return 0, false, nil
+		}
+		return 0, false, fmt.Errorf("failed to read %q: %w", path, err)
+	}
+	text := strings.TrimSpace(string(content))
+	if text == "max" {
+		return 0, false, nil
+	}
+	value, err = strconv.ParseUint(text, 10, 64)
+	if err != nil {
+		return 0, false, fmt.Errorf("failed to parse %q: %w", path, err)
+	}
+	return value, true, nil
+}
@@ -0,0 +1,15 @@
+//go:build !linux
+
+package memutil
+
+import "fmt"
+
+// Available returns the number of bytes which can be allocated by a new process without swapping.
+func Available() (uint64, error) {
+	return 0, fmt.Errorf("memutil.Available: %w", ErrUnsupported)
+}
+
+// ProcessRSS returns the resident set size of the process in bytes.
+func ProcessRSS(pid int) (uint64, error) {
+	return 0, fmt.Errorf("memutil.ProcessRSS: %w", ErrUnsupported)
+}
@@ -0,0 +1,126 @@
+//go:build linux
+
+package memutil_test
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/pddg/photon-container/internal/memutil"
+)
+
+func Test_Available(t *testing.T) {
+	t.Parallel()
+	// Exercise
+	available, err := memutil.Available()
+
+	// Verify
+	require.NoError(t, err)
+	assert.Positive(t, available)
+}
+
+func Test_ProcessRSS(t *testing.T) {
+	t.Parallel()
+	// Exercise
+	rss, err := memutil.ProcessRSS(os.Getpid())
+
+	// Verify
+	require.NoError(t, err)
+	assert.Positive(t, rss)
+}
+
+func Test_ProcessRSS_NotExist(t *testing.T) {
+	t.Parallel()
+	// Exercise
+	_, err := memutil.ProcessRSS(-1)
+
+	// Verify
+	require.ErrorIs(t, err, os.ErrNotExist)
+}
+
+func Test_CgroupRoom(t *testing.T) {
+	t.Parallel()
+	testCases := []struct {
+		name        string
+		files       map[string]string
+		wantRoom    uint64
+		wantLimited bool
+	}{
+		{
+			name: "v2 excludes the inactive page cache from the usage",
+			files: map[string]string{
+				"memory.max":     "1000\n",
+				"memory.current": "800\n",
+				"memory.stat":    "anon 300\nfile 500\nactive_file 200\ninactive_file 300\n",
+			},
+			wantRoom:    500,
+			wantLimited: true,
+		},
+		{
+			name: "v2 without memory.stat",
+			files: map[string]string{
+				"memory.max":     "1000\n",
+				"memory.current": "800\n",
+			},
+			wantRoom:    200,
+			wantLimited: true,
+		},
+		{
+			name: "v2 over the limit",
+			files: map[string]string{
+				"memory.max":     "1000\n",
+				"memory.current": "1200\n",
+				"memory.stat":    "inactive_file 100\n",
+			},
+			wantRoom:    0,
+			wantLimited: true,
+		},
+		{
+			name: "v2 unlimited",
+			files: map[string]string{
+				"memory.max":     "max\n",
+				"memory.current": "800\n",
+			},
+			wantLimited: false,
+		},
+		{
+			name: "v1 excludes total_inactive_file from the usage",
+			files: map[string]string{
+				"memory/memory.limit_in_bytes": "1000\n",
+				"memory/memory.usage_in_bytes": "800\n",
+				"memory/memory.stat":           "inactive_file 50\ntotal_inactive_file 300\n",
+			},
+			wantRoom:    500,
+			wantLimited: true,
+		},
+		{
+			name:        "not mounted",
+			files:       map[string]string{},
+			wantLimited: false,
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+			// Setup
+			root := t.TempDir()
+			for name, content := range tc.files {
+				path := filepath.Join(root, name)
+				require.NoError(t, os.MkdirAll(filepath.Dir(path), 0o755))
+				require.NoError(t, os.WriteFile(path, []byte(content), 0o644))
+			}
+
+			// Exercise
+			room, limited, err := memutil.CgroupRoom(root)
+
+			// Verify
+			require.NoError(t, err)
+			assert.Equal(t, tc.wantLimited, limited)
+			assert.Equal(t, tc.wantRoom, room)
+		})
+	}
+}
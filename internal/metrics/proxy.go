@@ -0,0 +1,50 @@
+package metrics
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// ProxyMetrics is a prometheus.Collector that collects the requests proxied to Photon.
+type ProxyMetrics struct {
+	requests *prometheus.CounterVec
+	duration *prometheus.HistogramVec
+}
+
+func NewProxyMetrics() *ProxyMetrics {
+	return &ProxyMetrics{
+		requests: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "photon_proxy_requests_total",
+				Help: "Number of the requests proxied to Photon",
+			},
+			[]string{"route", "code"},
+		),
+		duration: prometheus.NewHistogramVec(
+			prometheus.HistogramOpts{
+				Name:    "photon_proxy_request_duration_seconds",
+				Help:    "Duration of the requests proxied to Photon",
+				Buckets: prometheus.DefBuckets,
+			},
+			[]string{"route"},
+		),
+	}
+}
+
+// Observe records a request to the route answered with the status code.
+func (m *ProxyMetrics) Observe(route string, code int, duration time.Duration) {
+	m.requests.WithLabelValues(route, strconv.Itoa(code)).Inc()
+	m.duration.WithLabelValues(route).Observe(duration.Seconds())
+}
+
+func (m *ProxyMetrics) Describe(ch chan<- *prometheus.Desc) {
+	m.requests.Describe(ch)
+	m.duration.Describe(ch)
+}
+
+func (m *ProxyMetrics) Collect(ch chan<- prometheus.Metric) {
+	m.requests.Collect(ch)
+	m.duration.Collect(ch)
+}
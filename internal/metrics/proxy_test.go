@@ -0,0 +1,37 @@
+package metrics_test
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/pddg/photon-container/internal/metrics"
+)
+
+func Test_ProxyMetrics(t *testing.T) {
+	t.Parallel()
+	// Setup
+	m := metrics.NewProxyMetrics()
+	expected := `
+# HELP photon_proxy_requests_total Number of the requests proxied to Photon
+# TYPE photon_proxy_requests_total counter
+photon_proxy_requests_total{code="200",route="/api"} 2
+photon_proxy_requests_total{code="503",route="/api"} 1
+photon_proxy_requests_total{code="200",route="/reverse"} 1
+`
+
+	// Exercise
+	m.Observe("/api", 200, 100*time.Millisecond)
+	m.Observe("/api", 200, 200*time.Millisecond)
+	m.Observe("/api", 503, time.Millisecond)
+	m.Observe("/reverse", 200, 50*time.Millisecond)
+
+	// Verify
+	err := testutil.CollectAndCompare(m, strings.NewReader(expected), "photon_proxy_requests_total")
+	require.NoError(t, err)
+	assert.Equal(t, 2, testutil.CollectAndCount(m, "photon_proxy_request_duration_seconds"))
+}
@@ -0,0 +1,65 @@
+package metrics
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/pddg/photon-container/internal/photon"
+)
+
+type Supervisor interface {
+	Status() photon.SupervisorStatus
+}
+
+// SupervisorMetrics is a prometheus.Collector that collects the state of the supervised Photon process.
+type SupervisorMetrics struct {
+	supervisor Supervisor
+
+	// metrics
+	upDesc        *prometheus.Desc
+	restartsDesc  *prometheus.Desc
+	crashLoopDesc *prometheus.Desc
+}
+
+func NewSupervisorMetrics(supervisor Supervisor) *SupervisorMetrics {
+	return &SupervisorMetrics{
+		supervisor: supervisor,
+		upDesc: prometheus.NewDesc(
+			"photon_server_up",
+			"Whether the Photon process is running",
+			nil,
+			nil,
+		),
+		restartsDesc: prometheus.NewDesc(
+			"photon_server_restarts_total",
+			"Number of the restarts of the Photon process after it exited unexpectedly",
+			nil,
+			nil,
+		),
+		crashLoopDesc: prometheus.NewDesc(
+			"photon_server_crash_loop",
+			"Whether the Photon process keeps exiting shortly after it is started",
+			nil,
+			nil,
+		),
+	}
+}
+
+func (m *SupervisorMetrics) Describe(ch chan<- *prometheus.Desc) {
+	ch <- m.upDesc
+	ch <- m.restartsDesc
+	ch <- m.crashLoopDesc
+}
+
+func (m *SupervisorMetrics) Collect(ch chan<- prometheus.Metric) {
+	status := m.supervisor.Status()
+	ch <- prometheus.MustNewConstMetric(m.upDesc, prometheus.GaugeValue, boolToFloat(status.Running))
+	ch <- prometheus.MustNewConstMetric(m.restartsDesc, prometheus.CounterValue, float64(status.Restarts))
+	ch <- prometheus.MustNewConstMetric(m.crashLoopDesc, prometheus.GaugeValue, boolToFloat(status.CrashLoop))
+}
+
+func boolToFloat(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
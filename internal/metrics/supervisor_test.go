@@ -0,0 +1,73 @@
+package metrics_test
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/require"
+
+	"github.com/pddg/photon-container/internal/metrics"
+	"github.com/pddg/photon-container/internal/photon"
+)
+
+type mockSupervisor struct {
+	status photon.SupervisorStatus
+}
+
+func (m *mockSupervisor) Status() photon.SupervisorStatus {
+	return m.status
+}
+
+func Test_SupervisorMetrics(t *testing.T) {
+	t.Parallel()
+	testCases := []struct {
+		name     string
+		status   photon.SupervisorStatus
+		expected string
+	}{
+		{
+			name:   "running",
+			status: photon.SupervisorStatus{Running: true, Restarts: 2},
+			expected: `
+# HELP photon_server_crash_loop Whether the Photon process keeps exiting shortly after it is started
+# TYPE photon_server_crash_loop gauge
+photon_server_crash_loop 0
+# HELP photon_server_restarts_total Number of the restarts of the Photon process after it exited unexpectedly
+# TYPE photon_server_restarts_total counter
+photon_server_restarts_total 2
+# HELP photon_server_up Whether the Photon process is running
+# TYPE photon_server_up gauge
+photon_server_up 1
+`,
+		},
+		{
+			name:   "crash loop",
+			status: photon.SupervisorStatus{Restarts: 5, ConsecutiveCrashes: 5, CrashLoop: true},
+			expected: `
+# HELP photon_server_crash_loop Whether the Photon process keeps exiting shortly after it is started
+# TYPE photon_server_crash_loop gauge
+photon_server_crash_loop 1
+# HELP photon_server_restarts_total Number of the restarts of the Photon process after it exited unexpectedly
+# TYPE photon_server_restarts_total counter
+photon_server_restarts_total 5
+# HELP photon_server_up Whether the Photon process is running
+# TYPE photon_server_up gauge
+photon_server_up 0
+`,
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+			// Setup
+			m := metrics.NewSupervisorMetrics(&mockSupervisor{status: tc.status})
+
+			// Exercise
+			err := testutil.CollectAndCompare(m, strings.NewReader(tc.expected))
+
+			// Verify
+			require.NoError(t, err)
+		})
+	}
+}
@@ -0,0 +1,39 @@
+package photon
+
+import (
+	"context"
+	"time"
+)
+
+// WithJava replaces the command to run the jar, so that the tests can supervise a fake process.
+func WithJava(path string) PhotonServerOption {
+	return func(s *PhotonServer) {
+		s.java = path
+	}
+}
+
+// DefaultBackoffDelay returns the delay of the default backoff before the restart after the consecutive crashes.
+func DefaultBackoffDelay(crashes int) time.Duration {
+	return defaultBackoffConfig.delay(crashes)
+}
+
+// DefaultStableUptime and DefaultCrashLoopThreshold are of the default backoff.
+var (
+	DefaultStableUptime       = defaultBackoffConfig.stableUptime
+	DefaultCrashLoopThreshold = defaultBackoffConfig.crashLoopThreshold
+)
+
+// WaitForStatus exposes waitForStatus to the tests with a fake Photon server.
+func (v *Validator) WaitForStatus(ctx context.Context, baseURL string, exited <-chan error) error {
+	return v.waitForStatus(ctx, baseURL, exited)
+}
+
+// RunQueries exposes runQueries to the tests with a fake Photon server.
+func (v *Validator) RunQueries(ctx context.Context, baseURL string) error {
+	return v.runQueries(ctx, baseURL)
+}
+
+// CountFeatures exposes countFeatures to the tests with a fake Photon server.
+func (v *Validator) CountFeatures(ctx context.Context, url string) (int, error) {
+	return v.countFeatures(ctx, url)
+}
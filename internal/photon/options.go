@@ -1,5 +1,7 @@
 package photon
 
+import "time"
+
 type PhotonServerOption func(*PhotonServer)
 
 func WithArgs(args ...string) PhotonServerOption {
@@ -7,3 +9,35 @@ func WithArgs(args ...string) PhotonServerOption {
 		s.additionalArgs = args
 	}
 }
+
+// WithListenPort sets the port which Photon listens on. The default is DefaultPort.
+func WithListenPort(port int) PhotonServerOption {
+	return func(s *PhotonServer) {
+		s.port = port
+	}
+}
+
+// WithRestartBackoff sets the delay before restarting the process which exited unexpectedly.
+// The delay starts from initial and is doubled for each consecutive crash up to max.
+func WithRestartBackoff(initial, max time.Duration) PhotonServerOption {
+	return func(s *PhotonServer) {
+		s.backoff.initial = initial
+		s.backoff.max = max
+	}
+}
+
+// WithCrashLoopThreshold sets the number of the consecutive crashes regarded as a crash loop.
+// The crashes are counted as consecutive unless the process runs longer than stableUptime in between.
+func WithCrashLoopThreshold(crashes int, stableUptime time.Duration) PhotonServerOption {
+	return func(s *PhotonServer) {
+		s.backoff.crashLoopThreshold = crashes
+		s.backoff.stableUptime = stableUptime
+	}
+}
+
+// WithoutRestart disables the restart of the process which exited unexpectedly.
+func WithoutRestart() PhotonServerOption {
+	return func(s *PhotonServer) {
+		s.restart = false
+	}
+}
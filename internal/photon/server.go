@@ -2,26 +2,50 @@ package photon
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"os"
 	"os/exec"
+	"strconv"
 	"sync"
 	"syscall"
 	"time"
 
 	"github.com/pddg/photon-container/internal/logging"
+	"github.com/pddg/photon-container/internal/memutil"
 )
 
+// DefaultPort is the port which Photon listens on unless `-listen-port` is given.
+const DefaultPort = 2322
+
 type PhotonServer struct {
+	// java is the command to run the jar. It is replaced by the tests.
+	java          string
 	jarPath       string
 	photonDataDir string
+	// port is passed as `-listen-port` unless it is 0.
+	port int
 
 	mutex        sync.Mutex
 	photonServer *exec.Cmd
 	stopServer   func()
+	// exited is closed when the process started last has exited.
+	exited chan struct{}
+	// exitErr is the result of the process started last. It can be read after exited is closed.
+	exitErr error
+	// stopped is true while the server is stopped by the agent, so that the supervisor does not restart it.
+	stopped bool
+	// restartTimer fires the restart scheduled by the supervisor.
+	restartTimer *time.Timer
+	// stableTimer resets the crash counter when the process has been running long enough.
+	stableTimer *time.Timer
+	status      SupervisorStatus
 
 	// additionalArgs are additional arguments to pass to the Photon server.
 	additionalArgs []string
+	// restart is false if the process should not be restarted when it exits unexpectedly.
+	restart bool
+	backoff backoffConfig
 }
 
 // NewPhotonServer creates a new PhotonServer.
@@ -32,8 +56,12 @@ func NewPhotonServer(
 	options ...PhotonServerOption,
 ) *PhotonServer {
 	ps := &PhotonServer{
+		java:          "java",
 		jarPath:       jarPath,
 		photonDataDir: photonDataDir,
+		stopped:       true,
+		restart:       true,
+		backoff:       defaultBackoffConfig,
 	}
 	for _, option := range options {
 		option(ps)
@@ -42,44 +70,41 @@ func NewPhotonServer(
 }
 
 // Start starts the Photon server.
+// The process is supervised and restarted when it exits unexpectedly until Stop is called.
+// The context must outlive the server, since the process is killed when it is canceled.
 func (s *PhotonServer) Start(ctx context.Context) error {
 	s.mutex.Lock()
 	defer s.mutex.Unlock()
-	logger := logging.FromContext(ctx)
-	if s.photonServer == nil {
-		s.photonServer, s.stopServer = s.newServerCommand(ctx)
-	}
-	if s.photonServer.ProcessState != nil {
-		if s.photonServer.ProcessState.Exited() {
-			// The server has exited, so we need to create a new one.
-			logger.DebugContext(ctx, "photon server has exited. creating a new server")
-			s.photonServer, s.stopServer = s.newServerCommand(ctx)
-		} else {
-			// The server is already running.
-			return nil
-		}
-	}
-	logger.InfoContext(ctx, "starting photon server", "command", s.photonServer.String())
-	if err := s.photonServer.Start(); err != nil {
-		return fmt.Errorf("photon.PhotonServer.Start: failed to start Photon server: %w", err)
+	s.stopped = false
+	if s.runningLocked() {
+		// The server is already running.
+		return nil
 	}
-	return nil
+	// The server is started by the agent. Give it another chance even if it has been crash looping.
+	s.cancelRestartLocked()
+	s.status.ConsecutiveCrashes = 0
+	s.status.CrashLoop = false
+	return s.startLocked(ctx)
 }
 
-// Restart restarts the Photon server.
+// Stop stops the Photon server. It is not restarted until Start is called.
 func (s *PhotonServer) Stop(ctx context.Context) error {
 	s.mutex.Lock()
 	defer s.mutex.Unlock()
 	logger := logging.FromContext(ctx)
-	if s.photonServer == nil {
+	s.stopped = true
+	s.cancelRestartLocked()
+	if !s.runningLocked() {
 		logger.DebugContext(ctx, "skip stopping server. photon server is not running")
 		return nil
 	}
 	logger.DebugContext(ctx, "sending SIGTERM to photon server")
 	s.stopServer()
 	logger.DebugContext(ctx, "waiting for photon server to stop")
-	if err := s.photonServer.Wait(); err != nil {
-		logger.WarnContext(ctx, "photon exited with error", "error", err)
+	// The supervisor closes it without the mutex.
+	<-s.exited
+	if s.exitErr != nil {
+		logger.WarnContext(ctx, "photon exited with error", "error", s.exitErr)
 		// No need to return an error here.
 		// The server has stopped, and the error is logged.
 		return nil
@@ -88,14 +113,121 @@ func (s *PhotonServer) Stop(ctx context.Context) error {
 	return nil
 }
 
+// Handover starts a second Photon server on the data directory and the port, and stops the current one once ready returns nil.
+// Both of them run while ready waits for the new one, so that Photon keeps serving during the switch.
+// The new one is stopped and the current one keeps running if ready returns an error.
+// If no server is running, the server is just started on the data directory and the port.
+func (s *PhotonServer) Handover(ctx context.Context, photonDataDir string, port int, ready func(ctx context.Context) error) error {
+	logger := logging.FromContext(ctx)
+	s.mutex.Lock()
+	prevDataDir, prevPort := s.photonDataDir, s.port
+	prevServer, prevStop, prevExited := s.photonServer, s.stopServer, s.exited
+	prevRunning := s.runningLocked()
+	s.photonDataDir, s.port = photonDataDir, port
+	s.stopped = false
+	s.cancelRestartLocked()
+	if err := s.startLocked(ctx); err != nil {
+		s.photonDataDir, s.port = prevDataDir, prevPort
+		s.photonServer, s.stopServer, s.exited = prevServer, prevStop, prevExited
+		s.mutex.Unlock()
+		return fmt.Errorf("photon.PhotonServer.Handover: %w", err)
+	}
+	s.mutex.Unlock()
+
+	if err := ready(ctx); err != nil {
+		s.mutex.Lock()
+		newStop, newExited := s.stopServer, s.exited
+		s.cancelRestartLocked()
+		s.photonDataDir, s.port = prevDataDir, prevPort
+		s.photonServer, s.stopServer, s.exited = prevServer, prevStop, prevExited
+		s.mutex.Unlock()
+		logger.WarnContext(ctx, "stop the new photon server since it is not ready", "error", err)
+		newStop()
+		<-newExited
+		return fmt.Errorf("photon.PhotonServer.Handover: %w", err)
+	}
+	if prevRunning {
+		// The supervisor does not restart it, since it is not the current process any more.
+		logger.InfoContext(ctx, "stop the previous photon server", "data_dir", prevDataDir)
+		prevStop()
+		<-prevExited
+	}
+	logger.InfoContext(ctx, "photon server handed over", "data_dir", photonDataDir, "port", port)
+	return nil
+}
+
+// MemoryUsage returns the resident set size of the running Photon server in bytes.
+func (s *PhotonServer) MemoryUsage() (uint64, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if !s.runningLocked() {
+		return 0, errors.New("photon.PhotonServer.MemoryUsage: photon server is not running")
+	}
+	rss, err := memutil.ProcessRSS(s.photonServer.Process.Pid)
+	if err != nil {
+		return 0, fmt.Errorf("photon.PhotonServer.MemoryUsage: %w", err)
+	}
+	return rss, nil
+}
+
 // Running returns true if the Photon server is running.
 func (s *PhotonServer) Running() bool {
 	s.mutex.Lock()
 	defer s.mutex.Unlock()
-	if s.photonServer == nil {
+	return s.runningLocked()
+}
+
+// done returns the channel which receives the result of the process started last when it exits.
+// It never receives if no process has been started.
+func (s *PhotonServer) done() <-chan error {
+	s.mutex.Lock()
+	exited := s.exited
+	s.mutex.Unlock()
+	done := make(chan error, 1)
+	if exited == nil {
+		return done
+	}
+	go func() {
+		<-exited
+		// The supervisor sets it before closing exited.
+		done <- s.exitErr
+	}()
+	return done
+}
+
+func (s *PhotonServer) runningLocked() bool {
+	if s.exited == nil {
 		return false
 	}
-	return s.photonServer.ProcessState != nil && s.photonServer.ProcessState.Exited()
+	select {
+	case <-s.exited:
+		return false
+	default:
+		return true
+	}
+}
+
+// startLocked starts a new process and its supervisor. The caller must hold the mutex.
+func (s *PhotonServer) startLocked(ctx context.Context) error {
+	logger := logging.FromContext(ctx)
+	cmd, stopServer := s.newServerCommand(ctx)
+	logger.InfoContext(ctx, "starting photon server", "command", cmd.String())
+	if err := cmd.Start(); err != nil {
+		stopServer()
+		return fmt.Errorf("photon.PhotonServer.Start: failed to start Photon server: %w", err)
+	}
+	exited := make(chan struct{})
+	s.photonServer, s.stopServer, s.exited = cmd, stopServer, exited
+	s.stableTimer = time.AfterFunc(s.backoff.stableUptime, func() {
+		s.mutex.Lock()
+		defer s.mutex.Unlock()
+		if s.photonServer == cmd && s.runningLocked() {
+			s.status.ConsecutiveCrashes = 0
+			s.status.CrashLoop = false
+		}
+	})
+	go s.supervise(ctx, cmd, exited)
+	return nil
 }
 
 func (s *PhotonServer) newServerCommand(
@@ -106,9 +238,12 @@ func (s *PhotonServer) newServerCommand(
 	serverCtx, cancel := context.WithCancel(ctx)
 
 	args := []string{"-jar", s.jarPath, "-data-dir", s.photonDataDir}
+	if s.port != 0 {
+		args = append(args, "-listen-port", strconv.Itoa(s.port))
+	}
 	args = append(args, s.additionalArgs...)
 
-	cmd := exec.CommandContext(serverCtx, "java", args...)
+	cmd := exec.CommandContext(serverCtx, s.java, args...)
 
 	// Send SIGTERM to the process when cancel is called.
 	cmd.Cancel = func() error {
@@ -0,0 +1,127 @@
+package photon
+
+import (
+	"context"
+	"os/exec"
+	"time"
+
+	"github.com/pddg/photon-container/internal/logging"
+)
+
+// SupervisorStatus is the state of the supervised Photon process.
+type SupervisorStatus struct {
+	Running bool `json:"running"`
+	// Restarts is the number of the restarts by the supervisor since the agent started.
+	Restarts int `json:"restarts"`
+	// ConsecutiveCrashes is the number of the unexpected exits without running stably in between.
+	ConsecutiveCrashes int `json:"consecutive_crashes"`
+	// CrashLoop is true if the process keeps exiting shortly after it is started.
+	CrashLoop     bool       `json:"crash_loop"`
+	LastExitError string     `json:"last_exit_error,omitempty"`
+	LastExitAt    *time.Time `json:"last_exit_at,omitempty"`
+}
+
+// backoffConfig configures the restarts of the process which exited unexpectedly.
+type backoffConfig struct {
+	// initial is the delay before the first restart. It is doubled for each consecutive crash up to max.
+	initial time.Duration
+	max     time.Duration
+	// stableUptime is the uptime after which the process is regarded as stable and the crashes are forgotten.
+	stableUptime time.Duration
+	// crashLoopThreshold is the number of the consecutive crashes regarded as a crash loop.
+	crashLoopThreshold int
+}
+
+var defaultBackoffConfig = backoffConfig{
+	initial:            time.Second,
+	max:                5 * time.Minute,
+	stableUptime:       10 * time.Minute,
+	crashLoopThreshold: 5,
+}
+
+// delay returns the delay before the restart after the consecutive crashes.
+func (c backoffConfig) delay(crashes int) time.Duration {
+	delay := c.initial
+	for i := 1; i < crashes && delay < c.max; i++ {
+		delay *= 2
+	}
+	return min(delay, c.max)
+}
+
+// Status returns the state of the supervised process.
+func (s *PhotonServer) Status() SupervisorStatus {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	status := s.status
+	status.Running = s.runningLocked()
+	return status
+}
+
+// supervise waits for the process to exit, and schedules the restart if it was not stopped by the agent.
+func (s *PhotonServer) supervise(ctx context.Context, cmd *exec.Cmd, exited chan struct{}) {
+	err := cmd.Wait()
+	s.exitErr = err
+	// Close it before taking the mutex, since Stop waits for it with the mutex held.
+	close(exited)
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.photonServer == cmd && s.stableTimer != nil {
+		s.stableTimer.Stop()
+	}
+	if s.stopped || s.photonServer != cmd || ctx.Err() != nil {
+		// Stopped by the agent, or the agent is shutting down.
+		return
+	}
+	s.recordCrashLocked(ctx, err)
+	if !s.restart {
+		return
+	}
+	s.scheduleRestartLocked(ctx)
+}
+
+// recordCrashLocked records the unexpected exit of the process. The caller must hold the mutex.
+func (s *PhotonServer) recordCrashLocked(ctx context.Context, err error) {
+	now := time.Now().UTC()
+	s.status.LastExitAt = &now
+	s.status.LastExitError = "exited without error"
+	if err != nil {
+		s.status.LastExitError = err.Error()
+	}
+	s.status.ConsecutiveCrashes++
+	if s.status.ConsecutiveCrashes >= s.backoff.crashLoopThreshold {
+		s.status.CrashLoop = true
+	}
+	logging.FromContext(ctx).ErrorContext(ctx, "photon server exited unexpectedly",
+		"error", s.status.LastExitError,
+		"consecutive_crashes", s.status.ConsecutiveCrashes,
+		"crash_loop", s.status.CrashLoop,
+	)
+}
+
+// scheduleRestartLocked restarts the process after the backoff. The caller must hold the mutex.
+func (s *PhotonServer) scheduleRestartLocked(ctx context.Context) {
+	delay := s.backoff.delay(s.status.ConsecutiveCrashes)
+	logging.FromContext(ctx).InfoContext(ctx, "restart photon server after backoff", "backoff", delay)
+	s.restartTimer = time.AfterFunc(delay, func() {
+		s.mutex.Lock()
+		defer s.mutex.Unlock()
+		s.restartTimer = nil
+		if s.stopped || s.runningLocked() || ctx.Err() != nil {
+			return
+		}
+		s.status.Restarts++
+		if err := s.startLocked(ctx); err != nil {
+			s.recordCrashLocked(ctx, err)
+			s.scheduleRestartLocked(ctx)
+		}
+	})
+}
+
+// cancelRestartLocked cancels the scheduled restart. The caller must hold the mutex.
+func (s *PhotonServer) cancelRestartLocked() {
+	if s.restartTimer != nil {
+		s.restartTimer.Stop()
+		s.restartTimer = nil
+	}
+}
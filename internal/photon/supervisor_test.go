@@ -0,0 +1,169 @@
+package photon_test
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/pddg/photon-container/internal/photon"
+)
+
+// fakeJava writes the shell script run instead of java. It ignores the arguments.
+func fakeJava(t *testing.T, script string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "java")
+	require.NoError(t, os.WriteFile(path, []byte("#!/bin/sh\n"+script+"\n"), 0755))
+	return path
+}
+
+func newSupervisedServer(t *testing.T, script string, options ...photon.PhotonServerOption) *photon.PhotonServer {
+	t.Helper()
+	options = append([]photon.PhotonServerOption{photon.WithJava(fakeJava(t, script))}, options...)
+	server := photon.NewPhotonServer(t.Context(), "photon.jar", t.TempDir(), options...)
+	t.Cleanup(func() {
+		_ = server.Stop(t.Context())
+	})
+	return server
+}
+
+func Test_BackoffDelay(t *testing.T) {
+	t.Parallel()
+	testCases := []struct {
+		crashes int
+		want    time.Duration
+	}{
+		{crashes: 1, want: time.Second},
+		{crashes: 2, want: 2 * time.Second},
+		{crashes: 3, want: 4 * time.Second},
+		{crashes: 9, want: 256 * time.Second},
+		{crashes: 10, want: 5 * time.Minute},
+		{crashes: 100, want: 5 * time.Minute},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.want.String(), func(t *testing.T) {
+			t.Parallel()
+			// Exercise
+			got := photon.DefaultBackoffDelay(tc.crashes)
+
+			// Verify
+			assert.Equal(t, tc.want, got)
+		})
+	}
+	t.Run("defaults", func(t *testing.T) {
+		t.Parallel()
+		assert.Equal(t, 10*time.Minute, photon.DefaultStableUptime)
+		assert.Equal(t, 5, photon.DefaultCrashLoopThreshold)
+	})
+}
+
+func Test_PhotonServer_Supervise(t *testing.T) {
+	t.Parallel()
+	t.Run("crash loop", func(t *testing.T) {
+		t.Parallel()
+		// Setup
+		server := newSupervisedServer(t, "exit 1",
+			photon.WithRestartBackoff(10*time.Millisecond, 40*time.Millisecond),
+			photon.WithCrashLoopThreshold(3, time.Hour),
+		)
+
+		// Exercise
+		require.NoError(t, server.Start(t.Context()))
+
+		// Verify
+		assert.Eventually(t, func() bool {
+			return server.Status().CrashLoop
+		}, 5*time.Second, 10*time.Millisecond)
+		status := server.Status()
+		assert.GreaterOrEqual(t, status.ConsecutiveCrashes, 3)
+		assert.GreaterOrEqual(t, status.Restarts, 2)
+		assert.Equal(t, "exit status 1", status.LastExitError)
+		assert.NotNil(t, status.LastExitAt)
+	})
+	t.Run("crashes are forgotten after stable uptime", func(t *testing.T) {
+		t.Parallel()
+		// Setup
+		// The process crashes twice, and then keeps running.
+		count := filepath.Join(t.TempDir(), "count")
+		server := newSupervisedServer(t, `n=$(cat `+count+` 2>/dev/null || echo 0)
+echo $((n+1)) > `+count+`
+[ "$n" -lt 2 ] && exit 1
+exec sleep 60`,
+			photon.WithRestartBackoff(10*time.Millisecond, 10*time.Millisecond),
+			photon.WithCrashLoopThreshold(5, 100*time.Millisecond),
+		)
+
+		// Exercise
+		require.NoError(t, server.Start(t.Context()))
+
+		// Verify
+		assert.Eventually(t, func() bool {
+			return server.Status().Restarts == 2
+		}, 5*time.Second, 10*time.Millisecond)
+		assert.Eventually(t, func() bool {
+			status := server.Status()
+			return status.Running && status.ConsecutiveCrashes == 0
+		}, 5*time.Second, 10*time.Millisecond)
+		assert.False(t, server.Status().CrashLoop)
+	})
+	t.Run("not restarted after stop", func(t *testing.T) {
+		t.Parallel()
+		// Setup
+		server := newSupervisedServer(t, "exec sleep 60",
+			photon.WithRestartBackoff(10*time.Millisecond, 10*time.Millisecond),
+		)
+		require.NoError(t, server.Start(t.Context()))
+		require.True(t, server.Running())
+
+		// Exercise
+		require.NoError(t, server.Stop(t.Context()))
+
+		// Verify
+		time.Sleep(100 * time.Millisecond)
+		status := server.Status()
+		assert.False(t, status.Running)
+		assert.Zero(t, status.Restarts)
+		assert.Zero(t, status.ConsecutiveCrashes)
+	})
+	t.Run("restart scheduled before stop is canceled", func(t *testing.T) {
+		t.Parallel()
+		// Setup
+		server := newSupervisedServer(t, "exit 1",
+			photon.WithRestartBackoff(200*time.Millisecond, 200*time.Millisecond),
+		)
+		require.NoError(t, server.Start(t.Context()))
+		require.Eventually(t, func() bool {
+			return server.Status().ConsecutiveCrashes == 1
+		}, 5*time.Second, 10*time.Millisecond)
+
+		// Exercise
+		require.NoError(t, server.Stop(t.Context()))
+
+		// Verify
+		time.Sleep(400 * time.Millisecond)
+		status := server.Status()
+		assert.False(t, status.Running)
+		assert.Zero(t, status.Restarts)
+	})
+	t.Run("not restarted without restart", func(t *testing.T) {
+		t.Parallel()
+		// Setup
+		server := newSupervisedServer(t, "exit 1",
+			photon.WithRestartBackoff(10*time.Millisecond, 10*time.Millisecond),
+			photon.WithoutRestart(),
+		)
+
+		// Exercise
+		require.NoError(t, server.Start(t.Context()))
+
+		// Verify
+		require.Eventually(t, func() bool {
+			return server.Status().ConsecutiveCrashes == 1
+		}, 5*time.Second, 10*time.Millisecond)
+		time.Sleep(100 * time.Millisecond)
+		assert.Zero(t, server.Status().Restarts)
+	})
+}
@@ -0,0 +1,173 @@
+package photon
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pddg/photon-container/internal/logging"
+)
+
+// ErrValidationFailed is returned when Photon does not work with the database to validate.
+var ErrValidationFailed = errors.New("validation failed")
+
+const (
+	// DefaultValidationPort is the default port which Photon listens on to validate a database.
+	DefaultValidationPort = 2323
+	// DefaultValidationTimeout is the default time to wait for Photon to be ready on the database to validate.
+	DefaultValidationTimeout = 10 * time.Minute
+)
+
+// validationCheckInterval is the interval to check the status of Photon while waiting for it to be ready.
+const validationCheckInterval = 2 * time.Second
+
+// Validator runs a second Photon server on a database which is not promoted yet,
+// and checks that it works before the database is promoted.
+type Validator struct {
+	jarPath    string
+	httpClient *http.Client
+
+	port    int
+	timeout time.Duration
+	// queries are the paths and the query strings of the smoke queries, such as `/api?q=Berlin`.
+	queries []string
+	// minFeatures is the number of features each smoke query must return at least.
+	minFeatures int
+	// additionalArgs are additional arguments to pass to the Photon server.
+	additionalArgs []string
+}
+
+// NewValidator creates a new Validator.
+func NewValidator(jarPath string, httpClient *http.Client, options ...ValidatorOption) *Validator {
+	v := &Validator{
+		jarPath:     jarPath,
+		httpClient:  httpClient,
+		port:        DefaultValidationPort,
+		timeout:     DefaultValidationTimeout,
+		minFeatures: 1,
+	}
+	for _, option := range options {
+		option(v)
+	}
+	return v
+}
+
+// Validate starts Photon on the unarchived database on the side port, waits for it to be ready, and runs the smoke queries.
+// The unarchived directory must contain `photon_data`. The Photon server is stopped when it returns.
+func (v *Validator) Validate(ctx context.Context, unarchived string) error {
+	logger := logging.FromContext(ctx)
+	args := []string{"-listen-ip", "127.0.0.1"}
+	// The crash of the server is reported as the failure of the validation, instead of being restarted.
+	server := NewPhotonServer(ctx, v.jarPath, unarchived,
+		WithArgs(append(args, v.additionalArgs...)...),
+		WithListenPort(v.port),
+		WithoutRestart(),
+	)
+	if err := server.Start(ctx); err != nil {
+		return fmt.Errorf("photon.Validator.Validate: %w", err)
+	}
+	defer func() {
+		// Stop it even if the context is canceled, since the directory will be removed.
+		if err := server.Stop(context.WithoutCancel(ctx)); err != nil {
+			logger.WarnContext(ctx, "failed to stop photon server for validation", "error", err)
+		}
+	}()
+
+	baseURL := "http://127.0.0.1:" + strconv.Itoa(v.port)
+	if err := v.waitForStatus(ctx, baseURL, server.done()); err != nil {
+		return fmt.Errorf("photon.Validator.Validate: %w: %w", ErrValidationFailed, err)
+	}
+	if err := v.runQueries(ctx, baseURL); err != nil {
+		return fmt.Errorf("photon.Validator.Validate: %w: %w", ErrValidationFailed, err)
+	}
+	return nil
+}
+
+// waitForStatus waits until Photon reports `status: ok` within the timeout.
+// It fails as soon as the process exits, which is reported to exited.
+func (v *Validator) waitForStatus(ctx context.Context, baseURL string, exited <-chan error) error {
+	ctx, cancel := context.WithTimeout(ctx, v.timeout)
+	defer cancel()
+	ticker := time.NewTicker(validationCheckInterval)
+	defer ticker.Stop()
+	var lastErr error
+	for {
+		var status struct {
+			Status string `json:"status"`
+		}
+		lastErr = v.getJSON(ctx, baseURL+"/status", &status)
+		if lastErr == nil {
+			if strings.ToLower(status.Status) == "ok" {
+				return nil
+			}
+			lastErr = fmt.Errorf("status is not OK: %s", status.Status)
+		}
+		logging.FromContext(ctx).DebugContext(ctx, "waiting for photon to be ready for validation", "error", lastErr)
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("photon is not ready within %s: %w", v.timeout, lastErr)
+		case err := <-exited:
+			if err == nil {
+				return errors.New("photon exited before it is ready")
+			}
+			return fmt.Errorf("photon exited before it is ready: %w", err)
+		case <-ticker.C:
+		}
+	}
+}
+
+// runQueries runs the smoke queries and checks that each of them returns enough features.
+func (v *Validator) runQueries(ctx context.Context, baseURL string) error {
+	logger := logging.FromContext(ctx)
+	for _, query := range v.queries {
+		features, err := v.countFeatures(ctx, baseURL+query)
+		if err != nil {
+			return fmt.Errorf("query %q: %w", query, err)
+		}
+		if features < v.minFeatures {
+			return fmt.Errorf("query %q returned %d features, less than %d", query, features, v.minFeatures)
+		}
+		logger.InfoContext(ctx, "smoke query passed", "query", query, "features", features)
+	}
+	return nil
+}
+
+// countFeatures returns the number of features in the GeoJSON returned by the query.
+func (v *Validator) countFeatures(ctx context.Context, url string) (int, error) {
+	var collection struct {
+		Features []json.RawMessage `json:"features"`
+	}
+	if err := v.getJSON(ctx, url, &collection); err != nil {
+		return 0, err
+	}
+	return len(collection.Features), nil
+}
+
+func (v *Validator) getJSON(ctx context.Context, url string, dest any) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := v.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	bodyBytes, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status code %d: %q", resp.StatusCode, string(bodyBytes))
+	}
+	if err := json.Unmarshal(bodyBytes, dest); err != nil {
+		return fmt.Errorf("failed to unmarshal response: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,42 @@
+package photon
+
+import "time"
+
+type ValidatorOption func(*Validator)
+
+// WithValidationPort sets the port which Photon listens on to validate a database.
+// It must differ from the one of the Photon server in service.
+func WithValidationPort(port int) ValidatorOption {
+	return func(v *Validator) {
+		v.port = port
+	}
+}
+
+// WithValidationTimeout sets the time to wait for Photon to be ready on the database to validate.
+func WithValidationTimeout(timeout time.Duration) ValidatorOption {
+	return func(v *Validator) {
+		v.timeout = timeout
+	}
+}
+
+// WithSmokeQueries sets the queries which must return at least the number of features set by WithMinFeatures.
+// e.g. `/api?q=Berlin`
+func WithSmokeQueries(queries ...string) ValidatorOption {
+	return func(v *Validator) {
+		v.queries = queries
+	}
+}
+
+// WithMinFeatures sets the number of features each smoke query must return at least. The default is 1.
+func WithMinFeatures(n int) ValidatorOption {
+	return func(v *Validator) {
+		v.minFeatures = n
+	}
+}
+
+// WithValidationArgs sets additional arguments to pass to the Photon server for validation.
+func WithValidationArgs(args ...string) ValidatorOption {
+	return func(v *Validator) {
+		v.additionalArgs = args
+	}
+}
@@ -0,0 +1,150 @@
+package photon_test
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/pddg/photon-container/internal/photon"
+)
+
+// newFakePhoton returns a server which responds to /status with the status,
+// and to /api with the number of features given by `?features=`.
+func newFakePhoton(t *testing.T, status string) *httptest.Server {
+	t.Helper()
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /status", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"status":"` + status + `","import_date":"2025-10-01T00:00:00Z"}`))
+	})
+	mux.HandleFunc("GET /api", func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Query().Get("features") {
+		case "2":
+			_, _ = w.Write([]byte(`{"type":"FeatureCollection","features":[{"type":"Feature"},{"type":"Feature"}]}`))
+		case "0":
+			_, _ = w.Write([]byte(`{"type":"FeatureCollection","features":[]}`))
+		default:
+			http.Error(w, "bad request", http.StatusBadRequest)
+		}
+	})
+	server := httptest.NewServer(mux)
+	t.Cleanup(server.Close)
+	return server
+}
+
+func Test_Validator_WaitForStatus(t *testing.T) {
+	t.Parallel()
+	t.Run("ready", func(t *testing.T) {
+		t.Parallel()
+		// Setup
+		server := newFakePhoton(t, "Ok")
+		validator := photon.NewValidator("photon.jar", server.Client())
+
+		// Exercise
+		err := validator.WaitForStatus(t.Context(), server.URL, make(chan error))
+
+		// Verify
+		require.NoError(t, err)
+	})
+	t.Run("not ready within the timeout", func(t *testing.T) {
+		t.Parallel()
+		// Setup
+		server := newFakePhoton(t, "loading")
+		validator := photon.NewValidator("photon.jar", server.Client(), photon.WithValidationTimeout(100*time.Millisecond))
+
+		// Exercise
+		err := validator.WaitForStatus(t.Context(), server.URL, make(chan error))
+
+		// Verify
+		require.ErrorContains(t, err, "status is not OK: loading")
+	})
+	t.Run("exited before it is ready", func(t *testing.T) {
+		t.Parallel()
+		// Setup
+		server := newFakePhoton(t, "loading")
+		validator := photon.NewValidator("photon.jar", server.Client())
+		exited := make(chan error, 1)
+		exitErr := errors.New("exit status 1")
+		exited <- exitErr
+		start := time.Now()
+
+		// Exercise
+		err := validator.WaitForStatus(t.Context(), server.URL, exited)
+
+		// Verify
+		require.ErrorIs(t, err, exitErr)
+		assert.Less(t, time.Since(start), photon.DefaultValidationTimeout)
+	})
+}
+
+func Test_Validator_RunQueries(t *testing.T) {
+	t.Parallel()
+	testCases := []struct {
+		name        string
+		queries     []string
+		minFeatures int
+		wantErr     string
+	}{
+		{
+			name:        "enough features",
+			queries:     []string{"/api?features=2"},
+			minFeatures: 2,
+		},
+		{
+			name:        "less features than the threshold",
+			queries:     []string{"/api?features=2", "/api?features=0"},
+			minFeatures: 1,
+			wantErr:     `query "/api?features=0" returned 0 features, less than 1`,
+		},
+		{
+			name:        "query failed",
+			queries:     []string{"/api?features=invalid"},
+			minFeatures: 1,
+			wantErr:     "unexpected status code 400",
+		},
+		{
+			name:        "no queries",
+			minFeatures: 1,
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+			// Setup
+			server := newFakePhoton(t, "Ok")
+			validator := photon.NewValidator("photon.jar", server.Client(),
+				photon.WithSmokeQueries(tc.queries...),
+				photon.WithMinFeatures(tc.minFeatures),
+			)
+
+			// Exercise
+			err := validator.RunQueries(t.Context(), server.URL)
+
+			// Verify
+			if tc.wantErr != "" {
+				require.ErrorContains(t, err, tc.wantErr)
+				return
+			}
+			require.NoError(t, err)
+		})
+	}
+}
+
+func Test_Validator_CountFeatures(t *testing.T) {
+	t.Parallel()
+	// Setup
+	server := newFakePhoton(t, "Ok")
+	validator := photon.NewValidator("photon.jar", server.Client())
+
+	// Exercise
+	got, err := validator.CountFeatures(t.Context(), server.URL+"/api?features=2")
+
+	// Verify
+	require.NoError(t, err)
+	assert.Equal(t, 2, got)
+}
@@ -13,6 +13,7 @@ const (
 type Archive struct {
 	baseURL     string
 	archiveName string
+	checksum    string
 }
 
 func NewArchive(archiveURL string, options ...ArchiveOption) (Archive, error) {
@@ -51,6 +52,13 @@ func (a Archive) URL() string {
 	return a.BaseURL() + "/" + a.Name()
 }
 
+// Checksum returns the checksum specification of the archive.
+// See downloader.ParseChecksumProvider for the format.
+// Empty string means that the default of the downloader is used.
+func (a Archive) Checksum() string {
+	return a.checksum
+}
+
 func (a Archive) FromArchiveName(name string) Archive {
 	a.archiveName = name
 	return a
@@ -63,3 +71,11 @@ func WithArchiveName(name string) ArchiveOption {
 		a.archiveName = name
 	}
 }
+
+// WithChecksum sets how the archive is verified.
+// See downloader.ParseChecksumProvider for the format.
+func WithChecksum(spec string) ArchiveOption {
+	return func(a *Archive) {
+		a.checksum = spec
+	}
+}
@@ -0,0 +1,299 @@
+package photondata
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"time"
+
+	"github.com/dustin/go-humanize"
+
+	"github.com/pddg/photon-container/internal/fsutil"
+	"github.com/pddg/photon-container/internal/logging"
+)
+
+// GenerationsDirName is the name of the directory in the Photon data directory where the previous databases are retained.
+const GenerationsDirName = "generations"
+
+// GenerationsManifestName is the name of the file which records the retained databases in the Photon data directory.
+const GenerationsManifestName = "generations.json"
+
+// ErrGenerationNotFound is returned when there is no retained database of the ID.
+var ErrGenerationNotFound = errors.New("generation not found")
+
+// Generation is a previous database retained to switch back to.
+type Generation struct {
+	ID string `json:"id"`
+	// ImportDate is the import date which Photon reported while it served the database. It is nil if it was not known.
+	ImportDate *time.Time `json:"import_date,omitempty"`
+	SizeBytes  int64      `json:"size_bytes"`
+	RetainedAt time.Time  `json:"retained_at"`
+}
+
+type generationManifest struct {
+	// Generations are sorted from the newest.
+	Generations []Generation `json:"generations"`
+}
+
+// Generations returns the retained databases from the newest.
+func (m *Migrator) Generations() ([]Generation, error) {
+	m.generationMutex.Lock()
+	defer m.generationMutex.Unlock()
+	generations, err := m.loadGenerations()
+	if err != nil {
+		return nil, fmt.Errorf("photondata.Migrator.Generations: %w", err)
+	}
+	return generations, nil
+}
+
+// MigrateToGeneration replaces the database with the retained one in the same way as MigrateByReplace.
+// It has to be confirmed by WaitForImport, and then committed by CommitReplace or rolled back by RollbackReplace.
+// The replaced database is retained as a new generation when it is committed.
+func (m *Migrator) MigrateToGeneration(ctx context.Context, id string) error {
+	if _, err := m.findGeneration(id); err != nil {
+		return fmt.Errorf("photondata.Migrator.MigrateToGeneration: %w", err)
+	}
+	generationDir := m.generationDir(id)
+	if err := m.begin(ctx, generationDir); err != nil {
+		return fmt.Errorf("photondata.Migrator.MigrateToGeneration: %w", err)
+	}
+	m.mutex.Lock()
+	m.record.Generation = id
+	m.save(ctx)
+	m.mutex.Unlock()
+	if err := m.swap(ctx, generationDir); err != nil {
+		return fmt.Errorf("photondata.Migrator.MigrateToGeneration: %w", err)
+	}
+	return nil
+}
+
+func (m *Migrator) generationsDir() string {
+	return filepath.Join(m.root, GenerationsDirName)
+}
+
+func (m *Migrator) generationDir(id string) string {
+	return filepath.Join(m.generationsDir(), id)
+}
+
+func (m *Migrator) manifestPath() string {
+	return filepath.Join(m.root, GenerationsManifestName)
+}
+
+func (m *Migrator) findGeneration(id string) (Generation, error) {
+	generations, err := m.Generations()
+	if err != nil {
+		return Generation{}, err
+	}
+	i := slices.IndexFunc(generations, func(g Generation) bool { return g.ID == id })
+	if i < 0 {
+		return Generation{}, fmt.Errorf("%w: %q", ErrGenerationNotFound, id)
+	}
+	return generations[i], nil
+}
+
+// loadGenerations reads the manifest. The caller must hold the generation mutex.
+func (m *Migrator) loadGenerations() ([]Generation, error) {
+	manifestBytes, err := os.ReadFile(m.manifestPath())
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return []Generation{}, nil
+		}
+		return nil, fmt.Errorf("failed to read manifest: %w", err)
+	}
+	var manifest generationManifest
+	if err := json.Unmarshal(manifestBytes, &manifest); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal manifest: %w", err)
+	}
+	if manifest.Generations == nil {
+		manifest.Generations = []Generation{}
+	}
+	return manifest.Generations, nil
+}
+
+// saveGenerations writes the manifest atomically. The caller must hold the generation mutex.
+func (m *Migrator) saveGenerations(generations []Generation) error {
+	manifestBytes, err := json.MarshalIndent(generationManifest{Generations: generations}, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal manifest: %w", err)
+	}
+	path := m.manifestPath()
+	tmpPath := path + ".tmp"
+	if err := os.WriteFile(tmpPath, manifestBytes, 0644); err != nil {
+		return fmt.Errorf("failed to write manifest: %w", err)
+	}
+	if err := os.Rename(tmpPath, path); err != nil {
+		return fmt.Errorf("failed to rename manifest: %w", err)
+	}
+	return nil
+}
+
+// forgetGeneration removes the generation which has been activated from the manifest.
+func (m *Migrator) forgetGeneration(id string) error {
+	m.generationMutex.Lock()
+	defer m.generationMutex.Unlock()
+	generations, err := m.loadGenerations()
+	if err != nil {
+		return err
+	}
+	generations = slices.DeleteFunc(generations, func(g Generation) bool { return g.ID == id })
+	return m.saveGenerations(generations)
+}
+
+// retainOld moves the database replaced by the migration in oldDir to the generations.
+// It is removed instead if no generation is retained, or if there is not enough space.
+//
+// The free space after retaining it must be at least as large as it, so that the next update can be extracted.
+// The oldest generations are removed to make room.
+func (m *Migrator) retainOld(ctx context.Context, oldDir string, importDate *time.Time) error {
+	logger := logging.FromContext(ctx)
+	removeOld := func() error {
+		if err := os.RemoveAll(oldDir); err != nil {
+			return fmt.Errorf("failed to remove old database %q: %w", oldDir, err)
+		}
+		return nil
+	}
+	if m.retainGenerations <= 0 {
+		return removeOld()
+	}
+
+	m.generationMutex.Lock()
+	defer m.generationMutex.Unlock()
+	generations, err := m.loadGenerations()
+	if err != nil {
+		return errors.Join(err, removeOld())
+	}
+	size, err := fsutil.DirSize(oldDir)
+	if err != nil {
+		return errors.Join(err, removeOld())
+	}
+	for {
+		free, err := fsutil.FreeSpace(m.root)
+		if err != nil {
+			return errors.Join(err, removeOld())
+		}
+		if free >= uint64(size) {
+			break
+		}
+		if len(generations) == 0 {
+			logger.WarnContext(ctx, "not enough space to retain the previous database",
+				"size", humanize.IBytes(uint64(size)),
+				"free", humanize.IBytes(free),
+			)
+			return removeOld()
+		}
+		var oldest Generation
+		generations, oldest = generations[:len(generations)-1], generations[len(generations)-1]
+		logger.InfoContext(ctx, "remove the oldest generation to make room", "id", oldest.ID)
+		if err := m.removeGeneration(generations, oldest); err != nil {
+			return errors.Join(err, removeOld())
+		}
+	}
+
+	now := time.Now().UTC()
+	generation := Generation{
+		ID:         generationID(importDate, now),
+		ImportDate: importDate,
+		SizeBytes:  size,
+		RetainedAt: now,
+	}
+	// The same database may be retained again after it was activated.
+	if i := slices.IndexFunc(generations, func(g Generation) bool { return g.ID == generation.ID }); i >= 0 {
+		duplicate := generations[i]
+		generations = slices.Delete(generations, i, i+1)
+		if err := m.removeGeneration(generations, duplicate); err != nil {
+			return errors.Join(err, removeOld())
+		}
+	}
+	if err := os.MkdirAll(m.generationsDir(), 0755); err != nil {
+		return errors.Join(fmt.Errorf("failed to create directory: %w", err), removeOld())
+	}
+	generationDir := m.generationDir(generation.ID)
+	if err := os.Rename(oldDir, generationDir); err != nil {
+		return errors.Join(fmt.Errorf("failed to rename %q to %q: %w", oldDir, generationDir, err), removeOld())
+	}
+	generations = append([]Generation{generation}, generations...)
+	for len(generations) > m.retainGenerations {
+		var oldest Generation
+		generations, oldest = generations[:len(generations)-1], generations[len(generations)-1]
+		if err := m.removeGeneration(generations, oldest); err != nil {
+			return err
+		}
+	}
+	if err := m.saveGenerations(generations); err != nil {
+		return err
+	}
+	logger.InfoContext(ctx, "retained the previous database", "id", generation.ID, "size", humanize.IBytes(uint64(size)))
+	return nil
+}
+
+// removeGeneration saves the manifest without the generation, and then removes it.
+// The caller must hold the generation mutex.
+func (m *Migrator) removeGeneration(rest []Generation, generation Generation) error {
+	if err := m.saveGenerations(rest); err != nil {
+		return err
+	}
+	generationDir := m.generationDir(generation.ID)
+	if err := os.RemoveAll(generationDir); err != nil {
+		return fmt.Errorf("failed to remove generation %q: %w", generationDir, err)
+	}
+	return nil
+}
+
+// cleanGenerations makes the manifest and the generations directory consistent after an interruption.
+// The entries without the database are dropped, and the databases not in the manifest are removed.
+func (m *Migrator) cleanGenerations(ctx context.Context) error {
+	m.generationMutex.Lock()
+	defer m.generationMutex.Unlock()
+	generations, err := m.loadGenerations()
+	if err != nil {
+		return err
+	}
+	logger := logging.FromContext(ctx)
+	kept := make([]Generation, 0, len(generations))
+	for _, generation := range generations {
+		exists, err := dirExists(m.generationDir(generation.ID))
+		if err != nil {
+			return err
+		}
+		if !exists {
+			logger.WarnContext(ctx, "drop generation without database", "id", generation.ID)
+			continue
+		}
+		kept = append(kept, generation)
+	}
+	if len(kept) != len(generations) {
+		if err := m.saveGenerations(kept); err != nil {
+			return err
+		}
+	}
+	entries, err := os.ReadDir(m.generationsDir())
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+		return fmt.Errorf("failed to read generations: %w", err)
+	}
+	for _, entry := range entries {
+		if slices.ContainsFunc(kept, func(g Generation) bool { return g.ID == entry.Name() }) {
+			continue
+		}
+		path := filepath.Join(m.generationsDir(), entry.Name())
+		logger.WarnContext(ctx, "remove database not in generation manifest", "path", path)
+		if err := os.RemoveAll(path); err != nil {
+			return fmt.Errorf("failed to remove %q: %w", path, err)
+		}
+	}
+	return nil
+}
+
+// generationID returns the ID of the generation named after its import date, or the time it was retained if it is not known.
+func generationID(importDate *time.Time, retainedAt time.Time) string {
+	if importDate != nil {
+		return importDate.UTC().Format("20060102T150405Z")
+	}
+	return retainedAt.UTC().Format("20060102T150405Z")
+}
@@ -0,0 +1,247 @@
+package photondata_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/pddg/photon-container/internal/photondata"
+)
+
+// migrateAndCommit replaces the database with a new one whose content is the given one.
+func migrateAndCommit(t *testing.T, migrator *photondata.Migrator, content string) {
+	t.Helper()
+	srcDir := setupSrcDir(t)
+	require.NoError(t, os.WriteFile(filepath.Join(srcDir, "photon_data", "node_1", "hello.txt"), []byte(content), 0644))
+	require.NoError(t, migrator.MigrateByReplace(t.Context(), srcDir))
+	require.NoError(t, migrator.CommitReplace(t.Context()))
+}
+
+func readGeneration(t *testing.T, photonDataDir, id string) string {
+	t.Helper()
+	got, err := os.ReadFile(filepath.Join(photonDataDir, photondata.GenerationsDirName, id, "hello.txt"))
+	require.NoError(t, err)
+	return string(got)
+}
+
+func Test_Migrator_CommitReplace_RetainGenerations(t *testing.T) {
+	t.Parallel()
+	t.Run("retain previous database", func(t *testing.T) {
+		t.Parallel()
+		// Setup
+		importTime := time.Date(2025, 10, 1, 0, 0, 0, 0, time.UTC)
+		mockPhoton := newMockPhotonServer(importTime, nil)
+		srv := httptest.NewServer(mockPhoton)
+		defer srv.Close()
+		destDataDir, destFile := setupDestDir(t)
+		migrator := photondata.NewMigrator(destDataDir, srv.Client(),
+			photondata.WithPhotonURL(srv.URL),
+			photondata.WithRetainGenerations(2),
+		)
+		// Cache the import date of the existing database
+		migrator.State(t.Context())
+
+		// Exercise
+		migrateAndCommit(t, migrator, "src")
+
+		// Verify
+		got, err := os.ReadFile(destFile)
+		require.NoError(t, err)
+		assert.Equal(t, "src", string(got))
+		assert.NoDirExists(t, filepath.Join(destDataDir, "node_1.old"))
+		generations, err := migrator.Generations()
+		require.NoError(t, err)
+		require.Len(t, generations, 1)
+		assert.Equal(t, "20251001T000000Z", generations[0].ID)
+		require.NotNil(t, generations[0].ImportDate)
+		assert.True(t, importTime.Equal(*generations[0].ImportDate))
+		assert.Equal(t, int64(len("dest")), generations[0].SizeBytes)
+		assert.Equal(t, "dest", readGeneration(t, destDataDir, generations[0].ID))
+	})
+	t.Run("remove the oldest generation", func(t *testing.T) {
+		t.Parallel()
+		// Setup
+		importTime := time.Date(2025, 10, 1, 0, 0, 0, 0, time.UTC)
+		mockPhoton := newMockPhotonServer(importTime, nil)
+		srv := httptest.NewServer(mockPhoton)
+		defer srv.Close()
+		destDataDir, _ := setupDestDir(t)
+		migrator := photondata.NewMigrator(destDataDir, srv.Client(),
+			photondata.WithPhotonURL(srv.URL),
+			photondata.WithRetainGenerations(2),
+		)
+		for i, content := range []string{"first", "second"} {
+			migrator.State(t.Context())
+			migrateAndCommit(t, migrator, content)
+			mockPhoton.Set(importTime.AddDate(0, 0, i+1), nil)
+		}
+		migrator.State(t.Context())
+
+		// Exercise
+		migrateAndCommit(t, migrator, "third")
+
+		// Verify
+		generations, err := migrator.Generations()
+		require.NoError(t, err)
+		require.Len(t, generations, 2)
+		assert.Equal(t, "20251003T000000Z", generations[0].ID)
+		assert.Equal(t, "second", readGeneration(t, destDataDir, generations[0].ID))
+		assert.Equal(t, "20251002T000000Z", generations[1].ID)
+		assert.Equal(t, "first", readGeneration(t, destDataDir, generations[1].ID))
+		assert.NoDirExists(t, filepath.Join(destDataDir, photondata.GenerationsDirName, "20251001T000000Z"))
+	})
+	t.Run("retain nothing by default", func(t *testing.T) {
+		t.Parallel()
+		// Setup
+		destDataDir, _ := setupDestDir(t)
+		migrator := photondata.NewMigrator(destDataDir, http.DefaultClient)
+
+		// Exercise
+		migrateAndCommit(t, migrator, "src")
+
+		// Verify
+		generations, err := migrator.Generations()
+		require.NoError(t, err)
+		assert.Empty(t, generations)
+		assert.NoDirExists(t, filepath.Join(destDataDir, photondata.GenerationsDirName))
+	})
+}
+
+func Test_Migrator_MigrateToGeneration(t *testing.T) {
+	t.Parallel()
+	setup := func(t *testing.T) (*photondata.Migrator, *mockPhotonServer, string) {
+		t.Helper()
+		mockPhoton := newMockPhotonServer(time.Date(2025, 10, 1, 0, 0, 0, 0, time.UTC), nil)
+		srv := httptest.NewServer(mockPhoton)
+		t.Cleanup(srv.Close)
+		destDataDir, _ := setupDestDir(t)
+		migrator := photondata.NewMigrator(destDataDir, srv.Client(),
+			photondata.WithPhotonURL(srv.URL),
+			photondata.WithRetainGenerations(2),
+			photondata.WithImportTimeout(100*time.Millisecond),
+		)
+		migrator.State(t.Context())
+		migrateAndCommit(t, migrator, "src")
+		mockPhoton.Set(time.Date(2025, 10, 8, 0, 0, 0, 0, time.UTC), nil)
+		migrator.State(t.Context())
+		return migrator, mockPhoton, destDataDir
+	}
+	t.Run("commit", func(t *testing.T) {
+		t.Parallel()
+		// Setup
+		migrator, mockPhoton, destDataDir := setup(t)
+
+		// Exercise
+		require.NoError(t, migrator.MigrateToGeneration(t.Context(), "20251001T000000Z"))
+		mockPhoton.Set(time.Date(2025, 10, 1, 0, 0, 0, 0, time.UTC), nil)
+		require.NoError(t, migrator.WaitForImport(t.Context()))
+		err := migrator.CommitReplace(t.Context())
+
+		// Verify
+		require.NoError(t, err)
+		got, err := os.ReadFile(filepath.Join(destDataDir, "node_1", "hello.txt"))
+		require.NoError(t, err)
+		assert.Equal(t, "dest", string(got))
+		assert.Equal(t, photondata.MigrationStateMigrated, migrator.Record().State)
+		// The replaced database is retained, and the activated one is not a generation any more.
+		generations, err := migrator.Generations()
+		require.NoError(t, err)
+		require.Len(t, generations, 1)
+		assert.Equal(t, "20251008T000000Z", generations[0].ID)
+		assert.Equal(t, "src", readGeneration(t, destDataDir, generations[0].ID))
+		assert.NoDirExists(t, filepath.Join(destDataDir, photondata.GenerationsDirName, "20251001T000000Z"))
+	})
+	t.Run("roll back when the import date does not match", func(t *testing.T) {
+		t.Parallel()
+		// Setup
+		migrator, _, destDataDir := setup(t)
+		require.NoError(t, migrator.MigrateToGeneration(t.Context(), "20251001T000000Z"))
+
+		// Exercise
+		err := migrator.WaitForImport(t.Context())
+		require.ErrorIs(t, err, photondata.ErrImportNotServed)
+		err = migrator.RollbackReplace(t.Context(), err.Error())
+
+		// Verify
+		require.NoError(t, err)
+		got, err := os.ReadFile(filepath.Join(destDataDir, "node_1", "hello.txt"))
+		require.NoError(t, err)
+		assert.Equal(t, "src", string(got))
+		assert.Equal(t, photondata.MigrationStateRolledBack, migrator.Record().State)
+		// The generation is put back to be activated again.
+		generations, err := migrator.Generations()
+		require.NoError(t, err)
+		require.Len(t, generations, 1)
+		assert.Equal(t, "dest", readGeneration(t, destDataDir, "20251001T000000Z"))
+	})
+	t.Run("unknown generation", func(t *testing.T) {
+		t.Parallel()
+		// Setup
+		migrator, _, _ := setup(t)
+
+		// Exercise
+		err := migrator.MigrateToGeneration(t.Context(), "unknown")
+
+		// Verify
+		require.ErrorIs(t, err, photondata.ErrGenerationNotFound)
+		assert.Equal(t, photondata.MigrationStateMigrated, migrator.Record().State)
+	})
+}
+
+func Test_Migrator_Recover_Generations(t *testing.T) {
+	t.Parallel()
+	t.Run("put back interrupted activation", func(t *testing.T) {
+		t.Parallel()
+		// Setup
+		destDataDir, _ := setupDestDir(t)
+		migrator := photondata.NewMigrator(destDataDir, http.DefaultClient, photondata.WithRetainGenerations(2))
+		migrateAndCommit(t, migrator, "src")
+		generations, err := migrator.Generations()
+		require.NoError(t, err)
+		require.Len(t, generations, 1)
+		require.NoError(t, migrator.MigrateToGeneration(t.Context(), generations[0].ID))
+
+		// Exercise
+		recovered := photondata.NewMigrator(destDataDir, http.DefaultClient, photondata.WithRetainGenerations(2))
+		err = recovered.Recover(t.Context(), filepath.Join(destDataDir, "temp"))
+
+		// Verify
+		require.NoError(t, err)
+		assert.Equal(t, photondata.MigrationStateRolledBack, recovered.Record().State)
+		got, err := os.ReadFile(filepath.Join(destDataDir, "node_1", "hello.txt"))
+		require.NoError(t, err)
+		assert.Equal(t, "src", string(got))
+		assert.Equal(t, "dest", readGeneration(t, destDataDir, generations[0].ID))
+		assert.NoDirExists(t, filepath.Join(destDataDir, "node_1.old"))
+	})
+	t.Run("make manifest consistent", func(t *testing.T) {
+		t.Parallel()
+		// Setup
+		destDataDir, _ := setupDestDir(t)
+		migrator := photondata.NewMigrator(destDataDir, http.DefaultClient, photondata.WithRetainGenerations(2))
+		migrateAndCommit(t, migrator, "src")
+		generations, err := migrator.Generations()
+		require.NoError(t, err)
+		require.Len(t, generations, 1)
+		// The database of the generation is lost, and an unknown one is left.
+		require.NoError(t, os.RemoveAll(filepath.Join(destDataDir, photondata.GenerationsDirName, generations[0].ID)))
+		orphan := filepath.Join(destDataDir, photondata.GenerationsDirName, "orphan")
+		require.NoError(t, os.MkdirAll(orphan, 0755))
+
+		// Exercise
+		err = migrator.Recover(t.Context(), filepath.Join(destDataDir, "temp"))
+
+		// Verify
+		require.NoError(t, err)
+		generations, err = migrator.Generations()
+		require.NoError(t, err)
+		assert.Empty(t, generations)
+		assert.NoDirExists(t, orphan)
+	})
+}
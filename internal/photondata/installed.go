@@ -0,0 +1,127 @@
+package photondata
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/pddg/photon-container/internal/logging"
+)
+
+// InstalledArchiveFileName is the name of the file which records the archive of the live database
+// in the Photon data directory.
+const InstalledArchiveFileName = "installed-archive.json"
+
+// InstalledArchive describes the archive which the live database was downloaded from.
+type InstalledArchive struct {
+	URL          string    `json:"url"`
+	LastModified time.Time `json:"last_modified"`
+	// ETag is empty if the server did not return it.
+	ETag string `json:"etag,omitempty"`
+	// Checksum is the expected checksum of the archive formatted as `{{algorithm}}:{{digest}}`.
+	// It is empty if the archive was not verified.
+	Checksum    string    `json:"checksum,omitempty"`
+	InstalledAt time.Time `json:"installed_at"`
+}
+
+// RolledBackArchiveFileName is the name of the file which records the archive which the live database
+// has been switched back from to a retained generation.
+const RolledBackArchiveFileName = "rolled-back-archive.json"
+
+func (m *Migrator) installedArchivePath() string {
+	return filepath.Join(m.root, InstalledArchiveFileName)
+}
+
+func (m *Migrator) rolledBackArchivePath() string {
+	return filepath.Join(m.root, RolledBackArchiveFileName)
+}
+
+// InstalledArchive returns the archive which the live database was downloaded from.
+// nil is returned if it is unknown, such as the database has been uploaded or switched to a generation since then.
+func (m *Migrator) InstalledArchive() (*InstalledArchive, error) {
+	archive, err := readArchiveRecord(m.installedArchivePath())
+	if err != nil {
+		return nil, fmt.Errorf("photondata.Migrator.InstalledArchive: %w", err)
+	}
+	return archive, nil
+}
+
+// SetInstalledArchive records the archive which the live database has been downloaded from.
+// It must be called after the migration of the database from the archive has completed,
+// since every completed migration forgets the archive of the previous database.
+// The archive rolled back from is forgotten, since a newer archive or the same one on purpose has been installed.
+func (m *Migrator) SetInstalledArchive(archive InstalledArchive) error {
+	if err := writeArchiveRecord(m.installedArchivePath(), archive); err != nil {
+		return fmt.Errorf("photondata.Migrator.SetInstalledArchive: %w", err)
+	}
+	if err := os.Remove(m.rolledBackArchivePath()); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("photondata.Migrator.SetInstalledArchive: failed to remove rolled back archive: %w", err)
+	}
+	return nil
+}
+
+// RolledBackArchive returns the archive which the live database has been switched back from to a retained generation.
+// nil is returned if there is none, or a database has been installed from an archive since then.
+func (m *Migrator) RolledBackArchive() (*InstalledArchive, error) {
+	archive, err := readArchiveRecord(m.rolledBackArchivePath())
+	if err != nil {
+		return nil, fmt.Errorf("photondata.Migrator.RolledBackArchive: %w", err)
+	}
+	return archive, nil
+}
+
+// SetRolledBackArchive records the archive which the live database has been switched back from,
+// so that it is not installed again by the freshness check.
+func (m *Migrator) SetRolledBackArchive(archive InstalledArchive) error {
+	if err := writeArchiveRecord(m.rolledBackArchivePath(), archive); err != nil {
+		return fmt.Errorf("photondata.Migrator.SetRolledBackArchive: %w", err)
+	}
+	return nil
+}
+
+// readArchiveRecord reads the archive recorded in the file. nil is returned if it does not exist.
+func readArchiveRecord(path string) (*InstalledArchive, error) {
+	archiveBytes, err := os.ReadFile(path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to read: %w", err)
+	}
+	var archive InstalledArchive
+	if err := json.Unmarshal(archiveBytes, &archive); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal: %w", err)
+	}
+	return &archive, nil
+}
+
+// writeArchiveRecord writes the archive to the file atomically.
+func writeArchiveRecord(path string, archive InstalledArchive) error {
+	archiveBytes, err := json.MarshalIndent(archive, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal: %w", err)
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return fmt.Errorf("failed to create directory: %w", err)
+	}
+	tmpPath := path + ".tmp"
+	if err := os.WriteFile(tmpPath, archiveBytes, 0644); err != nil {
+		return fmt.Errorf("failed to write: %w", err)
+	}
+	if err := os.Rename(tmpPath, path); err != nil {
+		return fmt.Errorf("failed to rename: %w", err)
+	}
+	return nil
+}
+
+// forgetInstalledArchive removes the record of the archive once the live database has been replaced.
+// Failing to remove is logged, since it must not fail the migration itself.
+func (m *Migrator) forgetInstalledArchive(ctx context.Context) {
+	if err := os.Remove(m.installedArchivePath()); err != nil && !errors.Is(err, os.ErrNotExist) {
+		logging.FromContext(ctx).WarnContext(ctx, "failed to remove installed archive", "path", m.installedArchivePath(), "error", err)
+	}
+}
@@ -0,0 +1,112 @@
+package photondata_test
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/pddg/photon-container/internal/photondata"
+)
+
+func Test_Migrator_InstalledArchive(t *testing.T) {
+	t.Parallel()
+	t.Run("unknown by default", func(t *testing.T) {
+		t.Parallel()
+		// Setup
+		destDataDir, _ := setupDestDir(t)
+		migrator := photondata.NewMigrator(destDataDir, http.DefaultClient)
+
+		// Exercise
+		got, err := migrator.InstalledArchive()
+
+		// Verify
+		require.NoError(t, err)
+		assert.Nil(t, got)
+	})
+	t.Run("recorded after migration", func(t *testing.T) {
+		t.Parallel()
+		// Setup
+		destDataDir, _ := setupDestDir(t)
+		migrator := photondata.NewMigrator(destDataDir, http.DefaultClient)
+		migrateAndCommit(t, migrator, "src")
+		want := photondata.InstalledArchive{
+			URL:          "https://example.com/photon-db.tar.bz2",
+			LastModified: time.Date(2025, 10, 1, 0, 0, 0, 0, time.UTC),
+			ETag:         `"abc"`,
+			Checksum:     "md5:0123456789abcdef0123456789abcdef",
+			InstalledAt:  time.Date(2025, 10, 2, 0, 0, 0, 0, time.UTC),
+		}
+
+		// Exercise
+		require.NoError(t, migrator.SetInstalledArchive(want))
+
+		// Verify
+		got, err := migrator.InstalledArchive()
+		require.NoError(t, err)
+		require.NotNil(t, got)
+		assert.Equal(t, want, *got)
+		// It survives a restart of the agent.
+		recovered := photondata.NewMigrator(destDataDir, http.DefaultClient)
+		got, err = recovered.InstalledArchive()
+		require.NoError(t, err)
+		require.NotNil(t, got)
+		assert.Equal(t, want, *got)
+	})
+	t.Run("forgotten by the next migration", func(t *testing.T) {
+		t.Parallel()
+		// Setup
+		destDataDir, _ := setupDestDir(t)
+		migrator := photondata.NewMigrator(destDataDir, http.DefaultClient)
+		require.NoError(t, migrator.SetInstalledArchive(photondata.InstalledArchive{URL: "https://example.com/photon-db.tar.bz2"}))
+
+		// Exercise
+		migrateAndCommit(t, migrator, "src")
+
+		// Verify
+		got, err := migrator.InstalledArchive()
+		require.NoError(t, err)
+		assert.Nil(t, got)
+	})
+}
+
+func Test_Migrator_RolledBackArchive(t *testing.T) {
+	t.Parallel()
+	t.Run("kept across migrations", func(t *testing.T) {
+		t.Parallel()
+		// Setup
+		destDataDir, _ := setupDestDir(t)
+		migrator := photondata.NewMigrator(destDataDir, http.DefaultClient)
+		want := photondata.InstalledArchive{
+			URL:  "https://example.com/photon-db.tar.bz2",
+			ETag: `"abc"`,
+		}
+
+		// Exercise
+		require.NoError(t, migrator.SetRolledBackArchive(want))
+		migrateAndCommit(t, migrator, "src")
+
+		// Verify
+		got, err := migrator.RolledBackArchive()
+		require.NoError(t, err)
+		require.NotNil(t, got)
+		assert.Equal(t, want, *got)
+	})
+	t.Run("forgotten when an archive is installed", func(t *testing.T) {
+		t.Parallel()
+		// Setup
+		destDataDir, _ := setupDestDir(t)
+		migrator := photondata.NewMigrator(destDataDir, http.DefaultClient)
+		require.NoError(t, migrator.SetRolledBackArchive(photondata.InstalledArchive{URL: "https://example.com/photon-db.tar.bz2"}))
+
+		// Exercise
+		require.NoError(t, migrator.SetInstalledArchive(photondata.InstalledArchive{URL: "https://example.com/photon-db.tar.bz2"}))
+
+		// Verify
+		got, err := migrator.RolledBackArchive()
+		require.NoError(t, err)
+		assert.Nil(t, got)
+	})
+}
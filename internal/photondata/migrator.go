@@ -3,6 +3,7 @@ package photondata
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
@@ -12,44 +13,79 @@ import (
 	"sync"
 	"time"
 
+	"github.com/pddg/photon-container/internal/fsutil"
 	"github.com/pddg/photon-container/internal/logging"
+	"github.com/pddg/photon-container/internal/unarchiver"
 )
 
 var ErrMigrationInProgress = fmt.Errorf("migration in progress")
 
+// ErrImportNotServed is returned when Photon does not serve the new database within the timeout.
+var ErrImportNotServed = errors.New("photon does not serve the new database")
+
 type MigrationState string
 
 const (
 	MigrationStateUnknown   MigrationState = "unknown"
 	MigrationStateMigrated  MigrationState = "migrated"
 	MigrationStateMigrating MigrationState = "migrating"
+	// MigrationStateFailed means that the last migration has failed. The reason is recorded in MigrationRecord.
+	MigrationStateFailed MigrationState = "failed"
+	// MigrationStateRolledBack means that the last migration has failed and the previous database has been restored.
+	MigrationStateRolledBack MigrationState = "rolled_back"
 )
 
 var MigrationStates = []MigrationState{
 	MigrationStateUnknown,
 	MigrationStateMigrated,
 	MigrationStateMigrating,
+	MigrationStateFailed,
+	MigrationStateRolledBack,
 }
 
+// DefaultImportTimeout is the default time to wait for Photon to serve the new database.
+const DefaultImportTimeout = 10 * time.Minute
+
+// importCheckInterval is the interval to check the status of Photon while waiting for the new database.
+const importCheckInterval = 2 * time.Second
+
 type Migrator struct {
+	// root is the Photon data directory, where the state file and the generations are stored.
+	root string
+	// dataDir is the database of the live slot. It is changed only by the blue/green migration.
 	dataDir    string
 	httpClient *http.Client
 
+	// photonURL is the URL of Photon serving the blue slot.
 	photonURL string
+	// greenPhotonURL is the URL of Photon serving the green slot. The green slot is not used if it is empty.
+	greenPhotonURL string
+	// slotMutex guards the live slot, which is read by the checks of Photon while the migration switches it.
+	slotMutex sync.Mutex
+	liveSlot  Slot
+	// importTimeout is how long to wait for Photon to serve the new database before rolling back.
+	importTimeout time.Duration
+	// retainGenerations is the number of the previous databases retained in the generations directory.
+	retainGenerations int
 
 	mutex         sync.Mutex
-	state         MigrationState
+	record        MigrationRecord
 	cachedModTime time.Time
+	// generationMutex guards the generation manifest.
+	generationMutex sync.Mutex
 }
 
 func NewMigrator(photonDataDir string, httpClient *http.Client, options ...MigratorOption) *Migrator {
 	m := &Migrator{
+		root: photonDataDir,
 		// OpenSearch compatible data directory is named as `node_1`.
 		// Elasticsearch compatible data directory is named as `elasticsearch`.
-		dataDir:    filepath.Join(photonDataDir, "node_1"),
-		httpClient: httpClient,
-		photonURL:  "http://localhost:2322/",
-		state:      MigrationStateUnknown,
+		dataDir:       filepath.Join(photonDataDir, "node_1"),
+		liveSlot:      SlotBlue,
+		httpClient:    httpClient,
+		photonURL:     "http://localhost:2322/",
+		importTimeout: DefaultImportTimeout,
+		record:        MigrationRecord{State: MigrationStateUnknown},
 	}
 	for _, option := range options {
 		option(m)
@@ -58,21 +94,53 @@ func NewMigrator(photonDataDir string, httpClient *http.Client, options ...Migra
 }
 
 func (m *Migrator) State(ctx context.Context) (MigrationState, time.Time) {
-	importTime, err := m.getVersion(ctx)
+	importTime, err := m.getVersion(ctx, m.livePhotonURL())
 	m.mutex.Lock()
 	defer m.mutex.Unlock()
 	if err != nil {
-		return m.state, m.cachedModTime
+		return m.record.State, m.cachedModTime
+	}
+	if m.record.State == MigrationStateUnknown {
+		m.record.State = MigrationStateMigrated
+	}
+	m.cachedModTime = importTime
+	return m.record.State, importTime
+}
+
+// Record returns the record of the last migration.
+func (m *Migrator) Record() MigrationRecord {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	return m.record
+}
+
+// LiveDataSize returns the total size of the live database. It is 0 if the database does not exist.
+func (m *Migrator) LiveDataSize() (int64, error) {
+	dataDir := m.slotDataDir(m.LiveSlot())
+	size, err := fsutil.DirSize(dataDir)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return 0, nil
+		}
+		return 0, fmt.Errorf("photondata.Migrator.LiveDataSize: %w", err)
 	}
-	if m.state == MigrationStateUnknown {
-		m.state = MigrationStateMigrated
+	return size, nil
+}
+
+// Ping checks that Photon reports `status: ok`, and returns the import date of the database it serves.
+func (m *Migrator) Ping(ctx context.Context) (time.Time, error) {
+	importTime, err := m.getVersion(ctx, m.livePhotonURL())
+	if err != nil {
+		return time.Time{}, fmt.Errorf("photondata.Migrator.Ping: %w", err)
 	}
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
 	m.cachedModTime = importTime
-	return m.state, importTime
+	return importTime, nil
 }
 
-func (m *Migrator) getVersion(ctx context.Context) (time.Time, error) {
-	req, err := http.NewRequestWithContext(ctx, http.MethodGet, m.photonURL+"status", nil)
+func (m *Migrator) getVersion(ctx context.Context, photonURL string) (time.Time, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, photonURL+"status", nil)
 	if err != nil {
 		return time.Time{}, err
 	}
@@ -103,66 +171,289 @@ func (m *Migrator) getVersion(ctx context.Context) (time.Time, error) {
 }
 
 func (m *Migrator) MigrateByReplace(ctx context.Context, unarchived string) error {
-	logger := logging.FromContext(ctx)
-	m.mutex.Lock()
-	if m.state == MigrationStateMigrating {
-		m.mutex.Unlock()
-		return fmt.Errorf("photondata.Migrator.MigrateByReplace: %w", ErrMigrationInProgress)
+	if err := m.begin(ctx, unarchived); err != nil {
+		return fmt.Errorf("photondata.Migrator.MigrateByReplace: %w", err)
 	}
-	m.state = MigrationStateMigrating
-	m.mutex.Unlock()
 
+	if err := m.verifyUnarchived(ctx, unarchived); err != nil {
+		m.finish(ctx, MigrationStateFailed, err.Error())
+		return fmt.Errorf("photondata.Migrator.MigrateByReplace: %w", err)
+	}
+	if err := m.swap(ctx, filepath.Join(unarchived, "photon_data", "node_1")); err != nil {
+		return fmt.Errorf("photondata.Migrator.MigrateByReplace: %w", err)
+	}
+	return nil
+}
+
+// swap moves the existing database to `node_1.old` and the new one in.
+// The old one is restored if the new one can not be moved in.
+func (m *Migrator) swap(ctx context.Context, newDataDir string) error {
+	logger := logging.FromContext(ctx)
+	m.setPhase(ctx, MigrationPhaseSwapping)
 	oldDir := m.dataDir + ".old"
 	if err := os.Rename(m.dataDir, oldDir); err != nil {
-		return fmt.Errorf("photondata.Migrator.MigrateByReplace: failed to rename %q to %q: %w", m.dataDir, oldDir, err)
+		err = fmt.Errorf("failed to rename %q to %q: %w", m.dataDir, oldDir, err)
+		m.finish(ctx, MigrationStateFailed, err.Error())
+		return err
 	}
 
-	unarchivedDataDir := filepath.Join(unarchived, "photon_data", "node_1")
-	if err := os.Rename(unarchivedDataDir, m.dataDir); err != nil {
+	if err := os.Rename(newDataDir, m.dataDir); err != nil {
+		err = fmt.Errorf("failed to rename %q to %q: %w", newDataDir, m.dataDir, err)
 		if renameErr := os.Rename(oldDir, m.dataDir); renameErr != nil {
 			logger.WarnContext(ctx, "failed to restore old database", "path", oldDir, "error", renameErr)
+			m.finish(ctx, MigrationStateFailed, fmt.Sprintf("%s, and failed to restore the old database: %s", err, renameErr))
+		} else {
+			m.finish(ctx, MigrationStateRolledBack, err.Error())
 		}
-		return fmt.Errorf("photondata.Migrator.MigrateByReplace: failed to rename %q to %q: %w", unarchivedDataDir, m.dataDir, err)
+		return err
 	}
-	if err := os.RemoveAll(oldDir); err != nil {
-		logger.WarnContext(ctx, "failed to remove old database", "path", oldDir, "error", err)
+	// The old database is kept until Photon serves the new one. See CommitReplace and RollbackReplace.
+	m.setPhase(ctx, MigrationPhaseConfirming)
+	return nil
+}
+
+// WaitForImport waits until Photon reports `status: ok` with the import date
+// which is not older than the one served before the migration.
+// When a generation is activated, the import date must be the one recorded for it instead.
+// ErrImportNotServed is returned if it does not happen within the timeout set by WithImportTimeout.
+func (m *Migrator) WaitForImport(ctx context.Context) error {
+	if err := m.waitForImport(ctx, m.livePhotonURL()); err != nil {
+		return fmt.Errorf("photondata.Migrator.WaitForImport: %w", err)
 	}
-	m.mutex.Lock()
-	defer m.mutex.Unlock()
-	m.state = MigrationStateMigrated
 	return nil
 }
 
-func (m *Migrator) MigrateByRemoveFirst(ctx context.Context, unarchived string) (func() error, error) {
+// waitForImport waits until Photon at the URL serves the new database.
+func (m *Migrator) waitForImport(ctx context.Context, photonURL string) error {
+	logger := logging.FromContext(ctx)
 	m.mutex.Lock()
-	if m.state == MigrationStateMigrating {
-		m.mutex.Unlock()
-		return nil, fmt.Errorf("photondata.Migrator.MigrateByRemoveFirst: %w", ErrMigrationInProgress)
+	record := m.record
+	m.mutex.Unlock()
+	var previous, expected time.Time
+	if record.PreviousImportDate != nil {
+		previous = *record.PreviousImportDate
+	}
+	if record.Generation != "" {
+		generation, err := m.findGeneration(record.Generation)
+		if err != nil {
+			return err
+		}
+		// The generation is older than the database served before the migration.
+		previous = time.Time{}
+		if generation.ImportDate != nil {
+			expected = *generation.ImportDate
+		}
 	}
-	m.state = MigrationStateMigrating
+	ctx, cancel := context.WithTimeout(ctx, m.importTimeout)
+	defer cancel()
+	ticker := time.NewTicker(importCheckInterval)
+	defer ticker.Stop()
+	var lastErr error
+	for {
+		importTime, err := m.getVersion(ctx, photonURL)
+		switch {
+		case err != nil:
+			lastErr = err
+		case importTime.Before(previous):
+			lastErr = fmt.Errorf("import date %s is older than the previous one %s", importTime.Format(time.RFC3339), previous.Format(time.RFC3339))
+		case !expected.IsZero() && !importTime.Equal(expected):
+			lastErr = fmt.Errorf("import date %s is not the one of the generation %s", importTime.Format(time.RFC3339), expected.Format(time.RFC3339))
+		default:
+			m.mutex.Lock()
+			m.cachedModTime = importTime
+			m.mutex.Unlock()
+			logger.InfoContext(ctx, "photon serves the new database", "import_date", importTime)
+			return nil
+		}
+		logger.DebugContext(ctx, "waiting for photon to serve the new database", "error", lastErr)
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("%w within %s: %w", ErrImportNotServed, m.importTimeout, lastErr)
+		case <-ticker.C:
+		}
+	}
+}
+
+// CommitReplace records that the migration by MigrateByReplace or MigrateToGeneration has succeeded.
+// The old database is retained as a generation if WithRetainGenerations allows, or removed otherwise.
+func (m *Migrator) CommitReplace(ctx context.Context) error {
+	m.mutex.Lock()
+	record := m.record
 	m.mutex.Unlock()
+	// Record the success first. The old database must not be restored once it is moved away.
+	m.finish(ctx, MigrationStateMigrated, "")
+	if record.Generation != "" {
+		// The activated generation is the current database now.
+		if err := m.forgetGeneration(record.Generation); err != nil {
+			logging.FromContext(ctx).WarnContext(ctx, "failed to remove activated generation from manifest", "id", record.Generation, "error", err)
+		}
+	}
+	if err := m.retainOld(ctx, m.dataDir+".old", record.PreviousImportDate); err != nil {
+		return fmt.Errorf("photondata.Migrator.CommitReplace: %w", err)
+	}
+	return nil
+}
+
+// RollbackReplace discards the new database moved in by MigrateByReplace and restores the old one.
+// The generation moved in by MigrateToGeneration is put back instead of being discarded.
+// Photon must be stopped before it is called.
+func (m *Migrator) RollbackReplace(ctx context.Context, reason string) error {
+	logger := logging.FromContext(ctx)
+	oldDir := m.dataDir + ".old"
+	rollbackDir := m.dataDir + ".rollback"
+	m.mutex.Lock()
+	generation := m.record.Generation
+	m.mutex.Unlock()
+	if generation != "" {
+		rollbackDir = m.generationDir(generation)
+	}
+	if err := os.Rename(m.dataDir, rollbackDir); err != nil {
+		err = fmt.Errorf("failed to rename %q to %q: %w", m.dataDir, rollbackDir, err)
+		m.finish(ctx, MigrationStateFailed, fmt.Sprintf("%s, and failed to roll back: %s", reason, err))
+		return fmt.Errorf("photondata.Migrator.RollbackReplace: %w", err)
+	}
+	if err := os.Rename(oldDir, m.dataDir); err != nil {
+		err = fmt.Errorf("failed to rename %q to %q: %w", oldDir, m.dataDir, err)
+		if renameErr := os.Rename(rollbackDir, m.dataDir); renameErr != nil {
+			logger.WarnContext(ctx, "failed to put back new database", "path", rollbackDir, "error", renameErr)
+		}
+		m.finish(ctx, MigrationStateFailed, fmt.Sprintf("%s, and failed to roll back: %s", reason, err))
+		return fmt.Errorf("photondata.Migrator.RollbackReplace: %w", err)
+	}
+	if generation == "" {
+		if err := os.RemoveAll(rollbackDir); err != nil {
+			logger.WarnContext(ctx, "failed to remove new database", "path", rollbackDir, "error", err)
+		}
+	}
+	m.finish(ctx, MigrationStateRolledBack, reason)
+	return nil
+}
+
+func (m *Migrator) MigrateByRemoveFirst(ctx context.Context, unarchived string) (func() error, error) {
+	if err := m.begin(ctx, unarchived); err != nil {
+		return nil, fmt.Errorf("photondata.Migrator.MigrateByRemoveFirst: %w", err)
+	}
 
 	if err := os.RemoveAll(m.dataDir); err != nil {
-		return nil, fmt.Errorf("photondata.Migrator.MigrateByRemoveFirst: failed to remove %q: %w", m.dataDir, err)
+		err = fmt.Errorf("failed to remove %q: %w", m.dataDir, err)
+		m.finish(ctx, MigrationStateFailed, err.Error())
+		return nil, fmt.Errorf("photondata.Migrator.MigrateByRemoveFirst: %w", err)
 	}
+	m.setPhase(ctx, MigrationPhaseRemoved)
 	return func() error {
+		if err := m.verifyUnarchived(ctx, unarchived); err != nil {
+			m.finish(ctx, MigrationStateFailed, err.Error())
+			return fmt.Errorf("photondata.Migrator.MigrateByRemoveFirst: %w", err)
+		}
 		unarchivedDataDir := filepath.Join(unarchived, "photon_data", "node_1")
 		if err := os.Rename(unarchivedDataDir, m.dataDir); err != nil {
-			return fmt.Errorf("photondata.Migrator.MigrateByRemoveFirst: failed to rename %q to %q: %w", unarchivedDataDir, m.dataDir, err)
+			err = fmt.Errorf("failed to rename %q to %q: %w", unarchivedDataDir, m.dataDir, err)
+			m.finish(ctx, MigrationStateFailed, err.Error())
+			return fmt.Errorf("photondata.Migrator.MigrateByRemoveFirst: %w", err)
 		}
-		m.mutex.Lock()
-		defer m.mutex.Unlock()
-		m.state = MigrationStateMigrated
+		m.finish(ctx, MigrationStateMigrated, "")
 		return nil
 	}, nil
 }
 
-func (m *Migrator) ResetState(ctx context.Context) {
+// verifyUnarchived refuses the unarchived tree which has no valid completion marker,
+// since it may be an incomplete or corrupted one.
+func (m *Migrator) verifyUnarchived(ctx context.Context, unarchived string) error {
+	marker, err := unarchiver.ReadCompletionMarker(unarchived)
+	if err != nil {
+		return fmt.Errorf("refuse to promote %q: %w", unarchived, err)
+	}
+	logging.FromContext(ctx).InfoContext(ctx, "unarchived database is complete",
+		"path", unarchived,
+		"entries", marker.Entries,
+		"bytes", marker.Bytes,
+		"source_sha256", marker.SourceSHA256,
+		"resumed_offset", marker.ResumedOffset,
+		"durable", marker.Durable,
+		"completed_at", marker.CompletedAt,
+	)
 	m.mutex.Lock()
 	defer m.mutex.Unlock()
-	if _, err := m.getVersion(ctx); err != nil {
-		m.state = MigrationStateUnknown
+	m.record.SourceSHA256 = marker.SourceSHA256
+	m.save(ctx)
+	return nil
+}
+
+// begin records the beginning of the migration from the unarchived database.
+// ErrMigrationInProgress is returned if another migration is in progress.
+func (m *Migrator) begin(ctx context.Context, unarchived string) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if m.record.State == MigrationStateMigrating {
+		return ErrMigrationInProgress
+	}
+	now := time.Now().UTC()
+	m.record = MigrationRecord{
+		State:     MigrationStateMigrating,
+		Phase:     MigrationPhaseVerifying,
+		Source:    unarchived,
+		StartedAt: &now,
+	}
+	if !m.cachedModTime.IsZero() {
+		previous := m.cachedModTime
+		m.record.PreviousImportDate = &previous
+	}
+	m.save(ctx)
+	return nil
+}
+
+func (m *Migrator) setPhase(ctx context.Context, phase MigrationPhase) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.record.Phase = phase
+	m.save(ctx)
+}
+
+// Abort records that the migration in progress has been abandoned, such as by the cancel of the update.
+// It does nothing if no migration is in progress.
+func (m *Migrator) Abort(ctx context.Context, reason string) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if m.record.State != MigrationStateMigrating {
 		return
 	}
-	m.state = MigrationStateMigrated
+	m.finishLocked(ctx, MigrationStateFailed, reason)
+}
+
+// finish records the result of the migration.
+func (m *Migrator) finish(ctx context.Context, state MigrationState, reason string) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.finishLocked(ctx, state, reason)
+}
+
+func (m *Migrator) finishLocked(ctx context.Context, state MigrationState, reason string) {
+	if state == MigrationStateMigrated {
+		m.forgetInstalledArchive(ctx)
+	}
+	now := time.Now().UTC()
+	m.record.State = state
+	m.record.Phase = MigrationPhaseDone
+	m.record.Reason = reason
+	m.record.FinishedAt = &now
+	m.save(ctx)
+}
+
+// save writes the record to the state file. The caller must hold the mutex.
+// Failing to save is logged, since it must not fail the migration itself.
+func (m *Migrator) save(ctx context.Context) {
+	if err := m.saveRecord(); err != nil {
+		logging.FromContext(ctx).WarnContext(ctx, "failed to save migration state", "path", m.stateFilePath(), "error", err)
+	}
+}
+
+func (m *Migrator) ResetState(ctx context.Context) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	state := MigrationStateMigrated
+	if _, err := m.getVersion(ctx, m.livePhotonURL()); err != nil {
+		state = MigrationStateUnknown
+	}
+	m.record = MigrationRecord{State: state}
+	m.save(ctx)
 }
@@ -1,6 +1,9 @@
 package photondata
 
-import "strings"
+import (
+	"strings"
+	"time"
+)
 
 type MigratorOption func(*Migrator)
 
@@ -12,3 +15,30 @@ func WithPhotonURL(url string) MigratorOption {
 		m.photonURL = url
 	}
 }
+
+// WithGreenSlot enables the green slot served by Photon at the URL for the blue/green migration.
+// The URL must be different from the one of the blue slot set by WithPhotonURL.
+func WithGreenSlot(url string) MigratorOption {
+	if !strings.HasSuffix(url, "/") {
+		url += "/"
+	}
+	return func(m *Migrator) {
+		m.greenPhotonURL = url
+	}
+}
+
+// WithImportTimeout sets how long to wait for Photon to serve the new database before rolling back.
+// The default is DefaultImportTimeout.
+func WithImportTimeout(timeout time.Duration) MigratorOption {
+	return func(m *Migrator) {
+		m.importTimeout = timeout
+	}
+}
+
+// WithRetainGenerations sets the number of the previous databases retained to switch back to.
+// They are retained only when the disk space allows. The default is 0, which retains none.
+func WithRetainGenerations(n int) MigratorOption {
+	return func(m *Migrator) {
+		m.retainGenerations = n
+	}
+}
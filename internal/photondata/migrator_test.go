@@ -2,6 +2,7 @@ package photondata_test
 
 import (
 	"encoding/json"
+	"errors"
 	"net/http"
 	"net/http/httptest"
 	"os"
@@ -14,6 +15,7 @@ import (
 	"github.com/stretchr/testify/require"
 
 	"github.com/pddg/photon-container/internal/photondata"
+	"github.com/pddg/photon-container/internal/unarchiver"
 )
 
 type mockPhotonServer struct {
@@ -78,6 +80,7 @@ func setupSrcDir(t *testing.T) string {
 	require.NoError(t, os.MkdirAll(srcOpenSearchDir, 0755))
 	srcFile := filepath.Join(srcOpenSearchDir, "hello.txt")
 	require.NoError(t, os.WriteFile(srcFile, []byte("src"), 0644))
+	require.NoError(t, unarchiver.WriteCompletionMarker(srcDir, unarchiver.CompletionMarker{Entries: 4, Bytes: 3}))
 	return srcDir
 }
 
@@ -106,6 +109,11 @@ func Test_Migrator_MigrateByReplace(t *testing.T) {
 		got, err := os.ReadFile(destFile)
 		require.NoError(t, err)
 		assert.Equal(t, "src", string(got))
+		// The old database is kept until the migration is committed or rolled back.
+		assert.DirExists(t, filepath.Join(destDataDir, "node_1.old"))
+		record := migrator.Record()
+		assert.Equal(t, photondata.MigrationStateMigrating, record.State)
+		assert.Equal(t, photondata.MigrationPhaseConfirming, record.Phase)
 	})
 	t.Run("recover when failed to rename", func(t *testing.T) {
 		t.Parallel()
@@ -120,6 +128,7 @@ func Test_Migrator_MigrateByReplace(t *testing.T) {
 		// Migrate will fail because the source directory is empty
 		srcDir := filepath.Join(t.TempDir(), "src")
 		require.NoError(t, os.MkdirAll(srcDir, 0755))
+		require.NoError(t, unarchiver.WriteCompletionMarker(srcDir, unarchiver.CompletionMarker{}))
 
 		migrator := photondata.NewMigrator(destDataDir, srv.Client(), photondata.WithPhotonURL(srv.URL))
 
@@ -132,6 +141,35 @@ func Test_Migrator_MigrateByReplace(t *testing.T) {
 		require.NoError(t, err)
 		// The file should not be replaced
 		assert.Equal(t, "dest", string(got))
+		record := migrator.Record()
+		assert.Equal(t, photondata.MigrationStateRolledBack, record.State)
+		assert.NotEmpty(t, record.Reason)
+	})
+	t.Run("refuse tree without completion marker", func(t *testing.T) {
+		t.Parallel()
+		// Setup
+		now := time.Now()
+		mockPhoton := newMockPhotonServer(now, nil)
+		srv := httptest.NewServer(mockPhoton)
+		defer srv.Close()
+
+		// Setup files to be replaced
+		destDataDir, destFile := setupDestDir(t)
+		// Setup source files and remove the marker as if the extraction was interrupted
+		srcDir := setupSrcDir(t)
+		require.NoError(t, os.Remove(filepath.Join(srcDir, unarchiver.CompletionMarkerName)))
+
+		migrator := photondata.NewMigrator(destDataDir, srv.Client(), photondata.WithPhotonURL(srv.URL))
+
+		// Exercise
+		err := migrator.MigrateByReplace(t.Context(), srcDir)
+
+		// Verify
+		require.ErrorIs(t, err, unarchiver.ErrNoCompletionMarker)
+		got, err := os.ReadFile(destFile)
+		require.NoError(t, err)
+		// The file should not be replaced
+		assert.Equal(t, "dest", string(got))
 	})
 	t.Run("migration blocked when it is in progress", func(t *testing.T) {
 		t.Parallel()
@@ -143,15 +181,146 @@ func Test_Migrator_MigrateByReplace(t *testing.T) {
 		migrator := photondata.NewMigrator(t.TempDir(), srv.Client(), photondata.WithPhotonURL(srv.URL))
 
 		// Exercise
-		// First migration. It should NOT be succeeded.
-		err := migrator.MigrateByReplace(t.Context(), t.TempDir())
-		require.Error(t, err)
+		// First migration. Do not call actual migration function to keep it in progress.
+		_, err := migrator.MigrateByRemoveFirst(t.Context(), t.TempDir())
+		require.NoError(t, err)
 		// Second migration. It should be blocked.
 		err = migrator.MigrateByReplace(t.Context(), t.TempDir())
 
 		// Verify
 		require.ErrorIs(t, err, photondata.ErrMigrationInProgress)
 	})
+	t.Run("failed migration does not block the next one", func(t *testing.T) {
+		t.Parallel()
+		// Setup
+		now := time.Now()
+		mockPhoton := newMockPhotonServer(now, nil)
+		srv := httptest.NewServer(mockPhoton)
+		defer srv.Close()
+		destDataDir, destFile := setupDestDir(t)
+		migrator := photondata.NewMigrator(destDataDir, srv.Client(), photondata.WithPhotonURL(srv.URL))
+		// First migration. It should fail since there is no completion marker.
+		err := migrator.MigrateByReplace(t.Context(), t.TempDir())
+		require.Error(t, err)
+		state, _ := migrator.State(t.Context())
+		require.Equal(t, photondata.MigrationStateFailed, state)
+
+		// Exercise
+		err = migrator.MigrateByReplace(t.Context(), setupSrcDir(t))
+
+		// Verify
+		require.NoError(t, err)
+		got, err := os.ReadFile(destFile)
+		require.NoError(t, err)
+		assert.Equal(t, "src", string(got))
+	})
+}
+
+func Test_Migrator_WaitForImport(t *testing.T) {
+	t.Parallel()
+	t.Run("normal", func(t *testing.T) {
+		t.Parallel()
+		// Setup
+		previous := time.Now().Add(-time.Hour).Truncate(time.Second)
+		mockPhoton := newMockPhotonServer(previous, nil)
+		srv := httptest.NewServer(mockPhoton)
+		defer srv.Close()
+		destDataDir, _ := setupDestDir(t)
+		migrator := photondata.NewMigrator(destDataDir, srv.Client(), photondata.WithPhotonURL(srv.URL))
+		// Cache the import date of the existing database
+		state, _ := migrator.State(t.Context())
+		require.Equal(t, photondata.MigrationStateMigrated, state)
+		require.NoError(t, migrator.MigrateByReplace(t.Context(), setupSrcDir(t)))
+		mockPhoton.Set(previous.Add(time.Hour), nil)
+
+		// Exercise
+		err := migrator.WaitForImport(t.Context())
+
+		// Verify
+		require.NoError(t, err)
+	})
+	t.Run("older import date", func(t *testing.T) {
+		t.Parallel()
+		// Setup
+		previous := time.Now().Truncate(time.Second)
+		mockPhoton := newMockPhotonServer(previous, nil)
+		srv := httptest.NewServer(mockPhoton)
+		defer srv.Close()
+		destDataDir, _ := setupDestDir(t)
+		migrator := photondata.NewMigrator(destDataDir, srv.Client(),
+			photondata.WithPhotonURL(srv.URL),
+			photondata.WithImportTimeout(100*time.Millisecond),
+		)
+		state, _ := migrator.State(t.Context())
+		require.Equal(t, photondata.MigrationStateMigrated, state)
+		require.NoError(t, migrator.MigrateByReplace(t.Context(), setupSrcDir(t)))
+		mockPhoton.Set(previous.Add(-time.Hour), nil)
+
+		// Exercise
+		err := migrator.WaitForImport(t.Context())
+
+		// Verify
+		require.ErrorIs(t, err, photondata.ErrImportNotServed)
+	})
+	t.Run("photon server does not work", func(t *testing.T) {
+		t.Parallel()
+		// Setup
+		mockPhoton := newMockPhotonServer(time.Now(), errors.New("test"))
+		srv := httptest.NewServer(mockPhoton)
+		defer srv.Close()
+		destDataDir, _ := setupDestDir(t)
+		migrator := photondata.NewMigrator(destDataDir, srv.Client(),
+			photondata.WithPhotonURL(srv.URL),
+			photondata.WithImportTimeout(100*time.Millisecond),
+		)
+
+		// Exercise
+		err := migrator.WaitForImport(t.Context())
+
+		// Verify
+		require.ErrorIs(t, err, photondata.ErrImportNotServed)
+	})
+}
+
+func Test_Migrator_CommitReplace(t *testing.T) {
+	t.Parallel()
+	// Setup
+	destDataDir, destFile := setupDestDir(t)
+	migrator := photondata.NewMigrator(destDataDir, http.DefaultClient)
+	require.NoError(t, migrator.MigrateByReplace(t.Context(), setupSrcDir(t)))
+
+	// Exercise
+	err := migrator.CommitReplace(t.Context())
+
+	// Verify
+	require.NoError(t, err)
+	got, err := os.ReadFile(destFile)
+	require.NoError(t, err)
+	assert.Equal(t, "src", string(got))
+	assert.NoDirExists(t, filepath.Join(destDataDir, "node_1.old"))
+	assert.Equal(t, photondata.MigrationStateMigrated, migrator.Record().State)
+}
+
+func Test_Migrator_RollbackReplace(t *testing.T) {
+	t.Parallel()
+	// Setup
+	destDataDir, destFile := setupDestDir(t)
+	migrator := photondata.NewMigrator(destDataDir, http.DefaultClient)
+	require.NoError(t, migrator.MigrateByReplace(t.Context(), setupSrcDir(t)))
+
+	// Exercise
+	err := migrator.RollbackReplace(t.Context(), "test")
+
+	// Verify
+	require.NoError(t, err)
+	got, err := os.ReadFile(destFile)
+	require.NoError(t, err)
+	assert.Equal(t, "dest", string(got))
+	assert.NoDirExists(t, filepath.Join(destDataDir, "node_1.old"))
+	assert.NoDirExists(t, filepath.Join(destDataDir, "node_1.rollback"))
+	record := migrator.Record()
+	assert.Equal(t, photondata.MigrationStateRolledBack, record.State)
+	assert.Equal(t, "test", record.Reason)
 }
 
 func Test_Migrator_MigrateByRemoveFirst(t *testing.T) {
@@ -188,6 +357,32 @@ func Test_Migrator_MigrateByRemoveFirst(t *testing.T) {
 		require.NoError(t, err)
 		assert.Equal(t, "src", string(got))
 	})
+	t.Run("refuse tree without completion marker", func(t *testing.T) {
+		t.Parallel()
+		// Setup
+		now := time.Now()
+		mockPhoton := newMockPhotonServer(now, nil)
+		srv := httptest.NewServer(mockPhoton)
+		defer srv.Close()
+
+		// Setup files to be removed
+		destDataDir, _ := setupDestDir(t)
+		// Setup source files with a broken marker
+		srcDir := setupSrcDir(t)
+		require.NoError(t, os.WriteFile(filepath.Join(srcDir, unarchiver.CompletionMarkerName), []byte("{"), 0644))
+
+		migrator := photondata.NewMigrator(destDataDir, srv.Client(), photondata.WithPhotonURL(srv.URL))
+		runMigration, err := migrator.MigrateByRemoveFirst(t.Context(), srcDir)
+		require.NoError(t, err)
+
+		// Exercise
+		err = runMigration()
+
+		// Verify
+		require.ErrorIs(t, err, unarchiver.ErrNoCompletionMarker)
+		_, err = os.Stat(filepath.Join(srcDir, "photon_data", "node_1", "hello.txt"))
+		require.NoError(t, err)
+	})
 	t.Run("migration blocked when it is in progress", func(t *testing.T) {
 		t.Parallel()
 		// Setup
@@ -254,6 +449,40 @@ func Test_Migrator_State(t *testing.T) {
 	})
 }
 
+func Test_Migrator_Ping(t *testing.T) {
+	t.Parallel()
+	t.Run("normal", func(t *testing.T) {
+		t.Parallel()
+		// Setup
+		now := time.Now().UTC().Truncate(time.Second)
+		mockPhoton := newMockPhotonServer(now, nil)
+		srv := httptest.NewServer(mockPhoton)
+		defer srv.Close()
+		migrator := photondata.NewMigrator(t.TempDir(), srv.Client(), photondata.WithPhotonURL(srv.URL))
+
+		// Exercise
+		version, err := migrator.Ping(t.Context())
+
+		// Verify
+		require.NoError(t, err)
+		assert.Equal(t, now, version)
+	})
+	t.Run("error", func(t *testing.T) {
+		t.Parallel()
+		// Setup
+		mockPhoton := newMockPhotonServer(time.Time{}, assert.AnError)
+		srv := httptest.NewServer(mockPhoton)
+		defer srv.Close()
+		migrator := photondata.NewMigrator(t.TempDir(), srv.Client(), photondata.WithPhotonURL(srv.URL))
+
+		// Exercise
+		_, err := migrator.Ping(t.Context())
+
+		// Verify
+		require.Error(t, err)
+	})
+}
+
 func Test_Migrator_ResetState(t *testing.T) {
 	t.Parallel()
 	t.Run("photon server works", func(t *testing.T) {
@@ -265,7 +494,7 @@ func Test_Migrator_ResetState(t *testing.T) {
 		defer srv.Close()
 
 		migrator := photondata.NewMigrator(t.TempDir(), srv.Client(), photondata.WithPhotonURL(srv.URL))
-		// Fail the migration to set the state to migrating
+		// Fail the migration to set the state to failed
 		err := migrator.MigrateByReplace(t.Context(), t.TempDir())
 		require.Error(t, err)
 
@@ -285,7 +514,7 @@ func Test_Migrator_ResetState(t *testing.T) {
 		defer srv.Close()
 
 		migrator := photondata.NewMigrator(t.TempDir(), srv.Client(), photondata.WithPhotonURL(srv.URL))
-		// Fail the migration to set the state to migrating
+		// Fail the migration to set the state to failed
 		err := migrator.MigrateByReplace(t.Context(), t.TempDir())
 		require.Error(t, err)
 
@@ -298,3 +527,187 @@ func Test_Migrator_ResetState(t *testing.T) {
 		assert.Equal(t, time.Time{}, version)
 	})
 }
+
+func writeState(t *testing.T, photonDataDir string, record photondata.MigrationRecord) {
+	t.Helper()
+	recordBytes, err := json.Marshal(record)
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(filepath.Join(photonDataDir, photondata.StateFileName), recordBytes, 0644))
+}
+
+func Test_Migrator_Recover(t *testing.T) {
+	t.Parallel()
+	testCases := []struct {
+		name string
+		// setup prepares the directories left by the interrupted migration and returns the state to persist.
+		setup     func(t *testing.T, photonDataDir, srcDir string) photondata.MigrationRecord
+		wantState photondata.MigrationState
+		// wantContent is the content of hello.txt in node_1. Empty means that node_1 does not exist.
+		wantContent string
+	}{
+		{
+			name: "no state file",
+			setup: func(t *testing.T, photonDataDir, srcDir string) photondata.MigrationRecord {
+				require.NoError(t, os.Remove(filepath.Join(photonDataDir, photondata.StateFileName)))
+				return photondata.MigrationRecord{}
+			},
+			wantState:   photondata.MigrationStateUnknown,
+			wantContent: "dest",
+		},
+		{
+			name: "roll back interrupted swap",
+			setup: func(t *testing.T, photonDataDir, srcDir string) photondata.MigrationRecord {
+				require.NoError(t, os.Rename(filepath.Join(photonDataDir, "node_1"), filepath.Join(photonDataDir, "node_1.old")))
+				return photondata.MigrationRecord{State: photondata.MigrationStateMigrating, Phase: photondata.MigrationPhaseSwapping, Source: srcDir}
+			},
+			wantState:   photondata.MigrationStateRolledBack,
+			wantContent: "dest",
+		},
+		{
+			name: "complete swap",
+			setup: func(t *testing.T, photonDataDir, srcDir string) photondata.MigrationRecord {
+				require.NoError(t, os.Rename(filepath.Join(photonDataDir, "node_1"), filepath.Join(photonDataDir, "node_1.old")))
+				require.NoError(t, os.Rename(filepath.Join(srcDir, "photon_data", "node_1"), filepath.Join(photonDataDir, "node_1")))
+				return photondata.MigrationRecord{State: photondata.MigrationStateMigrating, Phase: photondata.MigrationPhaseConfirming, Source: srcDir}
+			},
+			wantState:   photondata.MigrationStateRolledBack,
+			wantContent: "dest",
+		},
+		{
+			name: "remove old database after commit",
+			setup: func(t *testing.T, photonDataDir, srcDir string) photondata.MigrationRecord {
+				require.NoError(t, os.Rename(filepath.Join(photonDataDir, "node_1"), filepath.Join(photonDataDir, "node_1.old")))
+				require.NoError(t, os.Rename(filepath.Join(srcDir, "photon_data", "node_1"), filepath.Join(photonDataDir, "node_1")))
+				return photondata.MigrationRecord{State: photondata.MigrationStateMigrated, Phase: photondata.MigrationPhaseDone, Source: srcDir}
+			},
+			wantState:   photondata.MigrationStateMigrated,
+			wantContent: "src",
+		},
+		{
+			name: "remove interrupted rollback",
+			setup: func(t *testing.T, photonDataDir, srcDir string) photondata.MigrationRecord {
+				require.NoError(t, os.Rename(filepath.Join(srcDir, "photon_data", "node_1"), filepath.Join(photonDataDir, "node_1.rollback")))
+				return photondata.MigrationRecord{State: photondata.MigrationStateMigrating, Phase: photondata.MigrationPhaseConfirming, Source: srcDir}
+			},
+			wantState:   photondata.MigrationStateRolledBack,
+			wantContent: "dest",
+		},
+		{
+			name: "resume after removal",
+			setup: func(t *testing.T, photonDataDir, srcDir string) photondata.MigrationRecord {
+				require.NoError(t, os.RemoveAll(filepath.Join(photonDataDir, "node_1")))
+				return photondata.MigrationRecord{State: photondata.MigrationStateMigrating, Phase: photondata.MigrationPhaseRemoved, Source: srcDir}
+			},
+			wantState:   photondata.MigrationStateMigrated,
+			wantContent: "src",
+		},
+		{
+			name: "fail after removal without complete tree",
+			setup: func(t *testing.T, photonDataDir, srcDir string) photondata.MigrationRecord {
+				require.NoError(t, os.RemoveAll(filepath.Join(photonDataDir, "node_1")))
+				require.NoError(t, os.Remove(filepath.Join(srcDir, unarchiver.CompletionMarkerName)))
+				return photondata.MigrationRecord{State: photondata.MigrationStateMigrating, Phase: photondata.MigrationPhaseRemoved, Source: srcDir}
+			},
+			wantState: photondata.MigrationStateFailed,
+		},
+		{
+			name: "fail while verifying",
+			setup: func(t *testing.T, photonDataDir, srcDir string) photondata.MigrationRecord {
+				return photondata.MigrationRecord{State: photondata.MigrationStateMigrating, Phase: photondata.MigrationPhaseVerifying, Source: srcDir}
+			},
+			wantState:   photondata.MigrationStateFailed,
+			wantContent: "dest",
+		},
+		{
+			name: "keep finished state",
+			setup: func(t *testing.T, photonDataDir, srcDir string) photondata.MigrationRecord {
+				return photondata.MigrationRecord{State: photondata.MigrationStateRolledBack, Phase: photondata.MigrationPhaseDone, Reason: "test"}
+			},
+			wantState:   photondata.MigrationStateRolledBack,
+			wantContent: "dest",
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+			// Setup
+			photonDataDir, _ := setupDestDir(t)
+			srcDir := filepath.Join(photonDataDir, "temp")
+			require.NoError(t, os.Rename(setupSrcDir(t), srcDir))
+			writeState(t, photonDataDir, photondata.MigrationRecord{State: photondata.MigrationStateMigrated})
+			if record := tc.setup(t, photonDataDir, srcDir); record.State != "" {
+				writeState(t, photonDataDir, record)
+			}
+			migrator := photondata.NewMigrator(photonDataDir, http.DefaultClient)
+
+			// Exercise
+			err := migrator.Recover(t.Context(), srcDir)
+
+			// Verify
+			require.NoError(t, err)
+			assert.Equal(t, tc.wantState, migrator.Record().State)
+			assert.NoDirExists(t, filepath.Join(photonDataDir, "node_1.old"))
+			assert.NoDirExists(t, filepath.Join(photonDataDir, "node_1.rollback"))
+			assert.NoDirExists(t, srcDir)
+			if tc.wantContent == "" {
+				assert.NoDirExists(t, filepath.Join(photonDataDir, "node_1"))
+			} else {
+				got, err := os.ReadFile(filepath.Join(photonDataDir, "node_1", "hello.txt"))
+				require.NoError(t, err)
+				assert.Equal(t, tc.wantContent, string(got))
+			}
+			if tc.wantState == photondata.MigrationStateRolledBack || tc.wantState == photondata.MigrationStateFailed {
+				assert.NotEmpty(t, migrator.Record().Reason)
+			}
+			// The recovered state is persisted.
+			recovered := photondata.NewMigrator(photonDataDir, http.DefaultClient)
+			require.NoError(t, recovered.Recover(t.Context(), srcDir))
+			assert.Equal(t, tc.wantState, recovered.Record().State)
+		})
+	}
+	t.Run("keep temp directory to resume upload", func(t *testing.T) {
+		t.Parallel()
+		// Setup
+		photonDataDir, _ := setupDestDir(t)
+		tempDir := filepath.Join(photonDataDir, "temp")
+		require.NoError(t, os.MkdirAll(tempDir, 0755))
+		require.NoError(t, os.WriteFile(filepath.Join(tempDir, unarchiver.CheckpointName), []byte(`{"version":1,"offset":512}`), 0644))
+		migrator := photondata.NewMigrator(photonDataDir, http.DefaultClient)
+
+		// Exercise
+		err := migrator.Recover(t.Context(), tempDir)
+
+		// Verify
+		require.NoError(t, err)
+		assert.FileExists(t, filepath.Join(tempDir, unarchiver.CheckpointName))
+	})
+}
+
+func Test_Migrator_LiveDataSize(t *testing.T) {
+	t.Parallel()
+	t.Run("live database", func(t *testing.T) {
+		t.Parallel()
+		// Setup
+		destDataDir, _ := setupDestDir(t)
+		migrator := photondata.NewMigrator(destDataDir, http.DefaultClient)
+
+		// Exercise
+		size, err := migrator.LiveDataSize()
+
+		// Verify
+		require.NoError(t, err)
+		assert.Equal(t, int64(len("dest")), size)
+	})
+	t.Run("no database", func(t *testing.T) {
+		t.Parallel()
+		// Setup
+		migrator := photondata.NewMigrator(filepath.Join(t.TempDir(), "photon_data"), http.DefaultClient)
+
+		// Exercise
+		size, err := migrator.LiveDataSize()
+
+		// Verify
+		require.NoError(t, err)
+		assert.Zero(t, size)
+	})
+}
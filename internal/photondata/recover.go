@@ -0,0 +1,198 @@
+package photondata
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/pddg/photon-container/internal/logging"
+	"github.com/pddg/photon-container/internal/unarchiver"
+)
+
+// Recover loads the persisted migration state and recovers the database left by a migration interrupted by a restart.
+// It must be called before the Photon server is started.
+//
+//   - If the existing database has been moved to `node_1.old` but the new one is not moved in, the old one is restored.
+//   - If the new one has been moved in but it was not confirmed to be served by Photon, the old one is restored.
+//   - If the migration has been committed but `node_1.old` is left, it is removed.
+//   - The new database left by an interrupted rollback in `node_1.rollback` is removed.
+//     The generation being activated is put back to the generations instead.
+//   - If the blue/green migration has not switched the live slot, the new database in the standby slot is removed.
+//     If it has, the database of the previous slot is retained or removed.
+//   - The generation manifest is made consistent with the generations directory.
+//   - If the existing database has been removed and the unarchived one is complete, it is moved in.
+//   - The temp directory is removed unless it has a checkpoint to resume the upload from.
+func (m *Migrator) Recover(ctx context.Context, tempDir string) error {
+	logger := logging.FromContext(ctx)
+	record, err := m.loadRecord()
+	if err != nil {
+		// The state file is informational. A broken one must not prevent the agent from starting.
+		logger.WarnContext(ctx, "ignore broken migration state", "path", m.stateFilePath(), "error", err)
+		record = MigrationRecord{State: MigrationStateUnknown}
+	}
+	liveSlot, err := m.loadSlot()
+	if err != nil {
+		return fmt.Errorf("photondata.Migrator.Recover: %w", err)
+	}
+	m.setLiveSlot(liveSlot)
+	oldDir := m.dataDir + ".old"
+	// The new database discarded by an interrupted rollback.
+	rollbackDir := m.dataDir + ".rollback"
+	if record.State == MigrationStateMigrating && record.Generation != "" {
+		// The generation being activated is put back instead.
+		rollbackDir = m.generationDir(record.Generation)
+	}
+	rollbackExists, err := dirExists(rollbackDir)
+	if err != nil {
+		return fmt.Errorf("photondata.Migrator.Recover: %w", err)
+	}
+	oldExists, err := dirExists(oldDir)
+	if err != nil {
+		return fmt.Errorf("photondata.Migrator.Recover: %w", err)
+	}
+	dataExists, err := dirExists(m.dataDir)
+	if err != nil {
+		return fmt.Errorf("photondata.Migrator.Recover: %w", err)
+	}
+
+	now := time.Now().UTC()
+	finish := func(state MigrationState, reason string) {
+		if state == MigrationStateMigrated {
+			m.forgetInstalledArchive(ctx)
+		}
+		record.State = state
+		record.Phase = MigrationPhaseDone
+		record.Reason = reason
+		record.FinishedAt = &now
+		logger.WarnContext(ctx, "recovered interrupted migration", "state", state, "reason", reason)
+	}
+	switch {
+	case record.State == MigrationStateMigrating && record.Slot != "":
+		if err := m.recoverStandby(ctx, record); err != nil {
+			return fmt.Errorf("photondata.Migrator.Recover: %w", err)
+		}
+		if liveSlot == record.Slot {
+			finish(MigrationStateMigrated, "")
+		} else {
+			finish(MigrationStateRolledBack, "the agent stopped before the standby Photon server served the new database. the previous database is kept")
+		}
+	case oldExists && !dataExists:
+		if err := os.Rename(oldDir, m.dataDir); err != nil {
+			return fmt.Errorf("photondata.Migrator.Recover: failed to restore %q to %q: %w", oldDir, m.dataDir, err)
+		}
+		finish(MigrationStateRolledBack, "the agent stopped while replacing the database. the previous database has been restored")
+	case rollbackExists && !oldExists && dataExists && record.State == MigrationStateMigrating:
+		// The old database had been restored, but the state was not saved.
+		finish(MigrationStateRolledBack, "the agent stopped while rolling back the database. the previous database has been restored")
+	case oldExists && dataExists && record.State == MigrationStateMigrating:
+		if err := os.Rename(m.dataDir, rollbackDir); err != nil {
+			return fmt.Errorf("photondata.Migrator.Recover: failed to rename %q to %q: %w", m.dataDir, rollbackDir, err)
+		}
+		if err := os.Rename(oldDir, m.dataDir); err != nil {
+			return fmt.Errorf("photondata.Migrator.Recover: failed to restore %q to %q: %w", oldDir, m.dataDir, err)
+		}
+		finish(MigrationStateRolledBack, "the agent stopped before Photon served the new database. the previous database has been restored")
+	case oldExists && dataExists:
+		// The migration has been committed, but the removal of the old database was interrupted.
+		if err := os.RemoveAll(oldDir); err != nil {
+			return fmt.Errorf("photondata.Migrator.Recover: failed to remove %q: %w", oldDir, err)
+		}
+	case record.State != MigrationStateMigrating:
+		// Nothing was interrupted.
+	case record.Phase == MigrationPhaseRemoved && !dataExists:
+		if err := m.resumeRemoved(ctx, record.Source); err != nil {
+			logger.WarnContext(ctx, "failed to resume interrupted migration", "source", record.Source, "error", err)
+			finish(MigrationStateFailed, "the agent stopped after the existing database was removed. run the update again")
+		} else {
+			finish(MigrationStateMigrated, "")
+		}
+	case dataExists && record.Phase != MigrationPhaseVerifying:
+		// The new database had been moved in, but the state was not saved.
+		finish(MigrationStateMigrated, "")
+	default:
+		finish(MigrationStateFailed, "interrupted by the restart of the agent")
+	}
+
+	if err := os.RemoveAll(m.dataDir + ".rollback"); err != nil {
+		return fmt.Errorf("photondata.Migrator.Recover: failed to remove %q: %w", m.dataDir+".rollback", err)
+	}
+	if err := m.cleanGenerations(ctx); err != nil {
+		// The generations are optional. They must not prevent the agent from starting.
+		logger.WarnContext(ctx, "failed to clean generations", "path", m.manifestPath(), "error", err)
+	}
+	if err := removeStaleTempDir(ctx, tempDir); err != nil {
+		return fmt.Errorf("photondata.Migrator.Recover: %w", err)
+	}
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.record = record
+	m.save(ctx)
+	return nil
+}
+
+// recoverStandby cleans up the slot which is not live after the blue/green migration was interrupted.
+// It is the new database if the live slot has not been switched, or the previous one otherwise.
+func (m *Migrator) recoverStandby(ctx context.Context, record MigrationRecord) error {
+	if m.LiveSlot() == record.Slot {
+		previousDataDir := m.slotDataDir(record.Slot.Other())
+		exists, err := dirExists(previousDataDir)
+		if err != nil || !exists {
+			// It has been retained or removed already.
+			return err
+		}
+		return m.retainOld(ctx, previousDataDir, record.PreviousImportDate)
+	}
+	standbyDataDir := m.slotDataDir(record.Slot)
+	if err := os.RemoveAll(standbyDataDir); err != nil {
+		return fmt.Errorf("failed to remove %q: %w", standbyDataDir, err)
+	}
+	return nil
+}
+
+// resumeRemoved moves the unarchived database in, if it was complete when the migration was interrupted.
+func (m *Migrator) resumeRemoved(ctx context.Context, unarchived string) error {
+	if unarchived == "" {
+		return errors.New("no unarchived database")
+	}
+	if err := m.verifyUnarchived(ctx, unarchived); err != nil {
+		return err
+	}
+	unarchivedDataDir := filepath.Join(unarchived, "photon_data", "node_1")
+	if err := os.Rename(unarchivedDataDir, m.dataDir); err != nil {
+		return fmt.Errorf("failed to rename %q to %q: %w", unarchivedDataDir, m.dataDir, err)
+	}
+	return nil
+}
+
+// removeStaleTempDir removes the temp directory left by an interrupted update.
+// It is kept if it has a checkpoint, since the upload can be resumed from it.
+func removeStaleTempDir(ctx context.Context, tempDir string) error {
+	exists, err := dirExists(tempDir)
+	if err != nil || !exists {
+		return err
+	}
+	if _, err := unarchiver.ReadCheckpoint(tempDir); err == nil {
+		logging.FromContext(ctx).InfoContext(ctx, "keep the interrupted upload to resume it", "path", tempDir)
+		return nil
+	}
+	logging.FromContext(ctx).InfoContext(ctx, "remove stale temp directory", "path", tempDir)
+	if err := os.RemoveAll(tempDir); err != nil {
+		return fmt.Errorf("failed to remove %q: %w", tempDir, err)
+	}
+	return nil
+}
+
+func dirExists(path string) (bool, error) {
+	stat, err := os.Stat(path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return false, nil
+		}
+		return false, fmt.Errorf("failed to stat %q: %w", path, err)
+	}
+	return stat.IsDir(), nil
+}
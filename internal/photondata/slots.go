@@ -0,0 +1,224 @@
+package photondata
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+
+	"github.com/pddg/photon-container/internal/logging"
+)
+
+// SlotFileName is the name of the file which records the live slot in the Photon data directory.
+const SlotFileName = "slot.json"
+
+// GreenSlotDirName is the name of the directory of the green slot in the Photon data directory.
+const GreenSlotDirName = "green"
+
+// ErrGreenSlotDisabled is returned when the blue/green migration is requested without the green slot.
+var ErrGreenSlotDisabled = errors.New("green slot is not enabled")
+
+// Slot is one of the two places where Photon can serve the database from.
+// The blue/green migration moves the new database to the slot which is not live, and switches to it
+// once a second Photon server serves it.
+type Slot string
+
+const (
+	// SlotBlue serves `photon_data/node_1`. It is live unless the blue/green migration has switched to the green one.
+	SlotBlue Slot = "blue"
+	// SlotGreen serves `photon_data/green/photon_data/node_1`.
+	SlotGreen Slot = "green"
+)
+
+// Other returns the other slot.
+func (s Slot) Other() Slot {
+	if s == SlotGreen {
+		return SlotBlue
+	}
+	return SlotGreen
+}
+
+type slotFile struct {
+	Live Slot `json:"live"`
+}
+
+// LiveSlot returns the slot serving the database.
+func (m *Migrator) LiveSlot() Slot {
+	m.slotMutex.Lock()
+	defer m.slotMutex.Unlock()
+	return m.liveSlot
+}
+
+// SlotPhotonDir returns the directory which the Photon server of the slot is started with as `-data-dir`.
+func (m *Migrator) SlotPhotonDir(slot Slot) string {
+	if slot == SlotGreen {
+		return filepath.Join(m.root, GreenSlotDirName)
+	}
+	return filepath.Dir(m.root)
+}
+
+// SlotPort returns the port which the Photon server of the slot listens on.
+// It is 0 if the URL of the slot does not have a port.
+func (m *Migrator) SlotPort(slot Slot) int {
+	u, err := url.Parse(m.slotPhotonURL(slot))
+	if err != nil {
+		return 0
+	}
+	port, err := strconv.Atoi(u.Port())
+	if err != nil {
+		return 0
+	}
+	return port
+}
+
+func (m *Migrator) slotPhotonURL(slot Slot) string {
+	if slot == SlotGreen {
+		return m.greenPhotonURL
+	}
+	return m.photonURL
+}
+
+func (m *Migrator) livePhotonURL() string {
+	return m.slotPhotonURL(m.LiveSlot())
+}
+
+func (m *Migrator) slotDataDir(slot Slot) string {
+	return filepath.Join(m.SlotPhotonDir(slot), "photon_data", "node_1")
+}
+
+func (m *Migrator) slotFilePath() string {
+	return filepath.Join(m.root, SlotFileName)
+}
+
+// MigrateToStandby moves the unarchived database to the slot which is not live, and returns the slot.
+// A second Photon server has to be started on it, and confirmed by WaitForStandby.
+// Then SwitchSlot makes it live, and CommitStandby finishes the migration. DiscardStandby abandons it instead.
+func (m *Migrator) MigrateToStandby(ctx context.Context, unarchived string) (Slot, error) {
+	if m.greenPhotonURL == "" {
+		return "", fmt.Errorf("photondata.Migrator.MigrateToStandby: %w", ErrGreenSlotDisabled)
+	}
+	if err := m.begin(ctx, unarchived); err != nil {
+		return "", fmt.Errorf("photondata.Migrator.MigrateToStandby: %w", err)
+	}
+	if err := m.verifyUnarchived(ctx, unarchived); err != nil {
+		m.finish(ctx, MigrationStateFailed, err.Error())
+		return "", fmt.Errorf("photondata.Migrator.MigrateToStandby: %w", err)
+	}
+	standby := m.LiveSlot().Other()
+	standbyDataDir := m.slotDataDir(standby)
+	// The database left in the standby slot by an interrupted migration is discarded.
+	if err := os.RemoveAll(standbyDataDir); err != nil {
+		err = fmt.Errorf("failed to remove %q: %w", standbyDataDir, err)
+		m.finish(ctx, MigrationStateFailed, err.Error())
+		return "", fmt.Errorf("photondata.Migrator.MigrateToStandby: %w", err)
+	}
+	if err := os.MkdirAll(filepath.Dir(standbyDataDir), 0755); err != nil {
+		err = fmt.Errorf("failed to create directory: %w", err)
+		m.finish(ctx, MigrationStateFailed, err.Error())
+		return "", fmt.Errorf("photondata.Migrator.MigrateToStandby: %w", err)
+	}
+	unarchivedDataDir := filepath.Join(unarchived, "photon_data", "node_1")
+	if err := os.Rename(unarchivedDataDir, standbyDataDir); err != nil {
+		err = fmt.Errorf("failed to rename %q to %q: %w", unarchivedDataDir, standbyDataDir, err)
+		m.finish(ctx, MigrationStateFailed, err.Error())
+		return "", fmt.Errorf("photondata.Migrator.MigrateToStandby: %w", err)
+	}
+	m.mutex.Lock()
+	m.record.Slot = standby
+	m.record.Phase = MigrationPhaseStandby
+	m.save(ctx)
+	m.mutex.Unlock()
+	return standby, nil
+}
+
+// WaitForStandby waits until the Photon server of the standby slot serves the new database in the same way as WaitForImport.
+func (m *Migrator) WaitForStandby(ctx context.Context) error {
+	standby := m.Record().Slot
+	if err := m.waitForImport(ctx, m.slotPhotonURL(standby)); err != nil {
+		return fmt.Errorf("photondata.Migrator.WaitForStandby: %w", err)
+	}
+	return nil
+}
+
+// SwitchSlot makes the standby slot live. The Photon server of the previous slot must be stopped after it.
+func (m *Migrator) SwitchSlot(ctx context.Context) error {
+	standby := m.Record().Slot
+	if err := m.saveSlot(standby); err != nil {
+		return fmt.Errorf("photondata.Migrator.SwitchSlot: %w", err)
+	}
+	m.setLiveSlot(standby)
+	m.setPhase(ctx, MigrationPhaseSwitched)
+	logging.FromContext(ctx).InfoContext(ctx, "switched live slot", "slot", standby)
+	return nil
+}
+
+// CommitStandby records that the blue/green migration has succeeded.
+// The database of the previous slot is retained as a generation if WithRetainGenerations allows, or removed otherwise.
+// The Photon server of the previous slot must be stopped before it is called.
+func (m *Migrator) CommitStandby(ctx context.Context) error {
+	record := m.Record()
+	m.finish(ctx, MigrationStateMigrated, "")
+	if err := m.retainOld(ctx, m.slotDataDir(record.Slot.Other()), record.PreviousImportDate); err != nil {
+		return fmt.Errorf("photondata.Migrator.CommitStandby: %w", err)
+	}
+	return nil
+}
+
+// DiscardStandby removes the new database in the standby slot. The live database is untouched.
+// The Photon server of the standby slot must be stopped before it is called.
+func (m *Migrator) DiscardStandby(ctx context.Context, reason string) error {
+	standbyDataDir := m.slotDataDir(m.Record().Slot)
+	// The live database is served regardless of the removal.
+	m.finish(ctx, MigrationStateRolledBack, reason)
+	if err := os.RemoveAll(standbyDataDir); err != nil {
+		return fmt.Errorf("photondata.Migrator.DiscardStandby: failed to remove %q: %w", standbyDataDir, err)
+	}
+	return nil
+}
+
+func (m *Migrator) setLiveSlot(slot Slot) {
+	m.slotMutex.Lock()
+	defer m.slotMutex.Unlock()
+	m.liveSlot = slot
+	m.dataDir = m.slotDataDir(slot)
+}
+
+// loadSlot reads the slot file. The blue slot is returned if it does not exist.
+func (m *Migrator) loadSlot() (Slot, error) {
+	slotBytes, err := os.ReadFile(m.slotFilePath())
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return SlotBlue, nil
+		}
+		return "", fmt.Errorf("failed to read slot file: %w", err)
+	}
+	var slot slotFile
+	if err := json.Unmarshal(slotBytes, &slot); err != nil {
+		return "", fmt.Errorf("failed to unmarshal slot file: %w", err)
+	}
+	if slot.Live != SlotBlue && slot.Live != SlotGreen {
+		return "", fmt.Errorf("unknown slot %q", slot.Live)
+	}
+	return slot.Live, nil
+}
+
+// saveSlot writes the slot file atomically.
+func (m *Migrator) saveSlot(slot Slot) error {
+	slotBytes, err := json.MarshalIndent(slotFile{Live: slot}, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal slot file: %w", err)
+	}
+	path := m.slotFilePath()
+	tmpPath := path + ".tmp"
+	if err := os.WriteFile(tmpPath, slotBytes, 0644); err != nil {
+		return fmt.Errorf("failed to write slot file: %w", err)
+	}
+	if err := os.Rename(tmpPath, path); err != nil {
+		return fmt.Errorf("failed to rename slot file: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,168 @@
+package photondata_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/pddg/photon-container/internal/photondata"
+)
+
+func readSlot(t *testing.T, migrator *photondata.Migrator, slot photondata.Slot) string {
+	t.Helper()
+	got, err := os.ReadFile(filepath.Join(migrator.SlotPhotonDir(slot), "photon_data", "node_1", "hello.txt"))
+	require.NoError(t, err)
+	return string(got)
+}
+
+func Test_Migrator_MigrateToStandby(t *testing.T) {
+	t.Parallel()
+	setup := func(t *testing.T) (*photondata.Migrator, string) {
+		t.Helper()
+		importTime := time.Date(2025, 10, 1, 0, 0, 0, 0, time.UTC)
+		blue := httptest.NewServer(newMockPhotonServer(importTime, nil))
+		t.Cleanup(blue.Close)
+		green := httptest.NewServer(newMockPhotonServer(importTime.AddDate(0, 0, 7), nil))
+		t.Cleanup(green.Close)
+		destDataDir, _ := setupDestDir(t)
+		migrator := photondata.NewMigrator(destDataDir, http.DefaultClient,
+			photondata.WithPhotonURL(blue.URL),
+			photondata.WithGreenSlot(green.URL),
+			photondata.WithImportTimeout(100*time.Millisecond),
+		)
+		// Cache the import date of the existing database
+		migrator.State(t.Context())
+		return migrator, destDataDir
+	}
+	t.Run("switch to green slot", func(t *testing.T) {
+		t.Parallel()
+		// Setup
+		migrator, destDataDir := setup(t)
+
+		// Exercise
+		standby, err := migrator.MigrateToStandby(t.Context(), setupSrcDir(t))
+		require.NoError(t, err)
+		require.NoError(t, migrator.WaitForStandby(t.Context()))
+		require.NoError(t, migrator.SwitchSlot(t.Context()))
+		err = migrator.CommitStandby(t.Context())
+
+		// Verify
+		require.NoError(t, err)
+		assert.Equal(t, photondata.SlotGreen, standby)
+		assert.Equal(t, photondata.SlotGreen, migrator.LiveSlot())
+		assert.Equal(t, filepath.Join(destDataDir, photondata.GreenSlotDirName), migrator.SlotPhotonDir(photondata.SlotGreen))
+		assert.Equal(t, "src", readSlot(t, migrator, photondata.SlotGreen))
+		assert.NoDirExists(t, filepath.Join(destDataDir, "node_1"))
+		assert.Equal(t, photondata.MigrationStateMigrated, migrator.Record().State)
+		assert.FileExists(t, filepath.Join(destDataDir, photondata.SlotFileName))
+		// The checks of Photon follow the live slot.
+		importDate, err := migrator.Ping(t.Context())
+		require.NoError(t, err)
+		assert.Equal(t, time.Date(2025, 10, 8, 0, 0, 0, 0, time.UTC), importDate)
+	})
+	t.Run("switch back to blue slot", func(t *testing.T) {
+		t.Parallel()
+		// Setup
+		migrator, destDataDir := setup(t)
+		_, err := migrator.MigrateToStandby(t.Context(), setupSrcDir(t))
+		require.NoError(t, err)
+		require.NoError(t, migrator.SwitchSlot(t.Context()))
+		require.NoError(t, migrator.CommitStandby(t.Context()))
+		srcDir := setupSrcDir(t)
+		require.NoError(t, os.WriteFile(filepath.Join(srcDir, "photon_data", "node_1", "hello.txt"), []byte("next"), 0644))
+
+		// Exercise
+		standby, err := migrator.MigrateToStandby(t.Context(), srcDir)
+		require.NoError(t, err)
+		require.NoError(t, migrator.SwitchSlot(t.Context()))
+		err = migrator.CommitStandby(t.Context())
+
+		// Verify
+		require.NoError(t, err)
+		assert.Equal(t, photondata.SlotBlue, standby)
+		assert.Equal(t, photondata.SlotBlue, migrator.LiveSlot())
+		assert.Equal(t, "next", readSlot(t, migrator, photondata.SlotBlue))
+		assert.NoDirExists(t, filepath.Join(destDataDir, photondata.GreenSlotDirName, "photon_data", "node_1"))
+	})
+	t.Run("discard standby", func(t *testing.T) {
+		t.Parallel()
+		// Setup
+		migrator, destDataDir := setup(t)
+		_, err := migrator.MigrateToStandby(t.Context(), setupSrcDir(t))
+		require.NoError(t, err)
+
+		// Exercise
+		err = migrator.DiscardStandby(t.Context(), "not served")
+
+		// Verify
+		require.NoError(t, err)
+		assert.Equal(t, photondata.SlotBlue, migrator.LiveSlot())
+		assert.Equal(t, "dest", readSlot(t, migrator, photondata.SlotBlue))
+		assert.NoDirExists(t, filepath.Join(destDataDir, photondata.GreenSlotDirName, "photon_data", "node_1"))
+		assert.Equal(t, photondata.MigrationStateRolledBack, migrator.Record().State)
+		assert.Equal(t, "not served", migrator.Record().Reason)
+	})
+	t.Run("green slot disabled", func(t *testing.T) {
+		t.Parallel()
+		// Setup
+		destDataDir, _ := setupDestDir(t)
+		migrator := photondata.NewMigrator(destDataDir, http.DefaultClient)
+
+		// Exercise
+		_, err := migrator.MigrateToStandby(t.Context(), setupSrcDir(t))
+
+		// Verify
+		require.ErrorIs(t, err, photondata.ErrGreenSlotDisabled)
+		assert.NotEqual(t, photondata.MigrationStateMigrating, migrator.Record().State)
+	})
+}
+
+func Test_Migrator_Recover_Standby(t *testing.T) {
+	t.Parallel()
+	t.Run("discard standby not switched", func(t *testing.T) {
+		t.Parallel()
+		// Setup
+		destDataDir, _ := setupDestDir(t)
+		migrator := photondata.NewMigrator(destDataDir, http.DefaultClient, photondata.WithGreenSlot("http://localhost:2324"))
+		_, err := migrator.MigrateToStandby(t.Context(), setupSrcDir(t))
+		require.NoError(t, err)
+
+		// Exercise
+		recovered := photondata.NewMigrator(destDataDir, http.DefaultClient, photondata.WithGreenSlot("http://localhost:2324"))
+		err = recovered.Recover(t.Context(), filepath.Join(destDataDir, "temp"))
+
+		// Verify
+		require.NoError(t, err)
+		assert.Equal(t, photondata.MigrationStateRolledBack, recovered.Record().State)
+		assert.Equal(t, photondata.SlotBlue, recovered.LiveSlot())
+		assert.Equal(t, "dest", readSlot(t, recovered, photondata.SlotBlue))
+		assert.NoDirExists(t, filepath.Join(destDataDir, photondata.GreenSlotDirName, "photon_data", "node_1"))
+	})
+	t.Run("finish switched migration", func(t *testing.T) {
+		t.Parallel()
+		// Setup
+		destDataDir, _ := setupDestDir(t)
+		migrator := photondata.NewMigrator(destDataDir, http.DefaultClient, photondata.WithGreenSlot("http://localhost:2324"))
+		_, err := migrator.MigrateToStandby(t.Context(), setupSrcDir(t))
+		require.NoError(t, err)
+		require.NoError(t, migrator.SwitchSlot(t.Context()))
+
+		// Exercise
+		recovered := photondata.NewMigrator(destDataDir, http.DefaultClient, photondata.WithGreenSlot("http://localhost:2324"))
+		err = recovered.Recover(t.Context(), filepath.Join(destDataDir, "temp"))
+
+		// Verify
+		require.NoError(t, err)
+		assert.Equal(t, photondata.MigrationStateMigrated, recovered.Record().State)
+		assert.Equal(t, photondata.SlotGreen, recovered.LiveSlot())
+		assert.Equal(t, 2324, recovered.SlotPort(photondata.SlotGreen))
+		assert.Equal(t, "src", readSlot(t, recovered, photondata.SlotGreen))
+		assert.NoDirExists(t, filepath.Join(destDataDir, "node_1"))
+	})
+}
@@ -0,0 +1,107 @@
+package photondata
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// StateFileName is the name of the file which records the migration state in the Photon data directory.
+// It survives a restart of the agent, so that an interrupted migration can be recovered.
+const StateFileName = "migration-state.json"
+
+type MigrationPhase string
+
+const (
+	// MigrationPhaseVerifying is the phase to verify the unarchived database. The existing database is untouched.
+	MigrationPhaseVerifying MigrationPhase = "verifying"
+	// MigrationPhaseSwapping is the phase where the existing database has been moved to `node_1.old`
+	// and the unarchived one is being moved in.
+	MigrationPhaseSwapping MigrationPhase = "swapping"
+	// MigrationPhaseRemoved is the phase where the existing database has been removed
+	// and the unarchived one is not moved in yet.
+	MigrationPhaseRemoved MigrationPhase = "removed"
+	// MigrationPhaseConfirming is the phase where the new database has been moved in
+	// and the old one is kept in `node_1.old` until Photon serves the new one.
+	MigrationPhaseConfirming MigrationPhase = "confirming"
+	// MigrationPhaseStandby is the phase where the new database has been moved to the standby slot
+	// and a second Photon server is being started on it. The live database is untouched.
+	MigrationPhaseStandby MigrationPhase = "standby"
+	// MigrationPhaseSwitched is the phase where the standby slot has become live
+	// and the database of the previous slot is being retained or removed.
+	MigrationPhaseSwitched MigrationPhase = "switched"
+	// MigrationPhaseDone is the phase after the migration has finished, successfully or not.
+	MigrationPhaseDone MigrationPhase = "done"
+)
+
+// MigrationRecord is the state of the last migration persisted in the state file.
+type MigrationRecord struct {
+	State MigrationState `json:"state"`
+	Phase MigrationPhase `json:"phase,omitempty"`
+	// Source is the directory of the unarchived database.
+	Source string `json:"source,omitempty"`
+	// SourceSHA256 is the checksum of the archive recorded in the completion marker of the source.
+	// It covers only the rest of the tar stream if the extraction was resumed.
+	SourceSHA256 string `json:"source_sha256,omitempty"`
+	// Generation is the ID of the retained database activated by the migration.
+	Generation string `json:"generation,omitempty"`
+	// Slot is the standby slot which the blue/green migration moved the new database to.
+	Slot Slot `json:"slot,omitempty"`
+	// PreviousImportDate is the import date of the database served before the migration.
+	PreviousImportDate *time.Time `json:"previous_import_date,omitempty"`
+	// Reason describes why the migration has failed or has been rolled back.
+	Reason     string     `json:"reason,omitempty"`
+	StartedAt  *time.Time `json:"started_at,omitempty"`
+	FinishedAt *time.Time `json:"finished_at,omitempty"`
+	UpdatedAt  time.Time  `json:"updated_at"`
+}
+
+// KeepsServing returns true if Photon keeps serving the live database during the migration,
+// which is the case of the blue/green migration.
+func (r MigrationRecord) KeepsServing() bool {
+	return r.Phase == MigrationPhaseStandby || r.Phase == MigrationPhaseSwitched
+}
+
+func (m *Migrator) stateFilePath() string {
+	return filepath.Join(m.root, StateFileName)
+}
+
+// loadRecord reads the state file. The unknown state is returned if it does not exist.
+func (m *Migrator) loadRecord() (MigrationRecord, error) {
+	recordBytes, err := os.ReadFile(m.stateFilePath())
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return MigrationRecord{State: MigrationStateUnknown}, nil
+		}
+		return MigrationRecord{}, fmt.Errorf("failed to read state file: %w", err)
+	}
+	var record MigrationRecord
+	if err := json.Unmarshal(recordBytes, &record); err != nil {
+		return MigrationRecord{}, fmt.Errorf("failed to unmarshal state file: %w", err)
+	}
+	return record, nil
+}
+
+// saveRecord writes the state file atomically. The caller must hold the mutex.
+func (m *Migrator) saveRecord() error {
+	m.record.UpdatedAt = time.Now().UTC()
+	recordBytes, err := json.MarshalIndent(m.record, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal state file: %w", err)
+	}
+	path := m.stateFilePath()
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return fmt.Errorf("failed to create directory: %w", err)
+	}
+	tmpPath := path + ".tmp"
+	if err := os.WriteFile(tmpPath, recordBytes, 0644); err != nil {
+		return fmt.Errorf("failed to write state file: %w", err)
+	}
+	if err := os.Rename(tmpPath, path); err != nil {
+		return fmt.Errorf("failed to rename state file: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,42 @@
+package scheduler
+
+import "time"
+
+type SchedulerOption func(*Scheduler)
+
+// WithWindow allows the scheduled updates to start only within the window.
+// The default is to allow them at any time.
+func WithWindow(window Window) SchedulerOption {
+	return func(s *Scheduler) {
+		s.window = &window
+	}
+}
+
+// WithJitter delays each scheduled update by a random duration up to jitter,
+// so that the agents sharing the same schedule do not download the archive at the same time.
+func WithJitter(jitter time.Duration) SchedulerOption {
+	return func(s *Scheduler) {
+		s.jitter = jitter
+	}
+}
+
+// WithMinInterval skips the scheduled update if the last successful update finished within the interval.
+func WithMinInterval(interval time.Duration) SchedulerOption {
+	return func(s *Scheduler) {
+		s.minInterval = interval
+	}
+}
+
+// WithDryRun only logs the update which the scheduler would start.
+func WithDryRun() SchedulerOption {
+	return func(s *Scheduler) {
+		s.dryRun = true
+	}
+}
+
+// WithLocation sets the time zone of the schedule and the window. The default is time.Local.
+func WithLocation(location *time.Location) SchedulerOption {
+	return func(s *Scheduler) {
+		s.location = location
+	}
+}
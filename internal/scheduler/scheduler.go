@@ -0,0 +1,208 @@
+// Package scheduler starts the updates of the Photon database periodically.
+package scheduler
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"time"
+
+	"github.com/robfig/cron/v3"
+
+	"github.com/pddg/photon-container/internal/logging"
+	"github.com/pddg/photon-container/internal/photondata"
+	"github.com/pddg/photon-container/internal/updater"
+)
+
+// Outcome is the result of a scheduled update.
+type Outcome string
+
+const (
+	// OutcomeStarted means that the update job has been started.
+	OutcomeStarted Outcome = "started"
+	// OutcomeDryRun means that the update would have been started, but it was not in the dry-run mode.
+	OutcomeDryRun Outcome = "dry_run"
+	// OutcomeOutsideWindow means that it is not the time of day when the updates are allowed.
+	OutcomeOutsideWindow Outcome = "outside_window"
+	// OutcomeTooSoon means that the last successful update or activation finished within the minimum interval.
+	OutcomeTooSoon Outcome = "too_soon"
+	// OutcomeUpToDate means that the database is not older than the archive.
+	OutcomeUpToDate Outcome = "up_to_date"
+	// OutcomeBusy means that another job or migration is in progress.
+	OutcomeBusy Outcome = "busy"
+)
+
+type Updater interface {
+	Check(ctx context.Context, archive photondata.Archive) (updater.Decision, error)
+	DownloadAndUpdate(ctx context.Context, archive photondata.Archive, options ...updater.UpdateOption) error
+}
+
+type Migrator interface {
+	Record() photondata.MigrationRecord
+}
+
+type JobManager interface {
+	StartIfIdle(ctx context.Context, kind updater.JobKind) (context.Context, *updater.Job, error)
+	List() []updater.JobStatus
+}
+
+// Scheduler starts the update of the database from the archive on the cron schedule,
+// in the same way as `POST /migrate/download`.
+type Scheduler struct {
+	spec     string
+	schedule cron.Schedule
+	updater  Updater
+	migrator Migrator
+	jobs     JobManager
+	archive  photondata.Archive
+
+	window      *Window
+	jitter      time.Duration
+	minInterval time.Duration
+	dryRun      bool
+	location    *time.Location
+}
+
+// New creates a new Scheduler. The spec is a standard cron expression, such as `0 3 * * 1`.
+func New(
+	spec string,
+	updater Updater,
+	migrator Migrator,
+	jobs JobManager,
+	archive photondata.Archive,
+	options ...SchedulerOption,
+) (*Scheduler, error) {
+	schedule, err := cron.ParseStandard(spec)
+	if err != nil {
+		return nil, fmt.Errorf("scheduler.New: invalid schedule %q: %w", spec, err)
+	}
+	s := &Scheduler{
+		spec:     spec,
+		schedule: schedule,
+		updater:  updater,
+		migrator: migrator,
+		jobs:     jobs,
+		archive:  archive,
+		location: time.Local,
+	}
+	for _, option := range options {
+		option(s)
+	}
+	return s, nil
+}
+
+// Run triggers the updates on the schedule until the context is canceled.
+func (s *Scheduler) Run(ctx context.Context) {
+	logger := logging.FromContext(ctx).With("schedule", s.spec)
+	ctx = logging.NewContext(ctx, logger)
+	c := cron.New(cron.WithLocation(s.location))
+	var id cron.EntryID
+	id = c.Schedule(s.schedule, cron.FuncJob(func() {
+		if !s.waitJitter(ctx) {
+			return
+		}
+		outcome, err := s.Trigger(ctx)
+		if err != nil {
+			logger.ErrorContext(ctx, "scheduled update failed", "error", err)
+			return
+		}
+		logger.InfoContext(ctx, "scheduled update", "outcome", outcome, "next", c.Entry(id).Next)
+	}))
+	c.Start()
+	logger.InfoContext(ctx, "scheduler started",
+		"schedule", s.spec,
+		"window", s.window,
+		"jitter", s.jitter,
+		"min_interval", s.minInterval,
+		"dry_run", s.dryRun,
+		"next", c.Entry(id).Next,
+	)
+	<-ctx.Done()
+	// Wait for the trigger in progress. The update job itself is not waited.
+	<-c.Stop().Done()
+}
+
+// waitJitter waits for a random duration up to the jitter. It returns false if the context is canceled.
+func (s *Scheduler) waitJitter(ctx context.Context) bool {
+	if s.jitter <= 0 {
+		return true
+	}
+	timer := time.NewTimer(rand.N(s.jitter))
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return false
+	case <-timer.C:
+		return true
+	}
+}
+
+// Trigger starts the update unless it is outside the window, too soon after the last update,
+// another job is in progress, or the database is up to date.
+// The update job runs in background, and the context must outlive it.
+func (s *Scheduler) Trigger(ctx context.Context) (Outcome, error) {
+	logger := logging.FromContext(ctx)
+	now := time.Now().In(s.location)
+	if s.window != nil && !s.window.Contains(now) {
+		return OutcomeOutsideWindow, nil
+	}
+	if s.busy() {
+		return OutcomeBusy, nil
+	}
+	if last, ok := s.lastUpdate(); ok && s.minInterval > 0 && now.Sub(last) < s.minInterval {
+		return OutcomeTooSoon, nil
+	}
+	decision, err := s.updater.Check(ctx, s.archive)
+	if err != nil {
+		return "", fmt.Errorf("scheduler.Scheduler.Trigger: %w", err)
+	}
+	if !decision.Migratable {
+		logger.InfoContext(ctx, "database is up to date", "policy", decision.Policy, "reason", decision.Reason)
+		return OutcomeUpToDate, nil
+	}
+	if s.dryRun {
+		logger.InfoContext(ctx, "dry run. the update would be started", "archive", s.archive.URL(), "reason", decision.Reason)
+		return OutcomeDryRun, nil
+	}
+	// Another job may have been started during the check.
+	jobCtx, job, err := s.jobs.StartIfIdle(ctx, updater.JobKindDownload)
+	if errors.Is(err, updater.ErrJobRunning) {
+		return OutcomeBusy, nil
+	}
+	if err != nil {
+		return "", fmt.Errorf("scheduler.Scheduler.Trigger: %w", err)
+	}
+	logger.InfoContext(ctx, "start scheduled update", "job_id", job.ID(), "archive", s.archive.URL())
+	go func() {
+		if err := s.updater.DownloadAndUpdate(jobCtx, s.archive); err != nil && !errors.Is(err, updater.ErrUpToDate) {
+			logging.FromContext(jobCtx).ErrorContext(jobCtx, "failed to update", "error", err)
+		}
+	}()
+	return OutcomeStarted, nil
+}
+
+func (s *Scheduler) busy() bool {
+	if s.migrator.Record().State == photondata.MigrationStateMigrating {
+		return true
+	}
+	for _, job := range s.jobs.List() {
+		if job.State == updater.JobStateRunning {
+			return true
+		}
+	}
+	return false
+}
+
+// lastUpdate returns when the last successful update or activation finished.
+// An activation counts, so that a database rolled back by the operator is kept for the minimum interval at least.
+func (s *Scheduler) lastUpdate() (time.Time, bool) {
+	// The jobs are listed from the newest.
+	for _, job := range s.jobs.List() {
+		if job.State != updater.JobStateSucceeded || job.FinishedAt == nil {
+			continue
+		}
+		return *job.FinishedAt, true
+	}
+	return time.Time{}, false
+}
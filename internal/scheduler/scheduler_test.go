@@ -0,0 +1,303 @@
+package scheduler_test
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/pddg/photon-container/internal/photondata"
+	"github.com/pddg/photon-container/internal/scheduler"
+	"github.com/pddg/photon-container/internal/updater"
+)
+
+type mockUpdater struct {
+	migratable    bool
+	migratableErr error
+	// checking is called during the check, if set.
+	checking func()
+
+	updated chan struct{}
+}
+
+func newMockUpdater(migratable bool, err error) *mockUpdater {
+	return &mockUpdater{
+		migratable:    migratable,
+		migratableErr: err,
+		updated:       make(chan struct{}, 1),
+	}
+}
+
+func (m *mockUpdater) Check(ctx context.Context, archive photondata.Archive) (updater.Decision, error) {
+	if m.checking != nil {
+		m.checking()
+	}
+	return updater.Decision{Migratable: m.migratable}, m.migratableErr
+}
+
+func (m *mockUpdater) DownloadAndUpdate(ctx context.Context, archive photondata.Archive, options ...updater.UpdateOption) error {
+	updater.JobFromContext(ctx).Finish(ctx, nil)
+	m.updated <- struct{}{}
+	return nil
+}
+
+type mockMigrator struct {
+	state photondata.MigrationState
+}
+
+func (m *mockMigrator) Record() photondata.MigrationRecord {
+	return photondata.MigrationRecord{State: m.state}
+}
+
+func newJobManager(t *testing.T) *updater.JobManager {
+	t.Helper()
+	jobs, err := updater.NewJobManager(t.Context(), updater.UpdateStrategySequential, filepath.Join(t.TempDir(), "jobs.json"))
+	require.NoError(t, err)
+	return jobs
+}
+
+// windowExcluding returns the window which does not contain now.
+func windowExcluding(t *testing.T, now time.Time) scheduler.Window {
+	t.Helper()
+	window, err := scheduler.ParseWindow(now.Add(time.Hour).Format("15:04") + "-" + now.Add(2*time.Hour).Format("15:04"))
+	require.NoError(t, err)
+	return window
+}
+
+func Test_Scheduler_Trigger(t *testing.T) {
+	t.Parallel()
+	archive, err := photondata.NewArchive("https://example.com/photon-db.tar.bz2")
+	require.NoError(t, err)
+	testCases := []struct {
+		name        string
+		migratable  bool
+		state       photondata.MigrationState
+		setupJobs   func(t *testing.T, jobs *updater.JobManager)
+		duringCheck func(t *testing.T, jobs *updater.JobManager)
+		options     func(t *testing.T) []scheduler.SchedulerOption
+		want        scheduler.Outcome
+		wantUpdate  bool
+	}{
+		{
+			name:       "start update",
+			migratable: true,
+			want:       scheduler.OutcomeStarted,
+			wantUpdate: true,
+		},
+		{
+			name:       "up to date",
+			migratable: false,
+			want:       scheduler.OutcomeUpToDate,
+		},
+		{
+			name:       "dry run",
+			migratable: true,
+			options: func(t *testing.T) []scheduler.SchedulerOption {
+				return []scheduler.SchedulerOption{scheduler.WithDryRun()}
+			},
+			want: scheduler.OutcomeDryRun,
+		},
+		{
+			name:       "outside window",
+			migratable: true,
+			options: func(t *testing.T) []scheduler.SchedulerOption {
+				return []scheduler.SchedulerOption{scheduler.WithWindow(windowExcluding(t, time.Now()))}
+			},
+			want: scheduler.OutcomeOutsideWindow,
+		},
+		{
+			name:       "job is running",
+			migratable: true,
+			setupJobs: func(t *testing.T, jobs *updater.JobManager) {
+				jobs.Start(t.Context(), updater.JobKindUpload)
+			},
+			want: scheduler.OutcomeBusy,
+		},
+		{
+			name:       "migrating",
+			migratable: true,
+			state:      photondata.MigrationStateMigrating,
+			want:       scheduler.OutcomeBusy,
+		},
+		{
+			name:       "too soon after last update",
+			migratable: true,
+			setupJobs: func(t *testing.T, jobs *updater.JobManager) {
+				_, job := jobs.Start(t.Context(), updater.JobKindDownload)
+				job.Finish(t.Context(), nil)
+			},
+			options: func(t *testing.T) []scheduler.SchedulerOption {
+				return []scheduler.SchedulerOption{scheduler.WithMinInterval(time.Hour)}
+			},
+			want: scheduler.OutcomeTooSoon,
+		},
+		{
+			name:       "job is started during the check",
+			migratable: true,
+			duringCheck: func(t *testing.T, jobs *updater.JobManager) {
+				jobs.Start(t.Context(), updater.JobKindUpload)
+			},
+			want: scheduler.OutcomeBusy,
+		},
+		{
+			name:       "too soon after activation",
+			migratable: true,
+			setupJobs: func(t *testing.T, jobs *updater.JobManager) {
+				_, job := jobs.Start(t.Context(), updater.JobKindActivate)
+				job.Finish(t.Context(), nil)
+			},
+			options: func(t *testing.T) []scheduler.SchedulerOption {
+				return []scheduler.SchedulerOption{scheduler.WithMinInterval(time.Hour)}
+			},
+			want: scheduler.OutcomeTooSoon,
+		},
+		{
+			name:       "last update failed",
+			migratable: true,
+			setupJobs: func(t *testing.T, jobs *updater.JobManager) {
+				_, job := jobs.Start(t.Context(), updater.JobKindDownload)
+				job.Finish(t.Context(), errors.New("failed"))
+			},
+			options: func(t *testing.T) []scheduler.SchedulerOption {
+				return []scheduler.SchedulerOption{scheduler.WithMinInterval(time.Hour)}
+			},
+			want:       scheduler.OutcomeStarted,
+			wantUpdate: true,
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+			// Setup
+			mockUpdater := newMockUpdater(tc.migratable, nil)
+			jobs := newJobManager(t)
+			if tc.setupJobs != nil {
+				tc.setupJobs(t, jobs)
+			}
+			if tc.duringCheck != nil {
+				mockUpdater.checking = func() { tc.duringCheck(t, jobs) }
+			}
+			var options []scheduler.SchedulerOption
+			if tc.options != nil {
+				options = tc.options(t)
+			}
+			s, err := scheduler.New("0 3 * * *", mockUpdater, &mockMigrator{state: tc.state}, jobs, archive, options...)
+			require.NoError(t, err)
+
+			// Exercise
+			got, err := s.Trigger(t.Context())
+
+			// Verify
+			require.NoError(t, err)
+			assert.Equal(t, tc.want, got)
+			if tc.wantUpdate {
+				select {
+				case <-mockUpdater.updated:
+				case <-time.After(5 * time.Second):
+					t.Fatal("the update was not started")
+				}
+				require.NotEmpty(t, jobs.List())
+				assert.Equal(t, updater.JobKindDownload, jobs.List()[0].Kind)
+			} else {
+				for _, job := range jobs.List() {
+					assert.False(t, job.Kind == updater.JobKindDownload && job.State == updater.JobStateRunning, "no update job is started")
+				}
+				assert.Empty(t, mockUpdater.updated)
+			}
+		})
+	}
+	t.Run("failed to check migratability", func(t *testing.T) {
+		t.Parallel()
+		// Setup
+		mockUpdater := newMockUpdater(false, errors.New("unreachable"))
+		s, err := scheduler.New("0 3 * * *", mockUpdater, &mockMigrator{}, newJobManager(t), archive)
+		require.NoError(t, err)
+
+		// Exercise
+		_, err = s.Trigger(t.Context())
+
+		// Verify
+		require.Error(t, err)
+	})
+}
+
+func Test_New_InvalidSchedule(t *testing.T) {
+	t.Parallel()
+	// Exercise
+	_, err := scheduler.New("every day", newMockUpdater(false, nil), &mockMigrator{}, newJobManager(t), photondata.Archive{})
+
+	// Verify
+	require.Error(t, err)
+}
+
+func Test_ParseWindow(t *testing.T) {
+	t.Parallel()
+	at := func(hour, minute int) time.Time {
+		return time.Date(2025, 10, 1, hour, minute, 0, 0, time.UTC)
+	}
+	testCases := []struct {
+		name    string
+		window  string
+		wantErr bool
+		inside  []time.Time
+		outside []time.Time
+	}{
+		{
+			name:    "within a day",
+			window:  "01:00-05:30",
+			inside:  []time.Time{at(1, 0), at(3, 0), at(5, 29)},
+			outside: []time.Time{at(0, 59), at(5, 30), at(23, 0)},
+		},
+		{
+			name:    "wrap around midnight",
+			window:  "22:00-04:00",
+			inside:  []time.Time{at(22, 0), at(23, 59), at(0, 0), at(3, 59)},
+			outside: []time.Time{at(4, 0), at(12, 0), at(21, 59)},
+		},
+		{
+			name:    "with spaces",
+			window:  "22:00 - 04:00",
+			inside:  []time.Time{at(23, 0)},
+			outside: []time.Time{at(12, 0)},
+		},
+		{
+			name:    "no separator",
+			window:  "22:00",
+			wantErr: true,
+		},
+		{
+			name:    "invalid time",
+			window:  "25:00-04:00",
+			wantErr: true,
+		},
+		{
+			name:    "empty window",
+			window:  "04:00-04:00",
+			wantErr: true,
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+			// Exercise
+			window, err := scheduler.ParseWindow(tc.window)
+
+			// Verify
+			if tc.wantErr {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			for _, inside := range tc.inside {
+				assert.True(t, window.Contains(inside), "%s should be inside %s", inside, window)
+			}
+			for _, outside := range tc.outside {
+				assert.False(t, window.Contains(outside), "%s should be outside %s", outside, window)
+			}
+		})
+	}
+}
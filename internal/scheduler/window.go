@@ -0,0 +1,61 @@
+package scheduler
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Window is the time of day when the scheduled updates are allowed to start.
+// It may wrap around midnight, such as `22:00-04:00`.
+type Window struct {
+	// start and end are the offsets from midnight. end is exclusive.
+	start time.Duration
+	end   time.Duration
+}
+
+// ParseWindow parses the window formatted as `HH:MM-HH:MM`.
+func ParseWindow(s string) (Window, error) {
+	startText, endText, ok := strings.Cut(s, "-")
+	if !ok {
+		return Window{}, fmt.Errorf("scheduler.ParseWindow: %q is not formatted as HH:MM-HH:MM", s)
+	}
+	start, err := parseTimeOfDay(startText)
+	if err != nil {
+		return Window{}, fmt.Errorf("scheduler.ParseWindow: %w", err)
+	}
+	end, err := parseTimeOfDay(endText)
+	if err != nil {
+		return Window{}, fmt.Errorf("scheduler.ParseWindow: %w", err)
+	}
+	if start == end {
+		return Window{}, fmt.Errorf("scheduler.ParseWindow: %q is empty", s)
+	}
+	return Window{start: start, end: end}, nil
+}
+
+func parseTimeOfDay(s string) (time.Duration, error) {
+	t, err := time.Parse("15:04", strings.TrimSpace(s))
+	if err != nil {
+		return 0, fmt.Errorf("invalid time of day %q: %w", s, err)
+	}
+	return time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute, nil
+}
+
+// Contains returns true if the time of day of t in its location is within the window.
+func (w Window) Contains(t time.Time) bool {
+	hour, minute, second := t.Clock()
+	offset := time.Duration(hour)*time.Hour + time.Duration(minute)*time.Minute + time.Duration(second)*time.Second
+	if w.start < w.end {
+		return w.start <= offset && offset < w.end
+	}
+	// The window wraps around midnight.
+	return w.start <= offset || offset < w.end
+}
+
+func (w Window) String() string {
+	format := func(d time.Duration) string {
+		return fmt.Sprintf("%02d:%02d", int(d.Hours()), int(d.Minutes())%60)
+	}
+	return format(w.start) + "-" + format(w.end)
+}
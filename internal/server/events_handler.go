@@ -0,0 +1,108 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/pddg/photon-container/internal/logging"
+	"github.com/pddg/photon-container/internal/updater"
+)
+
+// keepAliveInterval is the interval of the comments sent to keep the idle stream open through proxies.
+const keepAliveInterval = 15 * time.Second
+
+type EventsHandler struct {
+	jobs JobManager
+}
+
+// NewEventsHandler creates a new EventsHandler.
+// It streams the events of the update jobs as Server-Sent Events.
+func NewEventsHandler(jobs JobManager) *EventsHandler {
+	return &EventsHandler{
+		jobs: jobs,
+	}
+}
+
+// ServeHTTP streams the events until the client disconnects.
+// If the `job_id` query parameter is given, only the events of the job are sent,
+// and the stream ends after the job is finished.
+func (h *EventsHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	jobID := r.URL.Query().Get("job_id")
+	// Subscribe before looking up the job, so that no event is missed in between.
+	events := h.jobs.Subscribe(ctx)
+	var finished *updater.Event
+	if jobID != "" {
+		job, ok := h.jobs.Get(jobID)
+		if !ok {
+			writeJSON(w, http.StatusNotFound, errorResponse{Error: "job not found"})
+			return
+		}
+		if job.State != updater.JobStateRunning {
+			finished = &updater.Event{
+				Type:      updater.EventFinished,
+				JobID:     job.ID,
+				Time:      time.Now().UTC(),
+				State:     job.State,
+				Error:     job.Error,
+				Attention: job.Attention,
+			}
+		}
+	}
+
+	rc := http.NewResponseController(w)
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	if finished != nil {
+		h.send(w, rc, *finished)
+		return
+	}
+	if err := rc.Flush(); err != nil {
+		logging.FromContext(ctx).WarnContext(ctx, "streaming is not supported", "error", err)
+		return
+	}
+
+	keepAlive := time.NewTicker(keepAliveInterval)
+	defer keepAlive.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-keepAlive.C:
+			if _, err := fmt.Fprint(w, ": keep-alive\n\n"); err != nil {
+				return
+			}
+			if err := rc.Flush(); err != nil {
+				return
+			}
+		case event, ok := <-events:
+			if !ok {
+				return
+			}
+			if jobID != "" && event.JobID != jobID {
+				continue
+			}
+			if err := h.send(w, rc, event); err != nil {
+				return
+			}
+			if jobID != "" && event.Type == updater.EventFinished {
+				return
+			}
+		}
+	}
+}
+
+// send writes the event in the format of Server-Sent Events.
+func (h *EventsHandler) send(w http.ResponseWriter, rc *http.ResponseController, event updater.Event) error {
+	eventBytes, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	if _, err := fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event.Type, eventBytes); err != nil {
+		return err
+	}
+	return rc.Flush()
+}
@@ -0,0 +1,38 @@
+package server
+
+import (
+	"net/http"
+
+	"github.com/pddg/photon-container/internal/photon"
+)
+
+type Supervisor interface {
+	Status() photon.SupervisorStatus
+}
+
+type HealthHandler struct {
+	supervisor Supervisor
+}
+
+// NewHealthHandler creates a new HealthHandler.
+// It reports the liveness of the agent. It fails while the Photon server is crash looping,
+// since restarting the container may be the only remedy.
+func NewHealthHandler(supervisor Supervisor) *HealthHandler {
+	return &HealthHandler{
+		supervisor: supervisor,
+	}
+}
+
+type healthResponse struct {
+	Status string                  `json:"status"`
+	Photon photon.SupervisorStatus `json:"photon"`
+}
+
+func (h *HealthHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	status := h.supervisor.Status()
+	if status.CrashLoop {
+		writeJSON(w, http.StatusServiceUnavailable, healthResponse{Status: "crash_loop", Photon: status})
+		return
+	}
+	writeJSON(w, http.StatusOK, healthResponse{Status: "ok", Photon: status})
+}
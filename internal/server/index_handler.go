@@ -0,0 +1,107 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"slices"
+	"time"
+
+	"github.com/pddg/photon-container/internal/logging"
+	"github.com/pddg/photon-container/internal/photondata"
+	"github.com/pddg/photon-container/internal/updater"
+)
+
+type IndexActivator interface {
+	Activate(ctx context.Context, id string) error
+}
+
+type IndexHandler struct {
+	ctx       context.Context
+	migrator  Migrator
+	activator IndexActivator
+	jobs      JobManager
+	mux       *http.ServeMux
+}
+
+// NewIndexHandler creates a new IndexHandler.
+// It lists the retained generations of the database and switches Photon back to one of them.
+func NewIndexHandler(ctx context.Context, migrator Migrator, activator IndexActivator, jobs JobManager) *IndexHandler {
+	h := &IndexHandler{
+		ctx:       ctx,
+		migrator:  migrator,
+		activator: activator,
+		jobs:      jobs,
+		mux:       http.NewServeMux(),
+	}
+	h.mux.HandleFunc("GET /indexes", h.list)
+	h.mux.HandleFunc("POST /indexes/{id}/activate", h.activate)
+	return h
+}
+
+type indexesResponse struct {
+	Current     currentIndexResponse    `json:"current"`
+	Generations []photondata.Generation `json:"generations"`
+}
+
+type currentIndexResponse struct {
+	State      string `json:"state"`
+	ImportDate string `json:"import_date"`
+}
+
+func (h *IndexHandler) list(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	generations, err := h.migrator.Generations()
+	if err != nil {
+		logging.FromContext(ctx).ErrorContext(ctx, "failed to list generations", "error", err)
+		writeJSON(w, http.StatusInternalServerError, errorResponse{Error: err.Error()})
+		return
+	}
+	state, importDate := h.migrator.State(ctx)
+	writeJSON(w, http.StatusOK, indexesResponse{
+		Current: currentIndexResponse{
+			State:      string(state),
+			ImportDate: importDate.Format(time.RFC3339),
+		},
+		Generations: generations,
+	})
+}
+
+// activate switches the database to the generation in background.
+// The progress can be followed in the same way as the updates.
+func (h *IndexHandler) activate(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	id := r.PathValue("id")
+	generations, err := h.migrator.Generations()
+	if err != nil {
+		logging.FromContext(ctx).ErrorContext(ctx, "failed to list generations", "error", err)
+		writeJSON(w, http.StatusInternalServerError, errorResponse{Error: err.Error()})
+		return
+	}
+	if !slices.ContainsFunc(generations, func(g photondata.Generation) bool { return g.ID == id }) {
+		writeJSON(w, http.StatusNotFound, errorResponse{Error: "generation not found"})
+		return
+	}
+	if h.migrator.Record().State == photondata.MigrationStateMigrating {
+		writeJSON(w, http.StatusConflict, errorResponse{Error: photondata.ErrMigrationInProgress.Error()})
+		return
+	}
+	// Do not use r.Context() here. It may be canceled before the activation is finished.
+	jobCtx, job, err := h.jobs.StartIfIdle(h.ctx, updater.JobKindActivate)
+	if err != nil {
+		writeJSON(w, http.StatusConflict, errorResponse{Error: updater.ErrJobRunning.Error()})
+		return
+	}
+	go func() {
+		if err := h.activator.Activate(jobCtx, id); err != nil {
+			logging.FromContext(jobCtx).ErrorContext(jobCtx, "failed to activate generation", "generation", id, "error", err)
+		}
+	}()
+	writeJSON(w, http.StatusOK, jobStartedResponse{
+		JobID:   job.ID(),
+		Message: "activation started. Check /jobs/" + job.ID() + " if you want to know the progress",
+	})
+}
+
+func (h *IndexHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	h.mux.ServeHTTP(w, r)
+}
@@ -0,0 +1,104 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"net/http"
+
+	"github.com/pddg/photon-container/internal/logging"
+	"github.com/pddg/photon-container/internal/updater"
+)
+
+type JobManager interface {
+	StartIfIdle(ctx context.Context, kind updater.JobKind) (context.Context, *updater.Job, error)
+	List() []updater.JobStatus
+	Get(id string) (updater.JobStatus, bool)
+	Cancel(ctx context.Context, id string) error
+	CancelRunning(ctx context.Context) []string
+	Subscribe(ctx context.Context) <-chan updater.Event
+}
+
+type JobHandler struct {
+	jobs JobManager
+	mux  *http.ServeMux
+}
+
+// NewJobHandler creates a new JobHandler.
+// It serves the current and the past update jobs.
+func NewJobHandler(jobs JobManager) *JobHandler {
+	h := &JobHandler{
+		jobs: jobs,
+		mux:  http.NewServeMux(),
+	}
+	h.mux.HandleFunc("GET /jobs", h.list)
+	h.mux.HandleFunc("GET /jobs/{id}", h.get)
+	h.mux.HandleFunc("DELETE /jobs/{id}", h.cancel)
+	return h
+}
+
+func (h *JobHandler) list(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, h.jobs.List())
+}
+
+func (h *JobHandler) get(w http.ResponseWriter, r *http.Request) {
+	job, ok := h.jobs.Get(r.PathValue("id"))
+	if !ok {
+		writeJSON(w, http.StatusNotFound, errorResponse{Error: "job not found"})
+		return
+	}
+	writeJSON(w, http.StatusOK, job)
+}
+
+// cancel cancels the running job.
+// The job is finished in background, so its status should be polled until it is canceled.
+func (h *JobHandler) cancel(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	id := r.PathValue("id")
+	if err := h.jobs.Cancel(ctx, id); err != nil {
+		switch {
+		case errors.Is(err, updater.ErrJobNotFound):
+			writeJSON(w, http.StatusNotFound, errorResponse{Error: "job not found"})
+		case errors.Is(err, updater.ErrJobNotRunning):
+			writeJSON(w, http.StatusConflict, errorResponse{Error: "job is not running"})
+		default:
+			logging.FromContext(ctx).ErrorContext(ctx, "failed to cancel job", "job_id", id, "error", err)
+			writeJSON(w, http.StatusInternalServerError, errorResponse{Error: err.Error()})
+		}
+		return
+	}
+	writeJSON(w, http.StatusAccepted, jobsCanceledResponse{Canceled: []string{id}})
+}
+
+func (h *JobHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	h.mux.ServeHTTP(w, r)
+}
+
+type jobStartedResponse struct {
+	JobID   string `json:"job_id"`
+	Message string `json:"message"`
+}
+
+type jobsCanceledResponse struct {
+	Canceled []string `json:"canceled"`
+}
+
+type CancelHandler struct {
+	jobs JobManager
+}
+
+// NewCancelHandler creates a new CancelHandler.
+// It cancels all running update jobs.
+func NewCancelHandler(jobs JobManager) *CancelHandler {
+	return &CancelHandler{
+		jobs: jobs,
+	}
+}
+
+func (h *CancelHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	canceled := h.jobs.CancelRunning(r.Context())
+	if len(canceled) == 0 {
+		writeJSON(w, http.StatusConflict, errorResponse{Error: "no running job"})
+		return
+	}
+	writeJSON(w, http.StatusAccepted, jobsCanceledResponse{Canceled: canceled})
+}
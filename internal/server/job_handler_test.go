@@ -0,0 +1,108 @@
+package server_test
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/pddg/photon-container/internal/server"
+	"github.com/pddg/photon-container/internal/updater"
+)
+
+func Test_JobHandler_Cancel(t *testing.T) {
+	t.Parallel()
+	testCases := []struct {
+		name     string
+		finished bool
+		id       string
+		wantCode int
+	}{
+		{
+			name:     "running job",
+			wantCode: http.StatusAccepted,
+		},
+		{
+			name:     "finished job",
+			finished: true,
+			wantCode: http.StatusConflict,
+		},
+		{
+			name:     "unknown job",
+			id:       "unknown",
+			wantCode: http.StatusNotFound,
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+			// Setup
+			jobs := newJobManager(t)
+			ctx, job := jobs.Start(t.Context(), updater.JobKindDownload)
+			if tc.finished {
+				job.Finish(ctx, nil)
+			}
+			id := job.ID()
+			if tc.id != "" {
+				id = tc.id
+			}
+			handler := server.NewJobHandler(jobs)
+			rec := httptest.NewRecorder()
+
+			// Exercise
+			handler.ServeHTTP(rec, httptest.NewRequest(http.MethodDelete, "/jobs/"+id, nil))
+
+			// Verify
+			assert.Equal(t, tc.wantCode, rec.Code)
+			if tc.wantCode == http.StatusAccepted {
+				// The job is finished by the update itself after it stops.
+				assert.ErrorIs(t, context.Cause(ctx), updater.ErrJobCanceled)
+				assert.Equal(t, updater.JobStateRunning, job.Status().State)
+			}
+		})
+	}
+}
+
+func Test_CancelHandler(t *testing.T) {
+	t.Parallel()
+	t.Run("running jobs are canceled", func(t *testing.T) {
+		t.Parallel()
+		// Setup
+		jobs := newJobManager(t)
+		ctx, job := jobs.Start(t.Context(), updater.JobKindUpload)
+		handler := server.NewCancelHandler(jobs)
+		rec := httptest.NewRecorder()
+
+		// Exercise
+		handler.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/migrate/cancel", nil))
+
+		// Verify
+		assert.Equal(t, http.StatusAccepted, rec.Code)
+		var got struct {
+			Canceled []string `json:"canceled"`
+		}
+		require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &got))
+		assert.Equal(t, []string{job.ID()}, got.Canceled)
+		assert.ErrorIs(t, context.Cause(ctx), updater.ErrJobCanceled)
+	})
+	t.Run("no running job", func(t *testing.T) {
+		t.Parallel()
+		// Setup
+		jobs := newJobManager(t)
+		ctx, job := jobs.Start(t.Context(), updater.JobKindUpload)
+		job.Finish(ctx, nil)
+		handler := server.NewCancelHandler(jobs)
+		rec := httptest.NewRecorder()
+
+		// Exercise
+		handler.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/migrate/cancel", nil))
+
+		// Verify
+		assert.Equal(t, http.StatusConflict, rec.Code)
+		assert.Equal(t, updater.JobStateSucceeded, job.Status().State)
+	})
+}
@@ -3,7 +3,10 @@ package server
 import (
 	"context"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"net/http"
+	"strconv"
 	"time"
 
 	"github.com/pddg/photon-container/internal/logging"
@@ -14,7 +17,10 @@ import (
 
 type Migrator interface {
 	State(ctx context.Context) (photondata.MigrationState, time.Time)
+	Record() photondata.MigrationRecord
 	ResetState(ctx context.Context)
+	Generations() ([]photondata.Generation, error)
+	Ping(ctx context.Context) (time.Time, error)
 }
 
 type MigrateStatusHandler struct {
@@ -35,12 +41,22 @@ func NewMigrateStatusHandler(migrator Migrator) *MigrateStatusHandler {
 
 func (h *MigrateStatusHandler) get(w http.ResponseWriter, r *http.Request) {
 	state, version := h.migrator.State(r.Context())
+	record := h.migrator.Record()
 	res := struct {
 		State   string `json:"state"`
 		Version string `json:"version"`
+		// The details of the last migration.
+		Phase     string `json:"phase,omitempty"`
+		Reason    string `json:"reason,omitempty"`
+		UpdatedAt string `json:"updated_at,omitempty"`
 	}{
 		State:   string(state),
 		Version: version.Format(time.RFC3339),
+		Phase:   string(record.Phase),
+		Reason:  record.Reason,
+	}
+	if !record.UpdatedAt.IsZero() {
+		res.UpdatedAt = record.UpdatedAt.Format(time.RFC3339)
 	}
 	resultBytes, err := json.Marshal(res)
 	if err != nil {
@@ -66,6 +82,7 @@ type LocalMigrateHandler struct {
 	ctx      context.Context
 	migrator Migrator
 	updater  updater.UpdaterInterface
+	jobs     JobManager
 	archive  photondata.Archive
 }
 
@@ -73,12 +90,14 @@ func NewLocalMigrateHandler(
 	ctx context.Context,
 	migrator Migrator,
 	updater updater.UpdaterInterface,
+	jobs JobManager,
 	archive photondata.Archive,
 ) *LocalMigrateHandler {
 	return &LocalMigrateHandler{
 		ctx:      ctx,
 		migrator: migrator,
 		updater:  updater,
+		jobs:     jobs,
 		archive:  archive,
 	}
 }
@@ -93,25 +112,69 @@ func (h *LocalMigrateHandler) ServeHTTP(w http.ResponseWriter, r *http.Request)
 	if forceMigrate {
 		options = append(options, updater.WithForceUpdate())
 	}
+	// Do not use r.Context() here. It may be canceled before the update is finished.
+	ctx, job, err := h.jobs.StartIfIdle(h.ctx, updater.JobKindDownload)
+	if err != nil {
+		writeJSON(w, http.StatusConflict, errorResponse{Error: updater.ErrJobRunning.Error()})
+		return
+	}
 	go func() {
-		// Do not use r.Context() here. It may be canceled before the update is finished.
-		if err := h.updater.DownloadAndUpdate(h.ctx, h.archive, options...); err != nil {
-			logging.FromContext(h.ctx).ErrorContext(h.ctx, "failed to update", "error", err)
+		// The update skipped as up to date is logged by the updater.
+		if err := h.updater.DownloadAndUpdate(ctx, h.archive, options...); err != nil && !errors.Is(err, updater.ErrUpToDate) {
+			logging.FromContext(ctx).ErrorContext(ctx, "failed to update", "error", err)
 		}
 	}()
-	w.WriteHeader(http.StatusOK)
-	w.Write([]byte("migration started. Check logs if you want to know the progress"))
+	writeJSON(w, http.StatusOK, jobStartedResponse{
+		JobID:   job.ID(),
+		Message: "migration started. Check /jobs/" + job.ID() + " if you want to know the progress",
+	})
+}
+
+// FreshnessChecker decides whether the archive is new enough to replace the live database.
+type FreshnessChecker interface {
+	Check(ctx context.Context, archive photondata.Archive) (updater.Decision, error)
+}
+
+type MigrateCheckHandler struct {
+	checker FreshnessChecker
+	archive photondata.Archive
+}
+
+// NewMigrateCheckHandler creates a new MigrateCheckHandler.
+// It tells whether `POST /migrate/download` would update the database, and why, without starting it.
+func NewMigrateCheckHandler(checker FreshnessChecker, archive photondata.Archive) *MigrateCheckHandler {
+	return &MigrateCheckHandler{
+		checker: checker,
+		archive: archive,
+	}
+}
+
+func (h *MigrateCheckHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	archive := h.archive
+	if userSpecified := r.URL.Query().Get("archive"); userSpecified != "" {
+		archive = archive.FromArchiveName(userSpecified)
+	}
+	decision, err := h.checker.Check(ctx, archive)
+	if err != nil {
+		logging.FromContext(ctx).ErrorContext(ctx, "failed to check archive", "error", err)
+		writeJSON(w, http.StatusInternalServerError, errorResponse{Error: err.Error()})
+		return
+	}
+	writeJSON(w, http.StatusOK, decision)
 }
 
 type MigrateHandler struct {
 	ctx     context.Context
 	updater updater.UpdaterInterface
+	jobs    JobManager
 }
 
-func NewMigrateHandler(ctx context.Context, updater updater.UpdaterInterface) *MigrateHandler {
+func NewMigrateHandler(ctx context.Context, updater updater.UpdaterInterface, jobs JobManager) *MigrateHandler {
 	return &MigrateHandler{
 		ctx:     ctx,
 		updater: updater,
+		jobs:    jobs,
 	}
 }
 
@@ -120,18 +183,174 @@ func (h *MigrateHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	if r.URL.Query().Get("force") == "true" {
 		options = append(options, updater.WithForceUpdate())
 	}
+	// The compression is detected from the archive unless it is specified.
+	if compressionName := r.URL.Query().Get("compression"); compressionName != "" {
+		compression, err := unarchiver.ParseCompression(compressionName)
+		if err != nil {
+			r.Body.Close()
+			writeJSON(w, http.StatusBadRequest, errorResponse{Error: err.Error()})
+			return
+		}
+		options = append(options, updater.WithUnarchiveOptions(
+			unarchiver.WithCompression(compression),
+		))
+	}
 	if r.URL.Query().Get("no_compression") == "true" {
 		options = append(options, updater.WithUnarchiveOptions(
 			unarchiver.NoCompression(),
 		))
 	}
-	if err := h.updater.UpdateAsync(h.ctx, r.Body, options...); err != nil {
-		logging.FromContext(h.ctx).ErrorContext(h.ctx, "failed to update", "error", err)
+	// The body is the rest of the uncompressed tar stream when the interrupted upload is resumed.
+	if offsetStr := r.URL.Query().Get("offset"); offsetStr != "" {
+		offset, err := strconv.ParseInt(offsetStr, 10, 64)
+		if err != nil || offset < 0 {
+			r.Body.Close()
+			writeJSON(w, http.StatusBadRequest, errorResponse{Error: fmt.Sprintf("invalid offset %q", offsetStr)})
+			return
+		}
+		options = append(options, updater.WithUnarchiveOptions(
+			unarchiver.WithResumeOffset(offset),
+		))
+	}
+	// The size is used to check the free space before the existing database is touched.
+	uncompressed := r.URL.Query().Get("no_compression") == "true" || r.URL.Query().Get("compression") == "none"
+	if sizeStr := r.URL.Query().Get("uncompressed_size"); sizeStr != "" {
+		size, err := strconv.ParseInt(sizeStr, 10, 64)
+		if err != nil || size < 0 {
+			r.Body.Close()
+			writeJSON(w, http.StatusBadRequest, errorResponse{Error: fmt.Sprintf("invalid uncompressed size %q", sizeStr)})
+			return
+		}
+		options = append(options, updater.WithUncompressedSize(size))
+	} else if r.ContentLength > 0 && uncompressed {
+		options = append(options, updater.WithUncompressedSize(r.ContentLength))
+	} else if r.ContentLength > 0 {
+		options = append(options, updater.WithUploadSize(r.ContentLength))
+	}
+	ctx, job, err := h.jobs.StartIfIdle(h.ctx, updater.JobKindUpload)
+	if err != nil {
+		// Another update is writing the partial files.
+		r.Body.Close()
+		writeJSON(w, http.StatusConflict, errorResponse{Error: updater.ErrJobRunning.Error()})
+		return
+	}
+	if err := h.updater.UpdateAsync(ctx, r.Body, options...); err != nil {
+		logging.FromContext(ctx).ErrorContext(ctx, "failed to update", "error", err)
 		// Stop unnecessary request body reading.
 		r.Body.Close()
+		var unsafeErr *unarchiver.UnsafeEntryError
+		if errors.As(err, &unsafeErr) {
+			// The archive is rejected. Tell the caller which entry is the cause.
+			writeJSON(w, http.StatusUnprocessableEntity, unsafeEntryResponse{
+				Error:  unsafeErr.Error(),
+				Entry:  unsafeErr.Name,
+				Reason: unsafeErr.Reason,
+			})
+			return
+		}
+		var spaceErr *updater.InsufficientSpaceError
+		if errors.As(err, &spaceErr) {
+			writeJSON(w, http.StatusInsufficientStorage, insufficientSpaceResponse{
+				Error:          spaceErr.Error(),
+				RequiredBytes:  spaceErr.RequiredBytes(),
+				AvailableBytes: spaceErr.AvailableBytes(),
+				Estimated:      spaceErr.Estimated,
+			})
+			return
+		}
+		if errors.Is(err, unarchiver.ErrCheckpointMismatch) {
+			// The caller has to ask the accepted offset again.
+			writeJSON(w, http.StatusConflict, errorResponse{Error: err.Error()})
+			return
+		}
+		var interrupted *unarchiver.InterruptedError
+		if errors.As(err, &interrupted) {
+			// The extracted entries are kept. The caller can resume the upload from the offset.
+			writeJSON(w, http.StatusConflict, interruptedUploadResponse{
+				Error:  interrupted.Error(),
+				Offset: interrupted.Offset,
+			})
+			return
+		}
+		writeJSON(w, http.StatusInternalServerError, errorResponse{Error: err.Error()})
+		return
+	}
+	writeJSON(w, http.StatusOK, jobStartedResponse{
+		JobID:   job.ID(),
+		Message: "migration started. Check /jobs/" + job.ID() + " if you want to know the progress",
+	})
+}
+
+type UploadOffsetHandler struct {
+	updater updater.UpdaterInterface
+}
+
+// NewUploadOffsetHandler creates a new UploadOffsetHandler.
+// It tells the offset of the tar stream from which the interrupted upload can be resumed.
+func NewUploadOffsetHandler(updater updater.UpdaterInterface) *UploadOffsetHandler {
+	return &UploadOffsetHandler{
+		updater: updater,
+	}
+}
+
+func (h *UploadOffsetHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	checkpoint, err := h.updater.UploadCheckpoint(ctx)
+	if err != nil {
+		logging.FromContext(ctx).ErrorContext(ctx, "failed to read upload checkpoint", "error", err)
+		writeJSON(w, http.StatusInternalServerError, errorResponse{Error: err.Error()})
+		return
+	}
+	// Offset 0 means that there is no interrupted upload.
+	res := uploadOffsetResponse{}
+	if checkpoint != nil {
+		res = uploadOffsetResponse{
+			Offset:    checkpoint.Offset,
+			Entries:   checkpoint.Entries,
+			LastEntry: checkpoint.LastEntry,
+			UpdatedAt: checkpoint.UpdatedAt.Format(time.RFC3339),
+		}
+	}
+	writeJSON(w, http.StatusOK, res)
+}
+
+type uploadOffsetResponse struct {
+	Offset    int64  `json:"offset"`
+	Entries   int    `json:"entries,omitempty"`
+	LastEntry string `json:"last_entry,omitempty"`
+	UpdatedAt string `json:"updated_at,omitempty"`
+}
+
+type interruptedUploadResponse struct {
+	Error  string `json:"error"`
+	Offset int64  `json:"offset"`
+}
+
+type errorResponse struct {
+	Error string `json:"error"`
+}
+
+type insufficientSpaceResponse struct {
+	Error          string `json:"error"`
+	RequiredBytes  uint64 `json:"required_bytes"`
+	AvailableBytes uint64 `json:"available_bytes"`
+	// Estimated is true if the required space is estimated from the size of the compressed archive.
+	Estimated bool `json:"estimated"`
+}
+
+type unsafeEntryResponse struct {
+	Error  string `json:"error"`
+	Entry  string `json:"entry"`
+	Reason string `json:"reason"`
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	resultBytes, err := json.Marshal(v)
+	if err != nil {
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
-	w.WriteHeader(http.StatusOK)
-	w.Write([]byte("migration started. Check logs if you want to know the progress"))
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(resultBytes)
 }
@@ -0,0 +1,190 @@
+package server_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/pddg/photon-container/internal/photondata"
+	"github.com/pddg/photon-container/internal/server"
+	"github.com/pddg/photon-container/internal/unarchiver"
+	"github.com/pddg/photon-container/internal/updater"
+)
+
+// stubUpdater starts no update. The jobs are kept running.
+type stubUpdater struct {
+	// updateErr is returned by UpdateAsync.
+	updateErr error
+	uploads   atomic.Int32
+}
+
+func (u *stubUpdater) DownloadAndUpdate(ctx context.Context, archive photondata.Archive, options ...updater.UpdateOption) error {
+	return nil
+}
+
+func (u *stubUpdater) UpdateAsync(ctx context.Context, archive io.Reader, options ...updater.UpdateOption) error {
+	u.uploads.Add(1)
+	return u.updateErr
+}
+
+func (u *stubUpdater) UploadCheckpoint(ctx context.Context) (*unarchiver.Checkpoint, error) {
+	return nil, nil
+}
+
+type stubActivator struct{}
+
+func (a *stubActivator) Activate(ctx context.Context, id string) error {
+	return nil
+}
+
+func Test_Handlers_JobRunning(t *testing.T) {
+	t.Parallel()
+	archive, err := photondata.NewArchive("https://example.com/photon-db.tar.bz2")
+	require.NoError(t, err)
+	migrator := &stubMigrator{generations: []photondata.Generation{{ID: "20251001T000000Z"}}}
+	testCases := []struct {
+		name       string
+		newHandler func(ctx context.Context, u *stubUpdater, jobs *updater.JobManager) http.Handler
+		newRequest func() *http.Request
+	}{
+		{
+			name: "download",
+			newHandler: func(ctx context.Context, u *stubUpdater, jobs *updater.JobManager) http.Handler {
+				return server.NewLocalMigrateHandler(ctx, migrator, u, jobs, archive)
+			},
+			newRequest: func() *http.Request {
+				return httptest.NewRequest(http.MethodPost, "/migrate/download", nil)
+			},
+		},
+		{
+			name: "upload",
+			newHandler: func(ctx context.Context, u *stubUpdater, jobs *updater.JobManager) http.Handler {
+				return server.NewMigrateHandler(ctx, u, jobs)
+			},
+			newRequest: func() *http.Request {
+				return httptest.NewRequest(http.MethodPost, "/migrate/upload", strings.NewReader("archive"))
+			},
+		},
+		{
+			name: "activate",
+			newHandler: func(ctx context.Context, u *stubUpdater, jobs *updater.JobManager) http.Handler {
+				return server.NewIndexHandler(ctx, migrator, &stubActivator{}, jobs)
+			},
+			newRequest: func() *http.Request {
+				return httptest.NewRequest(http.MethodPost, "/indexes/20251001T000000Z/activate", nil)
+			},
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+			// Setup
+			jobs := newJobManager(t)
+			u := &stubUpdater{}
+			handler := tc.newHandler(t.Context(), u, jobs)
+			first := httptest.NewRecorder()
+			handler.ServeHTTP(first, tc.newRequest())
+			require.Equal(t, http.StatusOK, first.Code, first.Body.String())
+
+			// Exercise: the first job is still running
+			second := httptest.NewRecorder()
+			handler.ServeHTTP(second, tc.newRequest())
+
+			// Verify
+			assert.Equal(t, http.StatusConflict, second.Code)
+			var res map[string]string
+			require.NoError(t, json.Unmarshal(second.Body.Bytes(), &res))
+			assert.Equal(t, updater.ErrJobRunning.Error(), res["error"])
+			got := jobs.List()
+			require.Len(t, got, 1)
+			assert.Equal(t, updater.JobStateRunning, got[0].State)
+			if tc.name == "upload" {
+				// The second archive is not passed to the updater.
+				assert.Equal(t, int32(1), u.uploads.Load())
+			}
+		})
+	}
+}
+
+func Test_MigrateHandler_Error(t *testing.T) {
+	t.Parallel()
+	testCases := []struct {
+		name       string
+		query      string
+		updateErr  error
+		wantStatus int
+		wantError  string
+		wantOffset int64
+	}{
+		{
+			name:       "invalid compression",
+			query:      "?compression=lzma",
+			wantStatus: http.StatusBadRequest,
+			wantError:  "lzma",
+		},
+		{
+			name:       "invalid offset",
+			query:      "?offset=-1",
+			wantStatus: http.StatusBadRequest,
+			wantError:  `invalid offset "-1"`,
+		},
+		{
+			name:       "invalid uncompressed size",
+			query:      "?uncompressed_size=abc",
+			wantStatus: http.StatusBadRequest,
+			wantError:  `invalid uncompressed size "abc"`,
+		},
+		{
+			name:       "offset does not match the checkpoint",
+			query:      "?offset=1024",
+			updateErr:  fmt.Errorf("failed to resume: %w", unarchiver.ErrCheckpointMismatch),
+			wantStatus: http.StatusConflict,
+			wantError:  unarchiver.ErrCheckpointMismatch.Error(),
+		},
+		{
+			name:       "interrupted upload",
+			updateErr:  fmt.Errorf("failed to unarchive: %w", &unarchiver.InterruptedError{Offset: 2048, Err: io.ErrUnexpectedEOF}),
+			wantStatus: http.StatusConflict,
+			wantError:  "resumable from offset 2048",
+			wantOffset: 2048,
+		},
+		{
+			name:       "failed to update",
+			updateErr:  errors.New("disk is broken"),
+			wantStatus: http.StatusInternalServerError,
+			wantError:  "disk is broken",
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+			// Setup
+			handler := server.NewMigrateHandler(t.Context(), &stubUpdater{updateErr: tc.updateErr}, newJobManager(t))
+			rec := httptest.NewRecorder()
+
+			// Exercise
+			handler.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/migrate/upload"+tc.query, strings.NewReader("archive")))
+
+			// Verify
+			assert.Equal(t, tc.wantStatus, rec.Code)
+			assert.Equal(t, "application/json", rec.Header().Get("Content-Type"))
+			var res struct {
+				Error  string `json:"error"`
+				Offset int64  `json:"offset"`
+			}
+			require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &res), rec.Body.String())
+			assert.Contains(t, res.Error, tc.wantError)
+			assert.Equal(t, tc.wantOffset, res.Offset)
+		})
+	}
+}
@@ -0,0 +1,166 @@
+package server
+
+import (
+	"errors"
+	"math"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/pddg/photon-container/internal/logging"
+	"github.com/pddg/photon-container/internal/photondata"
+	"github.com/pddg/photon-container/internal/updater"
+)
+
+// defaultRetryAfter is the Retry-After during the migration when its completion time cannot be estimated.
+const defaultRetryAfter = 30 * time.Second
+
+// minRetryAfter is the lower bound of the Retry-After, so that clients do not retry too eagerly
+// when the migration takes longer than the estimation.
+const minRetryAfter = 5 * time.Second
+
+// ProxyObserver observes the requests proxied to Photon.
+type ProxyObserver interface {
+	Observe(route string, code int, duration time.Duration)
+}
+
+type PhotonProxy struct {
+	migrator Migrator
+	jobs     JobManager
+	observer ProxyObserver
+	proxy    *httputil.ReverseProxy
+	mux      *http.ServeMux
+}
+
+// NewPhotonProxy creates a new PhotonProxy.
+// It forwards the geocoding requests to the Photon server at the URL returned by target, which is called for each request.
+// While the database is being migrated, it answers 503 with the expected completion time instead.
+// The observer may be nil.
+func NewPhotonProxy(target func() *url.URL, migrator Migrator, jobs JobManager, observer ProxyObserver) *PhotonProxy {
+	p := &PhotonProxy{
+		migrator: migrator,
+		jobs:     jobs,
+		observer: observer,
+		mux:      http.NewServeMux(),
+	}
+	p.proxy = &httputil.ReverseProxy{
+		Rewrite: func(r *httputil.ProxyRequest) {
+			r.SetURL(target())
+			r.SetXForwarded()
+		},
+		ErrorHandler: p.handleError,
+	}
+	for _, route := range []string{"/api", "/reverse", "/status"} {
+		// The paths under the route, such as `/api/`, are observed as the route.
+		p.mux.Handle("GET "+route, p.handle(route))
+		p.mux.Handle("GET "+route+"/", p.handle(route))
+	}
+	return p
+}
+
+type maintenanceResponse struct {
+	Error string `json:"error"`
+	State string `json:"state"`
+	Phase string `json:"phase,omitempty"`
+	JobID string `json:"job_id,omitempty"`
+	// ExpectedCompletion is estimated from the duration of the last successful job of the same kind.
+	ExpectedCompletion *time.Time `json:"expected_completion,omitempty"`
+	// RetryAfter is the same as the Retry-After header in seconds.
+	RetryAfter int `json:"retry_after"`
+}
+
+func (p *PhotonProxy) handle(route string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		writer := &statusRecorder{ResponseWriter: w, statusCode: http.StatusOK}
+		start := time.Now()
+		if record := p.migrator.Record(); record.State == photondata.MigrationStateMigrating && !record.KeepsServing() {
+			p.writeMaintenance(writer)
+		} else {
+			p.proxy.ServeHTTP(writer, r)
+		}
+		if p.observer != nil {
+			p.observer.Observe(route, writer.statusCode, time.Since(start))
+		}
+	})
+}
+
+// handleError answers the maintenance response if Photon is down because of the job, such as the activation
+// which restarts Photon before the migration begins.
+func (p *PhotonProxy) handleError(w http.ResponseWriter, r *http.Request, err error) {
+	if errors.Is(err, r.Context().Err()) {
+		// The client has gone away.
+		w.WriteHeader(http.StatusBadGateway)
+		return
+	}
+	if _, running := p.runningJob(); running {
+		p.writeMaintenance(w)
+		return
+	}
+	logging.FromContext(r.Context()).WarnContext(r.Context(), "failed to proxy request to photon", "url", r.URL.String(), "error", err)
+	writeJSON(w, http.StatusBadGateway, errorResponse{Error: "photon is not available"})
+}
+
+func (p *PhotonProxy) writeMaintenance(w http.ResponseWriter) {
+	record := p.migrator.Record()
+	res := maintenanceResponse{
+		Error: "the database of photon is being updated",
+		State: string(record.State),
+		Phase: string(record.Phase),
+	}
+	retryAfter := defaultRetryAfter
+	if job, running := p.runningJob(); running {
+		res.JobID = job.ID
+		if expected, ok := p.expectedCompletion(job); ok {
+			res.ExpectedCompletion = &expected
+			retryAfter = max(time.Until(expected), minRetryAfter)
+		}
+	}
+	res.RetryAfter = int(math.Ceil(retryAfter.Seconds()))
+	w.Header().Set("Retry-After", strconv.Itoa(res.RetryAfter))
+	writeJSON(w, http.StatusServiceUnavailable, res)
+}
+
+func (p *PhotonProxy) runningJob() (updater.JobStatus, bool) {
+	for _, job := range p.jobs.List() {
+		if job.State == updater.JobStateRunning {
+			return job, true
+		}
+	}
+	return updater.JobStatus{}, false
+}
+
+// expectedCompletion estimates when the running job finishes from the last successful job of the same kind.
+func (p *PhotonProxy) expectedCompletion(running updater.JobStatus) (time.Time, bool) {
+	// The jobs are listed from the newest.
+	for _, job := range p.jobs.List() {
+		if job.ID == running.ID || job.Kind != running.Kind || job.Strategy != running.Strategy {
+			continue
+		}
+		if job.State != updater.JobStateSucceeded || job.FinishedAt == nil {
+			continue
+		}
+		return running.StartedAt.Add(job.FinishedAt.Sub(job.StartedAt)).UTC(), true
+	}
+	return time.Time{}, false
+}
+
+func (p *PhotonProxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	p.mux.ServeHTTP(w, r)
+}
+
+type statusRecorder struct {
+	http.ResponseWriter
+	statusCode int
+}
+
+func (r *statusRecorder) WriteHeader(statusCode int) {
+	r.statusCode = statusCode
+	r.ResponseWriter.WriteHeader(statusCode)
+}
+
+// Unwrap returns the original ResponseWriter, so that the proxy can flush the response.
+func (r *statusRecorder) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+}
@@ -0,0 +1,241 @@
+package server_test
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/pddg/photon-container/internal/photondata"
+	"github.com/pddg/photon-container/internal/server"
+	"github.com/pddg/photon-container/internal/updater"
+)
+
+// stubMigrator implements the methods of server.Migrator used by the handlers.
+type stubMigrator struct {
+	server.Migrator
+	record      photondata.MigrationRecord
+	generations []photondata.Generation
+}
+
+func (m *stubMigrator) Record() photondata.MigrationRecord {
+	return m.record
+}
+
+func (m *stubMigrator) Generations() ([]photondata.Generation, error) {
+	return m.generations, nil
+}
+
+type observation struct {
+	route string
+	code  int
+}
+
+type recordingObserver struct {
+	mutex        sync.Mutex
+	observations []observation
+}
+
+func (o *recordingObserver) Observe(route string, code int, duration time.Duration) {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	o.observations = append(o.observations, observation{route: route, code: code})
+}
+
+// newFakePhoton returns a server which answers the path of the request.
+func newFakePhoton(t *testing.T) *url.URL {
+	t.Helper()
+	photon := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(r.URL.Path))
+	}))
+	t.Cleanup(photon.Close)
+	target, err := url.Parse(photon.URL)
+	require.NoError(t, err)
+	return target
+}
+
+// unreachable returns the URL which nothing listens on.
+func unreachable(t *testing.T) *url.URL {
+	t.Helper()
+	photon := httptest.NewServer(http.NotFoundHandler())
+	target, err := url.Parse(photon.URL)
+	require.NoError(t, err)
+	photon.Close()
+	return target
+}
+
+func newJobManager(t *testing.T, history ...updater.JobStatus) *updater.JobManager {
+	t.Helper()
+	historyPath := filepath.Join(t.TempDir(), "jobs.json")
+	if len(history) > 0 {
+		historyBytes, err := json.Marshal(history)
+		require.NoError(t, err)
+		require.NoError(t, os.WriteFile(historyPath, historyBytes, 0644))
+	}
+	jobs, err := updater.NewJobManager(t.Context(), updater.UpdateStrategySequential, historyPath)
+	require.NoError(t, err)
+	return jobs
+}
+
+func Test_PhotonProxy_Proxy(t *testing.T) {
+	t.Parallel()
+	testCases := []struct {
+		path      string
+		wantRoute string
+	}{
+		{path: "/api?q=Berlin", wantRoute: "/api"},
+		{path: "/api/?q=Berlin", wantRoute: "/api"},
+		{path: "/reverse?lon=13.4&lat=52.5", wantRoute: "/reverse"},
+		{path: "/reverse/?lon=13.4&lat=52.5", wantRoute: "/reverse"},
+		{path: "/status", wantRoute: "/status"},
+		{path: "/status/", wantRoute: "/status"},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.path, func(t *testing.T) {
+			t.Parallel()
+			// Setup
+			target := newFakePhoton(t)
+			observer := &recordingObserver{}
+			proxy := server.NewPhotonProxy(func() *url.URL { return target }, &stubMigrator{}, newJobManager(t), observer)
+			req := httptest.NewRequest(http.MethodGet, tc.path, nil)
+			rec := httptest.NewRecorder()
+
+			// Exercise
+			proxy.ServeHTTP(rec, req)
+
+			// Verify
+			assert.Equal(t, http.StatusOK, rec.Code)
+			assert.Equal(t, req.URL.Path, rec.Body.String())
+			assert.Equal(t, []observation{{route: tc.wantRoute, code: http.StatusOK}}, observer.observations)
+		})
+	}
+	t.Run("other paths are not proxied", func(t *testing.T) {
+		t.Parallel()
+		// Setup
+		target := newFakePhoton(t)
+		proxy := server.NewPhotonProxy(func() *url.URL { return target }, &stubMigrator{}, newJobManager(t), nil)
+		rec := httptest.NewRecorder()
+
+		// Exercise
+		proxy.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/migrate/status", nil))
+
+		// Verify
+		assert.Equal(t, http.StatusNotFound, rec.Code)
+	})
+}
+
+func Test_PhotonProxy_Maintenance(t *testing.T) {
+	t.Parallel()
+	migrating := photondata.MigrationRecord{State: photondata.MigrationStateMigrating, Phase: photondata.MigrationPhaseSwapping}
+	t.Run("default Retry-After without running job", func(t *testing.T) {
+		t.Parallel()
+		// Setup
+		target := newFakePhoton(t)
+		proxy := server.NewPhotonProxy(func() *url.URL { return target }, &stubMigrator{record: migrating}, newJobManager(t), nil)
+		rec := httptest.NewRecorder()
+
+		// Exercise
+		proxy.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/api?q=Berlin", nil))
+
+		// Verify
+		assert.Equal(t, http.StatusServiceUnavailable, rec.Code)
+		assert.Equal(t, "30", rec.Header().Get("Retry-After"))
+		var got map[string]any
+		require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &got))
+		assert.Equal(t, "migrating", got["state"])
+		assert.Equal(t, "swapping", got["phase"])
+		assert.EqualValues(t, 30, got["retry_after"])
+		assert.NotContains(t, got, "expected_completion")
+	})
+	t.Run("expected completion from the last job", func(t *testing.T) {
+		t.Parallel()
+		// Setup
+		// The last update took an hour.
+		startedAt := time.Now().UTC().Add(-3 * time.Hour)
+		finishedAt := startedAt.Add(time.Hour)
+		jobs := newJobManager(t, updater.JobStatus{
+			ID:         "last",
+			Kind:       updater.JobKindDownload,
+			Strategy:   updater.UpdateStrategySequential,
+			State:      updater.JobStateSucceeded,
+			StartedAt:  startedAt,
+			FinishedAt: &finishedAt,
+		})
+		_, job := jobs.Start(t.Context(), updater.JobKindDownload)
+		target := newFakePhoton(t)
+		proxy := server.NewPhotonProxy(func() *url.URL { return target }, &stubMigrator{record: migrating}, jobs, nil)
+		rec := httptest.NewRecorder()
+
+		// Exercise
+		proxy.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/reverse/?lon=13.4&lat=52.5", nil))
+
+		// Verify
+		assert.Equal(t, http.StatusServiceUnavailable, rec.Code)
+		var got struct {
+			JobID              string    `json:"job_id"`
+			ExpectedCompletion time.Time `json:"expected_completion"`
+			RetryAfter         int       `json:"retry_after"`
+		}
+		require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &got))
+		assert.Equal(t, job.ID(), got.JobID)
+		assert.Equal(t, job.Status().StartedAt.Add(time.Hour), got.ExpectedCompletion)
+		assert.InDelta(t, 3600, got.RetryAfter, 5)
+		assert.Equal(t, strconv.Itoa(got.RetryAfter), rec.Header().Get("Retry-After"))
+	})
+	t.Run("proxied while the previous database keeps serving", func(t *testing.T) {
+		t.Parallel()
+		// Setup
+		target := newFakePhoton(t)
+		record := photondata.MigrationRecord{State: photondata.MigrationStateMigrating, Phase: photondata.MigrationPhaseStandby}
+		proxy := server.NewPhotonProxy(func() *url.URL { return target }, &stubMigrator{record: record}, newJobManager(t), nil)
+		rec := httptest.NewRecorder()
+
+		// Exercise
+		proxy.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/api?q=Berlin", nil))
+
+		// Verify
+		assert.Equal(t, http.StatusOK, rec.Code)
+	})
+	t.Run("photon is down for the running job", func(t *testing.T) {
+		t.Parallel()
+		// Setup
+		target := unreachable(t)
+		jobs := newJobManager(t)
+		jobs.Start(t.Context(), updater.JobKindActivate)
+		proxy := server.NewPhotonProxy(func() *url.URL { return target }, &stubMigrator{}, jobs, nil)
+		rec := httptest.NewRecorder()
+
+		// Exercise
+		proxy.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/api?q=Berlin", nil))
+
+		// Verify
+		assert.Equal(t, http.StatusServiceUnavailable, rec.Code)
+		assert.Equal(t, "30", rec.Header().Get("Retry-After"))
+	})
+	t.Run("photon is down without job", func(t *testing.T) {
+		t.Parallel()
+		// Setup
+		target := unreachable(t)
+		proxy := server.NewPhotonProxy(func() *url.URL { return target }, &stubMigrator{}, newJobManager(t), nil)
+		rec := httptest.NewRecorder()
+
+		// Exercise
+		proxy.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/api?q=Berlin", nil))
+
+		// Verify
+		assert.Equal(t, http.StatusBadGateway, rec.Code)
+		body, err := io.ReadAll(rec.Body)
+		require.NoError(t, err)
+		assert.Contains(t, string(body), "photon is not available")
+	})
+}
@@ -0,0 +1,128 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/pddg/photon-container/internal/photondata"
+)
+
+// readinessCacheTTL is how long the result of the check of Photon is reused, so that frequent probes do not load Photon.
+const readinessCacheTTL = 5 * time.Second
+
+// readinessCheckTimeout is the timeout of the check of Photon, which may hang while it is starting.
+const readinessCheckTimeout = 3 * time.Second
+
+type ReadinessHandler struct {
+	migrator Migrator
+
+	mutex       sync.Mutex
+	checkedAt   time.Time
+	photonCheck photonCheckResult
+}
+
+// NewReadinessHandler creates a new ReadinessHandler.
+// It reports whether Photon can answer the queries.
+// The migration in progress makes it not ready, unless `?migrating=ready` is given.
+func NewReadinessHandler(migrator Migrator) *ReadinessHandler {
+	return &ReadinessHandler{
+		migrator: migrator,
+	}
+}
+
+type readinessResponse struct {
+	Status string          `json:"status"`
+	Checks readinessChecks `json:"checks"`
+}
+
+type readinessChecks struct {
+	Photon    photonCheckResult    `json:"photon"`
+	Migration migrationCheckResult `json:"migration"`
+}
+
+type photonCheckResult struct {
+	Status     string `json:"status"`
+	ImportDate string `json:"import_date,omitempty"`
+	Error      string `json:"error,omitempty"`
+	CheckedAt  string `json:"checked_at"`
+}
+
+type migrationCheckResult struct {
+	Status string `json:"status"`
+	State  string `json:"state"`
+	Phase  string `json:"phase,omitempty"`
+}
+
+const (
+	checkStatusOK        = "ok"
+	checkStatusFail      = "fail"
+	checkStatusMigrating = "migrating"
+)
+
+func (h *ReadinessHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	res := readinessResponse{
+		Checks: readinessChecks{
+			Photon:    h.checkPhoton(r),
+			Migration: h.checkMigration(),
+		},
+	}
+	ready := res.Checks.Photon.Status == checkStatusOK && res.Checks.Migration.Status == checkStatusOK
+	if res.Checks.Migration.Status == checkStatusMigrating && r.URL.Query().Get("migrating") == "ready" {
+		// Photon is restarted soon. Keep receiving the traffic instead of being taken out.
+		ready = true
+	}
+	if !ready {
+		res.Status = "not_ready"
+		writeJSON(w, http.StatusServiceUnavailable, res)
+		return
+	}
+	res.Status = "ready"
+	writeJSON(w, http.StatusOK, res)
+}
+
+// checkPhoton checks the status of Photon. The result is cached for readinessCacheTTL.
+func (h *ReadinessHandler) checkPhoton(r *http.Request) photonCheckResult {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	if time.Since(h.checkedAt) < readinessCacheTTL {
+		return h.photonCheck
+	}
+	now := time.Now()
+	// The result is shared with other probes. It must not depend on whether this probe has gone away.
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(r.Context()), readinessCheckTimeout)
+	defer cancel()
+	importDate, err := h.migrator.Ping(ctx)
+	if err != nil {
+		h.photonCheck = photonCheckResult{
+			Status: checkStatusFail,
+			Error:  err.Error(),
+		}
+	} else {
+		h.photonCheck = photonCheckResult{
+			Status:     checkStatusOK,
+			ImportDate: importDate.Format(time.RFC3339),
+		}
+	}
+	h.photonCheck.CheckedAt = now.UTC().Format(time.RFC3339)
+	h.checkedAt = now
+	return h.photonCheck
+}
+
+func (h *ReadinessHandler) checkMigration() migrationCheckResult {
+	record := h.migrator.Record()
+	res := migrationCheckResult{
+		Status: checkStatusOK,
+		State:  string(record.State),
+	}
+	if record.State == photondata.MigrationStateMigrating {
+		res.Phase = string(record.Phase)
+		if record.KeepsServing() {
+			// The blue/green migration does not stop Photon.
+			return res
+		}
+		res.Status = checkStatusMigrating
+	}
+	return res
+}
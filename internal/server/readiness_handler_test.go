@@ -0,0 +1,53 @@
+package server_test
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/pddg/photon-container/internal/photondata"
+	"github.com/pddg/photon-container/internal/server"
+)
+
+// pingMigrator answers Ping unless the context is done.
+type pingMigrator struct {
+	stubMigrator
+}
+
+func (m *pingMigrator) Ping(ctx context.Context) (time.Time, error) {
+	if err := ctx.Err(); err != nil {
+		return time.Time{}, err
+	}
+	return time.Date(2025, 10, 1, 0, 0, 0, 0, time.UTC), nil
+}
+
+func Test_ReadinessHandler_CanceledProbe(t *testing.T) {
+	t.Parallel()
+	// Setup
+	handler := server.NewReadinessHandler(&pingMigrator{stubMigrator{record: photondata.MigrationRecord{State: photondata.MigrationStateMigrated}}})
+	ctx, cancel := context.WithCancel(t.Context())
+	cancel()
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/readyz", nil).WithContext(ctx))
+
+	// Exercise: the result of the canceled probe is reused
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+
+	// Verify
+	assert.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	var res struct {
+		Checks struct {
+			Photon struct {
+				Status string `json:"status"`
+			} `json:"photon"`
+		} `json:"checks"`
+	}
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &res))
+	assert.Equal(t, "ok", res.Checks.Photon.Status)
+}
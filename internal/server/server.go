@@ -18,16 +18,30 @@ func NewAPIServer(
 	ctx context.Context,
 	migrator Migrator,
 	updater updater.UpdaterInterface,
+	activator IndexActivator,
+	checker FreshnessChecker,
+	jobs JobManager,
+	supervisor Supervisor,
 	archive photondata.Archive,
 ) *APIServer {
 	mux := http.NewServeMux()
-	mux.HandleFunc("GET /healthz", func(w http.ResponseWriter, r *http.Request) {
-		w.WriteHeader(http.StatusOK)
-	})
+	// /healthz is kept for compatibility. It is the same as /livez.
+	mux.Handle("GET /healthz", NewHealthHandler(supervisor))
+	mux.Handle("GET /livez", NewHealthHandler(supervisor))
+	mux.Handle("GET /readyz", NewReadinessHandler(migrator))
 	mux.Handle("GET /metrics", promhttp.Handler())
 	mux.Handle("/migrate/status", NewMigrateStatusHandler(migrator))
-	mux.Handle("POST /migrate/download", NewLocalMigrateHandler(ctx, migrator, updater, archive))
-	mux.Handle("POST /migrate/upload", NewMigrateHandler(ctx, updater))
+	mux.Handle("POST /migrate/download", NewLocalMigrateHandler(ctx, migrator, updater, jobs, archive))
+	mux.Handle("GET /migrate/check", NewMigrateCheckHandler(checker, archive))
+	mux.Handle("POST /migrate/upload", NewMigrateHandler(ctx, updater, jobs))
+	mux.Handle("GET /migrate/upload/offset", NewUploadOffsetHandler(updater))
+	mux.Handle("POST /migrate/cancel", NewCancelHandler(jobs))
+	mux.Handle("GET /migrate/events", NewEventsHandler(jobs))
+	mux.Handle("GET /jobs", NewJobHandler(jobs))
+	mux.Handle("GET /jobs/{id}", NewJobHandler(jobs))
+	mux.Handle("DELETE /jobs/{id}", NewJobHandler(jobs))
+	mux.Handle("GET /indexes", NewIndexHandler(ctx, migrator, activator, jobs))
+	mux.Handle("POST /indexes/{id}/activate", NewIndexHandler(ctx, migrator, activator, jobs))
 
 	return &APIServer{
 		mux: mux,
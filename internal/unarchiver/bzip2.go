@@ -0,0 +1,405 @@
+package unarchiver
+
+import (
+	"bytes"
+	"compress/bzip2"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"slices"
+	"sync"
+)
+
+const (
+	bzip2BlockMagic = 0x314159265359
+	bzip2FinalMagic = 0x177245385090
+	bzip2MagicMask  = 1<<48 - 1
+
+	// bzip2ReadChunkSize is the size of a read from the compressed stream.
+	bzip2ReadChunkSize = 256 * 1024
+	// maxBzip2SegmentBytes is the maximum size of a compressed block.
+	// A block holds up to 900k bytes, and it is hardly larger than that after compression.
+	maxBzip2SegmentBytes = 4 * 1024 * 1024
+	// maxBzip2Merges is the maximum number of segments merged into a block.
+	// A segment is merged with the next one when a magic number appears in the compressed data by chance.
+	maxBzip2Merges = 8
+)
+
+// bzip2MagicCandidates maps the value of a byte to the bit shifts where a magic number may contain it.
+// Most of the bytes can not be a part of the magic numbers, so that the stream is scanned quickly.
+var bzip2MagicCandidates = func() (table [256]uint8) {
+	for s := range 8 {
+		for _, magic := range []uint64{bzip2BlockMagic, bzip2FinalMagic} {
+			table[byte(magic>>(8-s))] |= 1 << s
+		}
+	}
+	return table
+}()
+
+type bzip2SegmentKind int
+
+const (
+	// bzip2SegmentHeader is the stream header before the first block.
+	bzip2SegmentHeader bzip2SegmentKind = iota
+	// bzip2SegmentBlock is a block starting with the block magic.
+	bzip2SegmentBlock
+	// bzip2SegmentEnd is the end of a stream starting with the final magic.
+	// It contains the header of the next stream if the streams are concatenated.
+	bzip2SegmentEnd
+)
+
+// bzip2Segment is a bit range of the compressed stream between two magic numbers.
+type bzip2Segment struct {
+	kind bzip2SegmentKind
+	// raw holds the bytes containing the bit range. The range starts at the bit off of raw[0].
+	raw   []byte
+	off   int
+	nbits int
+
+	// data and err are the result of decoding. They are available after done is closed.
+	done chan struct{}
+	data []byte
+	err  error
+}
+
+// bits returns the n bits starting at the pos-th bit of the segment.
+func (s *bzip2Segment) bits(pos, n int) uint64 {
+	var v uint64
+	for i := s.off + pos; i < s.off+pos+n; i++ {
+		v = v<<1 | uint64(s.raw[i/8]>>(7-i%8))&1
+	}
+	return v
+}
+
+// crc returns the checksum following the magic number.
+func (s *bzip2Segment) crc() uint32 {
+	return uint32(s.bits(48, 32))
+}
+
+// mergeBzip2Segments returns a segment which covers both of the adjacent segments.
+func mergeBzip2Segments(a, b *bzip2Segment) *bzip2Segment {
+	end := a.off + a.nbits
+	return &bzip2Segment{
+		kind:  a.kind,
+		raw:   append(slices.Clone(a.raw[:end/8]), b.raw...),
+		off:   a.off,
+		nbits: a.nbits + b.nbits,
+	}
+}
+
+// decodeBzip2Segment decodes a block by wrapping it as a stream which has only the block.
+// The checksum of the stream equals to the one of the block.
+// The block size is always 900k since the size of the original stream is unknown here.
+func decodeBzip2Segment(s *bzip2Segment) ([]byte, error) {
+	if s.nbits < 80 {
+		return nil, fmt.Errorf("truncated bzip2 block")
+	}
+	w := &bitWriter{buf: make([]byte, 0, len(s.raw)+16)}
+	w.writeBits('B'<<24|'Z'<<16|'h'<<8|'9', 32)
+	w.writeBitRange(s.raw, s.off, s.nbits)
+	w.writeBits(bzip2FinalMagic, 48)
+	w.writeBits(uint64(s.crc()), 32)
+	return io.ReadAll(bzip2.NewReader(bytes.NewReader(w.buf)))
+}
+
+// bitWriter writes bits from the most significant bit of each byte.
+type bitWriter struct {
+	buf   []byte
+	nbits int
+}
+
+func (w *bitWriter) writeBits(v uint64, n int) {
+	for i := n - 1; i >= 0; i-- {
+		if w.nbits%8 == 0 {
+			w.buf = append(w.buf, 0)
+		}
+		w.buf[len(w.buf)-1] |= (byte(v>>i) & 1) << (7 - w.nbits%8)
+		w.nbits++
+	}
+}
+
+// writeBitRange writes the n bits starting at the off-th bit of src.
+func (w *bitWriter) writeBitRange(src []byte, off, n int) {
+	if w.nbits%8 != 0 {
+		for i := off; i < off+n; i++ {
+			w.writeBits(uint64(src[i/8]>>(7-i%8)), 1)
+		}
+		return
+	}
+	whole := n / 8
+	if off == 0 {
+		w.buf = append(w.buf, src[:whole]...)
+	} else {
+		for i := range whole {
+			w.buf = append(w.buf, src[i]<<off|src[i+1]>>(8-off))
+		}
+	}
+	w.nbits += whole * 8
+	for i := off + whole*8; i < off+n; i++ {
+		w.writeBits(uint64(src[i/8]>>(7-i%8)), 1)
+	}
+}
+
+// parallelBzip2Reader decompresses a bzip2 stream using multiple goroutines.
+// The compressed stream is split into blocks by their magic numbers, and the blocks are decoded concurrently.
+// The decoded blocks are returned in the original order. Concatenated streams such as the output of pbzip2 are supported.
+type parallelBzip2Reader struct {
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+
+	jobs    chan *bzip2Segment
+	ordered chan *bzip2Segment
+	scanErr error
+
+	// state of the consumer
+	pending     []byte
+	err         error
+	fileCRC     uint32
+	streamEnded bool
+}
+
+func newParallelBzip2Reader(ctx context.Context, archive io.Reader, workers int) *parallelBzip2Reader {
+	ctx, cancel := context.WithCancel(ctx)
+	r := &parallelBzip2Reader{
+		ctx:    ctx,
+		cancel: cancel,
+		jobs:   make(chan *bzip2Segment, workers),
+		// Limit the number of blocks held in memory.
+		ordered: make(chan *bzip2Segment, workers*2),
+	}
+	r.wg.Add(1 + workers)
+	go func() {
+		defer r.wg.Done()
+		r.scanErr = r.scan(archive)
+		close(r.jobs)
+		close(r.ordered)
+	}()
+	for range workers {
+		go func() {
+			defer r.wg.Done()
+			r.decode()
+		}()
+	}
+	return r
+}
+
+// scan splits the compressed stream into segments.
+func (r *parallelBzip2Reader) scan(archive io.Reader) error {
+	header := make([]byte, 4)
+	if _, err := io.ReadFull(archive, header); err != nil {
+		return fmt.Errorf("failed to read bzip2 header: %w", err)
+	}
+	if header[0] != 'B' || header[1] != 'Z' || header[2] != 'h' || header[3] < '1' || header[3] > '9' {
+		return bzip2.StructuralError("bad magic value")
+	}
+	var (
+		// buf holds the bytes from bufBase to pos.
+		buf     = header
+		bufBase int64
+		pos     = int64(len(header))
+		window  = uint64(header[0])<<24 | uint64(header[1])<<16 | uint64(header[2])<<8 | uint64(header[3])
+		// start is the bit offset of the current segment.
+		start int64
+		kind  = bzip2SegmentHeader
+	)
+	emit := func(end int64, next bzip2SegmentKind) error {
+		seg := &bzip2Segment{
+			kind:  kind,
+			raw:   slices.Clone(buf[start/8-bufBase : (end+7)/8-bufBase]),
+			off:   int(start % 8),
+			nbits: int(end - start),
+			done:  make(chan struct{}),
+		}
+		buf = buf[end/8-bufBase:]
+		bufBase = end / 8
+		start = end
+		kind = next
+		return r.dispatch(seg)
+	}
+	chunk := make([]byte, bzip2ReadChunkSize)
+	for {
+		n, err := archive.Read(chunk)
+		buf = append(buf, chunk[:n]...)
+		for _, b := range chunk[:n] {
+			window = window<<8 | uint64(b)
+			pos++
+			shifts := bzip2MagicCandidates[byte(window>>8)]
+			if shifts == 0 {
+				continue
+			}
+			for s := 7; s >= 0; s-- {
+				if shifts&(1<<s) == 0 {
+					continue
+				}
+				var next bzip2SegmentKind
+				switch (window >> s) & bzip2MagicMask {
+				case bzip2BlockMagic:
+					next = bzip2SegmentBlock
+				case bzip2FinalMagic:
+					next = bzip2SegmentEnd
+				default:
+					continue
+				}
+				markerStart := pos*8 - int64(s) - 48
+				if markerStart < 32 || (kind != bzip2SegmentHeader && markerStart < start+48) {
+					continue
+				}
+				if err := emit(markerStart, next); err != nil {
+					return err
+				}
+			}
+		}
+		if len(buf) > maxBzip2SegmentBytes {
+			return bzip2.StructuralError("block is too large")
+		}
+		if errors.Is(err, io.EOF) {
+			return emit(pos*8, kind)
+		}
+		if err != nil {
+			return fmt.Errorf("failed to read bzip2 stream: %w", err)
+		}
+		if err := r.ctx.Err(); err != nil {
+			return err
+		}
+	}
+}
+
+// dispatch passes the segment to the consumer, and to the workers if it is a block.
+func (r *parallelBzip2Reader) dispatch(seg *bzip2Segment) error {
+	select {
+	case r.ordered <- seg:
+	case <-r.ctx.Done():
+		return r.ctx.Err()
+	}
+	if seg.kind != bzip2SegmentBlock {
+		close(seg.done)
+		return nil
+	}
+	select {
+	case r.jobs <- seg:
+	case <-r.ctx.Done():
+		return r.ctx.Err()
+	}
+	return nil
+}
+
+func (r *parallelBzip2Reader) decode() {
+	for {
+		select {
+		case seg, ok := <-r.jobs:
+			if !ok {
+				return
+			}
+			seg.data, seg.err = decodeBzip2Segment(seg)
+			close(seg.done)
+		case <-r.ctx.Done():
+			return
+		}
+	}
+}
+
+// receive returns the next segment in the original order.
+// nil is returned when there are no more segments.
+func (r *parallelBzip2Reader) receive() (*bzip2Segment, error) {
+	select {
+	case seg, ok := <-r.ordered:
+		if !ok {
+			return nil, r.scanErr
+		}
+		select {
+		case <-seg.done:
+			return seg, nil
+		case <-r.ctx.Done():
+			return nil, r.ctx.Err()
+		}
+	case <-r.ctx.Done():
+		return nil, r.ctx.Err()
+	}
+}
+
+// next consumes the next segment and fills pending with the decoded bytes.
+func (r *parallelBzip2Reader) next() error {
+	seg, err := r.receive()
+	if err != nil {
+		return err
+	}
+	if seg == nil {
+		if !r.streamEnded {
+			return io.ErrUnexpectedEOF
+		}
+		return io.EOF
+	}
+	if r.streamEnded {
+		return bzip2.StructuralError("bad magic value in continuation file")
+	}
+	switch seg.kind {
+	case bzip2SegmentHeader:
+		if seg.nbits != 32 {
+			return bzip2.StructuralError("bad magic value found")
+		}
+	case bzip2SegmentBlock:
+		data, decodeErr := seg.data, seg.err
+		merged := seg
+		for range maxBzip2Merges {
+			if decodeErr == nil {
+				break
+			}
+			// The segment may end with a magic number which appears in the compressed data by chance.
+			following, err := r.receive()
+			if err != nil || following == nil {
+				break
+			}
+			merged = mergeBzip2Segments(merged, following)
+			data, decodeErr = decodeBzip2Segment(merged)
+		}
+		if decodeErr != nil {
+			return fmt.Errorf("failed to decode bzip2 block: %w", decodeErr)
+		}
+		r.fileCRC = (r.fileCRC<<1 | r.fileCRC>>31) ^ seg.crc()
+		r.pending = data
+	case bzip2SegmentEnd:
+		if seg.nbits < 80 {
+			return io.ErrUnexpectedEOF
+		}
+		if seg.crc() != r.fileCRC {
+			return bzip2.StructuralError("file checksum mismatch")
+		}
+		r.fileCRC = 0
+		// Skip ahead to byte boundary. The next stream may follow.
+		rest := seg.nbits - 80 - (8-(seg.off+80)%8)%8
+		switch rest {
+		case 0:
+			r.streamEnded = true
+		case 32:
+			header := seg.bits(seg.nbits-32, 32)
+			if header>>8 != 'B'<<16|'Z'<<8|'h' || byte(header) < '1' || byte(header) > '9' {
+				return bzip2.StructuralError("bad magic value in continuation file")
+			}
+		default:
+			return bzip2.StructuralError("bad magic value in continuation file")
+		}
+	}
+	return nil
+}
+
+func (r *parallelBzip2Reader) Read(p []byte) (int, error) {
+	for len(r.pending) == 0 {
+		if r.err != nil {
+			return 0, r.err
+		}
+		r.err = r.next()
+	}
+	n := copy(p, r.pending)
+	r.pending = r.pending[n:]
+	return n, nil
+}
+
+// Close stops the goroutines and waits for them.
+// The underlying reader is never read after Close returns.
+func (r *parallelBzip2Reader) Close() error {
+	r.cancel()
+	r.wg.Wait()
+	return nil
+}
@@ -0,0 +1,160 @@
+package unarchiver_test
+
+import (
+	"bytes"
+	"compress/bzip2"
+	"fmt"
+	"io"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/pddg/photon-container/internal/unarchiver"
+)
+
+// decompressBzip2 decompresses the input with compress/bzip2 and the parallel reader.
+func decompressBzip2(t *testing.T, input []byte, workers int) (want []byte, wantErr error, got []byte, gotErr error) {
+	t.Helper()
+	want, wantErr = io.ReadAll(bzip2.NewReader(bytes.NewReader(input)))
+	r := unarchiver.NewParallelBzip2Reader(t.Context(), bytes.NewReader(input), workers)
+	defer r.Close()
+	got, gotErr = io.ReadAll(r)
+	return want, wantErr, got, gotErr
+}
+
+// assertSameAsBzip2 asserts that the parallel reader decompresses the input as compress/bzip2 does.
+func assertSameAsBzip2(t *testing.T, input []byte, workers int) {
+	t.Helper()
+	want, wantErr, got, gotErr := decompressBzip2(t, input, workers)
+	if wantErr != nil {
+		assert.Error(t, gotErr, "compress/bzip2 failed with %v", wantErr)
+		return
+	}
+	require.NoError(t, gotErr)
+	assert.True(t, bytes.Equal(want, got), "decompressed %d bytes, want %d bytes", len(got), len(want))
+}
+
+func readTestdata(t testing.TB, names ...string) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	for _, name := range names {
+		b, err := os.ReadFile(name)
+		require.NoError(t, err)
+		buf.Write(b)
+	}
+	return buf.Bytes()
+}
+
+func Test_ParallelBzip2Reader(t *testing.T) {
+	t.Parallel()
+	testCases := []struct {
+		name  string
+		input []string
+	}{
+		{name: "single block", input: []string{"testdata/data.tar.bz2"}},
+		{name: "multiple blocks", input: []string{"testdata/multiblock.tar.bz2"}},
+		{name: "multiple streams", input: []string{"testdata/multistream.tar.bz2"}},
+		{
+			name:  "concatenated streams of multiple blocks",
+			input: []string{"testdata/multiblock.tar.bz2", "testdata/data.tar.bz2", "testdata/multistream.tar.bz2"},
+		},
+	}
+	for _, tc := range testCases {
+		for _, workers := range []int{1, 2, 8} {
+			t.Run(fmt.Sprintf("%s with %d workers", tc.name, workers), func(t *testing.T) {
+				t.Parallel()
+				// Setup
+				input := readTestdata(t, tc.input...)
+
+				// Exercise & Verify
+				assertSameAsBzip2(t, input, workers)
+			})
+		}
+	}
+}
+
+func Test_ParallelBzip2Reader_Corrupted(t *testing.T) {
+	t.Parallel()
+	input := readTestdata(t, "testdata/multiblock.tar.bz2", "testdata/multistream.tar.bz2")
+	testCases := []struct {
+		name    string
+		corrupt func([]byte) []byte
+	}{
+		{
+			name:    "empty",
+			corrupt: func(b []byte) []byte { return nil },
+		},
+		{
+			name:    "bad magic",
+			corrupt: func(b []byte) []byte { b[0] = 'X'; return b },
+		},
+		{
+			name:    "bad block size",
+			corrupt: func(b []byte) []byte { b[3] = '0'; return b },
+		},
+		{
+			name:    "truncated in the header",
+			corrupt: func(b []byte) []byte { return b[:2] },
+		},
+		{
+			name:    "truncated in the first block",
+			corrupt: func(b []byte) []byte { return b[:100] },
+		},
+		{
+			name:    "truncated in the middle",
+			corrupt: func(b []byte) []byte { return b[:len(b)/2] },
+		},
+		{
+			name:    "truncated in the end of stream",
+			corrupt: func(b []byte) []byte { return b[:len(b)-3] },
+		},
+		{
+			name:    "garbage after the end of stream",
+			corrupt: func(b []byte) []byte { return append(b, "garbage"...) },
+		},
+		{
+			name:    "another header after the end of stream",
+			corrupt: func(b []byte) []byte { return append(b, "BZh9"...) },
+		},
+		{
+			name:    "corrupted file checksum",
+			corrupt: func(b []byte) []byte { b[len(b)-2] ^= 0xff; return b },
+		},
+	}
+	// Flip the bytes around the whole archive, which hits the block headers, the Huffman tables and the block data.
+	for off := 4; off < len(input); off += len(input) / 19 {
+		testCases = append(testCases, struct {
+			name    string
+			corrupt func([]byte) []byte
+		}{
+			name:    fmt.Sprintf("flipped at %d", off),
+			corrupt: func(b []byte) []byte { b[off] ^= 0x5a; return b },
+		})
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+			// Setup
+			corrupted := tc.corrupt(bytes.Clone(input))
+
+			// Exercise
+			_, wantErr, _, gotErr := decompressBzip2(t, corrupted, 4)
+
+			// Verify
+			require.Error(t, wantErr)
+			assert.Error(t, gotErr)
+		})
+	}
+}
+
+func FuzzParallelBzip2Reader(f *testing.F) {
+	f.Add(readTestdata(f, "testdata/data.tar.bz2"))
+	f.Add(readTestdata(f, "testdata/multiblock.tar.bz2"))
+	f.Add(readTestdata(f, "testdata/multistream.tar.bz2"))
+	f.Add(readTestdata(f, "testdata/data.tar.bz2", "testdata/data.tar.bz2"))
+	f.Fuzz(func(t *testing.T, input []byte) {
+		assertSameAsBzip2(t, input, 3)
+	})
+}
@@ -0,0 +1,193 @@
+package unarchiver
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"sync"
+	"time"
+)
+
+// CheckpointName is the name of the checkpoint written at the root of the destination.
+const CheckpointName = ".unarchive-checkpoint.json"
+
+const checkpointVersion = 1
+
+// checkpointInterval is the number of bytes of the tar stream between periodic checkpoints.
+// A checkpoint is also written when the extraction is interrupted.
+const checkpointInterval = 256 << 20
+
+// tarBlockSize is the size of a block in a tar stream. Every header starts at a block boundary.
+const tarBlockSize = 512
+
+// ErrNoCheckpoint is returned when the destination has no valid checkpoint.
+var ErrNoCheckpoint = errors.New("no valid checkpoint")
+
+// ErrCheckpointMismatch is returned when the offset to resume from is not the one of the checkpoint.
+var ErrCheckpointMismatch = errors.New("offset does not match the checkpoint")
+
+// InterruptedError is returned when reading the archive fails part-way.
+// The extracted entries are kept, and the extraction can be resumed by sending the rest of the tar stream from Offset.
+type InterruptedError struct {
+	// Offset is the offset of the tar stream where the extraction can be resumed.
+	Offset int64
+	Err    error
+}
+
+func (e *InterruptedError) Error() string {
+	return fmt.Sprintf("unarchive interrupted, resumable from offset %d: %v", e.Offset, e.Err)
+}
+
+func (e *InterruptedError) Unwrap() error {
+	return e.Err
+}
+
+// Checkpoint records the last entry which has been fully written.
+type Checkpoint struct {
+	Version int `json:"version"`
+	// Offset is the offset of the uncompressed tar stream just after the last written entry.
+	Offset int64 `json:"offset"`
+	// Entries is the number of entries extracted so far.
+	Entries int `json:"entries"`
+	// Bytes is the total size of the files extracted so far.
+	Bytes int64 `json:"bytes"`
+	// LastEntry is the name of the last written entry.
+	LastEntry string `json:"last_entry"`
+	// Directories are the directories whose modes and modification times are not applied yet.
+	Directories []CheckpointDirectory `json:"directories,omitempty"`
+	// Symlinks are the symbolic links created from the archive.
+	Symlinks  []string  `json:"symlinks,omitempty"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+type CheckpointDirectory struct {
+	Name    string      `json:"name"`
+	Mode    fs.FileMode `json:"mode"`
+	ModTime time.Time   `json:"mod_time"`
+}
+
+// ReadCheckpoint reads the checkpoint in the directory.
+// ErrNoCheckpoint is returned if it does not exist or it is invalid.
+func ReadCheckpoint(dir string) (*Checkpoint, error) {
+	root, err := os.OpenRoot(dir)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, fmt.Errorf("unarchiver.ReadCheckpoint: %w in %q", ErrNoCheckpoint, dir)
+		}
+		return nil, fmt.Errorf("unarchiver.ReadCheckpoint: failed to open %q: %w", dir, err)
+	}
+	defer root.Close()
+	checkpoint, err := readCheckpoint(root)
+	if err != nil {
+		return nil, fmt.Errorf("unarchiver.ReadCheckpoint: %w in %q", err, dir)
+	}
+	return checkpoint, nil
+}
+
+func readCheckpoint(root *os.Root) (*Checkpoint, error) {
+	checkpointBytes, err := root.ReadFile(CheckpointName)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, ErrNoCheckpoint
+		}
+		return nil, fmt.Errorf("failed to read checkpoint: %w", err)
+	}
+	var checkpoint Checkpoint
+	if err := json.Unmarshal(checkpointBytes, &checkpoint); err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrNoCheckpoint, err)
+	}
+	if checkpoint.Version != checkpointVersion {
+		return nil, fmt.Errorf("%w: unsupported version %d", ErrNoCheckpoint, checkpoint.Version)
+	}
+	return &checkpoint, nil
+}
+
+func writeCheckpoint(root *os.Root, checkpoint Checkpoint, durable bool) error {
+	checkpoint.Version = checkpointVersion
+	checkpoint.UpdatedAt = time.Now().UTC()
+	checkpointBytes, err := json.Marshal(checkpoint)
+	if err != nil {
+		return fmt.Errorf("failed to marshal checkpoint: %w", err)
+	}
+	tmpName := CheckpointName + ".tmp"
+	f, err := root.OpenFile(tmpName, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to create checkpoint: %w", err)
+	}
+	defer func() {
+		_ = f.Close()
+		_ = root.Remove(tmpName)
+	}()
+	if _, err := f.Write(checkpointBytes); err != nil {
+		return fmt.Errorf("failed to write checkpoint: %w", err)
+	}
+	if durable {
+		if err := f.Sync(); err != nil {
+			return fmt.Errorf("failed to sync checkpoint: %w", err)
+		}
+	}
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("failed to close checkpoint: %w", err)
+	}
+	if err := root.Rename(tmpName, CheckpointName); err != nil {
+		return fmt.Errorf("failed to rename checkpoint: %w", err)
+	}
+	if durable {
+		if err := syncDir(root, "."); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func removeCheckpoint(root *os.Root) error {
+	if err := root.Remove(CheckpointName); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("failed to remove checkpoint: %w", err)
+	}
+	return nil
+}
+
+// nextHeaderOffset returns the offset of the next header after the entry data ending at the offset.
+func nextHeaderOffset(offset int64) int64 {
+	return (offset + tarBlockSize - 1) / tarBlockSize * tarBlockSize
+}
+
+// countingReader counts the bytes of the tar stream.
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// sourceReader records the error of reading the archive to tell an interruption from other failures.
+// It may be read by the decompressor in background.
+type sourceReader struct {
+	r     io.Reader
+	mutex sync.Mutex
+	err   error
+}
+
+func (s *sourceReader) Read(p []byte) (int, error) {
+	n, err := s.r.Read(p)
+	if err != nil && !errors.Is(err, io.EOF) {
+		s.mutex.Lock()
+		s.err = err
+		s.mutex.Unlock()
+	}
+	return n, err
+}
+
+// failed returns true if reading the archive has failed.
+func (s *sourceReader) failed() bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.err != nil
+}
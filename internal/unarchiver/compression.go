@@ -0,0 +1,149 @@
+package unarchiver
+
+import (
+	"bufio"
+	"bytes"
+	"compress/bzip2"
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/ulikunitz/xz"
+
+	"github.com/pddg/photon-container/internal/logging"
+)
+
+// Compression is the compression format of the archive.
+type Compression string
+
+const (
+	// CompressionAuto detects the compression format from the magic bytes of the archive.
+	CompressionAuto  Compression = "auto"
+	CompressionNone  Compression = "none"
+	CompressionBzip2 Compression = "bzip2"
+	CompressionGzip  Compression = "gzip"
+	CompressionZstd  Compression = "zstd"
+	CompressionXz    Compression = "xz"
+)
+
+// ParseCompression returns the Compression of the given name.
+// An empty name means CompressionAuto.
+func ParseCompression(name string) (Compression, error) {
+	switch Compression(strings.ToLower(name)) {
+	case "", CompressionAuto:
+		return CompressionAuto, nil
+	case CompressionNone:
+		return CompressionNone, nil
+	case CompressionBzip2:
+		return CompressionBzip2, nil
+	case CompressionGzip:
+		return CompressionGzip, nil
+	case CompressionZstd:
+		return CompressionZstd, nil
+	case CompressionXz:
+		return CompressionXz, nil
+	default:
+		return "", fmt.Errorf("unarchiver.ParseCompression: unsupported compression %q", name)
+	}
+}
+
+var compressionMagics = []struct {
+	compression Compression
+	magic       []byte
+}{
+	{compression: CompressionBzip2, magic: []byte("BZh")},
+	{compression: CompressionGzip, magic: []byte{0x1f, 0x8b}},
+	{compression: CompressionZstd, magic: []byte{0x28, 0xb5, 0x2f, 0xfd}},
+	{compression: CompressionXz, magic: []byte{0xfd, '7', 'z', 'X', 'Z', 0x00}},
+}
+
+// detectCompression peeks the magic bytes of the archive.
+// CompressionNone is returned if no known magic bytes are found, since a tar archive has no magic bytes at the beginning.
+func detectCompression(r *bufio.Reader) (Compression, error) {
+	head, err := r.Peek(6)
+	if err != nil && !errors.Is(err, io.EOF) {
+		return "", fmt.Errorf("failed to read magic bytes: %w", err)
+	}
+	for _, m := range compressionMagics {
+		if bytes.HasPrefix(head, m.magic) {
+			return m.compression, nil
+		}
+	}
+	return CompressionNone, nil
+}
+
+// Decompress returns the reader of the decompressed archive.
+// The compression is detected from the magic bytes of the archive if it is CompressionAuto.
+// The returned reader must be closed after reading. It does not close the archive.
+func (u *Unarchiver) Decompress(ctx context.Context, archive io.Reader, compression Compression) (io.ReadCloser, error) {
+	if compression == CompressionAuto {
+		buffered := bufio.NewReader(archive)
+		detected, err := detectCompression(buffered)
+		if err != nil {
+			return nil, fmt.Errorf("unarchiver.Unarchiver.Decompress: failed to detect compression: %w", err)
+		}
+		archive = buffered
+		compression = detected
+		logging.FromContext(ctx).InfoContext(ctx, "Detected compression", "compression", compression)
+	}
+	r, closeDecompressor, err := u.decompress(ctx, archive, compression)
+	if err != nil {
+		return nil, fmt.Errorf("unarchiver.Unarchiver.Decompress: %w", err)
+	}
+	return &decompressReader{
+		Reader: r,
+		close:  sync.OnceFunc(closeDecompressor),
+	}, nil
+}
+
+type decompressReader struct {
+	io.Reader
+	close func()
+}
+
+// Close stops the decompressor. It is safe to call it multiple times.
+func (d *decompressReader) Close() error {
+	d.close()
+	return nil
+}
+
+// decompress returns the reader of the decompressed archive.
+// The returned close function must be called after reading.
+func (u *Unarchiver) decompress(ctx context.Context, archive io.Reader, compression Compression) (io.Reader, func(), error) {
+	switch compression {
+	case CompressionNone:
+		return archive, func() {}, nil
+	case CompressionBzip2:
+		if u.decompressionWorkers > 1 {
+			bz := newParallelBzip2Reader(ctx, archive, u.decompressionWorkers)
+			// Wait for the goroutines so that the archive is not read after returning.
+			return bz, func() { _ = bz.Close() }, nil
+		}
+		return bzip2.NewReader(archive), func() {}, nil
+	case CompressionGzip:
+		gz, err := gzip.NewReader(archive)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to read gzip header: %w", err)
+		}
+		return gz, func() { _ = gz.Close() }, nil
+	case CompressionZstd:
+		zr, err := zstd.NewReader(archive, zstd.WithDecoderConcurrency(u.decompressionWorkers))
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to create zstd decoder: %w", err)
+		}
+		return zr, zr.Close, nil
+	case CompressionXz:
+		xr, err := xz.NewReader(archive)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to read xz header: %w", err)
+		}
+		return xr, func() {}, nil
+	default:
+		return nil, nil, fmt.Errorf("unsupported compression %q", compression)
+	}
+}
@@ -0,0 +1,12 @@
+package unarchiver
+
+import (
+	"context"
+	"io"
+)
+
+// NewParallelBzip2Reader returns the reader which decompresses the bzip2 blocks on the given number of goroutines.
+// It must be closed after reading.
+func NewParallelBzip2Reader(ctx context.Context, archive io.Reader, workers int) io.ReadCloser {
+	return newParallelBzip2Reader(ctx, archive, workers)
+}
@@ -0,0 +1,403 @@
+package unarchiver
+
+import (
+	"archive/tar"
+	"context"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/pddg/photon-container/internal/logging"
+)
+
+// extractor writes the entries of an archive under the destination directory.
+// All operations go through os.Root, so that nothing is written outside the destination
+// even if the archive contains tricky links.
+type extractor struct {
+	root    *os.Root
+	umask   fs.FileMode
+	durable bool
+
+	// dirs are the directories created or found so far.
+	dirs map[string]struct{}
+	// dirHeaders are the headers of the directories in the archive.
+	// Their modes and modification times are applied at the end,
+	// since creating entries in a directory changes its modification time and a read-only mode prevents it.
+	dirHeaders []dirHeader
+	// symlinks are the symbolic links created from the archive.
+	symlinks map[string]struct{}
+	// traversed are the paths which the targets of the symbolic links pass through.
+	// They must not be replaced by symbolic links, which would change where the targets point.
+	traversed map[string]struct{}
+	// skipped counts the entries which are not extracted by their types.
+	skipped map[byte]int
+	// dirtyDirs are the directories whose entries have been changed.
+	// They are synced at the end in the durable mode.
+	dirtyDirs map[string]struct{}
+}
+
+type dirHeader struct {
+	name    string
+	mode    fs.FileMode
+	modTime time.Time
+}
+
+func newExtractor(root *os.Root, umask fs.FileMode, durable bool) *extractor {
+	return &extractor{
+		root:      root,
+		umask:     umask,
+		durable:   durable,
+		dirs:      map[string]struct{}{".": {}},
+		symlinks:  map[string]struct{}{},
+		traversed: map[string]struct{}{},
+		skipped:   map[byte]int{},
+		dirtyDirs: map[string]struct{}{},
+	}
+}
+
+// extract writes the entry. The name must be cleaned and validated by entryValidator.
+func (x *extractor) extract(ctx context.Context, header *tar.Header, name string, r io.Reader) error {
+	if err := x.checkParents(name); err != nil {
+		return err
+	}
+	switch header.Typeflag {
+	case tar.TypeDir:
+		return x.extractDir(header, name)
+	case tar.TypeReg, tar.TypeGNUSparse:
+		return x.extractFile(header, name, r)
+	case tar.TypeSymlink:
+		return x.extractSymlink(header, name)
+	case tar.TypeLink:
+		return x.extractHardlink(header, name)
+	default:
+		x.skipped[header.Typeflag]++
+		logging.FromContext(ctx).DebugContext(ctx, "Skip unsupported entry", "name", header.Name, "type", string(header.Typeflag))
+		return nil
+	}
+}
+
+// checkParents rejects the entry if its parent directory is a symbolic link in the archive.
+// Otherwise a relative link target could be resolved from an unexpected directory.
+func (x *extractor) checkParents(name string) error {
+	if dir, ok := x.symlinkParent(name); ok {
+		return &UnsafeEntryError{Name: name, Reason: fmt.Sprintf("parent %q is a symbolic link", dir)}
+	}
+	return nil
+}
+
+// symlinkParent returns the parent directory of the name which is a symbolic link in the archive.
+func (x *extractor) symlinkParent(name string) (string, bool) {
+	for dir := path.Dir(name); dir != "."; dir = path.Dir(dir) {
+		if _, ok := x.symlinks[dir]; ok {
+			return dir, true
+		}
+	}
+	return "", false
+}
+
+func (x *extractor) perm(header *tar.Header) fs.FileMode {
+	return fs.FileMode(header.Mode).Perm() &^ x.umask
+}
+
+// mkdirAll creates the directory and its parents which are not in the archive.
+func (x *extractor) mkdirAll(name string) error {
+	if _, ok := x.dirs[name]; ok {
+		return nil
+	}
+	if err := x.root.MkdirAll(name, 0755&^x.umask); err != nil {
+		return fmt.Errorf("failed to create directory %q: %w", name, err)
+	}
+	for dir := name; dir != "."; dir = path.Dir(dir) {
+		x.dirs[dir] = struct{}{}
+		x.markDirty(dir)
+	}
+	return nil
+}
+
+// markDirty records that an entry in the parent directory of the name has been changed.
+func (x *extractor) markDirty(name string) {
+	if x.durable {
+		x.dirtyDirs[path.Dir(name)] = struct{}{}
+	}
+}
+
+func (x *extractor) extractDir(header *tar.Header, name string) error {
+	if err := x.mkdirAll(path.Dir(name)); err != nil {
+		return err
+	}
+	if _, ok := x.dirs[name]; !ok {
+		stat, err := x.root.Lstat(name)
+		switch {
+		case errors.Is(err, fs.ErrNotExist):
+			// The owner must be able to create entries in it until the mode is applied at the end.
+			if err := x.root.Mkdir(name, 0700); err != nil {
+				return fmt.Errorf("failed to create directory %q: %w", name, err)
+			}
+			x.markDirty(name)
+		case err != nil:
+			return fmt.Errorf("failed to stat directory %q: %w", name, err)
+		case !stat.IsDir():
+			return fmt.Errorf("failed to create directory %q: not a directory", name)
+		}
+		x.dirs[name] = struct{}{}
+	}
+	x.dirHeaders = append(x.dirHeaders, dirHeader{
+		name:    name,
+		mode:    x.perm(header),
+		modTime: header.ModTime,
+	})
+	return nil
+}
+
+// extractFile writes the file to a temporary file and renames it, so that a partially written file is never visible.
+func (x *extractor) extractFile(header *tar.Header, name string, r io.Reader) error {
+	if err := x.mkdirAll(path.Dir(name)); err != nil {
+		return err
+	}
+	tmpName := path.Join(path.Dir(name), ".tmp-"+rand.Text())
+	f, err := x.root.OpenFile(tmpName, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return fmt.Errorf("failed to create temp file for %q: %w", name, err)
+	}
+	defer func() {
+		_ = f.Close()
+		_ = x.root.Remove(tmpName)
+	}()
+	if _, err := io.Copy(f, r); err != nil {
+		return fmt.Errorf("failed to write file %q: %w", name, err)
+	}
+	if x.durable {
+		if err := f.Sync(); err != nil {
+			return fmt.Errorf("failed to sync file %q: %w", name, err)
+		}
+	}
+	if err := f.Chmod(x.perm(header)); err != nil {
+		return fmt.Errorf("failed to change mode of %q: %w", name, err)
+	}
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("failed to close file %q: %w", name, err)
+	}
+	if err := x.root.Rename(tmpName, name); err != nil {
+		return fmt.Errorf("failed to rename temp file to %q: %w", name, err)
+	}
+	delete(x.symlinks, name)
+	x.markDirty(name)
+	if err := x.root.Chtimes(name, header.ModTime, header.ModTime); err != nil {
+		return fmt.Errorf("failed to change modtime of file %q: %w", name, err)
+	}
+	return nil
+}
+
+func (x *extractor) extractSymlink(header *tar.Header, name string) error {
+	if err := validateSymlinkTarget(name, header.Linkname); err != nil {
+		return err
+	}
+	if _, ok := x.traversed[name]; ok {
+		return &UnsafeEntryError{Name: name, Reason: "the target of another symbolic link passes through it"}
+	}
+	if err := x.resolveSymlink(name, header.Linkname); err != nil {
+		return err
+	}
+	if err := x.mkdirAll(path.Dir(name)); err != nil {
+		return err
+	}
+	if err := x.removeExisting(name); err != nil {
+		return err
+	}
+	if err := x.root.Symlink(header.Linkname, name); err != nil {
+		return fmt.Errorf("failed to create symbolic link %q: %w", name, err)
+	}
+	x.symlinks[name] = struct{}{}
+	x.markDirty(name)
+	return nil
+}
+
+func (x *extractor) extractHardlink(header *tar.Header, name string) error {
+	target, err := cleanEntryName(header.Linkname)
+	if err != nil {
+		return &UnsafeEntryError{Name: name, Reason: fmt.Sprintf("link target %q: %s", header.Linkname, err)}
+	}
+	if _, ok := x.symlinks[target]; ok {
+		// The hard link would resolve the relative target of the symbolic link from another directory.
+		return &UnsafeEntryError{Name: name, Reason: fmt.Sprintf("link target %q is a symbolic link", header.Linkname)}
+	}
+	if dir, ok := x.symlinkParent(target); ok {
+		return &UnsafeEntryError{Name: name, Reason: fmt.Sprintf("parent %q of link target %q is a symbolic link", dir, header.Linkname)}
+	}
+	if err := x.mkdirAll(path.Dir(name)); err != nil {
+		return err
+	}
+	if err := x.removeExisting(name); err != nil {
+		return err
+	}
+	if err := x.root.Link(target, name); err != nil {
+		return fmt.Errorf("failed to create hard link %q: %w", name, err)
+	}
+	x.markDirty(name)
+	return nil
+}
+
+// removeExisting removes the file or the link at the name to replace it.
+func (x *extractor) removeExisting(name string) error {
+	if err := x.root.Remove(name); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return fmt.Errorf("failed to remove existing %q: %w", name, err)
+	}
+	delete(x.symlinks, name)
+	return nil
+}
+
+// finish applies the modes and the modification times of the directories from the deepest one.
+func (x *extractor) finish(ctx context.Context) error {
+	for i := len(x.dirHeaders) - 1; i >= 0; i-- {
+		dir := x.dirHeaders[i]
+		if err := x.root.Chmod(dir.name, dir.mode); err != nil {
+			return fmt.Errorf("failed to change mode of directory %q: %w", dir.name, err)
+		}
+		if err := x.root.Chtimes(dir.name, dir.modTime, dir.modTime); err != nil {
+			return fmt.Errorf("failed to change modtime of directory %q: %w", dir.name, err)
+		}
+	}
+	if err := x.sync(); err != nil {
+		return err
+	}
+	for typeflag, count := range x.skipped {
+		logging.FromContext(ctx).WarnContext(ctx, "Skipped unsupported entries", "type", typeName(typeflag), "count", count)
+	}
+	return nil
+}
+
+// sync syncs the directories whose entries have been changed in the durable mode.
+func (x *extractor) sync() error {
+	for dir := range x.dirtyDirs {
+		if err := syncDir(x.root, dir); err != nil {
+			return err
+		}
+		delete(x.dirtyDirs, dir)
+	}
+	return nil
+}
+
+// state returns the state to be saved in the checkpoint.
+func (x *extractor) state() ([]CheckpointDirectory, []string) {
+	dirs := make([]CheckpointDirectory, 0, len(x.dirHeaders))
+	for _, dir := range x.dirHeaders {
+		dirs = append(dirs, CheckpointDirectory{Name: dir.name, Mode: dir.mode, ModTime: dir.modTime})
+	}
+	symlinks := make([]string, 0, len(x.symlinks))
+	for name := range x.symlinks {
+		symlinks = append(symlinks, name)
+	}
+	slices.Sort(symlinks)
+	return dirs, symlinks
+}
+
+// restore restores the state saved in the checkpoint.
+// The directories are not restored, since existing ones are reused as they are.
+func (x *extractor) restore(checkpoint Checkpoint) error {
+	for _, dir := range checkpoint.Directories {
+		x.dirHeaders = append(x.dirHeaders, dirHeader{name: dir.Name, mode: dir.Mode, modTime: dir.ModTime})
+	}
+	for _, name := range checkpoint.Symlinks {
+		x.symlinks[name] = struct{}{}
+	}
+	// Resolve the links again to record the paths which their targets pass through.
+	for _, name := range checkpoint.Symlinks {
+		linkname, err := x.root.Readlink(name)
+		if err != nil {
+			return fmt.Errorf("failed to read symbolic link %q: %w", name, err)
+		}
+		if err := x.resolveSymlink(name, linkname); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// maxSymlinkHops is the maximum number of symbolic links followed to resolve a target, as ELOOP of Linux.
+const maxSymlinkHops = 40
+
+// resolveSymlink follows the target of the symbolic link at name through the links extracted so far,
+// and rejects it if it goes outside of the destination.
+// Checking the target alone is not enough, since it may pass through another link such as `d/l1/../..` where `d/l1` is `..`.
+func (x *extractor) resolveSymlink(name, linkname string) error {
+	hops := 0
+	if _, err := x.resolve(path.Dir(name), linkname, &hops); err != nil {
+		return &UnsafeEntryError{Name: name, Reason: fmt.Sprintf("link target %q: %s", linkname, err)}
+	}
+	return nil
+}
+
+// resolve returns the path of the relative target from the directory, following the symbolic links in the archive.
+func (x *extractor) resolve(dir, target string, hops *int) (string, error) {
+	if target == "" || path.IsAbs(target) {
+		return "", fmt.Errorf("absolute target %q", target)
+	}
+	current := dir
+	components := strings.Split(target, "/")
+	for i, component := range components {
+		switch component {
+		case "", ".":
+			continue
+		case "..":
+			if current == "." {
+				return "", errors.New("outside of the destination")
+			}
+			current = path.Dir(current)
+			continue
+		}
+		next := path.Join(current, component)
+		if i < len(components)-1 {
+			x.traversed[next] = struct{}{}
+		}
+		if _, ok := x.symlinks[next]; !ok {
+			current = next
+			continue
+		}
+		if *hops++; *hops > maxSymlinkHops {
+			return "", errors.New("too many levels of symbolic links")
+		}
+		linkname, err := x.root.Readlink(next)
+		if err != nil {
+			return "", fmt.Errorf("failed to read symbolic link %q: %w", next, err)
+		}
+		current, err = x.resolve(path.Dir(next), linkname, hops)
+		if err != nil {
+			return "", err
+		}
+	}
+	return current, nil
+}
+
+// validateSymlinkTarget rejects the symbolic link if its target is outside of the destination.
+func validateSymlinkTarget(name, linkname string) error {
+	if linkname == "" || path.IsAbs(linkname) {
+		return &UnsafeEntryError{Name: name, Reason: fmt.Sprintf("absolute link target %q", linkname)}
+	}
+	resolved := path.Join(path.Dir(name), linkname)
+	if resolved == ".." || strings.HasPrefix(resolved, "../") {
+		return &UnsafeEntryError{Name: name, Reason: fmt.Sprintf("link target %q is outside of the destination", linkname)}
+	}
+	return nil
+}
+
+func typeName(typeflag byte) string {
+	switch typeflag {
+	case tar.TypeChar:
+		return "char_device"
+	case tar.TypeBlock:
+		return "block_device"
+	case tar.TypeFifo:
+		return "fifo"
+	case tar.TypeCont:
+		return "contiguous"
+	default:
+		return fmt.Sprintf("type_%q", typeflag)
+	}
+}
@@ -0,0 +1,133 @@
+package unarchiver
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+)
+
+// CompletionMarkerName is the name of the completion marker written at the root of the destination.
+const CompletionMarkerName = ".unarchive-complete.json"
+
+const completionMarkerVersion = 1
+
+// ErrNoCompletionMarker is returned when the destination has no valid completion marker.
+var ErrNoCompletionMarker = errors.New("no valid completion marker")
+
+// CompletionMarker records that an archive has been extracted completely.
+// It is written after all entries are extracted, so that a tree without it must not be used.
+type CompletionMarker struct {
+	Version int `json:"version"`
+	// Entries is the number of entries in the archive.
+	Entries int `json:"entries"`
+	// Bytes is the total size of the files in the archive.
+	Bytes int64 `json:"bytes"`
+	// SourceSHA256 is the SHA-256 checksum of the archive as it was read, before decompression.
+	// If the extraction was resumed, it covers only the rest of the tar stream sent from ResumedOffset,
+	// and it can not be compared with the checksum of the archive.
+	// The hash is not chained across the resume since the interrupted part may have been compressed.
+	SourceSHA256 string `json:"source_sha256"`
+	// ResumedOffset is the offset of the tar stream which the last extraction was resumed from.
+	ResumedOffset int64 `json:"resumed_offset,omitempty"`
+	// Durable is true if the extracted files and directories were synced to the storage.
+	Durable     bool      `json:"durable"`
+	CompletedAt time.Time `json:"completed_at"`
+}
+
+// ReadCompletionMarker reads the completion marker in the directory.
+// ErrNoCompletionMarker is returned if it does not exist or it is invalid.
+func ReadCompletionMarker(dir string) (*CompletionMarker, error) {
+	root, err := os.OpenRoot(dir)
+	if err != nil {
+		return nil, fmt.Errorf("unarchiver.ReadCompletionMarker: failed to open %q: %w", dir, err)
+	}
+	defer root.Close()
+	markerBytes, err := root.ReadFile(CompletionMarkerName)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, fmt.Errorf("unarchiver.ReadCompletionMarker: %w in %q", ErrNoCompletionMarker, dir)
+		}
+		return nil, fmt.Errorf("unarchiver.ReadCompletionMarker: failed to read marker in %q: %w", dir, err)
+	}
+	var marker CompletionMarker
+	if err := json.Unmarshal(markerBytes, &marker); err != nil {
+		return nil, fmt.Errorf("unarchiver.ReadCompletionMarker: %w in %q: %w", ErrNoCompletionMarker, dir, err)
+	}
+	if marker.Version != completionMarkerVersion {
+		return nil, fmt.Errorf("unarchiver.ReadCompletionMarker: %w in %q: unsupported version %d", ErrNoCompletionMarker, dir, marker.Version)
+	}
+	return &marker, nil
+}
+
+// WriteCompletionMarker writes the completion marker in the directory and syncs it.
+func WriteCompletionMarker(dir string, marker CompletionMarker) error {
+	root, err := os.OpenRoot(dir)
+	if err != nil {
+		return fmt.Errorf("unarchiver.WriteCompletionMarker: failed to open %q: %w", dir, err)
+	}
+	defer root.Close()
+	if err := writeCompletionMarker(root, marker, true); err != nil {
+		return fmt.Errorf("unarchiver.WriteCompletionMarker: %w", err)
+	}
+	return nil
+}
+
+func writeCompletionMarker(root *os.Root, marker CompletionMarker, durable bool) error {
+	marker.Version = completionMarkerVersion
+	markerBytes, err := json.Marshal(marker)
+	if err != nil {
+		return fmt.Errorf("failed to marshal completion marker: %w", err)
+	}
+	tmpName := CompletionMarkerName + ".tmp"
+	f, err := root.OpenFile(tmpName, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to create completion marker: %w", err)
+	}
+	defer func() {
+		_ = f.Close()
+		_ = root.Remove(tmpName)
+	}()
+	if _, err := f.Write(markerBytes); err != nil {
+		return fmt.Errorf("failed to write completion marker: %w", err)
+	}
+	if durable {
+		if err := f.Sync(); err != nil {
+			return fmt.Errorf("failed to sync completion marker: %w", err)
+		}
+	}
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("failed to close completion marker: %w", err)
+	}
+	if err := root.Rename(tmpName, CompletionMarkerName); err != nil {
+		return fmt.Errorf("failed to rename completion marker: %w", err)
+	}
+	if durable {
+		if err := syncDir(root, "."); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// removeCompletionMarker removes the marker left by a previous extraction.
+func removeCompletionMarker(root *os.Root) error {
+	if err := root.Remove(CompletionMarkerName); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("failed to remove completion marker: %w", err)
+	}
+	return nil
+}
+
+// syncDir syncs the directory to persist the entries in it.
+func syncDir(root *os.Root, name string) error {
+	d, err := root.Open(name)
+	if err != nil {
+		return fmt.Errorf("failed to open directory %q: %w", name, err)
+	}
+	defer d.Close()
+	if err := d.Sync(); err != nil {
+		return fmt.Errorf("failed to sync directory %q: %w", name, err)
+	}
+	return nil
+}
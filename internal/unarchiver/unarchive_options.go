@@ -4,7 +4,22 @@ type UnarchiveOption func(*runtimeOption)
 
 // NoCompression represents an option that the archive is not compressed.
 func NoCompression() UnarchiveOption {
+	return WithCompression(CompressionNone)
+}
+
+// WithCompression specifies the compression format of the archive.
+// The default is CompressionAuto, which detects it from the magic bytes of the archive.
+func WithCompression(compression Compression) UnarchiveOption {
+	return func(a *runtimeOption) {
+		a.compression = compression
+	}
+}
+
+// WithResumeOffset resumes the interrupted extraction from the offset of the tar stream.
+// The archive must be the rest of the uncompressed tar stream from the offset,
+// and the offset must be the one of the checkpoint in the destination.
+func WithResumeOffset(offset int64) UnarchiveOption {
 	return func(a *runtimeOption) {
-		a.noCompression = true
+		a.resumeOffset = offset
 	}
 }
@@ -2,14 +2,17 @@ package unarchiver
 
 import (
 	"archive/tar"
-	"compress/bzip2"
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"errors"
 	"fmt"
 	"io"
+	"io/fs"
 	"math"
 	"os"
-	"path/filepath"
+	"runtime"
+	"time"
 
 	"github.com/fujiwara/shapeio"
 
@@ -18,11 +21,33 @@ import (
 
 type Unarchiver struct {
 	unarchiveLimitBytesPerSec float64
+	decompressionWorkers      int
+	allowedPrefixes           []string
+	maxEntries                int
+	maxTotalBytes             int64
+	umask                     fs.FileMode
+	durable                   bool
+	progressFunc              ProgressFunc
 }
 
+// Progress is the progress of an extraction.
+type Progress struct {
+	// Entries is the number of entries extracted so far.
+	Entries int
+	// Bytes is the total size of the files extracted so far.
+	Bytes int64
+	// Offset is the offset of the uncompressed tar stream read so far.
+	Offset int64
+}
+
+// ProgressFunc receives the progress of an extraction.
+type ProgressFunc func(ctx context.Context, progress Progress)
+
 func NewUnarchiver(options ...UnarchiverOption) *Unarchiver {
 	u := &Unarchiver{
 		unarchiveLimitBytesPerSec: math.MaxFloat64,
+		decompressionWorkers:      runtime.NumCPU(),
+		umask:                     0022,
 	}
 	for _, option := range options {
 		option(u)
@@ -33,6 +58,21 @@ func NewUnarchiver(options ...UnarchiverOption) *Unarchiver {
 func (u *Unarchiver) Unarchive(ctx context.Context, archive io.Reader, destPath string, options ...UnarchiveOption) error {
 	logger := logging.FromContext(ctx)
 	logger.InfoContext(ctx, "Unarchive database", "dest", destPath)
+	opt := &runtimeOption{
+		compression: CompressionAuto,
+	}
+	for _, option := range options {
+		option(opt)
+	}
+	if opt.resumeOffset == 0 {
+		if _, err := ReadCheckpoint(destPath); err == nil {
+			// Start over. The entries of the interrupted extraction must not be mixed with the new archive.
+			logger.InfoContext(ctx, "Discard the interrupted extraction", "dest", destPath)
+			if err := os.RemoveAll(destPath); err != nil {
+				return fmt.Errorf("unarchiver.Unarchiver.Unarchive: failed to remove destination directory %q: %w", destPath, err)
+			}
+		}
+	}
 	destStat, err := os.Stat(destPath)
 	if err != nil {
 		if err := os.MkdirAll(destPath, 0755); err != nil {
@@ -44,7 +84,12 @@ func (u *Unarchiver) Unarchive(ctx context.Context, archive io.Reader, destPath
 			return fmt.Errorf("unarchiver.Unarchiver.Unarchive: destination %q is not a directory", destPath)
 		}
 	}
-	if err := u.unarchive(ctx, archive, destPath, options...); err != nil {
+	if err := u.unarchive(ctx, archive, destPath, opt); err != nil {
+		var interrupted *InterruptedError
+		if errors.As(err, &interrupted) || errors.Is(err, ErrCheckpointMismatch) {
+			// Keep the extracted entries so that the extraction can be resumed.
+			return fmt.Errorf("unarchiver.Unarchiver.Unarchive: failed to unarchive to %q: %w", destPath, err)
+		}
 		if rmErr := os.RemoveAll(destPath); rmErr != nil {
 			err = errors.Join(err, fmt.Errorf("unarchiver.Unarchiver.Unarchive: failed to remove destination directory %q: %w", destPath, rmErr))
 		}
@@ -54,75 +99,143 @@ func (u *Unarchiver) Unarchive(ctx context.Context, archive io.Reader, destPath
 }
 
 type runtimeOption struct {
-	// noCompression specifies whether to skip decompression.
-	noCompression bool
+	// compression specifies the compression format of the archive.
+	compression Compression
+	// resumeOffset is the offset of the tar stream to resume the extraction from.
+	resumeOffset int64
 }
 
-func (u *Unarchiver) unarchive(ctx context.Context, archive io.Reader, destPath string, options ...UnarchiveOption) error {
-	opt := &runtimeOption{}
-	for _, option := range options {
-		option(opt)
+func (u *Unarchiver) unarchive(ctx context.Context, archive io.Reader, destPath string, opt *runtimeOption) error {
+	root, err := os.OpenRoot(destPath)
+	if err != nil {
+		return fmt.Errorf("unarchiver.Unarchiver.Unarchive: failed to open destination %q: %w", destPath, err)
 	}
-	var r io.Reader
-	if opt.noCompression {
-		r = archive
-	} else {
-		r = bzip2.NewReader(archive)
+	defer root.Close()
+	// The marker of a previous extraction must not survive an incomplete one.
+	if err := removeCompletionMarker(root); err != nil {
+		return fmt.Errorf("unarchiver.Unarchiver.Unarchive: %w", err)
+	}
+	validator := u.newEntryValidator()
+	x := newExtractor(root, u.umask, u.durable)
+	compression := opt.compression
+	checkpoint := Checkpoint{}
+	if opt.resumeOffset > 0 {
+		if compression != CompressionAuto && compression != CompressionNone {
+			return fmt.Errorf("unarchiver.Unarchiver.Unarchive: the rest of the tar stream must not be compressed, but got %q", compression)
+		}
+		// The rest of the tar stream does not start with magic bytes.
+		compression = CompressionNone
+		saved, err := readCheckpoint(root)
+		if err != nil {
+			return fmt.Errorf("unarchiver.Unarchiver.Unarchive: failed to resume from offset %d: %w: %w", opt.resumeOffset, ErrCheckpointMismatch, err)
+		}
+		if saved.Offset != opt.resumeOffset {
+			return fmt.Errorf("unarchiver.Unarchiver.Unarchive: %w: got %d, want %d", ErrCheckpointMismatch, opt.resumeOffset, saved.Offset)
+		}
+		checkpoint = *saved
+		validator.entries = checkpoint.Entries
+		validator.totalBytes = checkpoint.Bytes
+		if err := x.restore(checkpoint); err != nil {
+			return fmt.Errorf("unarchiver.Unarchiver.Unarchive: failed to restore the checkpoint: %w", err)
+		}
+		logging.FromContext(ctx).InfoContext(ctx, "Resume unarchive", "offset", checkpoint.Offset, "entries", checkpoint.Entries, "last_entry", checkpoint.LastEntry)
 	}
+
+	src := &sourceReader{r: archive}
+	// The checksum of the source is recorded in the completion marker.
+	sourceHash := sha256.New()
+	source := io.TeeReader(src, sourceHash)
+	r, err := u.Decompress(ctx, source, compression)
+	if err != nil {
+		return fmt.Errorf("unarchiver.Unarchiver.Unarchive: failed to decompress: %w", err)
+	}
+	defer r.Close()
 	limited := shapeio.NewReaderWithContext(r, ctx)
 	limited.SetRateLimit(u.unarchiveLimitBytesPerSec)
-	untar := tar.NewReader(limited)
+	counter := &countingReader{r: limited, n: checkpoint.Offset}
+	untar := tar.NewReader(counter)
+	lastCheckpoint := checkpoint.Offset
+	// interrupted saves the checkpoint if the error is caused by reading the archive.
+	// A truncated or corrupted archive which has been read to the end is not resumable.
+	interrupted := func(err error) error {
+		if !src.failed() {
+			return err
+		}
+		if cpErr := u.saveCheckpoint(x, checkpoint); cpErr != nil {
+			return errors.Join(err, cpErr)
+		}
+		return &InterruptedError{Offset: checkpoint.Offset, Err: err}
+	}
 	for {
 		header, err := untar.Next()
 		if err != nil {
 			if err == io.EOF {
-				return nil
+				break
 			}
-			return fmt.Errorf("unarchiver.Unarchiver.Unarchive: failed to read tar header: %w", err)
+			return interrupted(fmt.Errorf("unarchiver.Unarchiver.Unarchive: failed to read tar header: %w", err))
 		}
 		if header == nil {
 			continue
 		}
-		target := filepath.Join(destPath, header.Name)
-		switch header.Typeflag {
-		case tar.TypeDir:
-			if _, err := os.Stat(target); err != nil {
-				if errors.Is(err, os.ErrNotExist) {
-					if err := os.Mkdir(target, 0755); err != nil {
-						return fmt.Errorf("unarchiver.Unarchiver.Unarchive: failed to create directory %q: %w", target, err)
-					}
-				} else {
-					return fmt.Errorf("unarchiver.Unarchiver.Unarchive: failed to stat directory %q: %w", target, err)
-				}
-			}
-			if err := os.Chtimes(target, header.ModTime, header.ModTime); err != nil {
-				return fmt.Errorf("unarchiver.Unarchiver.Unarchive: failed to change modtime of directory %q: %w", target, err)
-			}
-		case tar.TypeReg:
-			if err := atomicWrite(target, untar); err != nil {
-				return fmt.Errorf("unarchiver.Unarchiver.Unarchive: failed to write file %q: %w", target, err)
-			}
-			if err := os.Chtimes(target, header.ModTime, header.ModTime); err != nil {
-				return fmt.Errorf("unarchiver.Unarchiver.Unarchive: failed to change modtime of directory %q: %w", target, err)
+		name, err := validator.validate(header)
+		if err != nil {
+			return err
+		}
+		if err := x.extract(ctx, header, name, untar); err != nil {
+			return interrupted(fmt.Errorf("unarchiver.Unarchiver.Unarchive: %w", err))
+		}
+		// Consume the data which is not extracted, such as the one of a skipped entry.
+		if _, err := io.Copy(io.Discard, untar); err != nil {
+			return interrupted(fmt.Errorf("unarchiver.Unarchiver.Unarchive: failed to skip %q: %w", name, err))
+		}
+		checkpoint.Offset = nextHeaderOffset(counter.n)
+		checkpoint.Entries = validator.entries
+		checkpoint.Bytes = validator.totalBytes
+		checkpoint.LastEntry = header.Name
+		if u.progressFunc != nil {
+			u.progressFunc(ctx, Progress{Entries: checkpoint.Entries, Bytes: checkpoint.Bytes, Offset: checkpoint.Offset})
+		}
+		if checkpoint.Offset-lastCheckpoint >= checkpointInterval {
+			if err := u.saveCheckpoint(x, checkpoint); err != nil {
+				return fmt.Errorf("unarchiver.Unarchiver.Unarchive: %w", err)
 			}
+			lastCheckpoint = checkpoint.Offset
 		}
 	}
-}
+	if err := x.finish(ctx); err != nil {
+		return fmt.Errorf("unarchiver.Unarchiver.Unarchive: %w", err)
+	}
 
-func atomicWrite(dest string, src io.Reader) error {
-	tmpFile, err := os.CreateTemp(filepath.Dir(dest), "tmp-*")
-	if err != nil {
-		return fmt.Errorf("failed to create temp file: %w", err)
+	// Read the trailing bytes of the source, such as the padding of tar, to calculate its checksum.
+	// The decompressor must be stopped first since it may read the source in background.
+	r.Close()
+	if _, err := io.Copy(io.Discard, source); err != nil {
+		return fmt.Errorf("unarchiver.Unarchiver.Unarchive: failed to read the rest of the archive: %w", err)
+	}
+	if err := removeCheckpoint(root); err != nil {
+		return fmt.Errorf("unarchiver.Unarchiver.Unarchive: %w", err)
 	}
-	defer func() {
-		_ = tmpFile.Close()
-		_ = os.Remove(tmpFile.Name())
-	}()
-	if _, err := io.Copy(tmpFile, src); err != nil {
-		return fmt.Errorf("failed to copy file: %w", err)
+	marker := CompletionMarker{
+		Entries:       validator.entries,
+		Bytes:         validator.totalBytes,
+		SourceSHA256:  hex.EncodeToString(sourceHash.Sum(nil)),
+		ResumedOffset: opt.resumeOffset,
+		Durable:       u.durable,
+		CompletedAt:   time.Now().UTC(),
 	}
-	if err := os.Rename(tmpFile.Name(), dest); err != nil {
-		return fmt.Errorf("failed to rename temp file to %q: %w", dest, err)
+	if err := writeCompletionMarker(root, marker, u.durable); err != nil {
+		return fmt.Errorf("unarchiver.Unarchiver.Unarchive: %w", err)
 	}
+	logging.FromContext(ctx).InfoContext(ctx, "Unarchive complete", "entries", marker.Entries, "bytes", marker.Bytes, "source_sha256", marker.SourceSHA256, "resumed_offset", marker.ResumedOffset, "durable", marker.Durable)
 	return nil
 }
+
+// saveCheckpoint writes the checkpoint with the state of the extractor.
+func (u *Unarchiver) saveCheckpoint(x *extractor, checkpoint Checkpoint) error {
+	// The entries before the checkpoint must be persisted before the checkpoint itself.
+	if err := x.sync(); err != nil {
+		return err
+	}
+	checkpoint.Directories, checkpoint.Symlinks = x.state()
+	return writeCheckpoint(x.root, checkpoint, u.durable)
+}
@@ -1,5 +1,7 @@
 package unarchiver
 
+import "io/fs"
+
 type UnarchiverOption func(*Unarchiver)
 
 // WithUnarchiveLimitBytesPerSec sets the unarchive speed limit in bytes per second.
@@ -9,3 +11,59 @@ func WithUnarchiveLimitBytesPerSec(limit float64) UnarchiverOption {
 		u.unarchiveLimitBytesPerSec = limit
 	}
 }
+
+// WithDecompressionWorkers sets the number of goroutines to decompress bzip2 blocks and zstd frames.
+// The default is the number of CPUs. 1 decompresses the archive on the calling goroutine.
+func WithDecompressionWorkers(workers int) UnarchiverOption {
+	return func(u *Unarchiver) {
+		u.decompressionWorkers = max(workers, 1)
+	}
+}
+
+// WithAllowedPrefixes restricts the entries of the archive to the given top-level directories such as `photon_data/`.
+// The default is to allow all entries.
+func WithAllowedPrefixes(prefixes ...string) UnarchiverOption {
+	return func(u *Unarchiver) {
+		u.allowedPrefixes = prefixes
+	}
+}
+
+// WithMaxEntries sets the maximum number of entries in the archive.
+// The default is 0, which means unlimited.
+func WithMaxEntries(n int) UnarchiverOption {
+	return func(u *Unarchiver) {
+		u.maxEntries = n
+	}
+}
+
+// WithMaxTotalBytes sets the maximum total size of the files in the archive.
+// The default is 0, which means unlimited.
+func WithMaxTotalBytes(n int64) UnarchiverOption {
+	return func(u *Unarchiver) {
+		u.maxTotalBytes = n
+	}
+}
+
+// WithUmask sets the mask applied to the modes of the extracted files and directories.
+// The default is 0022.
+func WithUmask(umask fs.FileMode) UnarchiverOption {
+	return func(u *Unarchiver) {
+		u.umask = umask.Perm()
+	}
+}
+
+// WithDurable enables to sync the extracted files and directories to the storage before the completion marker is written.
+// It makes the extraction slower, but the extracted tree survives a crash of the node.
+func WithDurable() UnarchiverOption {
+	return func(u *Unarchiver) {
+		u.durable = true
+	}
+}
+
+// WithProgressFunc sets the function which receives the progress of the extraction after each entry.
+// It is called on the goroutine of the extraction, so it must return quickly.
+func WithProgressFunc(fn ProgressFunc) UnarchiverOption {
+	return func(u *Unarchiver) {
+		u.progressFunc = fn
+	}
+}
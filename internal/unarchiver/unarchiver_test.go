@@ -1,9 +1,20 @@
 package unarchiver_test
 
 import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
 	"os"
 	"path/filepath"
+	"strings"
 	"testing"
+	"testing/iotest"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
@@ -29,6 +40,29 @@ func Test_Unarchiver_Unarchive(t *testing.T) {
 				unarchiver.NoCompression(),
 			},
 		},
+		{
+			name:  "uncompressed without option",
+			input: "testdata/data.tar",
+		},
+		{
+			name:  "gzip",
+			input: "testdata/data.tar.gz",
+		},
+		{
+			name:  "zstd",
+			input: "testdata/data.tar.zst",
+		},
+		{
+			name:  "xz",
+			input: "testdata/data.tar.xz",
+		},
+		{
+			name:  "explicit compression",
+			input: "testdata/data.tar.zst",
+			options: []unarchiver.UnarchiveOption{
+				unarchiver.WithCompression(unarchiver.CompressionZstd),
+			},
+		},
 	}
 	for _, tc := range testCases {
 		t.Run(tc.name, func(t *testing.T) {
@@ -51,3 +85,635 @@ func Test_Unarchiver_Unarchive(t *testing.T) {
 		})
 	}
 }
+
+func sha256File(t *testing.T, name string) string {
+	t.Helper()
+	content, err := os.ReadFile(name)
+	require.NoError(t, err)
+	sum := sha256.Sum256(content)
+	return hex.EncodeToString(sum[:])
+}
+
+func Test_Unarchiver_Unarchive_CompletionMarker(t *testing.T) {
+	t.Parallel()
+	testCases := []struct {
+		name    string
+		input   string
+		options []unarchiver.UnarchiverOption
+	}{
+		{
+			name:  "compressed",
+			input: "testdata/data.tar.bz2",
+		},
+		{
+			name:  "uncompressed",
+			input: "testdata/data.tar",
+		},
+		{
+			name:  "durable",
+			input: "testdata/data.tar.zst",
+			options: []unarchiver.UnarchiverOption{
+				unarchiver.WithDurable(),
+			},
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+			// Setup
+			dest := t.TempDir()
+			archive, err := os.Open(tc.input)
+			require.NoError(t, err)
+			defer archive.Close()
+			u := unarchiver.NewUnarchiver(tc.options...)
+
+			// Exercise
+			err = u.Unarchive(t.Context(), archive, dest)
+
+			// Verify
+			require.NoError(t, err)
+			marker, err := unarchiver.ReadCompletionMarker(dest)
+			require.NoError(t, err)
+			// data/ and data/hello.txt
+			assert.Equal(t, 2, marker.Entries)
+			assert.Equal(t, int64(len("hello world!\n")), marker.Bytes)
+			assert.Equal(t, sha256File(t, tc.input), marker.SourceSHA256)
+			assert.Equal(t, len(tc.options) > 0, marker.Durable)
+			assert.False(t, marker.CompletedAt.IsZero())
+		})
+	}
+}
+
+func Test_ReadCompletionMarker(t *testing.T) {
+	t.Parallel()
+	t.Run("no marker", func(t *testing.T) {
+		t.Parallel()
+		// Exercise
+		_, err := unarchiver.ReadCompletionMarker(t.TempDir())
+
+		// Verify
+		require.ErrorIs(t, err, unarchiver.ErrNoCompletionMarker)
+	})
+	t.Run("broken marker", func(t *testing.T) {
+		t.Parallel()
+		// Setup
+		dir := t.TempDir()
+		require.NoError(t, os.WriteFile(filepath.Join(dir, unarchiver.CompletionMarkerName), []byte(`{"version":0}`), 0644))
+
+		// Exercise
+		_, err := unarchiver.ReadCompletionMarker(dir)
+
+		// Verify
+		require.ErrorIs(t, err, unarchiver.ErrNoCompletionMarker)
+	})
+}
+
+func Test_Unarchiver_Unarchive_WrongCompression(t *testing.T) {
+	t.Parallel()
+	// Setup
+	dest := filepath.Join(t.TempDir(), "dest")
+	archive, err := os.Open("testdata/data.tar.gz")
+	require.NoError(t, err)
+	defer archive.Close()
+	u := unarchiver.NewUnarchiver()
+
+	// Exercise
+	err = u.Unarchive(t.Context(), archive, dest, unarchiver.WithCompression(unarchiver.CompressionBzip2))
+
+	// Verify
+	assert.Error(t, err)
+}
+
+type entry struct {
+	name     string
+	typeflag byte
+	content  string
+	linkname string
+	mode     int64
+}
+
+func newArchive(t *testing.T, entries []entry) *bytes.Buffer {
+	t.Helper()
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, e := range entries {
+		mode := e.mode
+		if mode == 0 {
+			mode = 0644
+		}
+		require.NoError(t, tw.WriteHeader(&tar.Header{
+			Name:     e.name,
+			Typeflag: e.typeflag,
+			Linkname: e.linkname,
+			Mode:     mode,
+			Size:     int64(len(e.content)),
+		}))
+		_, err := tw.Write([]byte(e.content))
+		require.NoError(t, err)
+	}
+	require.NoError(t, tw.Close())
+	return &buf
+}
+
+func Test_Unarchiver_Unarchive_UnsafeEntry(t *testing.T) {
+	t.Parallel()
+	testCases := []struct {
+		name    string
+		entries []entry
+		options []unarchiver.UnarchiverOption
+		wantErr bool
+	}{
+		{
+			name: "safe entries",
+			entries: []entry{
+				{name: "./", typeflag: tar.TypeDir},
+				{name: "./data/", typeflag: tar.TypeDir},
+				{name: "./data/hello.txt", typeflag: tar.TypeReg, content: "hello"},
+			},
+			options: []unarchiver.UnarchiverOption{
+				unarchiver.WithAllowedPrefixes("data/"),
+				unarchiver.WithMaxEntries(3),
+				unarchiver.WithMaxTotalBytes(5),
+			},
+		},
+		{
+			name: "parent directory",
+			entries: []entry{
+				{name: "../evil.txt", typeflag: tar.TypeReg, content: "evil"},
+			},
+			wantErr: true,
+		},
+		{
+			name: "parent directory in the middle",
+			entries: []entry{
+				{name: "data/../../evil.txt", typeflag: tar.TypeReg, content: "evil"},
+			},
+			wantErr: true,
+		},
+		{
+			name: "absolute path",
+			entries: []entry{
+				{name: "/tmp/evil.txt", typeflag: tar.TypeReg, content: "evil"},
+			},
+			wantErr: true,
+		},
+		{
+			name: "not allowed prefix",
+			entries: []entry{
+				{name: "other/evil.txt", typeflag: tar.TypeReg, content: "evil"},
+			},
+			options: []unarchiver.UnarchiverOption{
+				unarchiver.WithAllowedPrefixes("data/"),
+			},
+			wantErr: true,
+		},
+		{
+			name: "similar prefix",
+			entries: []entry{
+				{name: "data2/evil.txt", typeflag: tar.TypeReg, content: "evil"},
+			},
+			options: []unarchiver.UnarchiverOption{
+				unarchiver.WithAllowedPrefixes("data"),
+			},
+			wantErr: true,
+		},
+		{
+			name: "absolute symbolic link",
+			entries: []entry{
+				{name: "data/", typeflag: tar.TypeDir},
+				{name: "data/link", typeflag: tar.TypeSymlink, linkname: "/etc"},
+			},
+			wantErr: true,
+		},
+		{
+			name: "symbolic link to outside",
+			entries: []entry{
+				{name: "data/", typeflag: tar.TypeDir},
+				{name: "data/link", typeflag: tar.TypeSymlink, linkname: "../../a"},
+			},
+			wantErr: true,
+		},
+		{
+			name: "entry through symbolic link",
+			entries: []entry{
+				{name: "data/", typeflag: tar.TypeDir},
+				{name: "data/sub/", typeflag: tar.TypeDir},
+				{name: "data/sub/link", typeflag: tar.TypeSymlink, linkname: ".."},
+				{name: "data/sub/link/evil.txt", typeflag: tar.TypeSymlink, linkname: "../../evil.txt"},
+			},
+			wantErr: true,
+		},
+		{
+			name: "symbolic link through another link to outside",
+			entries: []entry{
+				{name: "photon_data/", typeflag: tar.TypeDir},
+				{name: "photon_data/d/", typeflag: tar.TypeDir},
+				{name: "photon_data/d/l1", typeflag: tar.TypeSymlink, linkname: ".."},
+				{name: "photon_data/e", typeflag: tar.TypeSymlink, linkname: "d/l1/../../.."},
+			},
+			wantErr: true,
+		},
+		{
+			name: "symbolic link through another link inside",
+			entries: []entry{
+				{name: "photon_data/", typeflag: tar.TypeDir},
+				{name: "photon_data/d/", typeflag: tar.TypeDir},
+				{name: "photon_data/d/l1", typeflag: tar.TypeSymlink, linkname: ".."},
+				{name: "photon_data/e", typeflag: tar.TypeSymlink, linkname: "d/l1/d/../.."},
+			},
+		},
+		{
+			name: "symbolic link replacing a directory which another link passes through",
+			entries: []entry{
+				{name: "photon_data/", typeflag: tar.TypeDir},
+				{name: "photon_data/d/", typeflag: tar.TypeDir},
+				{name: "photon_data/e", typeflag: tar.TypeSymlink, linkname: "d/../.."},
+				{name: "photon_data/d", typeflag: tar.TypeSymlink, linkname: ".."},
+			},
+			wantErr: true,
+		},
+		{
+			name: "symbolic link loop",
+			entries: []entry{
+				{name: "photon_data/", typeflag: tar.TypeDir},
+				{name: "photon_data/a", typeflag: tar.TypeSymlink, linkname: "b"},
+				{name: "photon_data/b", typeflag: tar.TypeSymlink, linkname: "a"},
+				{name: "photon_data/c", typeflag: tar.TypeSymlink, linkname: "a/x"},
+			},
+			wantErr: true,
+		},
+		{
+			name: "hard link to outside",
+			entries: []entry{
+				{name: "data/", typeflag: tar.TypeDir},
+				{name: "data/link", typeflag: tar.TypeLink, linkname: "../evil.txt"},
+			},
+			wantErr: true,
+		},
+		{
+			name: "too many entries",
+			entries: []entry{
+				{name: "data/", typeflag: tar.TypeDir},
+				{name: "data/a.txt", typeflag: tar.TypeReg, content: "a"},
+				{name: "data/b.txt", typeflag: tar.TypeReg, content: "b"},
+			},
+			options: []unarchiver.UnarchiverOption{
+				unarchiver.WithMaxEntries(2),
+			},
+			wantErr: true,
+		},
+		{
+			name: "too large",
+			entries: []entry{
+				{name: "data/", typeflag: tar.TypeDir},
+				{name: "data/a.txt", typeflag: tar.TypeReg, content: "aaa"},
+				{name: "data/b.txt", typeflag: tar.TypeReg, content: "bbb"},
+			},
+			options: []unarchiver.UnarchiverOption{
+				unarchiver.WithMaxTotalBytes(5),
+			},
+			wantErr: true,
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+			// Setup
+			root := t.TempDir()
+			dest := filepath.Join(root, "a", "dest")
+			archive := newArchive(t, tc.entries)
+			u := unarchiver.NewUnarchiver(tc.options...)
+
+			// Exercise
+			err := u.Unarchive(t.Context(), archive, dest)
+
+			// Verify
+			if !tc.wantErr {
+				require.NoError(t, err)
+				return
+			}
+			var unsafeErr *unarchiver.UnsafeEntryError
+			require.ErrorAs(t, err, &unsafeErr)
+			assert.NoFileExists(t, filepath.Join(root, "a", "evil.txt"))
+			assert.NoFileExists(t, filepath.Join(root, "evil.txt"))
+			assert.NoDirExists(t, dest)
+		})
+	}
+}
+
+func Test_Unarchiver_Unarchive_Links(t *testing.T) {
+	t.Parallel()
+	// Setup
+	dest := t.TempDir()
+	archive := newArchive(t, []entry{
+		{name: "data/", typeflag: tar.TypeDir, mode: 0750},
+		{name: "data/hello.txt", typeflag: tar.TypeReg, content: "hello", mode: 0666},
+		{name: "data/script.sh", typeflag: tar.TypeReg, content: "exit 0", mode: 0777},
+		{name: "data/symlink.txt", typeflag: tar.TypeSymlink, linkname: "hello.txt"},
+		{name: "data/hardlink.txt", typeflag: tar.TypeLink, linkname: "data/hello.txt"},
+		{name: "data/nested/dir/file.txt", typeflag: tar.TypeReg, content: "nested"},
+		{name: "data/fifo", typeflag: tar.TypeFifo},
+	})
+	u := unarchiver.NewUnarchiver(unarchiver.WithUmask(0027))
+
+	// Exercise
+	err := u.Unarchive(t.Context(), archive, dest)
+
+	// Verify
+	require.NoError(t, err)
+	dataStat, err := os.Stat(filepath.Join(dest, "data"))
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0750), dataStat.Mode().Perm())
+	helloStat, err := os.Stat(filepath.Join(dest, "data", "hello.txt"))
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0640), helloStat.Mode().Perm())
+	scriptStat, err := os.Stat(filepath.Join(dest, "data", "script.sh"))
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0750), scriptStat.Mode().Perm())
+	linkTarget, err := os.Readlink(filepath.Join(dest, "data", "symlink.txt"))
+	require.NoError(t, err)
+	assert.Equal(t, "hello.txt", linkTarget)
+	hardlinkStat, err := os.Stat(filepath.Join(dest, "data", "hardlink.txt"))
+	require.NoError(t, err)
+	assert.True(t, os.SameFile(helloStat, hardlinkStat))
+	got, err := os.ReadFile(filepath.Join(dest, "data", "nested", "dir", "file.txt"))
+	require.NoError(t, err)
+	assert.Equal(t, "nested", string(got))
+	assert.NoFileExists(t, filepath.Join(dest, "data", "fifo"))
+}
+
+func Test_Unarchiver_Unarchive_Progress(t *testing.T) {
+	t.Parallel()
+	// Setup
+	dest := t.TempDir()
+	archive := newArchive(t, []entry{
+		{name: "data/", typeflag: tar.TypeDir},
+		{name: "data/hello.txt", typeflag: tar.TypeReg, content: "hello"},
+		{name: "data/world.txt", typeflag: tar.TypeReg, content: "world!"},
+	})
+	var got []unarchiver.Progress
+	u := unarchiver.NewUnarchiver(unarchiver.WithProgressFunc(func(ctx context.Context, progress unarchiver.Progress) {
+		got = append(got, progress)
+	}))
+
+	// Exercise
+	err := u.Unarchive(t.Context(), archive, dest)
+
+	// Verify
+	require.NoError(t, err)
+	require.Len(t, got, 3)
+	assert.Equal(t, []int{1, 2, 3}, []int{got[0].Entries, got[1].Entries, got[2].Entries})
+	assert.Equal(t, []int64{0, 5, 11}, []int64{got[0].Bytes, got[1].Bytes, got[2].Bytes})
+	assert.Less(t, got[0].Offset, got[1].Offset)
+	assert.Less(t, got[1].Offset, got[2].Offset)
+}
+
+func Test_ParseCompression(t *testing.T) {
+	t.Parallel()
+	testCases := []struct {
+		name    string
+		want    unarchiver.Compression
+		wantErr bool
+	}{
+		{name: "", want: unarchiver.CompressionAuto},
+		{name: "auto", want: unarchiver.CompressionAuto},
+		{name: "none", want: unarchiver.CompressionNone},
+		{name: "bzip2", want: unarchiver.CompressionBzip2},
+		{name: "GZIP", want: unarchiver.CompressionGzip},
+		{name: "zstd", want: unarchiver.CompressionZstd},
+		{name: "xz", want: unarchiver.CompressionXz},
+		{name: "lz4", wantErr: true},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+			// Exercise
+			got, err := unarchiver.ParseCompression(tc.name)
+
+			// Verify
+			if tc.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tc.want, got)
+		})
+	}
+}
+
+func Test_Unarchiver_Unarchive_DecompressionWorkers(t *testing.T) {
+	t.Parallel()
+	var lines bytes.Buffer
+	for i := range 30000 {
+		fmt.Fprintf(&lines, "line %d\n", i)
+	}
+	testCases := []struct {
+		name    string
+		input   string
+		workers int
+	}{
+		{
+			name:    "single block",
+			input:   "testdata/data.tar.bz2",
+			workers: 4,
+		},
+		{
+			name:    "multiple blocks",
+			input:   "testdata/multiblock.tar.bz2",
+			workers: 4,
+		},
+		{
+			name:    "multiple streams",
+			input:   "testdata/multistream.tar.bz2",
+			workers: 4,
+		},
+		{
+			name:    "more blocks than workers",
+			input:   "testdata/multiblock.tar.bz2",
+			workers: 2,
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+			// Setup
+			dest := t.TempDir()
+			archive, err := os.Open(tc.input)
+			require.NoError(t, err)
+			defer archive.Close()
+			u := unarchiver.NewUnarchiver(unarchiver.WithDecompressionWorkers(tc.workers))
+
+			// Exercise
+			err = u.Unarchive(t.Context(), archive, dest)
+
+			// Verify
+			require.NoError(t, err)
+			got, err := os.ReadFile(filepath.Join(dest, "data", "hello.txt"))
+			require.NoError(t, err)
+			assert.Equal(t, "hello world!\n", string(got))
+			marker, err := unarchiver.ReadCompletionMarker(dest)
+			require.NoError(t, err)
+			assert.Equal(t, sha256File(t, tc.input), marker.SourceSHA256)
+			if tc.input != "testdata/data.tar.bz2" {
+				got, err := os.ReadFile(filepath.Join(dest, "data", "lines.txt"))
+				require.NoError(t, err)
+				assert.Equal(t, lines.String(), string(got))
+			}
+		})
+	}
+	t.Run("corrupted", func(t *testing.T) {
+		t.Parallel()
+		// Setup
+		dest := filepath.Join(t.TempDir(), "dest")
+		archive, err := os.ReadFile("testdata/multiblock.tar.bz2")
+		require.NoError(t, err)
+		archive[len(archive)/2] ^= 0xff
+		u := unarchiver.NewUnarchiver(unarchiver.WithDecompressionWorkers(4))
+
+		// Exercise
+		err = u.Unarchive(t.Context(), bytes.NewReader(archive), dest)
+
+		// Verify
+		assert.Error(t, err)
+	})
+}
+
+func Test_Unarchiver_Unarchive_Resume(t *testing.T) {
+	t.Parallel()
+	entries := []entry{
+		{name: "data/", typeflag: tar.TypeDir, mode: 0750},
+		{name: "data/first.txt", typeflag: tar.TypeReg, content: strings.Repeat("first\n", 1000)},
+		{name: "data/symlink.txt", typeflag: tar.TypeSymlink, linkname: "first.txt"},
+		{name: "data/second.txt", typeflag: tar.TypeReg, content: strings.Repeat("second\n", 1000)},
+		{name: "data/third.txt", typeflag: tar.TypeReg, content: strings.Repeat("third\n", 1000)},
+	}
+	tarBytes := newArchive(t, entries).Bytes()
+	var gzipped bytes.Buffer
+	gw := gzip.NewWriter(&gzipped)
+	_, err := gw.Write(tarBytes)
+	require.NoError(t, err)
+	require.NoError(t, gw.Close())
+	testCases := []struct {
+		name    string
+		archive []byte
+	}{
+		{
+			name:    "uncompressed",
+			archive: tarBytes,
+		},
+		{
+			name:    "gzip",
+			archive: gzipped.Bytes(),
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+			// Setup: the connection breaks in the middle of the second file
+			dest := filepath.Join(t.TempDir(), "dest")
+			broken := io.MultiReader(
+				bytes.NewReader(tc.archive[:len(tc.archive)*2/3]),
+				iotest.ErrReader(errors.New("connection reset by peer")),
+			)
+			u := unarchiver.NewUnarchiver()
+			err := u.Unarchive(t.Context(), broken, dest)
+			var interrupted *unarchiver.InterruptedError
+			require.ErrorAs(t, err, &interrupted)
+			checkpoint, err := unarchiver.ReadCheckpoint(dest)
+			require.NoError(t, err)
+			require.Equal(t, interrupted.Offset, checkpoint.Offset)
+			require.Positive(t, checkpoint.Offset)
+			_, err = unarchiver.ReadCompletionMarker(dest)
+			require.ErrorIs(t, err, unarchiver.ErrNoCompletionMarker)
+
+			// Exercise: send the rest of the tar stream
+			rest := bytes.NewReader(tarBytes[checkpoint.Offset:])
+			err = u.Unarchive(t.Context(), rest, dest, unarchiver.WithResumeOffset(checkpoint.Offset))
+
+			// Verify
+			require.NoError(t, err)
+			for _, e := range entries {
+				if e.typeflag != tar.TypeReg {
+					continue
+				}
+				got, err := os.ReadFile(filepath.Join(dest, e.name))
+				require.NoError(t, err)
+				assert.Equal(t, e.content, string(got))
+			}
+			dataStat, err := os.Stat(filepath.Join(dest, "data"))
+			require.NoError(t, err)
+			assert.Equal(t, os.FileMode(0750), dataStat.Mode().Perm())
+			marker, err := unarchiver.ReadCompletionMarker(dest)
+			require.NoError(t, err)
+			assert.Equal(t, len(entries), marker.Entries)
+			assert.Equal(t, checkpoint.Offset, marker.ResumedOffset)
+			_, err = unarchiver.ReadCheckpoint(dest)
+			require.ErrorIs(t, err, unarchiver.ErrNoCheckpoint)
+		})
+	}
+	t.Run("offset mismatch", func(t *testing.T) {
+		t.Parallel()
+		// Setup
+		dest := filepath.Join(t.TempDir(), "dest")
+		broken := io.MultiReader(
+			bytes.NewReader(tarBytes[:len(tarBytes)/2]),
+			iotest.ErrReader(errors.New("connection reset by peer")),
+		)
+		u := unarchiver.NewUnarchiver()
+		err := u.Unarchive(t.Context(), broken, dest)
+		var interrupted *unarchiver.InterruptedError
+		require.ErrorAs(t, err, &interrupted)
+
+		// Exercise
+		offset := interrupted.Offset + 512
+		err = u.Unarchive(t.Context(), bytes.NewReader(tarBytes[offset:]), dest, unarchiver.WithResumeOffset(offset))
+
+		// Verify: the extracted entries are kept
+		require.ErrorIs(t, err, unarchiver.ErrCheckpointMismatch)
+		checkpoint, err := unarchiver.ReadCheckpoint(dest)
+		require.NoError(t, err)
+		assert.Equal(t, interrupted.Offset, checkpoint.Offset)
+	})
+	for _, tc := range testCases {
+		t.Run("truncated "+tc.name, func(t *testing.T) {
+			t.Parallel()
+			// Setup: the archive ends in the middle of the second file without an error of the connection
+			dest := filepath.Join(t.TempDir(), "dest")
+			truncated := bytes.NewReader(tc.archive[:len(tc.archive)/2])
+			u := unarchiver.NewUnarchiver()
+
+			// Exercise
+			err := u.Unarchive(t.Context(), truncated, dest)
+
+			// Verify
+			require.ErrorIs(t, err, io.ErrUnexpectedEOF)
+			var interrupted *unarchiver.InterruptedError
+			assert.False(t, errors.As(err, &interrupted))
+			_, err = unarchiver.ReadCheckpoint(dest)
+			assert.ErrorIs(t, err, unarchiver.ErrNoCheckpoint)
+		})
+	}
+	t.Run("start over", func(t *testing.T) {
+		t.Parallel()
+		// Setup
+		dest := filepath.Join(t.TempDir(), "dest")
+		broken := io.MultiReader(
+			bytes.NewReader(tarBytes[:len(tarBytes)/2]),
+			iotest.ErrReader(errors.New("connection reset by peer")),
+		)
+		u := unarchiver.NewUnarchiver()
+		err := u.Unarchive(t.Context(), broken, dest)
+		var interrupted *unarchiver.InterruptedError
+		require.ErrorAs(t, err, &interrupted)
+
+		// Exercise: send another archive from the beginning
+		err = u.Unarchive(t.Context(), newArchive(t, []entry{
+			{name: "other/", typeflag: tar.TypeDir},
+		}), dest)
+
+		// Verify: the entries of the interrupted extraction are discarded
+		require.NoError(t, err)
+		assert.NoDirExists(t, filepath.Join(dest, "data"))
+		assert.DirExists(t, filepath.Join(dest, "other"))
+	})
+}
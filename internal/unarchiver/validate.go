@@ -0,0 +1,93 @@
+package unarchiver
+
+import (
+	"archive/tar"
+	"fmt"
+	"path"
+	"strings"
+)
+
+// UnsafeEntryError is returned when the archive contains an entry which must not be extracted.
+// The unarchiving is aborted when it is found.
+type UnsafeEntryError struct {
+	// Name is the name of the entry in the archive.
+	Name string
+	// Reason describes why the entry is rejected.
+	Reason string
+}
+
+func (e *UnsafeEntryError) Error() string {
+	return fmt.Sprintf("unsafe entry %q: %s", e.Name, e.Reason)
+}
+
+// entryValidator validates the entries of an archive before they are extracted.
+type entryValidator struct {
+	allowedPrefixes []string
+	maxEntries      int
+	maxTotalBytes   int64
+
+	entries    int
+	totalBytes int64
+}
+
+func (u *Unarchiver) newEntryValidator() *entryValidator {
+	return &entryValidator{
+		allowedPrefixes: u.allowedPrefixes,
+		maxEntries:      u.maxEntries,
+		maxTotalBytes:   u.maxTotalBytes,
+	}
+}
+
+// validate checks the entry and returns its cleaned name.
+// The name is validated lexically. It does not touch the file system.
+func (v *entryValidator) validate(header *tar.Header) (string, error) {
+	v.entries++
+	if v.maxEntries > 0 && v.entries > v.maxEntries {
+		return "", &UnsafeEntryError{Name: header.Name, Reason: fmt.Sprintf("archive has more than %d entries", v.maxEntries)}
+	}
+	if header.Typeflag == tar.TypeReg {
+		v.totalBytes += header.Size
+		if v.maxTotalBytes > 0 && v.totalBytes > v.maxTotalBytes {
+			return "", &UnsafeEntryError{Name: header.Name, Reason: fmt.Sprintf("total size of files exceeds %d bytes", v.maxTotalBytes)}
+		}
+	}
+	name, err := cleanEntryName(header.Name)
+	if err != nil {
+		return "", &UnsafeEntryError{Name: header.Name, Reason: err.Error()}
+	}
+	if !v.allowed(name) {
+		return "", &UnsafeEntryError{Name: header.Name, Reason: fmt.Sprintf("entry is not under %s", strings.Join(v.allowedPrefixes, ", "))}
+	}
+	return name, nil
+}
+
+// allowed returns true if the cleaned name is under one of the allowed prefixes.
+// The root of the archive itself is always allowed.
+func (v *entryValidator) allowed(name string) bool {
+	if len(v.allowedPrefixes) == 0 || name == "." {
+		return true
+	}
+	for _, prefix := range v.allowedPrefixes {
+		prefix = strings.Trim(path.Clean(prefix), "/")
+		if name == prefix || strings.HasPrefix(name, prefix+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// cleanEntryName rejects absolute paths and `..` segments, and returns the cleaned name.
+func cleanEntryName(name string) (string, error) {
+	if name == "" {
+		return "", fmt.Errorf("empty name")
+	}
+	if strings.HasPrefix(name, "/") || strings.Contains(name, `\`) || strings.Contains(name, "\x00") {
+		return "", fmt.Errorf("absolute path or invalid character")
+	}
+	for _, segment := range strings.Split(name, "/") {
+		if segment == ".." {
+			return "", fmt.Errorf("parent directory reference")
+		}
+	}
+	return path.Clean(name), nil
+}
@@ -0,0 +1,63 @@
+package updater_test
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/pddg/photon-container/internal/photondata"
+	"github.com/pddg/photon-container/internal/updater"
+)
+
+func Test_Updater_Activate(t *testing.T) {
+	t.Parallel()
+	installed := &photondata.InstalledArchive{URL: "https://example.com/photon-db.tar.bz2", ETag: `"a"`}
+	testCases := []struct {
+		name           string
+		migrator       *stubMigrator
+		wantErr        bool
+		wantRolledBack *photondata.InstalledArchive
+	}{
+		{
+			name:           "the installed archive is recorded as rolled back from",
+			migrator:       &stubMigrator{installed: installed},
+			wantRolledBack: installed,
+		},
+		{
+			name:     "the installed archive is unknown",
+			migrator: &stubMigrator{},
+		},
+		{
+			name:     "failed to activate",
+			migrator: &stubMigrator{installed: installed, activateErr: errors.New("generation is broken")},
+			wantErr:  true,
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+			// Setup
+			jobs, err := updater.NewJobManager(t.Context(), updater.UpdateStrategySequential, filepath.Join(t.TempDir(), "jobs.json"))
+			require.NoError(t, err)
+			ctx, job := jobs.Start(t.Context(), updater.JobKindActivate)
+			u, err := updater.New(updater.UpdateStrategySequential, &stubDownloader{}, nil, &stubPhotonServer{}, tc.migrator, t.TempDir())
+			require.NoError(t, err)
+
+			// Exercise
+			err = u.Activate(ctx, "20251001T000000Z")
+
+			// Verify
+			if tc.wantErr {
+				require.Error(t, err)
+				assert.Equal(t, updater.JobStateFailed, job.Status().State)
+			} else {
+				require.NoError(t, err)
+				assert.Equal(t, updater.JobStateSucceeded, job.Status().State)
+			}
+			assert.Equal(t, tc.wantRolledBack, tc.migrator.setRolledBack)
+		})
+	}
+}
@@ -0,0 +1,118 @@
+package updater
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/dustin/go-humanize"
+
+	"github.com/pddg/photon-container/internal/logging"
+	"github.com/pddg/photon-container/internal/memutil"
+)
+
+// ErrInsufficientMemory is returned when the node can not host the second Photon server of the bluegreen strategy.
+var ErrInsufficientMemory = errors.New("insufficient memory for the second Photon server")
+
+// BlueGreenUpdater downloads and unarchives the database in the same way as ParallelUpdater.
+// Instead of restarting the Photon server, it starts a second one on the new database in the standby slot,
+// and stops the previous one after the second one serves the new database.
+type BlueGreenUpdater struct {
+	*ParallelUpdater
+	photonServer HandoverPhotonServer
+	migrator     SlotMigrator
+	// requiredMemory is the memory which the second Photon server needs. The memory used by the live one is assumed if it is 0.
+	requiredMemory uint64
+}
+
+// NewBlueGreenUpdater creates a new BlueGreenUpdater.
+func NewBlueGreenUpdater(
+	downloader Downloader,
+	unarchiver Unarchiver,
+	photonServer HandoverPhotonServer,
+	migrator SlotMigrator,
+	photonDataDir string,
+	options ...UpdaterOption,
+) *BlueGreenUpdater {
+	opts := initUpdaterOptions(options...)
+	u := &BlueGreenUpdater{
+		photonServer:   photonServer,
+		migrator:       migrator,
+		requiredMemory: opts.blueGreenMemory,
+	}
+	// The database is promoted by switchPhotonServer instead of the replacement by the migrator.
+	u.ParallelUpdater = &ParallelUpdater{
+		downloader:    downloader,
+		unarchiver:    unarchiver,
+		photonServer:  eventPhotonServer{photonServer},
+		validator:     opts.validator,
+		photonDataDir: photonDataDir,
+		strategy:      UpdateStrategyBlueGreen,
+		promoteStep:   "start Photon server on new database and switch to it",
+		promote:       u.switchPhotonServer,
+	}
+	return u
+}
+
+// switchPhotonServer moves the unarchived database to the standby slot, and hands over to the Photon server on it.
+// The previous Photon server keeps serving until the new one serves the new database.
+func (u *BlueGreenUpdater) switchPhotonServer(ctx context.Context, unarchived string) error {
+	logger := logging.FromContext(ctx)
+	if err := u.checkMemory(ctx); err != nil {
+		return err
+	}
+	standby, err := u.migrator.MigrateToStandby(ctx, unarchived)
+	if err != nil {
+		return fmt.Errorf("failed to move new database to standby slot: %w", err)
+	}
+	logger.InfoContext(ctx, "start Photon server on standby slot", "slot", standby)
+	err = u.photonServer.Handover(ctx, u.migrator.SlotPhotonDir(standby), u.migrator.SlotPort(standby), func(ctx context.Context) error {
+		if err := u.migrator.WaitForStandby(ctx); err != nil {
+			return err
+		}
+		// The proxy and the checks of Photon follow the live slot.
+		return u.migrator.SwitchSlot(ctx)
+	})
+	if err != nil {
+		logger.ErrorContext(ctx, "keep serving the previous database", "error", err)
+		if discardErr := u.migrator.DiscardStandby(ctx, err.Error()); discardErr != nil {
+			logger.WarnContext(ctx, "failed to discard new database", "error", discardErr)
+		}
+		return fmt.Errorf("%w: %w", ErrRolledBack, err)
+	}
+	JobFromContext(ctx).publish(Event{Type: EventPhotonSwitched})
+	if err := u.migrator.CommitStandby(ctx); err != nil {
+		logger.WarnContext(ctx, "failed to commit the new database", "error", err)
+	}
+	return nil
+}
+
+// checkMemory makes sure that the node can host the second Photon server while both of them are running.
+func (u *BlueGreenUpdater) checkMemory(ctx context.Context) error {
+	logger := logging.FromContext(ctx)
+	required := u.requiredMemory
+	if required == 0 {
+		if !u.photonServer.Running() {
+			// Only the new one will run.
+			return nil
+		}
+		usage, err := u.photonServer.MemoryUsage()
+		if err != nil {
+			return fmt.Errorf("failed to measure memory usage of Photon server: %w", err)
+		}
+		required = usage
+	}
+	available, err := memutil.Available()
+	if err != nil {
+		if errors.Is(err, memutil.ErrUnsupported) {
+			logger.WarnContext(ctx, "skip memory check", "error", err)
+			return nil
+		}
+		return fmt.Errorf("failed to measure available memory: %w", err)
+	}
+	if available < required {
+		return fmt.Errorf("%w: %s required, %s available", ErrInsufficientMemory, humanize.IBytes(required), humanize.IBytes(available))
+	}
+	logger.InfoContext(ctx, "enough memory for the second Photon server", "required", humanize.IBytes(required), "available", humanize.IBytes(available))
+	return nil
+}
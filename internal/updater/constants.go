@@ -5,6 +5,8 @@ type UpdateStrategy string
 const (
 	UpdateStrategySequential UpdateStrategy = "sequential"
 	UpdateStrategyParallel   UpdateStrategy = "parallel"
+	UpdateStrategyStreaming  UpdateStrategy = "streaming"
+	UpdateStrategyBlueGreen  UpdateStrategy = "bluegreen"
 
 	DefaultUpdateStrategy = UpdateStrategySequential
 )
@@ -15,6 +17,10 @@ func NewUpdateStrategy(strategy string) UpdateStrategy {
 		return UpdateStrategySequential
 	case string(UpdateStrategyParallel):
 		return UpdateStrategyParallel
+	case string(UpdateStrategyStreaming):
+		return UpdateStrategyStreaming
+	case string(UpdateStrategyBlueGreen):
+		return UpdateStrategyBlueGreen
 	default:
 		return UpdateStrategySequential
 	}
@@ -5,13 +5,16 @@ import (
 	"io"
 	"time"
 
+	"github.com/pddg/photon-container/internal/downloader"
 	"github.com/pddg/photon-container/internal/photondata"
 	"github.com/pddg/photon-container/internal/unarchiver"
 )
 
 type Downloader interface {
 	Download(ctx context.Context, archive photondata.Archive, dest string) error
-	GetLastModified(ctx context.Context, archive photondata.Archive) (time.Time, error)
+	Inspect(ctx context.Context, archive photondata.Archive) (downloader.ArchiveInfo, error)
+	ExpectedChecksum(ctx context.Context, archive photondata.Archive) (downloader.Checksum, error)
+	Stream(ctx context.Context, archive photondata.Archive) (*downloader.Stream, error)
 }
 
 type Unarchiver interface {
@@ -23,17 +26,56 @@ type PhotonServer interface {
 	Stop(ctx context.Context) error
 }
 
+// HandoverPhotonServer is the Photon server which can hand over to a second one on another database without downtime.
+type HandoverPhotonServer interface {
+	PhotonServer
+	Handover(ctx context.Context, photonDataDir string, port int, ready func(ctx context.Context) error) error
+	Running() bool
+	MemoryUsage() (uint64, error)
+}
+
+// Validator checks the unarchived database before it is promoted.
+type Validator interface {
+	Validate(ctx context.Context, unarchived string) error
+}
+
 type ReplaceMigrator interface {
 	MigrateByReplace(ctx context.Context, unarchived string) error
+	WaitForImport(ctx context.Context) error
+	CommitReplace(ctx context.Context) error
+	RollbackReplace(ctx context.Context, reason string) error
 }
 
 type RemoveMigrator interface {
 	MigrateByRemoveFirst(ctx context.Context, unarchived string) (func() error, error)
+	Abort(ctx context.Context, reason string)
+}
+
+type GenerationMigrator interface {
+	Generations() ([]photondata.Generation, error)
+	MigrateToGeneration(ctx context.Context, id string) error
+}
+
+type SlotMigrator interface {
+	MigrateToStandby(ctx context.Context, unarchived string) (photondata.Slot, error)
+	WaitForStandby(ctx context.Context) error
+	SwitchSlot(ctx context.Context) error
+	CommitStandby(ctx context.Context) error
+	DiscardStandby(ctx context.Context, reason string) error
+	SlotPhotonDir(slot photondata.Slot) string
+	SlotPort(slot photondata.Slot) int
 }
 
 type Migrator interface {
 	ReplaceMigrator
 	RemoveMigrator
+	GenerationMigrator
+	SlotMigrator
 	State(ctx context.Context) (photondata.MigrationState, time.Time)
 	ResetState(ctx context.Context)
+	InstalledArchive() (*photondata.InstalledArchive, error)
+	SetInstalledArchive(archive photondata.InstalledArchive) error
+	RolledBackArchive() (*photondata.InstalledArchive, error)
+	SetRolledBackArchive(archive photondata.InstalledArchive) error
+	LiveDataSize() (int64, error)
 }
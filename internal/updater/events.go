@@ -0,0 +1,195 @@
+package updater
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/pddg/photon-container/internal/unarchiver"
+)
+
+type EventType string
+
+const (
+	// EventStep is published when a step of the job begins.
+	EventStep EventType = "step"
+	// EventDownloadProgress is published while the archive is downloaded.
+	EventDownloadProgress EventType = "download_progress"
+	// EventExtractProgress is published while the archive is extracted.
+	EventExtractProgress EventType = "extract_progress"
+	// EventPhotonStopped is published when the Photon server is stopped.
+	EventPhotonStopped EventType = "photon_stopped"
+	// EventPhotonStarted is published when the Photon server is started.
+	EventPhotonStarted EventType = "photon_started"
+	// EventPhotonSwitched is published when the Photon server on the new database takes over from the previous one.
+	EventPhotonSwitched EventType = "photon_switched"
+	// EventFinished is published when the job succeeds, fails, is skipped or is canceled.
+	EventFinished EventType = "finished"
+)
+
+// progressEventInterval is the minimum interval between progress events of a job.
+const progressEventInterval = time.Second
+
+// eventBufferSize is the number of events buffered for a subscriber.
+// Events are dropped for a subscriber which does not keep up with them,
+// except for the finished event which replaces the oldest buffered one.
+const eventBufferSize = 64
+
+// Event is a structured event of a job.
+// Only the fields related to the type are set.
+type Event struct {
+	Type  EventType `json:"type"`
+	JobID string    `json:"job_id"`
+	Time  time.Time `json:"time"`
+
+	Step       int    `json:"step,omitempty"`
+	TotalSteps int    `json:"total_steps,omitempty"`
+	StepName   string `json:"step_name,omitempty"`
+
+	// BytesRead is the number of bytes downloaded, or the total size of the files extracted so far.
+	BytesRead int64 `json:"bytes_read,omitempty"`
+	// TotalBytes is the size of the archive to download. It is not known for the extraction.
+	TotalBytes int64 `json:"total_bytes,omitempty"`
+	// BytesPerSec is the rate since the previous progress event.
+	BytesPerSec float64 `json:"bytes_per_sec,omitempty"`
+	Entries     int     `json:"entries,omitempty"`
+
+	State     JobState `json:"state,omitempty"`
+	Error     string   `json:"error,omitempty"`
+	Attention string   `json:"attention,omitempty"`
+}
+
+// eventBroker delivers the events to the subscribers without blocking the publisher.
+type eventBroker struct {
+	mutex       sync.Mutex
+	subscribers map[chan Event]struct{}
+}
+
+// Subscribe returns the channel receiving the events of all jobs.
+// The channel is closed when the context is done.
+func (m *JobManager) Subscribe(ctx context.Context) <-chan Event {
+	ch := make(chan Event, eventBufferSize)
+	b := &m.events
+	b.mutex.Lock()
+	if b.subscribers == nil {
+		b.subscribers = map[chan Event]struct{}{}
+	}
+	b.subscribers[ch] = struct{}{}
+	b.mutex.Unlock()
+	context.AfterFunc(ctx, func() {
+		b.mutex.Lock()
+		defer b.mutex.Unlock()
+		delete(b.subscribers, ch)
+		close(ch)
+	})
+	return ch
+}
+
+func (b *eventBroker) publish(event Event) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	for ch := range b.subscribers {
+		select {
+		case ch <- event:
+			continue
+		default:
+		}
+		if event.Type != EventFinished {
+			continue
+		}
+		// The subscriber waits for the finished event to know the result of the job,
+		// so drop the oldest event to make room for it. Only publish sends to the channel
+		// and it holds the lock, so the buffer has a room after receiving one.
+		select {
+		case <-ch:
+		default:
+		}
+		ch <- event
+	}
+}
+
+// publish publishes the event of the job.
+func (j *Job) publish(event Event) {
+	if j == nil {
+		return
+	}
+	event.JobID = j.ID()
+	if event.Time.IsZero() {
+		event.Time = time.Now().UTC()
+	}
+	j.manager.events.publish(event)
+}
+
+// progressSample is the last progress published, to throttle the events and calculate the rate.
+type progressSample struct {
+	time  time.Time
+	bytes int64
+}
+
+// publishProgress publishes the progress event at most once per progressEventInterval.
+// The last one is always published when the total is known.
+func (j *Job) publishProgress(event Event) {
+	if j == nil {
+		return
+	}
+	now := time.Now()
+	j.mutex.Lock()
+	last, ok := j.progress[event.Type]
+	if ok && now.Sub(last.time) < progressEventInterval && (event.TotalBytes == 0 || event.BytesRead < event.TotalBytes) {
+		j.mutex.Unlock()
+		return
+	}
+	if ok {
+		if elapsed := now.Sub(last.time).Seconds(); elapsed > 0 {
+			event.BytesPerSec = float64(event.BytesRead-last.bytes) / elapsed
+		}
+	}
+	if j.progress == nil {
+		j.progress = map[EventType]progressSample{}
+	}
+	j.progress[event.Type] = progressSample{time: now, bytes: event.BytesRead}
+	j.mutex.Unlock()
+	event.Time = now.UTC()
+	j.publish(event)
+}
+
+// ReportDownloadProgress publishes the progress of the download of the job carried by the context.
+// It is a downloader.ProgressFunc.
+func ReportDownloadProgress(ctx context.Context, bytesRead, totalBytes int64) {
+	JobFromContext(ctx).publishProgress(Event{
+		Type:       EventDownloadProgress,
+		BytesRead:  bytesRead,
+		TotalBytes: totalBytes,
+	})
+}
+
+// ReportExtractProgress publishes the progress of the extraction of the job carried by the context.
+// It is an unarchiver.ProgressFunc.
+func ReportExtractProgress(ctx context.Context, progress unarchiver.Progress) {
+	JobFromContext(ctx).publishProgress(Event{
+		Type:      EventExtractProgress,
+		BytesRead: progress.Bytes,
+		Entries:   progress.Entries,
+	})
+}
+
+// eventPhotonServer publishes the events when the Photon server is stopped or started.
+type eventPhotonServer struct {
+	PhotonServer
+}
+
+func (s eventPhotonServer) Start(ctx context.Context) error {
+	if err := s.PhotonServer.Start(ctx); err != nil {
+		return err
+	}
+	JobFromContext(ctx).publish(Event{Type: EventPhotonStarted})
+	return nil
+}
+
+func (s eventPhotonServer) Stop(ctx context.Context) error {
+	if err := s.PhotonServer.Stop(ctx); err != nil {
+		return err
+	}
+	JobFromContext(ctx).publish(Event{Type: EventPhotonStopped})
+	return nil
+}
@@ -0,0 +1,41 @@
+package updater_test
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/pddg/photon-container/internal/updater"
+)
+
+func Test_JobManager_Subscribe(t *testing.T) {
+	t.Parallel()
+
+	t.Run("the finished event is delivered to a subscriber which does not keep up", func(t *testing.T) {
+		t.Parallel()
+
+		// Setup
+		jobs, err := updater.NewJobManager(t.Context(), updater.UpdateStrategySequential, filepath.Join(t.TempDir(), "jobs.json"))
+		require.NoError(t, err)
+		events := jobs.Subscribe(t.Context())
+		ctx, job := jobs.Start(t.Context(), updater.JobKindDownload)
+
+		// Exercise
+		for range 100 {
+			// The progress event of the completed download is never throttled.
+			updater.ReportDownloadProgress(ctx, 10, 10)
+		}
+		job.Finish(ctx, nil)
+
+		// Verify
+		var last updater.Event
+		for len(events) > 0 {
+			last = <-events
+		}
+		assert.Equal(t, updater.EventFinished, last.Type)
+		assert.Equal(t, job.ID(), last.JobID)
+		assert.Equal(t, updater.JobStateSucceeded, last.State)
+	})
+}
@@ -0,0 +1,20 @@
+package updater
+
+import "context"
+
+// WithFreeSpace replaces the free space of the data directory for the tests.
+func WithFreeSpace(freeSpace func(path string) (uint64, error)) UpdaterOption {
+	return func(o *updaterOptions) {
+		o.freeSpace = freeSpace
+	}
+}
+
+// PreflightDownload exposes preflightDownload to the tests.
+func (u *Updater) PreflightDownload(ctx context.Context, size int64) error {
+	return u.preflightDownload(ctx, size)
+}
+
+// PreflightUpload exposes preflightUpload to the tests.
+func (u *Updater) PreflightUpload(ctx context.Context, options ...UpdateOption) error {
+	return u.preflightUpload(ctx, initOptions(options...))
+}
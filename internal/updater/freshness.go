@@ -0,0 +1,270 @@
+package updater
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/dustin/go-humanize"
+
+	"github.com/pddg/photon-container/internal/downloader"
+	"github.com/pddg/photon-container/internal/photondata"
+)
+
+// ErrUpToDate is returned when the update is skipped because the archive is not newer than the live database.
+var ErrUpToDate = errors.New("database is up to date")
+
+type FreshnessPolicyKind string
+
+const (
+	// FreshnessThreshold updates when the Last-Modified of the archive is newer than the import date
+	// of the live database by more than the threshold.
+	FreshnessThreshold FreshnessPolicyKind = "threshold"
+	// FreshnessETag updates when the ETag of the archive differs from the one of the installed archive.
+	FreshnessETag FreshnessPolicyKind = "etag"
+	// FreshnessChecksum updates when the expected checksum of the archive differs from the one of the installed archive.
+	FreshnessChecksum FreshnessPolicyKind = "checksum"
+	// FreshnessAlways always updates.
+	FreshnessAlways FreshnessPolicyKind = "always"
+)
+
+// DefaultFreshnessThreshold is the default threshold of FreshnessThreshold.
+// The import date reported by Photon may be a few days before the time the archive was uploaded (Last-Modified).
+// Therefore, simply comparing them will result in an update every time.
+const DefaultFreshnessThreshold = 7 * 24 * time.Hour
+
+// FreshnessPolicy decides whether the archive is new enough to replace the live database.
+type FreshnessPolicy struct {
+	Kind FreshnessPolicyKind
+	// Threshold is used only by FreshnessThreshold.
+	Threshold time.Duration
+}
+
+// DefaultFreshnessPolicy is the policy used unless it is configured.
+var DefaultFreshnessPolicy = FreshnessPolicy{Kind: FreshnessThreshold, Threshold: DefaultFreshnessThreshold}
+
+// ParseFreshnessPolicy parses the policy formatted as one of the followings.
+//
+//   - `threshold` or `threshold:{{duration}}` such as `threshold:12h`. The default threshold is 7 days.
+//   - `etag`
+//   - `checksum`
+//   - `always`
+func ParseFreshnessPolicy(spec string) (FreshnessPolicy, error) {
+	kind, param, hasParam := strings.Cut(spec, ":")
+	switch FreshnessPolicyKind(kind) {
+	case FreshnessThreshold:
+		policy := DefaultFreshnessPolicy
+		if hasParam {
+			threshold, err := time.ParseDuration(param)
+			if err != nil || threshold < 0 {
+				return FreshnessPolicy{}, fmt.Errorf("updater.ParseFreshnessPolicy: invalid threshold %q", param)
+			}
+			policy.Threshold = threshold
+		}
+		return policy, nil
+	case FreshnessETag, FreshnessChecksum, FreshnessAlways:
+		if hasParam {
+			return FreshnessPolicy{}, fmt.Errorf("updater.ParseFreshnessPolicy: %q does not take a parameter", kind)
+		}
+		return FreshnessPolicy{Kind: FreshnessPolicyKind(kind)}, nil
+	default:
+		return FreshnessPolicy{}, fmt.Errorf("updater.ParseFreshnessPolicy: unknown policy %q", spec)
+	}
+}
+
+func (p FreshnessPolicy) String() string {
+	if p.Kind == FreshnessThreshold {
+		return string(p.Kind) + ":" + p.Threshold.String()
+	}
+	return string(p.Kind)
+}
+
+// Decision is the result of the freshness check of the archive.
+// Only the facts which the policy looked at are set.
+type Decision struct {
+	Migratable bool   `json:"migratable"`
+	Policy     string `json:"policy"`
+	Reason     string `json:"reason"`
+	Archive    string `json:"archive"`
+	// ImportDate is the import date of the live database reported by Photon.
+	ImportDate *time.Time `json:"import_date,omitempty"`
+	// LastModified, ETag and Checksum are of the archive.
+	LastModified *time.Time `json:"last_modified,omitempty"`
+	ETag         string     `json:"etag,omitempty"`
+	Checksum     string     `json:"checksum,omitempty"`
+	// Installed is the archive which the live database was downloaded from.
+	Installed *photondata.InstalledArchive `json:"installed,omitempty"`
+	// RolledBack is the archive which the live database has been switched back from by an activation.
+	RolledBack *photondata.InstalledArchive `json:"rolled_back,omitempty"`
+}
+
+// Check decides whether the archive is new enough to replace the database served by Photon, and why.
+// It is the same check as DownloadAndUpdate does unless the update is forced.
+func (u *Updater) Check(ctx context.Context, archive photondata.Archive) (Decision, error) {
+	decision, err := u.checkMigratability(ctx, archive)
+	if err != nil {
+		return Decision{}, fmt.Errorf("updater.Updater.Check: %w", err)
+	}
+	return decision, nil
+}
+
+func (u *Updater) checkMigratability(ctx context.Context, archive photondata.Archive) (Decision, error) {
+	decision := Decision{
+		Policy:  u.freshness.String(),
+		Archive: archive.URL(),
+	}
+	var err error
+	switch u.freshness.Kind {
+	case FreshnessAlways:
+		// The policy always updates, even to the archive which has been rolled back from.
+		decision.Migratable = true
+		decision.Reason = "the policy always updates the database"
+		return decision, nil
+	case FreshnessETag, FreshnessChecksum:
+		decision, err = u.compareInstalled(ctx, archive, decision)
+	default:
+		decision, err = u.compareImportDate(ctx, archive, decision)
+	}
+	if err != nil || !decision.Migratable {
+		return decision, err
+	}
+	return u.compareRolledBack(ctx, archive, decision)
+}
+
+// compareRolledBack refuses the archive if the live database has been switched back from it by an activation.
+// Otherwise the next check would install the archive which the operator has rolled back from.
+func (u *Updater) compareRolledBack(ctx context.Context, archive photondata.Archive, decision Decision) (Decision, error) {
+	rolledBack, err := u.migrator.RolledBackArchive()
+	if err != nil {
+		return Decision{}, err
+	}
+	if rolledBack == nil || rolledBack.URL != archive.URL() {
+		return decision, nil
+	}
+	decision.RolledBack = rolledBack
+	var same bool
+	if rolledBack.Checksum != "" && decision.Checksum != "" {
+		same = rolledBack.Checksum == decision.Checksum
+	} else {
+		if decision.LastModified == nil {
+			info, err := u.downloader.Inspect(ctx, archive)
+			if err != nil {
+				return Decision{}, fmt.Errorf("failed to inspect %q: %w", archive.URL(), err)
+			}
+			decision.LastModified = &info.LastModified
+			decision.ETag = info.ETag
+		}
+		if rolledBack.ETag != "" && decision.ETag != "" {
+			same = rolledBack.ETag == decision.ETag
+		} else {
+			same = rolledBack.LastModified.Equal(*decision.LastModified)
+		}
+	}
+	if same {
+		decision.Migratable = false
+		decision.Reason = "the live database has been rolled back from the archive"
+	}
+	return decision, nil
+}
+
+// compareImportDate compares the Last-Modified of the archive with the import date of the live database.
+func (u *Updater) compareImportDate(ctx context.Context, archive photondata.Archive, decision Decision) (Decision, error) {
+	_, importTime := u.migrator.State(ctx)
+	info, err := u.downloader.Inspect(ctx, archive)
+	if err != nil {
+		return Decision{}, fmt.Errorf("failed to inspect %q: %w", archive.URL(), err)
+	}
+	decision.LastModified = &info.LastModified
+	if importTime.IsZero() {
+		decision.Migratable = true
+		decision.Reason = "the import date of the live database is unknown"
+		return decision, nil
+	}
+	decision.ImportDate = &importTime
+	diff := info.LastModified.Sub(importTime)
+	decision.Migratable = diff > u.freshness.Threshold
+	relative := humanize.RelTime(info.LastModified, importTime, "older", "newer")
+	if decision.Migratable {
+		decision.Reason = fmt.Sprintf("the archive is %s than the import date of the live database, beyond the threshold of %s", relative, u.freshness.Threshold)
+	} else {
+		decision.Reason = fmt.Sprintf("the archive is %s than the import date of the live database, within the threshold of %s", relative, u.freshness.Threshold)
+	}
+	return decision, nil
+}
+
+// compareInstalled compares the ETag or the checksum of the archive with the one of the installed archive.
+func (u *Updater) compareInstalled(ctx context.Context, archive photondata.Archive, decision Decision) (Decision, error) {
+	installed, err := u.migrator.InstalledArchive()
+	if err != nil {
+		return Decision{}, err
+	}
+	decision.Installed = installed
+	name := "ETag"
+	var latest, current string
+	if u.freshness.Kind == FreshnessETag {
+		info, err := u.downloader.Inspect(ctx, archive)
+		if err != nil {
+			return Decision{}, fmt.Errorf("failed to inspect %q: %w", archive.URL(), err)
+		}
+		decision.LastModified = &info.LastModified
+		decision.ETag = info.ETag
+		if info.ETag == "" {
+			return Decision{}, fmt.Errorf("the server does not return the ETag of %q", archive.URL())
+		}
+		latest = info.ETag
+		if installed != nil {
+			current = installed.ETag
+		}
+	} else {
+		name = "checksum"
+		checksum, err := u.downloader.ExpectedChecksum(ctx, archive)
+		if err != nil {
+			return Decision{}, err
+		}
+		if !checksum.Enabled() {
+			return Decision{}, fmt.Errorf("%q is not verified by checksum", archive.URL())
+		}
+		decision.Checksum = checksum.String()
+		latest = decision.Checksum
+		if installed != nil {
+			current = installed.Checksum
+		}
+	}
+	switch {
+	case installed == nil:
+		decision.Migratable = true
+		decision.Reason = "the archive of the live database is unknown"
+	case installed.URL != archive.URL():
+		decision.Migratable = true
+		decision.Reason = fmt.Sprintf("the live database was downloaded from another archive %q", installed.URL)
+	case current == "":
+		decision.Migratable = true
+		decision.Reason = fmt.Sprintf("the %s of the installed archive is unknown", name)
+	case current == latest:
+		decision.Reason = fmt.Sprintf("the %s of the archive is the same as the installed one", name)
+	default:
+		decision.Migratable = true
+		decision.Reason = fmt.Sprintf("the %s of the archive differs from the installed one", name)
+	}
+	return decision, nil
+}
+
+// installingArchive returns the facts of the archive to be recorded once the database has been updated from it.
+// They are taken before the download, so that they are not of a newer archive uploaded during the update.
+func (u *Updater) installingArchive(ctx context.Context, archive photondata.Archive, info downloader.ArchiveInfo) (photondata.InstalledArchive, error) {
+	installing := photondata.InstalledArchive{
+		URL:          archive.URL(),
+		LastModified: info.LastModified,
+		ETag:         info.ETag,
+	}
+	checksum, err := u.downloader.ExpectedChecksum(ctx, archive)
+	if err != nil {
+		return photondata.InstalledArchive{}, err
+	}
+	if checksum.Enabled() {
+		installing.Checksum = checksum.String()
+	}
+	return installing, nil
+}
@@ -0,0 +1,352 @@
+package updater_test
+
+import (
+	"context"
+	"errors"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/pddg/photon-container/internal/downloader"
+	"github.com/pddg/photon-container/internal/photondata"
+	"github.com/pddg/photon-container/internal/updater"
+)
+
+// stubMigrator implements the methods of updater.Migrator used by the tests.
+// The others panic, since the embedded interface is nil.
+type stubMigrator struct {
+	updater.Migrator
+	importDate   time.Time
+	installed    *photondata.InstalledArchive
+	rolledBack   *photondata.InstalledArchive
+	liveDataSize int64
+	// migrate is run as the migration returned by MigrateByRemoveFirst.
+	migrate func() error
+	// activateErr is returned by MigrateToGeneration.
+	activateErr error
+
+	mutex         sync.Mutex
+	aborted       string
+	setRolledBack *photondata.InstalledArchive
+}
+
+func (m *stubMigrator) State(ctx context.Context) (photondata.MigrationState, time.Time) {
+	return photondata.MigrationStateMigrated, m.importDate
+}
+
+func (m *stubMigrator) InstalledArchive() (*photondata.InstalledArchive, error) {
+	return m.installed, nil
+}
+
+func (m *stubMigrator) SetInstalledArchive(archive photondata.InstalledArchive) error {
+	return nil
+}
+
+func (m *stubMigrator) RolledBackArchive() (*photondata.InstalledArchive, error) {
+	return m.rolledBack, nil
+}
+
+func (m *stubMigrator) SetRolledBackArchive(archive photondata.InstalledArchive) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.setRolledBack = &archive
+	return nil
+}
+
+func (m *stubMigrator) MigrateToGeneration(ctx context.Context, id string) error {
+	return m.activateErr
+}
+
+func (m *stubMigrator) WaitForImport(ctx context.Context) error {
+	return nil
+}
+
+func (m *stubMigrator) CommitReplace(ctx context.Context) error {
+	return nil
+}
+
+func (m *stubMigrator) LiveDataSize() (int64, error) {
+	return m.liveDataSize, nil
+}
+
+func (m *stubMigrator) MigrateByRemoveFirst(ctx context.Context, unarchived string) (func() error, error) {
+	if m.migrate == nil {
+		return func() error { return nil }, nil
+	}
+	return m.migrate, nil
+}
+
+func (m *stubMigrator) Abort(ctx context.Context, reason string) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.aborted = reason
+}
+
+func (m *stubMigrator) abortReason() string {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	return m.aborted
+}
+
+// stubDownloader implements the methods of updater.Downloader used by the tests.
+type stubDownloader struct {
+	updater.Downloader
+	info       downloader.ArchiveInfo
+	inspectErr error
+	checksum   downloader.Checksum
+	// download is called instead of the download. An empty archive is written if it is nil.
+	download func(ctx context.Context, dest string) error
+}
+
+func (d *stubDownloader) Inspect(ctx context.Context, archive photondata.Archive) (downloader.ArchiveInfo, error) {
+	return d.info, d.inspectErr
+}
+
+func (d *stubDownloader) ExpectedChecksum(ctx context.Context, archive photondata.Archive) (downloader.Checksum, error) {
+	return d.checksum, nil
+}
+
+func (d *stubDownloader) Download(ctx context.Context, archive photondata.Archive, dest string) error {
+	if d.download != nil {
+		return d.download(ctx, dest)
+	}
+	return os.WriteFile(dest, nil, 0644)
+}
+
+func Test_ParseFreshnessPolicy(t *testing.T) {
+	t.Parallel()
+	testCases := []struct {
+		spec    string
+		want    updater.FreshnessPolicy
+		wantErr bool
+	}{
+		{spec: "threshold", want: updater.DefaultFreshnessPolicy},
+		{spec: "threshold:12h", want: updater.FreshnessPolicy{Kind: updater.FreshnessThreshold, Threshold: 12 * time.Hour}},
+		{spec: "threshold:0s", want: updater.FreshnessPolicy{Kind: updater.FreshnessThreshold}},
+		{spec: "threshold:-1h", wantErr: true},
+		{spec: "threshold:week", wantErr: true},
+		{spec: "etag", want: updater.FreshnessPolicy{Kind: updater.FreshnessETag}},
+		{spec: "etag:strong", wantErr: true},
+		{spec: "checksum", want: updater.FreshnessPolicy{Kind: updater.FreshnessChecksum}},
+		{spec: "always", want: updater.FreshnessPolicy{Kind: updater.FreshnessAlways}},
+		{spec: "never", wantErr: true},
+		{spec: "", wantErr: true},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.spec, func(t *testing.T) {
+			t.Parallel()
+			// Exercise
+			got, err := updater.ParseFreshnessPolicy(tc.spec)
+
+			// Verify
+			if tc.wantErr {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tc.want, got)
+			// The policy is formatted so that it can be parsed again.
+			reparsed, err := updater.ParseFreshnessPolicy(got.String())
+			require.NoError(t, err)
+			assert.Equal(t, got, reparsed)
+		})
+	}
+}
+
+func Test_Updater_Check(t *testing.T) {
+	t.Parallel()
+	archive, err := photondata.NewArchive("https://example.com/photon-db.tar.bz2")
+	require.NoError(t, err)
+	archiveURL := archive.URL()
+	importDate := time.Date(2025, 10, 1, 0, 0, 0, 0, time.UTC)
+	checksum := downloader.Checksum{Algorithm: downloader.AlgorithmMD5, Digest: "0123456789abcdef0123456789abcdef"}
+	otherChecksum := downloader.Checksum{Algorithm: downloader.AlgorithmMD5, Digest: "fedcba9876543210fedcba9876543210"}
+	testCases := []struct {
+		name       string
+		policy     string
+		migrator   *stubMigrator
+		downloader *stubDownloader
+		want       bool
+		wantReason string
+		wantErr    bool
+	}{
+		{
+			name:       "threshold: import date is unknown",
+			policy:     "threshold",
+			migrator:   &stubMigrator{},
+			downloader: &stubDownloader{info: downloader.ArchiveInfo{LastModified: importDate}},
+			want:       true,
+			wantReason: "the import date of the live database is unknown",
+		},
+		{
+			name:       "threshold: archive is newer beyond the threshold",
+			policy:     "threshold:24h",
+			migrator:   &stubMigrator{importDate: importDate},
+			downloader: &stubDownloader{info: downloader.ArchiveInfo{LastModified: importDate.Add(48 * time.Hour)}},
+			want:       true,
+			wantReason: "beyond the threshold of 24h0m0s",
+		},
+		{
+			name:       "threshold: archive is newer within the threshold",
+			policy:     "threshold",
+			migrator:   &stubMigrator{importDate: importDate},
+			downloader: &stubDownloader{info: downloader.ArchiveInfo{LastModified: importDate.Add(48 * time.Hour)}},
+			want:       false,
+			wantReason: "within the threshold of 168h0m0s",
+		},
+		{
+			name:       "threshold: archive is older",
+			policy:     "threshold:0s",
+			migrator:   &stubMigrator{importDate: importDate},
+			downloader: &stubDownloader{info: downloader.ArchiveInfo{LastModified: importDate.Add(-time.Hour)}},
+			want:       false,
+			wantReason: "older than the import date",
+		},
+		{
+			name:       "threshold: failed to inspect",
+			policy:     "threshold",
+			migrator:   &stubMigrator{importDate: importDate},
+			downloader: &stubDownloader{inspectErr: errors.New("unreachable")},
+			wantErr:    true,
+		},
+		{
+			name:       "etag: installed archive is unknown",
+			policy:     "etag",
+			migrator:   &stubMigrator{},
+			downloader: &stubDownloader{info: downloader.ArchiveInfo{ETag: `"a"`}},
+			want:       true,
+			wantReason: "the archive of the live database is unknown",
+		},
+		{
+			name:       "etag: installed from another archive",
+			policy:     "etag",
+			migrator:   &stubMigrator{installed: &photondata.InstalledArchive{URL: "https://example.com/other.tar.bz2", ETag: `"a"`}},
+			downloader: &stubDownloader{info: downloader.ArchiveInfo{ETag: `"a"`}},
+			want:       true,
+			wantReason: "another archive",
+		},
+		{
+			name:       "etag: ETag of installed archive is unknown",
+			policy:     "etag",
+			migrator:   &stubMigrator{installed: &photondata.InstalledArchive{URL: archiveURL}},
+			downloader: &stubDownloader{info: downloader.ArchiveInfo{ETag: `"a"`}},
+			want:       true,
+			wantReason: "the ETag of the installed archive is unknown",
+		},
+		{
+			name:       "etag: same",
+			policy:     "etag",
+			migrator:   &stubMigrator{installed: &photondata.InstalledArchive{URL: archiveURL, ETag: `"a"`}},
+			downloader: &stubDownloader{info: downloader.ArchiveInfo{ETag: `"a"`}},
+			want:       false,
+			wantReason: "the ETag of the archive is the same as the installed one",
+		},
+		{
+			name:       "etag: differs",
+			policy:     "etag",
+			migrator:   &stubMigrator{installed: &photondata.InstalledArchive{URL: archiveURL, ETag: `"a"`}},
+			downloader: &stubDownloader{info: downloader.ArchiveInfo{ETag: `"b"`}},
+			want:       true,
+			wantReason: "the ETag of the archive differs from the installed one",
+		},
+		{
+			name:       "etag: server does not return ETag",
+			policy:     "etag",
+			migrator:   &stubMigrator{installed: &photondata.InstalledArchive{URL: archiveURL, ETag: `"a"`}},
+			downloader: &stubDownloader{},
+			wantErr:    true,
+		},
+		{
+			name:       "checksum: same",
+			policy:     "checksum",
+			migrator:   &stubMigrator{installed: &photondata.InstalledArchive{URL: archiveURL, Checksum: checksum.String()}},
+			downloader: &stubDownloader{checksum: checksum},
+			want:       false,
+			wantReason: "the checksum of the archive is the same as the installed one",
+		},
+		{
+			name:       "checksum: differs",
+			policy:     "checksum",
+			migrator:   &stubMigrator{installed: &photondata.InstalledArchive{URL: archiveURL, Checksum: checksum.String()}},
+			downloader: &stubDownloader{checksum: otherChecksum},
+			want:       true,
+			wantReason: "the checksum of the archive differs from the installed one",
+		},
+		{
+			name:       "checksum: archive is not verified",
+			policy:     "checksum",
+			migrator:   &stubMigrator{installed: &photondata.InstalledArchive{URL: archiveURL, Checksum: checksum.String()}},
+			downloader: &stubDownloader{},
+			wantErr:    true,
+		},
+		{
+			name:       "always",
+			policy:     "always",
+			migrator:   &stubMigrator{installed: &photondata.InstalledArchive{URL: archiveURL, Checksum: checksum.String()}},
+			downloader: &stubDownloader{checksum: checksum},
+			want:       true,
+			wantReason: "the policy always updates the database",
+		},
+		{
+			name:   "rolled back from the same archive",
+			policy: "threshold:0s",
+			migrator: &stubMigrator{
+				importDate: importDate,
+				rolledBack: &photondata.InstalledArchive{URL: archiveURL, LastModified: importDate.Add(time.Hour), ETag: `"a"`},
+			},
+			downloader: &stubDownloader{info: downloader.ArchiveInfo{LastModified: importDate.Add(time.Hour), ETag: `"a"`}},
+			want:       false,
+			wantReason: "the live database has been rolled back from the archive",
+		},
+		{
+			name:   "rolled back from the same archive with always",
+			policy: "always",
+			migrator: &stubMigrator{
+				rolledBack: &photondata.InstalledArchive{URL: archiveURL, LastModified: importDate},
+			},
+			downloader: &stubDownloader{info: downloader.ArchiveInfo{LastModified: importDate}},
+			want:       true,
+			wantReason: "the policy always updates the database",
+		},
+		{
+			name:   "rolled back from an older archive",
+			policy: "etag",
+			migrator: &stubMigrator{
+				rolledBack: &photondata.InstalledArchive{URL: archiveURL, ETag: `"a"`},
+			},
+			downloader: &stubDownloader{info: downloader.ArchiveInfo{ETag: `"b"`}},
+			want:       true,
+			wantReason: "the archive of the live database is unknown",
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+			// Setup
+			policy, err := updater.ParseFreshnessPolicy(tc.policy)
+			require.NoError(t, err)
+			u, err := updater.New(updater.UpdateStrategySequential, tc.downloader, nil, nil, tc.migrator, t.TempDir(),
+				updater.WithFreshnessPolicy(policy),
+			)
+			require.NoError(t, err)
+
+			// Exercise
+			got, err := u.Check(t.Context(), archive)
+
+			// Verify
+			if tc.wantErr {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tc.want, got.Migratable)
+			assert.Contains(t, got.Reason, tc.wantReason)
+			assert.Equal(t, policy.String(), got.Policy)
+			assert.Equal(t, archiveURL, got.Archive)
+		})
+	}
+}
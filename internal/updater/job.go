@@ -0,0 +1,509 @@
+package updater
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pddg/photon-container/internal/logging"
+)
+
+type JobKind string
+
+const (
+	// JobKindDownload is a job which downloads the archive on the server.
+	JobKindDownload JobKind = "download"
+	// JobKindUpload is a job which unarchives the uploaded archive.
+	JobKindUpload JobKind = "upload"
+	// JobKindActivate is a job which switches the database back to a retained generation.
+	JobKindActivate JobKind = "activate"
+)
+
+type JobState string
+
+const (
+	JobStateRunning   JobState = "running"
+	JobStateSucceeded JobState = "succeeded"
+	JobStateFailed    JobState = "failed"
+	JobStateCanceled  JobState = "canceled"
+	// JobStateRolledBack means that the new database did not work and the previous one is served again.
+	JobStateRolledBack JobState = "rolled_back"
+	// JobStateSkipped means that the update was not needed, since the database is up to date.
+	JobStateSkipped JobState = "skipped"
+)
+
+var (
+	// ErrJobCanceled is the cause of the context of a canceled job.
+	ErrJobCanceled = errors.New("job canceled")
+	// ErrJobNotFound is returned when there is no job of the ID.
+	ErrJobNotFound = errors.New("job not found")
+	// ErrJobNotRunning is returned when the job to cancel has already finished.
+	ErrJobNotRunning = errors.New("job is not running")
+	// ErrJobRunning is returned when a job can not be started because another one is running.
+	ErrJobRunning = errors.New("another job is running")
+	// ErrRolledBack is returned when the update has been rolled back to the previous database.
+	ErrRolledBack = errors.New("update rolled back")
+)
+
+// DefaultJobHistorySize is the default number of jobs kept in the history.
+const DefaultJobHistorySize = 20
+
+// JobStatus is a snapshot of a job.
+type JobStatus struct {
+	ID       string         `json:"id"`
+	Kind     JobKind        `json:"kind"`
+	Strategy UpdateStrategy `json:"strategy"`
+	State    JobState       `json:"state"`
+	// Step is the current step of the job starting from 1. It is 0 until the first step begins.
+	Step       int    `json:"step"`
+	TotalSteps int    `json:"total_steps"`
+	StepName   string `json:"step_name"`
+	// BytesProcessed is the number of bytes of the archive read by the unarchiver.
+	BytesProcessed int64      `json:"bytes_processed"`
+	StartedAt      time.Time  `json:"started_at"`
+	FinishedAt     *time.Time `json:"finished_at,omitempty"`
+	Error          string     `json:"error,omitempty"`
+	// Attention describes what the operator has to do when the job could not restore the Photon server.
+	Attention string `json:"attention,omitempty"`
+	// Warnings describe what the job skipped without failing, such as the disk space check.
+	Warnings []string `json:"warnings,omitempty"`
+}
+
+// Job tracks an update of the Photon database.
+// All methods are safe to call on a nil Job, so that updates can run without tracking.
+type Job struct {
+	manager *JobManager
+	// parent is the context which the job was started with. It outlives the job.
+	parent context.Context
+	cancel context.CancelCauseFunc
+
+	mutex  sync.Mutex
+	status JobStatus
+	// progress is the last progress event published for each type.
+	progress map[EventType]progressSample
+}
+
+// Status returns the snapshot of the job.
+func (j *Job) Status() JobStatus {
+	if j == nil {
+		return JobStatus{}
+	}
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+	status := j.status
+	status.Warnings = slices.Clone(j.status.Warnings)
+	return status
+}
+
+// ID returns the ID of the job.
+func (j *Job) ID() string {
+	if j == nil {
+		return ""
+	}
+	return j.Status().ID
+}
+
+// Finish records the result of the job and saves the history.
+// The first call wins, since the error path and the completion path may both report the result.
+func (j *Job) Finish(ctx context.Context, err error) {
+	if j == nil {
+		return
+	}
+	j.mutex.Lock()
+	if j.status.State != JobStateRunning {
+		j.mutex.Unlock()
+		return
+	}
+	now := time.Now().UTC()
+	j.status.FinishedAt = &now
+	switch {
+	case err == nil:
+		j.status.State = JobStateSucceeded
+	case errors.Is(err, ErrRolledBack):
+		j.status.State = JobStateRolledBack
+		j.status.Error = err.Error()
+	case errors.Is(err, ErrUpToDate):
+		// The error tells why the update was not needed.
+		j.status.State = JobStateSkipped
+		j.status.Error = err.Error()
+	case errors.Is(err, ErrJobCanceled) || errors.Is(context.Cause(ctx), ErrJobCanceled):
+		j.status.State = JobStateCanceled
+		j.status.Error = err.Error()
+	default:
+		j.status.State = JobStateFailed
+		j.status.Error = err.Error()
+	}
+	status := j.status
+	j.mutex.Unlock()
+	// Release the resources of the context of the job.
+	j.cancel(nil)
+	j.manager.save(ctx)
+	j.publish(Event{Type: EventFinished, State: status.State, Error: status.Error, Attention: status.Attention})
+}
+
+// Cancel cancels the context of the job.
+// The job is finished by the update itself after it stops and cleans up.
+func (j *Job) Cancel() error {
+	if j == nil {
+		return ErrJobNotRunning
+	}
+	// Hold the lock until the context is canceled, so that the job is not finished in between.
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+	if j.status.State != JobStateRunning {
+		return ErrJobNotRunning
+	}
+	j.cancel(ErrJobCanceled)
+	return nil
+}
+
+// setAttention records what the operator has to do after the job.
+func (j *Job) setAttention(ctx context.Context, attention string) {
+	if j == nil {
+		return
+	}
+	j.mutex.Lock()
+	j.status.Attention = attention
+	j.mutex.Unlock()
+	j.manager.save(ctx)
+}
+
+// addWarning records what the job skipped without failing.
+func (j *Job) addWarning(ctx context.Context, warning string) {
+	if j == nil {
+		return
+	}
+	j.mutex.Lock()
+	j.status.Warnings = append(j.status.Warnings, warning)
+	j.mutex.Unlock()
+	j.manager.save(ctx)
+}
+
+func (j *Job) setStep(ctx context.Context, step, totalSteps int, name string) {
+	if j == nil {
+		return
+	}
+	j.mutex.Lock()
+	j.status.Step = step
+	j.status.TotalSteps = totalSteps
+	j.status.StepName = name
+	j.mutex.Unlock()
+	j.manager.save(ctx)
+	j.publish(Event{Type: EventStep, Step: step, TotalSteps: totalSteps, StepName: name})
+}
+
+func (j *Job) addBytes(n int64) {
+	if j == nil {
+		return
+	}
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+	j.status.BytesProcessed += n
+}
+
+// JobManager creates jobs and keeps the bounded history of them in a JSON file.
+type JobManager struct {
+	strategy    UpdateStrategy
+	historyPath string
+	historySize int
+
+	mutex sync.Mutex
+	// jobs are ordered from the oldest one.
+	jobs []*Job
+
+	events eventBroker
+}
+
+type JobManagerOption func(*JobManager)
+
+// WithJobHistorySize sets the number of finished jobs kept in the history.
+// The default is DefaultJobHistorySize.
+func WithJobHistorySize(size int) JobManagerOption {
+	return func(m *JobManager) {
+		if size > 0 {
+			m.historySize = size
+		}
+	}
+}
+
+// NewJobManager creates a new JobManager and loads the history from historyPath.
+// Jobs which were running when the agent stopped are marked as failed.
+func NewJobManager(ctx context.Context, strategy UpdateStrategy, historyPath string, options ...JobManagerOption) (*JobManager, error) {
+	m := &JobManager{
+		strategy:    strategy,
+		historyPath: historyPath,
+		historySize: DefaultJobHistorySize,
+	}
+	for _, option := range options {
+		option(m)
+	}
+	historyBytes, err := os.ReadFile(historyPath)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return m, nil
+		}
+		return nil, fmt.Errorf("updater.NewJobManager: failed to read job history %q: %w", historyPath, err)
+	}
+	var history []JobStatus
+	if err := json.Unmarshal(historyBytes, &history); err != nil {
+		// The history is informational. A broken one must not prevent the agent from starting.
+		logging.FromContext(ctx).WarnContext(ctx, "ignore broken job history", "path", historyPath, "error", err)
+		return m, nil
+	}
+	interrupted := false
+	for _, status := range history {
+		if status.State == JobStateRunning {
+			status.State = JobStateFailed
+			status.Error = "interrupted by the restart of the agent"
+			interrupted = true
+		}
+		m.jobs = append(m.jobs, &Job{manager: m, parent: ctx, cancel: func(error) {}, status: status})
+	}
+	if interrupted {
+		m.save(ctx)
+	}
+	return m, nil
+}
+
+// Start creates a new running job and returns the context carrying it.
+// The context is canceled when the job is canceled.
+func (m *JobManager) Start(ctx context.Context, kind JobKind) (context.Context, *Job) {
+	ctx, job, _ := m.start(ctx, kind, false)
+	return ctx, job
+}
+
+// StartIfIdle creates a new running job in the same way as Start, unless another job is running.
+// The check and the creation are atomic, so that two callers never start jobs at the same time.
+func (m *JobManager) StartIfIdle(ctx context.Context, kind JobKind) (context.Context, *Job, error) {
+	ctx, job, ok := m.start(ctx, kind, true)
+	if !ok {
+		return nil, nil, fmt.Errorf("updater.JobManager.StartIfIdle: %w", ErrJobRunning)
+	}
+	return ctx, job, nil
+}
+
+func (m *JobManager) start(ctx context.Context, kind JobKind, ifIdle bool) (context.Context, *Job, bool) {
+	parent := ctx
+	ctx, cancel := context.WithCancelCause(ctx)
+	job := &Job{
+		manager: m,
+		parent:  parent,
+		cancel:  cancel,
+		status: JobStatus{
+			ID:        newJobID(),
+			Kind:      kind,
+			Strategy:  m.strategy,
+			State:     JobStateRunning,
+			StartedAt: time.Now().UTC(),
+		},
+	}
+	m.mutex.Lock()
+	if ifIdle && slices.ContainsFunc(m.jobs, func(j *Job) bool { return j.Status().State == JobStateRunning }) {
+		m.mutex.Unlock()
+		cancel(nil)
+		return nil, nil, false
+	}
+	m.jobs = append(m.jobs, job)
+	m.mutex.Unlock()
+	m.save(ctx)
+	logger := logging.FromContext(ctx).With("job_id", job.status.ID)
+	return logging.NewContext(context.WithValue(ctx, jobContextKey{}, job), logger), job, true
+}
+
+// List returns the jobs from the newest one.
+func (m *JobManager) List() []JobStatus {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	statuses := make([]JobStatus, 0, len(m.jobs))
+	for i := len(m.jobs) - 1; i >= 0; i-- {
+		statuses = append(statuses, m.jobs[i].Status())
+	}
+	return statuses
+}
+
+// Get returns the job of the ID.
+func (m *JobManager) Get(id string) (JobStatus, bool) {
+	job, ok := m.find(id)
+	if !ok {
+		return JobStatus{}, false
+	}
+	return job.Status(), true
+}
+
+// Cancel cancels the running job of the ID.
+func (m *JobManager) Cancel(ctx context.Context, id string) error {
+	job, ok := m.find(id)
+	if !ok {
+		return fmt.Errorf("updater.JobManager.Cancel: %w: %q", ErrJobNotFound, id)
+	}
+	if err := job.Cancel(); err != nil {
+		return fmt.Errorf("updater.JobManager.Cancel: %w: %q", err, id)
+	}
+	logging.FromContext(ctx).InfoContext(ctx, "job canceled", "job_id", id)
+	return nil
+}
+
+// CancelRunning cancels all running jobs and returns their IDs.
+func (m *JobManager) CancelRunning(ctx context.Context) []string {
+	m.mutex.Lock()
+	jobs := slices.Clone(m.jobs)
+	m.mutex.Unlock()
+	var canceled []string
+	for _, job := range jobs {
+		if err := job.Cancel(); err == nil {
+			canceled = append(canceled, job.ID())
+			logging.FromContext(ctx).InfoContext(ctx, "job canceled", "job_id", job.ID())
+		}
+	}
+	return canceled
+}
+
+func (m *JobManager) find(id string) (*Job, bool) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	for _, job := range m.jobs {
+		if job.Status().ID == id {
+			return job, true
+		}
+	}
+	return nil, false
+}
+
+// save trims the finished jobs beyond the history size and writes the history.
+// Failing to save is logged, since it must not fail the update itself.
+func (m *JobManager) save(ctx context.Context) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	finished := 0
+	kept := make([]*Job, 0, len(m.jobs))
+	for i := len(m.jobs) - 1; i >= 0; i-- {
+		job := m.jobs[i]
+		if job.Status().State != JobStateRunning {
+			finished++
+			if finished > m.historySize {
+				continue
+			}
+		}
+		kept = append(kept, job)
+	}
+	history := make([]JobStatus, 0, len(kept))
+	m.jobs = m.jobs[:0]
+	for i := len(kept) - 1; i >= 0; i-- {
+		m.jobs = append(m.jobs, kept[i])
+		history = append(history, kept[i].Status())
+	}
+	if err := writeJobHistory(m.historyPath, history); err != nil {
+		logging.FromContext(ctx).WarnContext(ctx, "failed to save job history", "path", m.historyPath, "error", err)
+	}
+}
+
+func writeJobHistory(path string, history []JobStatus) error {
+	historyBytes, err := json.MarshalIndent(history, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal job history: %w", err)
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return fmt.Errorf("failed to create directory: %w", err)
+	}
+	tmpPath := path + ".tmp"
+	if err := os.WriteFile(tmpPath, historyBytes, 0644); err != nil {
+		return fmt.Errorf("failed to write job history: %w", err)
+	}
+	if err := os.Rename(tmpPath, path); err != nil {
+		return fmt.Errorf("failed to rename job history: %w", err)
+	}
+	return nil
+}
+
+func newJobID() string {
+	return time.Now().UTC().Format("20060102T150405Z") + "-" + strings.ToLower(rand.Text()[:6])
+}
+
+type jobContextKey struct{}
+
+// JobFromContext returns the job carried by the context. nil is returned if there is no job.
+func JobFromContext(ctx context.Context) *Job {
+	job, _ := ctx.Value(jobContextKey{}).(*Job)
+	return job
+}
+
+// withoutJobCancel returns the context which is not canceled by the job, but by its parent such as the shutdown of the agent.
+// It is used for the steps which must not be interrupted, and for the Photon server which must outlive the job.
+func withoutJobCancel(ctx context.Context) context.Context {
+	job := JobFromContext(ctx)
+	if job == nil {
+		return ctx
+	}
+	detached, cancel := context.WithCancel(context.WithoutCancel(ctx))
+	context.AfterFunc(job.parent, cancel)
+	return detached
+}
+
+// canceled returns the cause if the job has been canceled.
+func canceled(ctx context.Context) error {
+	if ctx.Err() == nil {
+		return nil
+	}
+	return context.Cause(ctx)
+}
+
+// startStep logs the beginning of the step and records it in the job.
+func startStep(ctx context.Context, logger *slog.Logger, step, totalSteps int, name string) {
+	logger.InfoContext(ctx, fmt.Sprintf("step %d/%d: %s", step, totalSteps, name))
+	JobFromContext(ctx).setStep(ctx, step, totalSteps, name)
+}
+
+// finishJob logs the result of the update and records it in the job.
+func finishJob(ctx context.Context, logger *slog.Logger, err error) {
+	if err == nil {
+		logger.InfoContext(ctx, "update complete")
+	}
+	JobFromContext(ctx).Finish(ctx, err)
+}
+
+// needsAttention logs what the operator has to do and records it in the job.
+func needsAttention(ctx context.Context, logger *slog.Logger, attention string) {
+	logger.ErrorContext(ctx, "the update needs attention", "attention", attention)
+	JobFromContext(ctx).setAttention(ctx, attention)
+}
+
+// warnJob logs what the update skipped without failing and records it in the job.
+func warnJob(ctx context.Context, logger *slog.Logger, warning string, err error) {
+	if err != nil {
+		logger.WarnContext(ctx, warning, "error", err)
+		warning += ": " + err.Error()
+	} else {
+		logger.WarnContext(ctx, warning)
+	}
+	JobFromContext(ctx).addWarning(ctx, warning)
+}
+
+// countBytes counts the bytes read from the archive as the progress of the job.
+func countBytes(ctx context.Context, r io.Reader) io.Reader {
+	job := JobFromContext(ctx)
+	if job == nil {
+		return r
+	}
+	return &jobReader{r: r, job: job}
+}
+
+type jobReader struct {
+	r   io.Reader
+	job *Job
+}
+
+func (j *jobReader) Read(p []byte) (int, error) {
+	n, err := j.r.Read(p)
+	j.job.addBytes(int64(n))
+	return n, err
+}
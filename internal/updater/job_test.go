@@ -0,0 +1,206 @@
+package updater_test
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/pddg/photon-container/internal/updater"
+)
+
+func newJobManager(t *testing.T, historyPath string, options ...updater.JobManagerOption) *updater.JobManager {
+	t.Helper()
+	jobs, err := updater.NewJobManager(t.Context(), updater.UpdateStrategySequential, historyPath, options...)
+	require.NoError(t, err)
+	return jobs
+}
+
+func Test_Job_Finish(t *testing.T) {
+	t.Parallel()
+	testCases := []struct {
+		name      string
+		err       error
+		wantState updater.JobState
+		wantError string
+	}{
+		{
+			name:      "succeeded",
+			wantState: updater.JobStateSucceeded,
+		},
+		{
+			name:      "failed",
+			err:       errors.New("failed to download"),
+			wantState: updater.JobStateFailed,
+			wantError: "failed to download",
+		},
+		{
+			name:      "rolled back",
+			err:       fmt.Errorf("photon is not ready: %w", updater.ErrRolledBack),
+			wantState: updater.JobStateRolledBack,
+			wantError: "photon is not ready: update rolled back",
+		},
+		{
+			name:      "skipped as up to date",
+			err:       fmt.Errorf("%w: the archive is the same", updater.ErrUpToDate),
+			wantState: updater.JobStateSkipped,
+			wantError: "database is up to date: the archive is the same",
+		},
+		{
+			name:      "canceled",
+			err:       updater.ErrJobCanceled,
+			wantState: updater.JobStateCanceled,
+			wantError: "job canceled",
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+			// Setup
+			jobs := newJobManager(t, filepath.Join(t.TempDir(), "jobs.json"))
+			ctx, job := jobs.Start(t.Context(), updater.JobKindDownload)
+
+			// Exercise
+			job.Finish(ctx, tc.err)
+			// The first result wins.
+			job.Finish(ctx, errors.New("reported twice"))
+
+			// Verify
+			got := job.Status()
+			assert.Equal(t, tc.wantState, got.State)
+			assert.Equal(t, tc.wantError, got.Error)
+			assert.NotNil(t, got.FinishedAt)
+		})
+	}
+}
+
+func Test_Job_Nil(t *testing.T) {
+	t.Parallel()
+	// Setup
+	var job *updater.Job
+
+	// Exercise & Verify
+	assert.Equal(t, updater.JobStatus{}, job.Status())
+	assert.Empty(t, job.ID())
+	assert.ErrorIs(t, job.Cancel(), updater.ErrJobNotRunning)
+	assert.NotPanics(t, func() { job.Finish(t.Context(), nil) })
+}
+
+func Test_NewJobManager(t *testing.T) {
+	t.Parallel()
+	t.Run("history is persisted", func(t *testing.T) {
+		t.Parallel()
+		// Setup
+		historyPath := filepath.Join(t.TempDir(), "jobs.json")
+		jobs := newJobManager(t, historyPath)
+		ctx, job := jobs.Start(t.Context(), updater.JobKindUpload)
+		job.Finish(ctx, errors.New("broken archive"))
+
+		// Exercise
+		recovered := newJobManager(t, historyPath)
+
+		// Verify
+		got, ok := recovered.Get(job.ID())
+		require.True(t, ok)
+		assert.Equal(t, job.Status(), got)
+	})
+	t.Run("running jobs are failed by the restart", func(t *testing.T) {
+		t.Parallel()
+		// Setup
+		historyPath := filepath.Join(t.TempDir(), "jobs.json")
+		jobs := newJobManager(t, historyPath)
+		_, job := jobs.Start(t.Context(), updater.JobKindDownload)
+
+		// Exercise
+		recovered := newJobManager(t, historyPath)
+
+		// Verify
+		got, ok := recovered.Get(job.ID())
+		require.True(t, ok)
+		assert.Equal(t, updater.JobStateFailed, got.State)
+		assert.Equal(t, "interrupted by the restart of the agent", got.Error)
+		// The recovered history is saved.
+		got, ok = newJobManager(t, historyPath).Get(job.ID())
+		require.True(t, ok)
+		assert.Equal(t, updater.JobStateFailed, got.State)
+	})
+	t.Run("broken history is ignored", func(t *testing.T) {
+		t.Parallel()
+		// Setup
+		historyPath := filepath.Join(t.TempDir(), "jobs.json")
+		require.NoError(t, os.WriteFile(historyPath, []byte("{broken"), 0644))
+
+		// Exercise
+		jobs := newJobManager(t, historyPath)
+
+		// Verify
+		assert.Empty(t, jobs.List())
+	})
+}
+
+func Test_JobManager_History(t *testing.T) {
+	t.Parallel()
+	// Setup
+	historyPath := filepath.Join(t.TempDir(), "jobs.json")
+	jobs := newJobManager(t, historyPath, updater.WithJobHistorySize(2))
+	_, running := jobs.Start(t.Context(), updater.JobKindDownload)
+	var finished []string
+	for range 3 {
+		ctx, job := jobs.Start(t.Context(), updater.JobKindUpload)
+		job.Finish(ctx, nil)
+		finished = append(finished, job.ID())
+	}
+
+	// Exercise
+	got := jobs.List()
+
+	// Verify
+	// The oldest finished job is trimmed, and the running one is kept regardless of its age.
+	ids := make([]string, 0, len(got))
+	for _, status := range got {
+		ids = append(ids, status.ID)
+	}
+	assert.Equal(t, []string{finished[2], finished[1], running.ID()}, ids)
+	_, ok := jobs.Get(finished[0])
+	assert.False(t, ok)
+	assert.Len(t, newJobManager(t, historyPath).List(), 3)
+}
+
+func Test_JobManager_Start_ID(t *testing.T) {
+	t.Parallel()
+	// Setup
+	jobs := newJobManager(t, filepath.Join(t.TempDir(), "jobs.json"))
+	seen := map[string]struct{}{}
+
+	for range 100 {
+		// Exercise
+		ctx, job := jobs.Start(t.Context(), updater.JobKindDownload)
+		job.Finish(ctx, nil)
+
+		// Verify
+		assert.Regexp(t, `^\d{8}T\d{6}Z-[a-z2-7]{6}$`, job.ID())
+		assert.NotContains(t, seen, job.ID())
+		seen[job.ID()] = struct{}{}
+	}
+}
+
+func Test_JobManager_StartIfIdle(t *testing.T) {
+	t.Parallel()
+	// Setup
+	jobs := newJobManager(t, filepath.Join(t.TempDir(), "jobs.json"))
+	ctx, job, err := jobs.StartIfIdle(t.Context(), updater.JobKindDownload)
+	require.NoError(t, err)
+
+	// Exercise
+	_, _, err = jobs.StartIfIdle(t.Context(), updater.JobKindUpload)
+
+	// Verify
+	require.ErrorIs(t, err, updater.ErrJobRunning)
+	job.Finish(ctx, nil)
+	_, _, err = jobs.StartIfIdle(t.Context(), updater.JobKindUpload)
+	require.NoError(t, err)
+}
@@ -1,6 +1,7 @@
 package updater
 
 import (
+	"github.com/pddg/photon-container/internal/fsutil"
 	"github.com/pddg/photon-container/internal/photondata"
 	"github.com/pddg/photon-container/internal/unarchiver"
 )
@@ -41,10 +42,87 @@ func WithArchiveName(name string) UpdateOption {
 	}
 }
 
+// WithUncompressedSize declares the size of the uncompressed tar stream uploaded.
+// The upload is refused if it would not fit in the free space of the data directory.
+func WithUncompressedSize(bytes int64) UpdateOption {
+	return func(o *updateOptions) {
+		o.uncompressedSize = bytes
+	}
+}
+
+// WithUploadSize declares the size of the compressed archive uploaded.
+// The size of the extracted database is estimated from it unless WithUncompressedSize is given.
+func WithUploadSize(bytes int64) UpdateOption {
+	return func(o *updateOptions) {
+		o.uploadSize = bytes
+	}
+}
+
+// UpdaterOption configures the updaters regardless of each update.
+type UpdaterOption func(*updaterOptions)
+
+// WithValidator validates the unarchived database before it is promoted by the parallel and streaming strategies.
+// The update fails and the live database is left untouched if the validation fails.
+// The sequential strategy ignores it, since the live database has been removed before the unarchiving.
+func WithValidator(validator Validator) UpdaterOption {
+	return func(o *updaterOptions) {
+		o.validator = validator
+	}
+}
+
+// WithBlueGreenMemory sets the memory in bytes which the second Photon server of the bluegreen strategy needs.
+// The update fails before the second one is started if the node does not have it available.
+// The default is 0, which assumes the memory used by the live Photon server.
+func WithBlueGreenMemory(bytes uint64) UpdaterOption {
+	return func(o *updaterOptions) {
+		o.blueGreenMemory = bytes
+	}
+}
+
+// WithFreshnessPolicy sets the policy to decide whether the archive is new enough to replace the live database.
+// The default is DefaultFreshnessPolicy.
+func WithFreshnessPolicy(policy FreshnessPolicy) UpdaterOption {
+	return func(o *updaterOptions) {
+		o.freshness = policy
+	}
+}
+
+// WithExtractionRatio sets the ratio of the size of the extracted database to the size of the compressed archive.
+// It is used to estimate whether the update fits in the free space of the data directory.
+// The default is DefaultExtractionRatio.
+func WithExtractionRatio(ratio float64) UpdaterOption {
+	return func(o *updaterOptions) {
+		o.extractionRatio = ratio
+	}
+}
+
+type updaterOptions struct {
+	validator       Validator
+	blueGreenMemory uint64
+	freshness       FreshnessPolicy
+	extractionRatio float64
+	// freeSpace returns the free space of the file system of the path. It is replaced by the tests.
+	freeSpace func(path string) (uint64, error)
+}
+
+func initUpdaterOptions(opts ...UpdaterOption) *updaterOptions {
+	o := &updaterOptions{
+		freshness:       DefaultFreshnessPolicy,
+		extractionRatio: DefaultExtractionRatio,
+		freeSpace:       fsutil.FreeSpace,
+	}
+	for _, opt := range opts {
+		opt(o)
+	}
+	return o
+}
+
 type updateOptions struct {
-	force         bool
-	archiveName   string
-	unarchiveOpts *unarchiveOptions
+	force            bool
+	archiveName      string
+	unarchiveOpts    *unarchiveOptions
+	uncompressedSize int64
+	uploadSize       int64
 }
 
 func initOptions(opts ...UpdateOption) *updateOptions {
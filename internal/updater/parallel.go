@@ -4,11 +4,14 @@ import (
 	"context"
 	"fmt"
 	"io"
+	"log/slog"
 	"os"
 	"path/filepath"
 
+	"github.com/pddg/photon-container/internal/downloader"
 	"github.com/pddg/photon-container/internal/logging"
 	"github.com/pddg/photon-container/internal/photondata"
+	"github.com/pddg/photon-container/internal/unarchiver"
 )
 
 type ParallelUpdater struct {
@@ -16,8 +19,16 @@ type ParallelUpdater struct {
 	unarchiver   Unarchiver
 	photonServer PhotonServer
 	migrator     ReplaceMigrator
+	// validator checks the unarchived database before it is promoted. It is optional.
+	validator Validator
 
 	photonDataDir string
+
+	// strategy is the strategy reported in the logs.
+	strategy UpdateStrategy
+	// promoteStep is the name of the last step, which promotes the unarchived database by promote.
+	promoteStep string
+	promote     func(ctx context.Context, unarchived string) error
 }
 
 // NewParallelUpdater creates a new ParallelUpdater.
@@ -27,33 +38,42 @@ func NewParallelUpdater(
 	photonServer PhotonServer,
 	migrator ReplaceMigrator,
 	photonDataDir string,
+	options ...UpdaterOption,
 ) *ParallelUpdater {
-	return &ParallelUpdater{
+	opts := initUpdaterOptions(options...)
+	u := &ParallelUpdater{
 		downloader:    downloader,
 		unarchiver:    unarchiver,
-		photonServer:  photonServer,
+		photonServer:  eventPhotonServer{photonServer},
 		migrator:      migrator,
+		validator:     opts.validator,
 		photonDataDir: photonDataDir,
+		strategy:      UpdateStrategyParallel,
+		promoteStep:   "replace archive and restart Photon server",
 	}
+	u.promote = u.restartPhotonServer
+	return u
 }
 
 func (u *ParallelUpdater) DownloadAndUpdate(ctx context.Context, archive photondata.Archive, options ...UpdateOption) error {
-	logger := logging.FromContext(ctx).With("strategy", UpdateStrategyParallel)
+	logger := logging.FromContext(ctx).With("strategy", u.strategy)
 	opts := initOptions(options...)
 	archive = opts.getArchive(archive)
 
-	logger.InfoContext(ctx, "step 1/1: download Photon database")
+	totalSteps := u.totalSteps(3)
+	startStep(ctx, logger, 1, totalSteps, "download Photon database")
 	archivePath := filepath.Join(u.photonDataDir, "photon-db.tar.bz2")
 	if err := u.downloader.Download(ctx, archive, archivePath); err != nil {
+		removePartialDownload(ctx, logger, archivePath)
 		return fmt.Errorf("updater.ParallelUpdater.UpdateByLocalArchive: failed to download %q to %q: %w", archive, archivePath, err)
 	}
 	defer func() {
-		if err := os.RemoveAll(archivePath); err != nil {
+		if err := downloader.Remove(archivePath); err != nil {
 			logger.WarnContext(ctx, "failed to remove archive", "path", archivePath, "error", err)
 		}
 	}()
 
-	logger.InfoContext(ctx, "step 2/3: unarchive Photon database")
+	startStep(ctx, logger, 2, totalSteps, "unarchive Photon database")
 	archiveFile, err := os.Open(archivePath)
 	if err != nil {
 		return fmt.Errorf("updater.ParallelUpdater.UpdateByLocalArchive: failed to open %q: %w", archivePath, err)
@@ -67,20 +87,28 @@ func (u *ParallelUpdater) DownloadAndUpdate(ctx context.Context, archive photond
 			logger.WarnContext(ctx, "failed to remove temp directory", "path", tempDir, "error", err)
 		}
 	}()
-	if err := u.unarchiver.Unarchive(ctx, archiveFile, tempDir); err != nil {
+	if err := u.unarchiver.Unarchive(ctx, countBytes(ctx, archiveFile), tempDir); err != nil {
 		return fmt.Errorf("updater.ParallelUpdater.UpdateByLocalArchive: failed to unarchive to %q: %w", tempDir, err)
 	}
+	step, err := u.validate(ctx, logger, 3, totalSteps, tempDir)
+	if err != nil {
+		return fmt.Errorf("updater.ParallelUpdater.UpdateByLocalArchive: %w", err)
+	}
 
-	logger.InfoContext(ctx, "step 3/3: replace archive and restart Photon server")
-	if err := u.restartPhotonServer(ctx, tempDir); err != nil {
-		return fmt.Errorf("updater.ParallelUpdater.UpdateByLocalArchive: failed to restart Photon server: %w", err)
+	if err := canceled(ctx); err != nil {
+		return fmt.Errorf("updater.ParallelUpdater.UpdateByLocalArchive: %w", err)
+	}
+	startStep(ctx, logger, step, totalSteps, u.promoteStep)
+	// The replacement is not canceled part-way. The old database is kept until it begins.
+	if err := u.promote(withoutJobCancel(ctx), tempDir); err != nil {
+		return fmt.Errorf("updater.ParallelUpdater.UpdateByLocalArchive: failed to promote database: %w", err)
 	}
 	logger.InfoContext(ctx, "update complete")
 	return nil
 }
 
 func (u *ParallelUpdater) UpdateAsync(ctx context.Context, archive io.Reader, options ...UpdateOption) error {
-	logger := logging.FromContext(ctx).With("strategy", UpdateStrategyParallel)
+	logger := logging.FromContext(ctx).With("strategy", u.strategy)
 	opts := initOptions(options...)
 	tempDir := filepath.Join(u.photonDataDir, "temp")
 	cleanup := func() {
@@ -89,35 +117,69 @@ func (u *ParallelUpdater) UpdateAsync(ctx context.Context, archive io.Reader, op
 		}
 	}
 
-	logger.InfoContext(ctx, "step 1/2: unarchive Photon database")
-	if err := u.unarchiver.Unarchive(ctx, archive, tempDir, opts.getUnarchiveOptions()...); err != nil {
-		// Clean up the temp directory before returning the error.
+	totalSteps := u.totalSteps(2)
+	startStep(ctx, logger, 1, totalSteps, "unarchive Photon database")
+	if err := u.unarchiver.Unarchive(ctx, countBytes(ctx, archive), tempDir, opts.getUnarchiveOptions()...); err != nil {
+		// Clean up the temp directory before returning the error unless the upload can be resumed.
 		// Unarchiving may leave some garbage files in the temp directory.
-		cleanup()
+		if !resumable(err) {
+			cleanup()
+		}
 		return fmt.Errorf("updater.ParallelUpdater.UpdateAsync: failed to unarchive to %q: %w", tempDir, err)
 	}
 	go func() {
 		// Clean up the temp directory after the update.
 		defer cleanup()
-		logger.InfoContext(ctx, "step 2/2: replace archive and restart Photon server")
-		if err := u.restartPhotonServer(ctx, tempDir); err != nil {
-			logger.ErrorContext(ctx, "failed to restart Photon server", "error", err)
+		step, err := u.validate(ctx, logger, 2, totalSteps, tempDir)
+		if err != nil {
+			finishJob(ctx, logger, fmt.Errorf("updater.ParallelUpdater.UpdateAsync: %w", err))
+			return
+		}
+		if err := canceled(ctx); err != nil {
+			finishJob(ctx, logger, fmt.Errorf("updater.ParallelUpdater.UpdateAsync: %w", err))
+			return
+		}
+		startStep(ctx, logger, step, totalSteps, u.promoteStep)
+		// The replacement is not canceled part-way. The old database is kept until it begins.
+		if err := u.promote(withoutJobCancel(ctx), tempDir); err != nil {
+			logger.ErrorContext(ctx, "failed to promote database", "error", err)
+			finishJob(ctx, logger, fmt.Errorf("updater.ParallelUpdater.UpdateAsync: failed to promote database: %w", err))
 			return
 		}
-		logger.InfoContext(ctx, "update complete")
+		finishJob(ctx, logger, nil)
 	}()
 	return nil
 }
 
-func (u *ParallelUpdater) restartPhotonServer(ctx context.Context, unarchived string) error {
-	if err := u.photonServer.Stop(ctx); err != nil {
-		return fmt.Errorf("failed to stop Photon server: %w", err)
+func (u *ParallelUpdater) UploadCheckpoint(ctx context.Context) (*unarchiver.Checkpoint, error) {
+	return readUploadCheckpoint(u.photonDataDir)
+}
+
+// totalSteps returns the number of the steps of the update, including the validation if it is configured.
+func (u *ParallelUpdater) totalSteps(steps int) int {
+	if u.validator != nil {
+		return steps + 1
 	}
-	if err := u.migrator.MigrateByReplace(ctx, unarchived); err != nil {
-		return fmt.Errorf("failed to replace existing database: %w", err)
+	return steps
+}
+
+// validate runs the validator on the unarchived database as the step, if it is configured.
+// The live database is left untouched if it fails. The number of the next step is returned.
+func (u *ParallelUpdater) validate(ctx context.Context, logger *slog.Logger, step, totalSteps int, unarchived string) (int, error) {
+	if u.validator == nil {
+		return step, nil
 	}
-	if err := u.photonServer.Start(ctx); err != nil {
-		return fmt.Errorf("failed to start Photon server: %w", err)
+	startStep(ctx, logger, step, totalSteps, "validate Photon database")
+	if err := u.validator.Validate(ctx, unarchived); err != nil {
+		return step, fmt.Errorf("failed to validate %q: %w", unarchived, err)
 	}
-	return nil
+	logger.InfoContext(ctx, "validation passed")
+	return step + 1, nil
+}
+
+// restartPhotonServer replaces the database with the unarchived one and restarts the Photon server.
+func (u *ParallelUpdater) restartPhotonServer(ctx context.Context, unarchived string) error {
+	return replaceDatabase(ctx, u.photonServer, u.migrator, func(ctx context.Context) error {
+		return u.migrator.MigrateByReplace(ctx, unarchived)
+	})
 }
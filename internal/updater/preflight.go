@@ -0,0 +1,138 @@
+package updater
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/dustin/go-humanize"
+
+	"github.com/pddg/photon-container/internal/fsutil"
+	"github.com/pddg/photon-container/internal/logging"
+)
+
+// DefaultExtractionRatio is the estimated ratio of the size of the extracted database to the size of the compressed archive.
+const DefaultExtractionRatio = 3.0
+
+// InsufficientSpaceError is returned when the update would not fit in the free space of the data directory.
+// It is returned before anything is deleted.
+type InsufficientSpaceError struct {
+	Path string
+	// ArchiveBytes is the size of the archive stored in the data directory. It is 0 if the archive is not stored.
+	ArchiveBytes uint64
+	// ExtractedBytes is the size of the extracted database.
+	ExtractedBytes uint64
+	// Estimated is true if ExtractedBytes is estimated from the size of the compressed archive.
+	Estimated bool
+	FreeBytes uint64
+	// ReclaimableBytes is the size of the live database removed before the new one is extracted.
+	ReclaimableBytes uint64
+}
+
+// RequiredBytes returns the space which the update needs.
+func (e *InsufficientSpaceError) RequiredBytes() uint64 {
+	return e.ArchiveBytes + e.ExtractedBytes
+}
+
+// AvailableBytes returns the space which the update can use.
+func (e *InsufficientSpaceError) AvailableBytes() uint64 {
+	return e.FreeBytes + e.ReclaimableBytes
+}
+
+func (e *InsufficientSpaceError) Error() string {
+	extracted := "extracted " + humanize.IBytes(e.ExtractedBytes)
+	if e.Estimated {
+		extracted = "estimated extracted " + humanize.IBytes(e.ExtractedBytes)
+	}
+	return fmt.Sprintf("insufficient space in %q: %s required (archive %s + %s), %s available (free %s + live database %s)",
+		e.Path,
+		humanize.IBytes(e.RequiredBytes()),
+		humanize.IBytes(e.ArchiveBytes),
+		extracted,
+		humanize.IBytes(e.AvailableBytes()),
+		humanize.IBytes(e.FreeBytes),
+		humanize.IBytes(e.ReclaimableBytes),
+	)
+}
+
+// spaceNeed is the space which an update needs in the data directory.
+type spaceNeed struct {
+	archiveBytes   uint64
+	extractedBytes uint64
+	estimated      bool
+}
+
+// preflightDownload checks the space for the download of the archive of the size, which is its Content-Length.
+// The size of the extracted database is estimated by the extraction ratio.
+func (u *Updater) preflightDownload(ctx context.Context, size int64) error {
+	if size <= 0 {
+		warnJob(ctx, logging.FromContext(ctx), "the size of the archive is unknown. disk space check skipped", nil)
+		return nil
+	}
+	need := spaceNeed{
+		extractedBytes: uint64(float64(size) * u.extractionRatio),
+		estimated:      true,
+	}
+	// The streaming strategy does not store the archive.
+	if u.strategy != UpdateStrategyStreaming {
+		need.archiveBytes = uint64(size)
+	}
+	return u.preflight(ctx, need)
+}
+
+// preflightUpload checks the space for the upload from the size declared by the client.
+// The uncompressed size is preferred to the size of the compressed archive, which needs the estimation.
+func (u *Updater) preflightUpload(ctx context.Context, opts *updateOptions) error {
+	switch {
+	case opts.uncompressedSize > 0:
+		return u.preflight(ctx, spaceNeed{extractedBytes: uint64(opts.uncompressedSize)})
+	case opts.uploadSize > 0:
+		return u.preflight(ctx, spaceNeed{
+			extractedBytes: uint64(float64(opts.uploadSize) * u.extractionRatio),
+			estimated:      true,
+		})
+	default:
+		warnJob(ctx, logging.FromContext(ctx), "the size of the upload is unknown. disk space check skipped", nil)
+		return nil
+	}
+}
+
+// preflight refuses the update if it would not fit in the free space of the data directory.
+// It must be called before anything is deleted.
+func (u *Updater) preflight(ctx context.Context, need spaceNeed) error {
+	logger := logging.FromContext(ctx)
+	free, err := u.freeSpace(u.photonDataDir)
+	if err != nil {
+		if errors.Is(err, fsutil.ErrUnsupported) {
+			warnJob(ctx, logger, "disk space check skipped", err)
+			return nil
+		}
+		return fmt.Errorf("failed to check disk space: %w", err)
+	}
+	var reclaimable uint64
+	if u.strategy == UpdateStrategySequential {
+		// The sequential strategy removes the live database before the download.
+		size, err := u.migrator.LiveDataSize()
+		if err != nil {
+			return fmt.Errorf("failed to check disk space: %w", err)
+		}
+		reclaimable = uint64(size)
+	}
+	spaceErr := &InsufficientSpaceError{
+		Path:             u.photonDataDir,
+		ArchiveBytes:     need.archiveBytes,
+		ExtractedBytes:   need.extractedBytes,
+		Estimated:        need.estimated,
+		FreeBytes:        free,
+		ReclaimableBytes: reclaimable,
+	}
+	if spaceErr.RequiredBytes() > spaceErr.AvailableBytes() {
+		return spaceErr
+	}
+	logger.InfoContext(ctx, "disk space check passed",
+		"required", humanize.IBytes(spaceErr.RequiredBytes()),
+		"available", humanize.IBytes(spaceErr.AvailableBytes()),
+		"estimated", need.estimated,
+	)
+	return nil
+}
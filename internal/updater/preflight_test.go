@@ -0,0 +1,245 @@
+package updater_test
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/pddg/photon-container/internal/fsutil"
+	"github.com/pddg/photon-container/internal/updater"
+)
+
+func freeSpace(bytes uint64, err error) func(path string) (uint64, error) {
+	return func(path string) (uint64, error) {
+		return bytes, err
+	}
+}
+
+func Test_Updater_PreflightDownload(t *testing.T) {
+	t.Parallel()
+	const liveDataSize = 100
+	testCases := []struct {
+		name      string
+		strategy  updater.UpdateStrategy
+		size      int64
+		options   []updater.UpdaterOption
+		freeSpace func(path string) (uint64, error)
+		// want is the error expected. nil means that the update fits.
+		want        *updater.InsufficientSpaceError
+		wantErr     bool
+		wantWarning string
+	}{
+		{
+			name:      "sequential can use the space of the live database",
+			strategy:  updater.UpdateStrategySequential,
+			size:      100,
+			freeSpace: freeSpace(300, nil),
+		},
+		{
+			name:      "sequential does not fit even with the live database",
+			strategy:  updater.UpdateStrategySequential,
+			size:      100,
+			freeSpace: freeSpace(250, nil),
+			want: &updater.InsufficientSpaceError{
+				ArchiveBytes:     100,
+				ExtractedBytes:   300,
+				Estimated:        true,
+				FreeBytes:        250,
+				ReclaimableBytes: liveDataSize,
+			},
+		},
+		{
+			name:      "parallel keeps the live database",
+			strategy:  updater.UpdateStrategyParallel,
+			size:      100,
+			freeSpace: freeSpace(350, nil),
+			want: &updater.InsufficientSpaceError{
+				ArchiveBytes:   100,
+				ExtractedBytes: 300,
+				Estimated:      true,
+				FreeBytes:      350,
+			},
+		},
+		{
+			name:      "streaming does not store the archive",
+			strategy:  updater.UpdateStrategyStreaming,
+			size:      100,
+			freeSpace: freeSpace(300, nil),
+		},
+		{
+			name:      "streaming needs the space for the extracted database",
+			strategy:  updater.UpdateStrategyStreaming,
+			size:      100,
+			freeSpace: freeSpace(299, nil),
+			want: &updater.InsufficientSpaceError{
+				ExtractedBytes: 300,
+				Estimated:      true,
+				FreeBytes:      299,
+			},
+		},
+		{
+			name:      "extraction ratio",
+			strategy:  updater.UpdateStrategyStreaming,
+			size:      100,
+			options:   []updater.UpdaterOption{updater.WithExtractionRatio(5)},
+			freeSpace: freeSpace(400, nil),
+			want: &updater.InsufficientSpaceError{
+				ExtractedBytes: 500,
+				Estimated:      true,
+				FreeBytes:      400,
+			},
+		},
+		{
+			name:        "size is unknown",
+			strategy:    updater.UpdateStrategySequential,
+			size:        -1,
+			freeSpace:   freeSpace(0, nil),
+			wantWarning: "the size of the archive is unknown. disk space check skipped",
+		},
+		{
+			name:        "free space is not supported",
+			strategy:    updater.UpdateStrategySequential,
+			size:        100,
+			freeSpace:   freeSpace(0, fmt.Errorf("fsutil.FreeSpace: %w", fsutil.ErrUnsupported)),
+			wantWarning: "disk space check skipped: fsutil.FreeSpace: not supported on this platform",
+		},
+		{
+			name:      "failed to get free space",
+			strategy:  updater.UpdateStrategySequential,
+			size:      100,
+			freeSpace: freeSpace(0, errors.New("permission denied")),
+			wantErr:   true,
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+			// Setup
+			dataDir := t.TempDir()
+			options := append([]updater.UpdaterOption{updater.WithFreeSpace(tc.freeSpace)}, tc.options...)
+			u, err := updater.New(tc.strategy, &stubDownloader{}, nil, nil, &stubMigrator{liveDataSize: liveDataSize}, dataDir, options...)
+			require.NoError(t, err)
+			jobs := newJobManager(t, filepath.Join(t.TempDir(), "jobs.json"))
+			ctx, job := jobs.Start(t.Context(), updater.JobKindDownload)
+
+			// Exercise
+			err = u.PreflightDownload(ctx, tc.size)
+
+			// Verify
+			switch {
+			case tc.want != nil:
+				var spaceErr *updater.InsufficientSpaceError
+				require.ErrorAs(t, err, &spaceErr)
+				tc.want.Path = dataDir
+				assert.Equal(t, tc.want, spaceErr)
+			case tc.wantErr:
+				require.Error(t, err)
+			default:
+				require.NoError(t, err)
+			}
+			if tc.wantWarning != "" {
+				assert.Equal(t, []string{tc.wantWarning}, job.Status().Warnings)
+			} else {
+				assert.Empty(t, job.Status().Warnings)
+			}
+		})
+	}
+}
+
+func Test_Updater_PreflightUpload(t *testing.T) {
+	t.Parallel()
+	testCases := []struct {
+		name        string
+		options     []updater.UpdateOption
+		freeSpace   uint64
+		want        *updater.InsufficientSpaceError
+		wantWarning string
+	}{
+		{
+			name:      "uncompressed size fits",
+			options:   []updater.UpdateOption{updater.WithUncompressedSize(300)},
+			freeSpace: 300,
+		},
+		{
+			name:      "uncompressed size is preferred to the upload size",
+			options:   []updater.UpdateOption{updater.WithUncompressedSize(300), updater.WithUploadSize(1000)},
+			freeSpace: 299,
+			want: &updater.InsufficientSpaceError{
+				ExtractedBytes: 300,
+				FreeBytes:      299,
+			},
+		},
+		{
+			name:      "extracted size is estimated from the upload size",
+			options:   []updater.UpdateOption{updater.WithUploadSize(100)},
+			freeSpace: 299,
+			want: &updater.InsufficientSpaceError{
+				ExtractedBytes: 300,
+				Estimated:      true,
+				FreeBytes:      299,
+			},
+		},
+		{
+			name:        "size is unknown",
+			wantWarning: "the size of the upload is unknown. disk space check skipped",
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+			// Setup
+			dataDir := t.TempDir()
+			u, err := updater.New(updater.UpdateStrategyStreaming, &stubDownloader{}, nil, nil, &stubMigrator{}, dataDir,
+				updater.WithFreeSpace(freeSpace(tc.freeSpace, nil)),
+			)
+			require.NoError(t, err)
+			jobs := newJobManager(t, filepath.Join(t.TempDir(), "jobs.json"))
+			ctx, job := jobs.Start(t.Context(), updater.JobKindUpload)
+
+			// Exercise
+			err = u.PreflightUpload(ctx, tc.options...)
+
+			// Verify
+			if tc.want != nil {
+				var spaceErr *updater.InsufficientSpaceError
+				require.ErrorAs(t, err, &spaceErr)
+				tc.want.Path = dataDir
+				assert.Equal(t, tc.want, spaceErr)
+				assert.Equal(t, tc.want.ArchiveBytes+tc.want.ExtractedBytes, spaceErr.RequiredBytes())
+				assert.Equal(t, tc.want.FreeBytes, spaceErr.AvailableBytes())
+			} else {
+				require.NoError(t, err)
+			}
+			if tc.wantWarning != "" {
+				assert.Equal(t, []string{tc.wantWarning}, job.Status().Warnings)
+			} else {
+				assert.Empty(t, job.Status().Warnings)
+			}
+		})
+	}
+}
+
+func Test_InsufficientSpaceError_Error(t *testing.T) {
+	t.Parallel()
+	// Setup
+	err := &updater.InsufficientSpaceError{
+		Path:             "/photon/photon_data",
+		ArchiveBytes:     80 << 30,
+		ExtractedBytes:   240 << 30,
+		Estimated:        true,
+		FreeBytes:        300 << 30,
+		ReclaimableBytes: 10 << 30,
+	}
+
+	// Exercise
+	got := err.Error()
+
+	// Verify
+	assert.Equal(t, `insufficient space in "/photon/photon_data": 320 GiB required (archive 80 GiB + estimated extracted 240 GiB), 310 GiB available (free 300 GiB + live database 10 GiB)`, got)
+	assert.EqualValues(t, 320<<30, err.RequiredBytes())
+	assert.EqualValues(t, 310<<30, err.AvailableBytes())
+}
@@ -0,0 +1,55 @@
+package updater
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/pddg/photon-container/internal/logging"
+)
+
+// replaceDatabase stops the Photon server, replaces the database by the migration and starts the Photon server again.
+// The old database is kept until Photon serves the new one, and it is restored if Photon does not.
+func replaceDatabase(ctx context.Context, photonServer PhotonServer, migrator ReplaceMigrator, migrate func(ctx context.Context) error) error {
+	logger := logging.FromContext(ctx)
+	if err := photonServer.Stop(ctx); err != nil {
+		return fmt.Errorf("failed to stop Photon server: %w", err)
+	}
+	if err := migrate(ctx); err != nil {
+		// The old database has been restored. Serve it again.
+		if startErr := photonServer.Start(ctx); startErr != nil {
+			needsAttention(ctx, logger, "Photon server is stopped since it failed to start with the old database")
+			return errors.Join(fmt.Errorf("failed to replace existing database: %w", err), fmt.Errorf("failed to start Photon server: %w", startErr))
+		}
+		return fmt.Errorf("failed to replace existing database: %w", err)
+	}
+	if err := photonServer.Start(ctx); err != nil {
+		return rollbackDatabase(ctx, photonServer, migrator, fmt.Errorf("failed to start Photon server: %w", err))
+	}
+	if err := migrator.WaitForImport(ctx); err != nil {
+		return rollbackDatabase(ctx, photonServer, migrator, err)
+	}
+	if err := migrator.CommitReplace(ctx); err != nil {
+		logger.WarnContext(ctx, "failed to commit the new database", "error", err)
+	}
+	return nil
+}
+
+// rollbackDatabase stops the Photon server and serves the old database again.
+func rollbackDatabase(ctx context.Context, photonServer PhotonServer, migrator ReplaceMigrator, cause error) error {
+	logger := logging.FromContext(ctx)
+	logger.ErrorContext(ctx, "roll back to the previous database", "error", cause)
+	if err := photonServer.Stop(ctx); err != nil {
+		needsAttention(ctx, logger, "Photon server could not be stopped to roll back to the previous database, which is kept in node_1.old")
+		return errors.Join(cause, fmt.Errorf("failed to stop Photon server: %w", err))
+	}
+	if err := migrator.RollbackReplace(ctx, cause.Error()); err != nil {
+		needsAttention(ctx, logger, "Photon server is stopped since the previous database could not be restored")
+		return errors.Join(cause, fmt.Errorf("failed to roll back: %w", err))
+	}
+	if err := photonServer.Start(ctx); err != nil {
+		needsAttention(ctx, logger, "Photon server is stopped since it failed to start with the previous database")
+		return errors.Join(cause, fmt.Errorf("failed to start Photon server: %w", err))
+	}
+	return fmt.Errorf("%w: %w", ErrRolledBack, cause)
+}
@@ -4,11 +4,14 @@ import (
 	"context"
 	"fmt"
 	"io"
+	"log/slog"
 	"os"
 	"path/filepath"
 
+	"github.com/pddg/photon-container/internal/downloader"
 	"github.com/pddg/photon-container/internal/logging"
 	"github.com/pddg/photon-container/internal/photondata"
+	"github.com/pddg/photon-container/internal/unarchiver"
 )
 
 type SequentialUpdater struct {
@@ -31,7 +34,7 @@ func NewSequentialUpdater(
 	return &SequentialUpdater{
 		downloader:    downloader,
 		unarchiver:    unarchiver,
-		photonServer:  photonServer,
+		photonServer:  eventPhotonServer{photonServer},
 		migrator:      migrator,
 		photonDataDir: photonDataDir,
 	}
@@ -42,52 +45,59 @@ func (u *SequentialUpdater) DownloadAndUpdate(ctx context.Context, archive photo
 	opts := initOptions(options...)
 	archive = opts.getArchive(archive)
 
-	logger.InfoContext(ctx, "step 1/6: stop Photon server")
+	startStep(ctx, logger, 1, 6, "stop Photon server")
 	tempDir := filepath.Join(u.photonDataDir, "temp")
 	if err := u.photonServer.Stop(ctx); err != nil {
 		return fmt.Errorf("updater.SequentialUpdater.UpdateByLocalArchive: failed to stop Photon server: %w", err)
 	}
 
-	logger.InfoContext(ctx, "step 2/6: remove existing database")
+	startStep(ctx, logger, 2, 6, "remove existing database")
 	runMigration, err := u.migrator.MigrateByRemoveFirst(ctx, tempDir)
 	if err != nil {
 		return fmt.Errorf("updater.SequentialUpdater.UpdateByLocalArchive: failed to remove existing database: %w", err)
 	}
 
-	logger.InfoContext(ctx, "step 3/6: download Photon database")
+	startStep(ctx, logger, 3, 6, "download Photon database")
 	archivePath := filepath.Join(u.photonDataDir, "photon-db.tar.bz2")
 	if err := u.downloader.Download(ctx, archive, archivePath); err != nil {
-		return fmt.Errorf("updater.SequentialUpdater.UpdateByLocalArchive: failed to download %q to %q: %w", archive, archivePath, err)
+		removePartialDownload(ctx, logger, archivePath)
+		return databaseLost(ctx, logger, fmt.Errorf("updater.SequentialUpdater.UpdateByLocalArchive: failed to download %q to %q: %w", archive, archivePath, err))
 	}
 	defer func() {
-		if err := os.RemoveAll(archivePath); err != nil {
+		if err := downloader.Remove(archivePath); err != nil {
 			logger.WarnContext(ctx, "failed to remove archive", "path", archivePath, "error", err)
 		}
 	}()
 
-	logger.InfoContext(ctx, "step 4/6: unarchive Photon database")
+	startStep(ctx, logger, 4, 6, "unarchive Photon database")
 	archiveFile, err := os.Open(archivePath)
 	if err != nil {
-		return fmt.Errorf("updater.SequentialUpdater.UpdateByLocalArchive: failed to open %q: %w", archivePath, err)
+		return databaseLost(ctx, logger, fmt.Errorf("updater.SequentialUpdater.UpdateByLocalArchive: failed to open %q: %w", archivePath, err))
 	}
 	defer archiveFile.Close()
-	if err := u.unarchiver.Unarchive(ctx, archiveFile, tempDir, opts.getUnarchiveOptions()...); err != nil {
-		return fmt.Errorf("updater.SequentialUpdater.UpdateByLocalArchive: failed to unarchive %q to %q: %w", archivePath, tempDir, err)
-	}
+	// Clean up the temp directory even if the unarchiving fails or the job is canceled.
 	defer func() {
 		if err := os.RemoveAll(tempDir); err != nil {
 			logger.WarnContext(ctx, "failed to remove temp directory", "path", tempDir, "error", err)
 		}
 	}()
+	if err := u.unarchiver.Unarchive(ctx, countBytes(ctx, archiveFile), tempDir, opts.getUnarchiveOptions()...); err != nil {
+		return databaseLost(ctx, logger, fmt.Errorf("updater.SequentialUpdater.UpdateByLocalArchive: failed to unarchive %q to %q: %w", archivePath, tempDir, err))
+	}
+	if err := canceled(ctx); err != nil {
+		return databaseLost(ctx, logger, fmt.Errorf("updater.SequentialUpdater.UpdateByLocalArchive: %w", err))
+	}
 
-	logger.InfoContext(ctx, "step 5/6: replace existing database")
+	// The rest is not canceled part-way, and the Photon server must outlive the job.
+	ctx = withoutJobCancel(ctx)
+	startStep(ctx, logger, 5, 6, "replace existing database")
 	if err := runMigration(); err != nil {
-		return fmt.Errorf("updater.SequentialUpdater.UpdateByLocalArchive: failed to run migration: %w", err)
+		return databaseLost(ctx, logger, fmt.Errorf("updater.SequentialUpdater.UpdateByLocalArchive: failed to run migration: %w", err))
 	}
 
-	logger.InfoContext(ctx, "step 6/6: start Photon server")
+	startStep(ctx, logger, 6, 6, "start Photon server")
 	if err := u.photonServer.Start(ctx); err != nil {
-		return fmt.Errorf("updater.SequentialUpdater.UpdateByLocalArchive: failed to start Photon server: %w", err)
+		return databaseLost(ctx, logger, fmt.Errorf("updater.SequentialUpdater.UpdateByLocalArchive: failed to start Photon server: %w", err))
 	}
 
 	logger.InfoContext(ctx, "update complete")
@@ -98,44 +108,67 @@ func (u *SequentialUpdater) UpdateAsync(ctx context.Context, archive io.Reader,
 	logger := logging.FromContext(ctx).With("strategy", UpdateStrategySequential)
 
 	opts := initOptions(options...)
-	logger.InfoContext(ctx, "step 1/5: stop Photon server")
+	startStep(ctx, logger, 1, 5, "stop Photon server")
 	tempDir := filepath.Join(u.photonDataDir, "temp")
 	if err := u.photonServer.Stop(ctx); err != nil {
 		return fmt.Errorf("updater.SequentialUpdater.UpdateAsync: failed to stop Photon server: %w", err)
 	}
 
-	logger.InfoContext(ctx, "step 2/5: remove existing database")
+	startStep(ctx, logger, 2, 5, "remove existing database")
 	runMigration, err := u.migrator.MigrateByRemoveFirst(ctx, tempDir)
 	if err != nil {
 		return fmt.Errorf("updater.SequentialUpdater.UpdateAsync: failed to remove existing database: %w", err)
 	}
 
-	logger.InfoContext(ctx, "step 3/5: unarchive Photon database")
+	startStep(ctx, logger, 3, 5, "unarchive Photon database")
 	cleanup := func() {
 		if err := os.RemoveAll(tempDir); err != nil {
 			logger.WarnContext(ctx, "failed to remove temp directory", "path", tempDir, "error", err)
 		}
 	}
-	if err := u.unarchiver.Unarchive(ctx, archive, tempDir, opts.getUnarchiveOptions()...); err != nil {
-		// Clean up the temp directory before returning the error.
+	if err := u.unarchiver.Unarchive(ctx, countBytes(ctx, archive), tempDir, opts.getUnarchiveOptions()...); err != nil {
+		// Clean up the temp directory before returning the error unless the upload can be resumed.
 		// Unarchiving may leave some garbage files in the temp directory.
-		cleanup()
-		return fmt.Errorf("updater.SequentialUpdater.UpdateAsync: failed to unarchive to %q: %w", tempDir, err)
+		if !resumable(err) {
+			cleanup()
+		}
+		return databaseLost(ctx, logger, fmt.Errorf("updater.SequentialUpdater.UpdateAsync: failed to unarchive to %q: %w", tempDir, err))
 	}
 	go func() {
 		// Clean up the temp directory after the update is complete.
 		defer cleanup()
-		logger.InfoContext(ctx, "step 4/5: replace existing database")
+		if err := canceled(ctx); err != nil {
+			// The migration will never run. Do not block the next update.
+			u.migrator.Abort(context.WithoutCancel(ctx), err.Error())
+			finishJob(ctx, logger, databaseLost(ctx, logger, fmt.Errorf("updater.SequentialUpdater.UpdateAsync: %w", err)))
+			return
+		}
+		// The rest is not canceled part-way, and the Photon server must outlive the job.
+		ctx := withoutJobCancel(ctx)
+		startStep(ctx, logger, 4, 5, "replace existing database")
 		if err := runMigration(); err != nil {
 			logger.ErrorContext(ctx, "failed to run migration", "error", err)
+			finishJob(ctx, logger, databaseLost(ctx, logger, fmt.Errorf("updater.SequentialUpdater.UpdateAsync: failed to run migration: %w", err)))
 			return
 		}
-		logger.InfoContext(ctx, "step 5/5: start Photon server")
+		startStep(ctx, logger, 5, 5, "start Photon server")
 		if err := u.photonServer.Start(ctx); err != nil {
 			logger.ErrorContext(ctx, "failed to start Photon server", "error", err)
+			finishJob(ctx, logger, databaseLost(ctx, logger, fmt.Errorf("updater.SequentialUpdater.UpdateAsync: failed to start Photon server: %w", err)))
 			return
 		}
-		logger.InfoContext(ctx, "update complete")
+		finishJob(ctx, logger, nil)
 	}()
 	return nil
 }
+
+func (u *SequentialUpdater) UploadCheckpoint(ctx context.Context) (*unarchiver.Checkpoint, error) {
+	return readUploadCheckpoint(u.photonDataDir)
+}
+
+// databaseLost records that the update has failed after the existing database was removed.
+// The Photon server cannot be restarted until the update succeeds.
+func databaseLost(ctx context.Context, logger *slog.Logger, err error) error {
+	needsAttention(ctx, logger, "the existing database has been removed and Photon server is stopped. Run the update again")
+	return err
+}
@@ -0,0 +1,157 @@
+package updater_test
+
+import (
+	"context"
+	"errors"
+	"io"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/pddg/photon-container/internal/photondata"
+	"github.com/pddg/photon-container/internal/unarchiver"
+	"github.com/pddg/photon-container/internal/updater"
+)
+
+const databaseLostAttention = "the existing database has been removed and Photon server is stopped. Run the update again"
+
+// stubUnarchiver drains the archive.
+type stubUnarchiver struct{}
+
+func (stubUnarchiver) Unarchive(ctx context.Context, src io.Reader, dest string, options ...unarchiver.UnarchiveOption) error {
+	_, err := io.Copy(io.Discard, src)
+	return err
+}
+
+// stubPhotonServer records the contexts which the Photon server is started with.
+type stubPhotonServer struct {
+	mutex   sync.Mutex
+	started []error
+}
+
+func (s *stubPhotonServer) Start(ctx context.Context) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.started = append(s.started, ctx.Err())
+	return nil
+}
+
+func (s *stubPhotonServer) Stop(ctx context.Context) error {
+	return nil
+}
+
+// startedWith returns the errors of the contexts which the Photon server has been started with.
+func (s *stubPhotonServer) startedWith() []error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return append([]error(nil), s.started...)
+}
+
+func newSequentialUpdater(t *testing.T, dl *stubDownloader, migrator *stubMigrator, photonServer *stubPhotonServer) *updater.Updater {
+	t.Helper()
+	u, err := updater.New(updater.UpdateStrategySequential, dl, stubUnarchiver{}, photonServer, migrator, t.TempDir(),
+		updater.WithFreshnessPolicy(updater.FreshnessPolicy{Kind: updater.FreshnessAlways}),
+	)
+	require.NoError(t, err)
+	return u
+}
+
+func newArchive(t *testing.T) photondata.Archive {
+	t.Helper()
+	archive, err := photondata.NewArchive("https://example.com/photon-db.tar.bz2")
+	require.NoError(t, err)
+	return archive
+}
+
+func Test_SequentialUpdater_DownloadAndUpdate_Cancel(t *testing.T) {
+	t.Parallel()
+	t.Run("canceled during download", func(t *testing.T) {
+		t.Parallel()
+		// Setup
+		downloading := make(chan struct{})
+		dl := &stubDownloader{download: func(ctx context.Context, dest string) error {
+			close(downloading)
+			<-ctx.Done()
+			return context.Cause(ctx)
+		}}
+		migrator := &stubMigrator{}
+		photonServer := &stubPhotonServer{}
+		u := newSequentialUpdater(t, dl, migrator, photonServer)
+		jobs := newJobManager(t, filepath.Join(t.TempDir(), "jobs.json"))
+		ctx, job := jobs.Start(t.Context(), updater.JobKindDownload)
+		result := make(chan error, 1)
+		go func() {
+			result <- u.DownloadAndUpdate(ctx, newArchive(t))
+		}()
+		<-downloading
+
+		// Exercise
+		require.NoError(t, jobs.Cancel(t.Context(), job.ID()))
+
+		// Verify
+		select {
+		case err := <-result:
+			require.ErrorIs(t, err, updater.ErrJobCanceled)
+		case <-time.After(5 * time.Second):
+			t.Fatal("the update was not stopped")
+		}
+		status := job.Status()
+		assert.Equal(t, updater.JobStateCanceled, status.State)
+		// The live database has been removed before the download.
+		assert.Equal(t, databaseLostAttention, status.Attention)
+		assert.NotEmpty(t, migrator.abortReason(), "the migration is aborted, so that the next update is not blocked")
+		assert.Empty(t, photonServer.startedWith())
+		// The finished job can not be canceled again.
+		assert.ErrorIs(t, jobs.Cancel(t.Context(), job.ID()), updater.ErrJobNotRunning)
+	})
+	t.Run("failed download", func(t *testing.T) {
+		t.Parallel()
+		// Setup
+		dl := &stubDownloader{download: func(ctx context.Context, dest string) error {
+			return errors.New("connection reset")
+		}}
+		migrator := &stubMigrator{}
+		u := newSequentialUpdater(t, dl, migrator, &stubPhotonServer{})
+		jobs := newJobManager(t, filepath.Join(t.TempDir(), "jobs.json"))
+		ctx, job := jobs.Start(t.Context(), updater.JobKindDownload)
+
+		// Exercise
+		err := u.DownloadAndUpdate(ctx, newArchive(t))
+
+		// Verify
+		require.ErrorContains(t, err, "connection reset")
+		status := job.Status()
+		assert.Equal(t, updater.JobStateFailed, status.State)
+		assert.Equal(t, databaseLostAttention, status.Attention)
+		assert.Empty(t, migrator.abortReason())
+	})
+	t.Run("replace step is not interrupted", func(t *testing.T) {
+		t.Parallel()
+		// Setup
+		jobs := newJobManager(t, filepath.Join(t.TempDir(), "jobs.json"))
+		ctx, job := jobs.Start(t.Context(), updater.JobKindDownload)
+		migrator := &stubMigrator{migrate: func() error {
+			// Canceled while the database is being replaced.
+			return job.Cancel()
+		}}
+		photonServer := &stubPhotonServer{}
+		u := newSequentialUpdater(t, &stubDownloader{}, migrator, photonServer)
+
+		// Exercise
+		err := u.DownloadAndUpdate(ctx, newArchive(t))
+
+		// Verify
+		require.NoError(t, err)
+		require.ErrorIs(t, context.Cause(ctx), updater.ErrJobCanceled)
+		status := job.Status()
+		assert.Equal(t, updater.JobStateSucceeded, status.State)
+		assert.Empty(t, status.Attention)
+		// Photon is started with the context which outlives the canceled job.
+		assert.Equal(t, []error{nil}, photonServer.startedWith())
+		assert.Empty(t, migrator.abortReason())
+	})
+}
@@ -0,0 +1,98 @@
+package updater
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/pddg/photon-container/internal/logging"
+	"github.com/pddg/photon-container/internal/photondata"
+	"github.com/pddg/photon-container/internal/unarchiver"
+)
+
+// StreamingUpdater downloads, decompresses and unarchives the Photon database in one pass.
+// The archive is never stored in the data directory, so that only the new index and the old index occupy the storage.
+type StreamingUpdater struct {
+	downloader Downloader
+	unarchiver Unarchiver
+	migrator   ReplaceMigrator
+
+	// parallel handles uploaded archives and restarts the Photon server.
+	// Uploaded archives are already streamed, so they are handled in the same way as the parallel strategy.
+	parallel *ParallelUpdater
+
+	photonDataDir string
+}
+
+// NewStreamingUpdater creates a new StreamingUpdater.
+func NewStreamingUpdater(
+	downloader Downloader,
+	unarchiver Unarchiver,
+	photonServer PhotonServer,
+	migrator ReplaceMigrator,
+	photonDataDir string,
+	options ...UpdaterOption,
+) *StreamingUpdater {
+	return &StreamingUpdater{
+		downloader:    downloader,
+		unarchiver:    unarchiver,
+		migrator:      migrator,
+		parallel:      NewParallelUpdater(downloader, unarchiver, photonServer, migrator, photonDataDir, options...),
+		photonDataDir: photonDataDir,
+	}
+}
+
+func (u *StreamingUpdater) DownloadAndUpdate(ctx context.Context, archive photondata.Archive, options ...UpdateOption) error {
+	logger := logging.FromContext(ctx).With("strategy", UpdateStrategyStreaming)
+	opts := initOptions(options...)
+	archive = opts.getArchive(archive)
+
+	totalSteps := u.parallel.totalSteps(3)
+	startStep(ctx, logger, 1, totalSteps, "download and unarchive Photon database")
+	stream, err := u.downloader.Stream(ctx, archive)
+	if err != nil {
+		return fmt.Errorf("updater.StreamingUpdater.DownloadAndUpdate: failed to download %q: %w", archive, err)
+	}
+	defer stream.Close()
+	tempDir := filepath.Join(u.photonDataDir, "temp")
+	// Clean up the temp directory even if the unarchiving fails.
+	// The extracted tree must be discarded if the checksum does not match.
+	defer func() {
+		if err := os.RemoveAll(tempDir); err != nil {
+			logger.WarnContext(ctx, "failed to remove temp directory", "path", tempDir, "error", err)
+		}
+	}()
+	if err := u.unarchiver.Unarchive(ctx, countBytes(ctx, stream), tempDir, opts.getUnarchiveOptions()...); err != nil {
+		return fmt.Errorf("updater.StreamingUpdater.DownloadAndUpdate: failed to unarchive to %q: %w", tempDir, err)
+	}
+
+	startStep(ctx, logger, 2, totalSteps, "verify checksum of Photon database")
+	if err := stream.Verify(); err != nil {
+		return fmt.Errorf("updater.StreamingUpdater.DownloadAndUpdate: failed to verify %q: %w", archive, err)
+	}
+	step, err := u.parallel.validate(ctx, logger, 3, totalSteps, tempDir)
+	if err != nil {
+		return fmt.Errorf("updater.StreamingUpdater.DownloadAndUpdate: %w", err)
+	}
+
+	if err := canceled(ctx); err != nil {
+		return fmt.Errorf("updater.StreamingUpdater.DownloadAndUpdate: %w", err)
+	}
+	startStep(ctx, logger, step, totalSteps, "replace archive and restart Photon server")
+	// The replacement is not canceled part-way. The old database is kept until it begins.
+	if err := u.parallel.restartPhotonServer(withoutJobCancel(ctx), tempDir); err != nil {
+		return fmt.Errorf("updater.StreamingUpdater.DownloadAndUpdate: failed to restart Photon server: %w", err)
+	}
+	logger.InfoContext(ctx, "update complete")
+	return nil
+}
+
+func (u *StreamingUpdater) UpdateAsync(ctx context.Context, archive io.Reader, options ...UpdateOption) error {
+	return u.parallel.UpdateAsync(ctx, archive, options...)
+}
+
+func (u *StreamingUpdater) UploadCheckpoint(ctx context.Context) (*unarchiver.Checkpoint, error) {
+	return u.parallel.UploadCheckpoint(ctx)
+}
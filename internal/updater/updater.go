@@ -2,25 +2,38 @@ package updater
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"io"
+	"log/slog"
+	"path/filepath"
 	"time"
 
-	"github.com/dustin/go-humanize"
-
+	"github.com/pddg/photon-container/internal/downloader"
 	"github.com/pddg/photon-container/internal/logging"
 	"github.com/pddg/photon-container/internal/photondata"
+	"github.com/pddg/photon-container/internal/unarchiver"
 )
 
 type UpdaterInterface interface {
 	DownloadAndUpdate(ctx context.Context, archive photondata.Archive, options ...UpdateOption) error
 	UpdateAsync(ctx context.Context, archive io.Reader, options ...UpdateOption) error
+	// UploadCheckpoint returns the checkpoint of the interrupted upload.
+	UploadCheckpoint(ctx context.Context) (*unarchiver.Checkpoint, error)
 }
 
 type Updater struct {
-	updaterImpl UpdaterInterface
-	migrator    Migrator
-	downloader  Downloader
+	updaterImpl  UpdaterInterface
+	migrator     Migrator
+	downloader   Downloader
+	photonServer PhotonServer
+	freshness    FreshnessPolicy
+
+	strategy      UpdateStrategy
+	photonDataDir string
+	// extractionRatio estimates the size of the extracted database from the size of the compressed archive.
+	extractionRatio float64
+	freeSpace       func(path string) (uint64, error)
 }
 
 func New(
@@ -30,63 +43,190 @@ func New(
 	photonServer PhotonServer,
 	migrator Migrator,
 	photonDataDir string,
+	options ...UpdaterOption,
 ) (*Updater, error) {
+	opts := initUpdaterOptions(options...)
 	var updaterImpl UpdaterInterface
 	switch strategy {
 	case UpdateStrategySequential:
 		updaterImpl = NewSequentialUpdater(downloader, unarchiver, photonServer, migrator, photonDataDir)
 	case UpdateStrategyParallel:
-		updaterImpl = NewParallelUpdater(downloader, unarchiver, photonServer, migrator, photonDataDir)
+		updaterImpl = NewParallelUpdater(downloader, unarchiver, photonServer, migrator, photonDataDir, options...)
+	case UpdateStrategyStreaming:
+		updaterImpl = NewStreamingUpdater(downloader, unarchiver, photonServer, migrator, photonDataDir, options...)
+	case UpdateStrategyBlueGreen:
+		handoverServer, ok := photonServer.(HandoverPhotonServer)
+		if !ok {
+			return nil, fmt.Errorf("updater.NewUpdater: strategy %q requires the Photon server to support the handover", strategy)
+		}
+		updaterImpl = NewBlueGreenUpdater(downloader, unarchiver, handoverServer, migrator, photonDataDir, options...)
 	default:
 		return nil, fmt.Errorf("updater.NewUpdater: unknown strategy %q", strategy)
 	}
 	return &Updater{
-		updaterImpl: updaterImpl,
-		migrator:    migrator,
-		downloader:  downloader,
+		updaterImpl:  updaterImpl,
+		migrator:     migrator,
+		downloader:   downloader,
+		photonServer: eventPhotonServer{photonServer},
+		freshness:    opts.freshness,
+
+		strategy:        strategy,
+		photonDataDir:   photonDataDir,
+		extractionRatio: opts.extractionRatio,
+		freeSpace:       opts.freeSpace,
 	}, nil
 }
 
+// DownloadAndUpdate downloads the archive and updates the database.
+// The job carried by the context is finished when it returns.
 func (u *Updater) DownloadAndUpdate(ctx context.Context, archive photondata.Archive, options ...UpdateOption) error {
+	err := u.downloadAndUpdate(ctx, archive, options...)
+	if err != nil {
+		u.abortIfCanceled(ctx)
+	}
+	JobFromContext(ctx).Finish(ctx, err)
+	return err
+}
+
+func (u *Updater) downloadAndUpdate(ctx context.Context, archive photondata.Archive, options ...UpdateOption) error {
 	opts := initOptions(options...)
 	if opts.force {
 		logging.FromContext(ctx).WarnContext(ctx, "force update initiated")
 		u.migrator.ResetState(ctx)
 	} else {
 		archive = opts.getArchive(archive)
-		migratable, err := u.checkMigratability(ctx, archive)
+		decision, err := u.checkMigratability(ctx, archive)
 		if err != nil {
 			return fmt.Errorf("updater.Updater.UpdateByLocalArchive: failed to check migratability: %w", err)
 		}
-		if !migratable {
-			return fmt.Errorf("updater.Updater.UpdateByLocalArchive: database is up to date")
+		if !decision.Migratable {
+			logging.FromContext(ctx).InfoContext(ctx, "database is up to date", "policy", decision.Policy, "reason", decision.Reason)
+			return fmt.Errorf("updater.Updater.UpdateByLocalArchive: %w: %s", ErrUpToDate, decision.Reason)
+		}
+	}
+	logger := logging.FromContext(ctx)
+	info, inspectErr := u.downloader.Inspect(ctx, archive)
+	if inspectErr != nil {
+		warnJob(ctx, logger, "failed to inspect the archive. disk space check skipped, and the archive is not recorded as installed", inspectErr)
+	} else if err := u.preflightDownload(ctx, info.Size); err != nil {
+		return fmt.Errorf("updater.Updater.DownloadAndUpdate: %w", err)
+	}
+	var installing photondata.InstalledArchive
+	recordInstalled := false
+	if inspectErr == nil {
+		var installingErr error
+		installing, installingErr = u.installingArchive(ctx, archive, info)
+		if installingErr != nil {
+			logger.WarnContext(ctx, "the archive is not recorded as installed", "error", installingErr)
+		}
+		recordInstalled = installingErr == nil
+	}
+	if err := u.updaterImpl.DownloadAndUpdate(ctx, archive); err != nil {
+		return err
+	}
+	if recordInstalled {
+		installing.InstalledAt = time.Now().UTC()
+		if err := u.migrator.SetInstalledArchive(installing); err != nil {
+			// The record is used only to decide the next update.
+			logger.WarnContext(ctx, "failed to record installed archive", "error", err)
 		}
 	}
-	return u.updaterImpl.DownloadAndUpdate(ctx, archive)
+	return nil
 }
 
+// UpdateAsync unarchives the archive and updates the database in background.
+// The job carried by the context is finished when the update in background completes or it returns an error.
 func (u *Updater) UpdateAsync(ctx context.Context, archive io.Reader, options ...UpdateOption) error {
 	opts := initOptions(options...)
+	if err := u.preflightUpload(ctx, opts); err != nil {
+		err = fmt.Errorf("updater.Updater.UpdateAsync: %w", err)
+		JobFromContext(ctx).Finish(ctx, err)
+		return err
+	}
 	if opts.force {
 		logging.FromContext(ctx).WarnContext(ctx, "force update initiated")
 		u.migrator.ResetState(ctx)
 	}
-	return u.updaterImpl.UpdateAsync(ctx, archive, options...)
+	if err := u.updaterImpl.UpdateAsync(ctx, archive, options...); err != nil {
+		if resumable(err) {
+			// The upload will be resumed. It must not be blocked by the state of the interrupted migration.
+			logging.FromContext(ctx).WarnContext(ctx, "upload interrupted. it can be resumed from the checkpoint", "error", err)
+			u.migrator.ResetState(ctx)
+		} else {
+			u.abortIfCanceled(ctx)
+		}
+		JobFromContext(ctx).Finish(ctx, err)
+		return err
+	}
+	return nil
 }
 
-func (u *Updater) checkMigratability(ctx context.Context, archive photondata.Archive) (bool, error) {
-	_, importTime := u.migrator.State(ctx)
-	lastModified, err := u.downloader.GetLastModified(ctx, archive)
+// Activate switches the database back to the retained generation, and restarts the Photon server.
+// The current database is retained as a new generation in turn.
+// The job carried by the context is finished when it returns.
+func (u *Updater) Activate(ctx context.Context, id string) error {
+	logger := logging.FromContext(ctx).With("generation", id)
+	startStep(ctx, logger, 1, 1, "activate generation "+id)
+	// The archive of the database switched away from must not be installed again by the next freshness check.
+	installed, err := u.migrator.InstalledArchive()
 	if err != nil {
-		return false, fmt.Errorf("updater.Updater.Update: failed to get last modified time of %q: %w", archive, err)
+		logger.WarnContext(ctx, "failed to read the installed archive", "error", err)
+	}
+	// The replacement is not canceled part-way, in the same way as the updates.
+	err = replaceDatabase(withoutJobCancel(ctx), u.photonServer, u.migrator, func(ctx context.Context) error {
+		return u.migrator.MigrateToGeneration(ctx, id)
+	})
+	if err != nil {
+		err = fmt.Errorf("updater.Updater.Activate: %w", err)
+	} else {
+		logger.InfoContext(ctx, "generation activated")
+		if installed != nil {
+			if err := u.migrator.SetRolledBackArchive(*installed); err != nil {
+				logger.WarnContext(ctx, "failed to record the archive rolled back from", "error", err)
+			}
+		}
+	}
+	JobFromContext(ctx).Finish(ctx, err)
+	return err
+}
+
+func (u *Updater) UploadCheckpoint(ctx context.Context) (*unarchiver.Checkpoint, error) {
+	return u.updaterImpl.UploadCheckpoint(ctx)
+}
+
+// abortIfCanceled records the migration left by the canceled job as failed, so that the next update is not blocked.
+func (u *Updater) abortIfCanceled(ctx context.Context) {
+	if err := canceled(ctx); err != nil {
+		u.migrator.Abort(context.WithoutCancel(ctx), err.Error())
+	}
+}
+
+// resumable returns true if the extraction of the uploaded archive can be resumed.
+func resumable(err error) bool {
+	var interrupted *unarchiver.InterruptedError
+	return errors.As(err, &interrupted) || errors.Is(err, unarchiver.ErrCheckpointMismatch)
+}
+
+// readUploadCheckpoint reads the checkpoint in the temp directory where the uploaded archive is extracted.
+// nil is returned if there is no interrupted upload.
+func readUploadCheckpoint(photonDataDir string) (*unarchiver.Checkpoint, error) {
+	checkpoint, err := unarchiver.ReadCheckpoint(filepath.Join(photonDataDir, "temp"))
+	if err != nil {
+		if errors.Is(err, unarchiver.ErrNoCheckpoint) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("updater.readUploadCheckpoint: %w", err)
+	}
+	return checkpoint, nil
+}
+
+// removePartialDownload removes the partially downloaded archive if the job has been canceled.
+// Otherwise it is kept, so that the next update resumes the download.
+func removePartialDownload(ctx context.Context, logger *slog.Logger, archivePath string) {
+	if canceled(ctx) == nil {
+		return
+	}
+	if err := downloader.RemovePartial(archivePath); err != nil {
+		logger.WarnContext(ctx, "failed to remove partial archive", "path", archivePath, "error", err)
 	}
-	logger := logging.FromContext(ctx)
-	// The importTime returned by photon may be a few days before the time the database was uploaded (lastModified).
-	// Therefore, simply comparing it with importTime will result in an update every time.
-	diff := lastModified.Sub(importTime)
-	if diff <= 7*24*time.Hour {
-		logger.InfoContext(ctx, "database is up to date", "importTime", importTime, "lastModified", humanize.RelTime(importTime, lastModified, "ago", "from now"))
-		return false, nil
-	}
-	return true, nil
 }